@@ -77,6 +77,21 @@ func main() {
 
 	// Initialize repositories
 	invoiceRepo := repository.NewInvoiceRepository(db)
+	outboxRepo := repository.NewPostingOutboxRepository(db)
+	journalRequestRepo := repository.NewJournalRequestRepository(db)
+	balanceUpdateRepo := repository.NewVendorBalanceUpdateRepository(db)
+	settingsRepo := repository.NewEntitySettingsRepository(db)
+	taxCodeRepo := repository.NewTaxCodeRepository(db)
+	exchangeRateRepo := repository.NewExchangeRateRepository(db)
+	revaluationRepo := repository.NewFXRevaluationRepository(db)
+	recurringRepo := repository.NewRecurringTemplateRepository(db)
+	paymentTermsRepo := repository.NewPaymentTermsRepository(db)
+	purchaseOrderRepo := repository.NewPurchaseOrderRepository(db)
+	matchRepo := repository.NewInvoiceMatchRepository(db)
+	receiptRepo := repository.NewReceiptRepository(db)
+	holdRepo := repository.NewInvoiceHoldRepository(db)
+	duplicateRepo := repository.NewDuplicateRepository(db)
+	splitRepo := repository.NewSplitInvoiceRepository(db)
 	rulesRepo := repository.NewApprovalRulesRepository(db)
 	workflowRepo := repository.NewApprovalWorkflowRepository(db)
 	stepsRepo := repository.NewApprovalStepsRepository(db)
@@ -104,6 +119,18 @@ func main() {
 	}
 	defer journalsClient.Close()
 
+	// GL-2 does not expose period status yet; periods are calendar months,
+	// closed through GL_CLOSED_THROUGH (YYYY-MM-DD) if set
+	var closedThrough *time.Time
+	if value := os.Getenv("GL_CLOSED_THROUGH"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid GL_CLOSED_THROUGH, expected YYYY-MM-DD")
+		}
+		closedThrough = &parsed
+	}
+	periodsClient := client.NewStubPeriodsClient(closedThrough)
+
 	// Connect to identity service for authentication
 	identityGrpcAddr := getEnv("IDENTITY_GRPC_URL", "localhost:9080")
 	identityConn, err := grpc.NewClient(identityGrpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
@@ -143,8 +170,40 @@ func main() {
 	}
 
 	// Initialize services
-	invoiceService := service.NewInvoiceService(invoiceRepo, vendorsClient, accountsClient, journalsClient, log)
-	routingService := service.NewApprovalRoutingService(rulesRepo, workflowRepo, stepsRepo, auditRepo, invoiceRepo, identityClient, log)
+	settingsService := service.NewEntitySettingsService(settingsRepo, accountsClient, log)
+	paymentTermsService := service.NewPaymentTermsService(paymentTermsRepo, log)
+	taxService := service.NewTaxService(taxCodeRepo, settingsService, accountsClient, log)
+	fxService := service.NewFXService(exchangeRateRepo, service.NewTableFXRateProvider(exchangeRateRepo), settingsService, log)
+	purchaseOrderService := service.NewPurchaseOrderService(purchaseOrderRepo, vendorsClient, log)
+	purchaseOrdersClient := service.NewTablePurchaseOrdersClient(purchaseOrderRepo)
+	holdService := service.NewHoldService(holdRepo, invoiceRepo, notificationPublisher, log)
+	matchingService := service.NewPOMatchingService(matchRepo, invoiceRepo, receiptRepo, purchaseOrdersClient, settingsService, holdService, log)
+	receiptService := service.NewReceiptService(receiptRepo, invoiceRepo, purchaseOrdersClient, log)
+	duplicateService := service.NewDuplicateDetectionService(duplicateRepo, invoiceRepo, vendorsClient, settingsService, log)
+	splitService := service.NewSplitInvoiceService(splitRepo, rulesRepo, invoiceRepo, settingsService, holdService, log)
+	idempotentJournals := service.NewIdempotentJournalsClient(journalsClient, journalRequestRepo, log)
+	invoiceService := service.NewInvoiceService(invoiceRepo, outboxRepo, journalRequestRepo, balanceUpdateRepo, vendorsClient, accountsClient, idempotentJournals, periodsClient, settingsService, taxService, fxService, paymentTermsService, matchingService, holdService, duplicateService, splitService, log)
+	revaluationService := service.NewFXRevaluationService(revaluationRepo, invoiceRepo, idempotentJournals, periodsClient, settingsService, fxService, log)
+	recurringService := service.NewRecurringInvoiceService(recurringRepo, invoiceRepo, invoiceService, vendorsClient, log)
+	routingService := service.NewApprovalRoutingService(rulesRepo, workflowRepo, stepsRepo, auditRepo, invoiceRepo, identityClient, splitService, log)
+
+	// Start GL posting dispatcher; stops when ctx is cancelled on shutdown
+	postingDispatcher := service.NewPostingDispatcher(
+		invoiceService,
+		time.Duration(getEnvInt("POSTING_DISPATCH_INTERVAL_SECONDS", 5))*time.Second,
+		getEnvInt("POSTING_DISPATCH_BATCH_SIZE", 20),
+		log,
+	)
+	go postingDispatcher.Run(ctx)
+
+	// Start recurring invoice scheduler; stops when ctx is cancelled on shutdown
+	recurringScheduler := service.NewRecurringScheduler(
+		recurringService,
+		time.Duration(getEnvInt("RECURRING_SCHEDULER_INTERVAL_SECONDS", 300))*time.Second,
+		getEnvInt("RECURRING_SCHEDULER_BATCH_SIZE", 20),
+		log,
+	)
+	go recurringScheduler.Run(ctx)
 
 	// Initialize approvals service client (be-plt-approvals)
 	approvalsGrpcAddr := getEnv("APPROVALS_GRPC_URL", "localhost:9088")
@@ -156,7 +215,7 @@ func main() {
 	log.Info().Str("approvals_grpc", approvalsGrpcAddr).Msg("Approvals gRPC client initialized")
 
 	// Setup HTTP routes
-	httpHandler := handler.NewHTTPHandler(invoiceService, log)
+	httpHandler := handler.NewHTTPHandler(invoiceService, settingsService, taxService, fxService, revaluationService, recurringService, paymentTermsService, purchaseOrderService, matchingService, receiptService, holdService, duplicateService, splitService, log)
 	mux := http.NewServeMux()
 
 	// Health check
@@ -176,12 +235,153 @@ func main() {
 	})
 
 	mux.HandleFunc("/api/v1/invoices/get", httpHandler.GetInvoice)
+	mux.HandleFunc("/api/v1/invoices/history", httpHandler.GetStatusHistory)
+	mux.HandleFunc("/api/v1/invoices/update", httpHandler.UpdateInvoice)
 	mux.HandleFunc("/api/v1/invoices/submit", httpHandler.SubmitForApproval)
 	mux.HandleFunc("/api/v1/invoices/approve", httpHandler.ApproveInvoice)
 	mux.HandleFunc("/api/v1/invoices/post", httpHandler.PostInvoice)
+	mux.HandleFunc("/api/v1/invoices/post/preview", httpHandler.PreviewPosting)
+	mux.HandleFunc("/api/v1/invoices/installments", httpHandler.GetPaymentSchedule)
+	mux.HandleFunc("/api/v1/invoices/match", httpHandler.MatchInvoice)
+	mux.HandleFunc("/api/v1/invoices/matches", httpHandler.ListInvoiceMatches)
+	mux.HandleFunc("/api/v1/invoices/matches/accept", httpHandler.AcceptMatchVariance)
+	mux.HandleFunc("/api/v1/invoices/receipts", httpHandler.ListInvoiceReceipts)
+	mux.HandleFunc("/api/v1/invoices/holds", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.ListInvoiceHolds(w, r)
+		case http.MethodPost:
+			httpHandler.PlaceHold(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/v1/invoices/holds/release", httpHandler.ReleaseHold)
+	mux.HandleFunc("/api/v1/invoices/duplicates", httpHandler.ListDuplicates)
+	mux.HandleFunc("/api/v1/invoices/duplicates/check", httpHandler.CheckDuplicates)
 	mux.HandleFunc("/api/v1/invoices/payment", httpHandler.RecordPayment)
+	mux.HandleFunc("/api/v1/invoices/payment/void", httpHandler.VoidPayment)
+	mux.HandleFunc("/api/v1/invoices/credit/apply", httpHandler.ApplyCreditMemo)
+	mux.HandleFunc("/api/v1/invoices/credit/unapply", httpHandler.UnapplyCreditMemo)
+	mux.HandleFunc("/api/v1/invoices/credit/applications", httpHandler.ListCreditApplications)
+	mux.HandleFunc("/api/v1/invoices/prepayment/apply", httpHandler.ApplyPrepayment)
+	mux.HandleFunc("/api/v1/invoices/prepayment/applications", httpHandler.ListPrepaymentApplications)
+	mux.HandleFunc("/api/v1/invoices/cancel", httpHandler.CancelInvoice)
+	mux.HandleFunc("/api/v1/invoices/void", httpHandler.VoidInvoice)
 	mux.HandleFunc("/api/v1/invoices/delete", httpHandler.DeleteInvoice)
 
+	// Entity settings routes
+	mux.HandleFunc("/api/v1/settings", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.GetEntitySettings(w, r)
+		case http.MethodPut:
+			httpHandler.UpdateEntitySettings(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Tax code routes
+	mux.HandleFunc("/api/v1/tax-codes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.ListTaxCodes(w, r)
+		case http.MethodPut:
+			httpHandler.UpsertTaxCode(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/v1/tax-codes/rates", httpHandler.AddTaxRate)
+
+	// Payment terms routes
+	mux.HandleFunc("/api/v1/payment-terms", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.ListPaymentTerms(w, r)
+		case http.MethodPut:
+			httpHandler.UpsertPaymentTerms(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Purchase order routes (local stand-in)
+	mux.HandleFunc("/api/v1/purchase-orders", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.GetPurchaseOrder(w, r)
+		case http.MethodPut:
+			httpHandler.UpsertPurchaseOrder(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Goods receipt routes
+	mux.HandleFunc("/api/v1/receipts", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.ListPOReceipts(w, r)
+		case http.MethodPost:
+			httpHandler.RecordReceipt(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/v1/receipts/get", httpHandler.GetReceipt)
+	mux.HandleFunc("/api/v1/receipts/return", httpHandler.RecordReturn)
+	mux.HandleFunc("/api/v1/receipts/uninvoiced", httpHandler.ListUninvoicedReceipts)
+
+	// Hold routes
+	mux.HandleFunc("/api/v1/holds", httpHandler.ListOpenHolds)
+
+	// Split invoice routes
+	mux.HandleFunc("/api/v1/split-invoices", httpHandler.ListSplitFindings)
+	mux.HandleFunc("/api/v1/split-invoices/review", httpHandler.ReviewSplitFinding)
+
+	// Exchange rate routes
+	mux.HandleFunc("/api/v1/exchange-rates", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.ListExchangeRates(w, r)
+		case http.MethodPut:
+			httpHandler.UpsertExchangeRate(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Period-end FX revaluation routes
+	mux.HandleFunc("/api/v1/fx-revaluations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.ListFXRevaluations(w, r)
+		case http.MethodPost:
+			httpHandler.RunFXRevaluation(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/v1/fx-revaluations/get", httpHandler.GetFXRevaluation)
+
+	// Recurring invoice template routes
+	mux.HandleFunc("/api/v1/recurring-invoices", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpHandler.ListRecurringTemplates(w, r)
+		case http.MethodPost:
+			httpHandler.CreateRecurringTemplate(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/v1/recurring-invoices/get", httpHandler.GetRecurringTemplate)
+	mux.HandleFunc("/api/v1/recurring-invoices/pause", httpHandler.PauseRecurringTemplate)
+	mux.HandleFunc("/api/v1/recurring-invoices/resume", httpHandler.ResumeRecurringTemplate)
+	mux.HandleFunc("/api/v1/recurring-invoices/skip", httpHandler.SkipRecurringOccurrence)
+
 	// Apply middleware
 	var h http.Handler = mux
 	h = middleware.RequestID(h)
@@ -235,6 +435,9 @@ func main() {
 
 	log.Info().Msg("Shutting down server...")
 
+	// Stop the posting dispatcher; unfinished postings resume on next start
+	cancel()
+
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer shutdownCancel()
 
@@ -1,10 +1,14 @@
 package client
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // VendorsClientInterface defines the interface for vendors service client
 type VendorsClientInterface interface {
 	ValidateVendor(ctx context.Context, vendorID, entityID string) (bool, string, error)
+	GetVendor(ctx context.Context, vendorID, entityID string) (*Vendor, error)
 	UpdateBalance(ctx context.Context, vendorID, entityID string, amount int64) error
 }
 
@@ -13,3 +17,21 @@ type AccountsClientInterface interface {
 	ValidateAccount(ctx context.Context, accountID, entityID string) (bool, string, error)
 	GetAccountByCode(ctx context.Context, code, entityID string) (*Account, error)
 }
+
+// PeriodsClientInterface defines the interface for accounting period clients
+type PeriodsClientInterface interface {
+	GetPeriod(ctx context.Context, periodID, entityID string) (*Period, error)
+	GetPeriodForDate(ctx context.Context, entityID string, date time.Time) (*Period, error)
+}
+
+// PurchaseOrdersClientInterface defines the interface for purchase order
+// clients. GetPurchaseOrder returns nil if the entity has no such PO.
+type PurchaseOrdersClientInterface interface {
+	GetPurchaseOrder(ctx context.Context, poNumber, entityID string) (*PurchaseOrder, error)
+}
+
+// FXRateProviderInterface defines the interface for exchange rate providers.
+// GetRate returns the rate effective on date, or nil if the provider has none.
+type FXRateProviderInterface interface {
+	GetRate(ctx context.Context, from, to string, date time.Time) (*FXRate, error)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/pesio-ai/be-lib-common/httpclient"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
 )
 
 // JournalsClient is a client for the journals service (GL-2)
@@ -21,28 +22,35 @@ func NewJournalsClient(baseURL string) *JournalsClient {
 
 // JournalLineRequest represents a journal line
 type JournalLineRequest struct {
-	LineNumber  int     `json:"line_number"`
-	AccountID   string  `json:"account_id"`
-	LineType    string  `json:"line_type"` // "debit" or "credit"
-	Amount      int64   `json:"amount"`
-	Description *string `json:"description,omitempty"`
-	Dimension1  *string `json:"dimension_1,omitempty"`
-	Dimension2  *string `json:"dimension_2,omitempty"`
-	Dimension3  *string `json:"dimension_3,omitempty"`
-	Dimension4  *string `json:"dimension_4,omitempty"`
-	Reference   *string `json:"reference,omitempty"`
+	LineNumber       int     `json:"line_number"`
+	AccountID        string  `json:"account_id"`
+	LineType         string  `json:"line_type"` // "debit" or "credit"
+	Amount           int64   `json:"amount"`
+	FunctionalAmount int64   `json:"functional_amount"` // Amount in the journal's functional currency
+	Description      *string `json:"description,omitempty"`
+	Dimension1       *string `json:"dimension_1,omitempty"`
+	Dimension2       *string `json:"dimension_2,omitempty"`
+	Dimension3       *string `json:"dimension_3,omitempty"`
+	Dimension4       *string `json:"dimension_4,omitempty"`
+	Reference        *string `json:"reference,omitempty"`
 }
 
-// CreateJournalRequest represents a create journal entry request
+// CreateJournalRequest represents a create journal entry request.
+// IdempotencyKey is not sent to GL-2; it identifies the request locally so
+// that a retry reuses the journal already created for it. Each line carries
+// its amount in Currency and in FunctionalCurrency, converted at ExchangeRate.
 type CreateJournalRequest struct {
-	EntityID      string                `json:"entity_id"`
-	JournalNumber string                `json:"journal_number"`
-	JournalDate   string                `json:"journal_date"`
-	JournalType   string                `json:"journal_type"`
-	Description   *string               `json:"description,omitempty"`
-	Reference     *string               `json:"reference,omitempty"`
-	Currency      string                `json:"currency"`
-	Lines         []*JournalLineRequest `json:"lines"`
+	EntityID           string                `json:"entity_id"`
+	JournalNumber      string                `json:"journal_number"`
+	JournalDate        string                `json:"journal_date"`
+	JournalType        string                `json:"journal_type"`
+	Description        *string               `json:"description,omitempty"`
+	Reference          *string               `json:"reference,omitempty"`
+	Currency           string                `json:"currency"`
+	FunctionalCurrency string                `json:"functional_currency,omitempty"`
+	ExchangeRate       *decimal.Rate         `json:"exchange_rate,omitempty"`
+	Lines              []*JournalLineRequest `json:"lines"`
+	IdempotencyKey     string                `json:"-"`
 }
 
 // CreateJournalResponse represents the create journal response
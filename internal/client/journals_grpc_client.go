@@ -44,14 +44,26 @@ func (c *JournalsGRPCClient) Close() error {
 
 // CreateJournal creates a journal entry via gRPC
 func (c *JournalsGRPCClient) CreateJournal(ctx context.Context, req *CreateJournalRequest) (string, error) {
+	// The proto carries one currency per journal; GL-2 keeps the ledger in
+	// the functional currency, so a foreign-currency journal is sent in it
+	currency := req.Currency
+	if req.FunctionalCurrency != "" {
+		currency = req.FunctionalCurrency
+	}
+
 	// Convert to proto request
 	lines := make([]*pb.CreateJournalLineRequest, len(req.Lines))
 	for i, line := range req.Lines {
+		amount := line.Amount
+		if req.FunctionalCurrency != "" {
+			amount = line.FunctionalAmount
+		}
+
 		lines[i] = &pb.CreateJournalLineRequest{
 			LineNumber:  int32(line.LineNumber),
 			AccountId:   line.AccountID,
 			LineType:    lineTypeToProto(line.LineType),
-			Amount:      line.Amount,
+			Amount:      amount,
 			Description: stringPtrToString(line.Description),
 			Dimension1:  stringPtrToString(line.Dimension1),
 			Dimension2:  stringPtrToString(line.Dimension2),
@@ -68,7 +80,7 @@ func (c *JournalsGRPCClient) CreateJournal(ctx context.Context, req *CreateJourn
 		JournalType:   journalTypeToProto(req.JournalType),
 		Description:   stringPtrToString(req.Description),
 		Reference:     stringPtrToString(req.Reference),
-		Currency:      req.Currency,
+		Currency:      currency,
 		Lines:         lines,
 	}
 
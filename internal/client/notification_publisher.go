@@ -10,12 +10,13 @@ import (
 	natsclient "github.com/pesio-ai/be-lib-common/nats"
 )
 
-// NotificationPublisher publishes approval workflow events to NATS JetStream
+// NotificationPublisher publishes approval workflow and hold events to NATS JetStream
 // for consumption by the be-plt-notifications service.
 //
 // Subject convention: notifications.ap.<event_type>
 // Event types: invoice_submitted, invoice_approval_required, invoice_approved,
-//              invoice_rejected, invoice_recalled
+//              invoice_rejected, invoice_recalled, invoice_hold_placed,
+//              invoice_hold_released
 //
 // All publish operations are non-fatal — errors are logged but never propagated
 // to the caller, so notification failures never interrupt approval operations.
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StubPeriodsClient is a local stand-in for the GL periods service until it
+// exposes period status. Periods are calendar months identified as
+// "YYYY-MM"; every period ending on or before closedThrough is closed and
+// all later periods are open.
+type StubPeriodsClient struct {
+	closedThrough *time.Time
+}
+
+// NewStubPeriodsClient creates a stub periods client. A nil closedThrough
+// leaves every period open.
+func NewStubPeriodsClient(closedThrough *time.Time) *StubPeriodsClient {
+	return &StubPeriodsClient{closedThrough: closedThrough}
+}
+
+// GetPeriod returns the period with the given "YYYY-MM" ID
+func (c *StubPeriodsClient) GetPeriod(ctx context.Context, periodID, entityID string) (*Period, error) {
+	start, err := time.Parse("2006-01", periodID)
+	if err != nil {
+		return nil, fmt.Errorf("period %s not found: expected YYYY-MM", periodID)
+	}
+	return c.period(entityID, start), nil
+}
+
+// GetPeriodForDate returns the period containing date
+func (c *StubPeriodsClient) GetPeriodForDate(ctx context.Context, entityID string, date time.Time) (*Period, error) {
+	start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return c.period(entityID, start), nil
+}
+
+// period builds the calendar-month period starting at start
+func (c *StubPeriodsClient) period(entityID string, start time.Time) *Period {
+	end := start.AddDate(0, 1, -1)
+
+	status := "open"
+	if c.closedThrough != nil && !end.After(*c.closedThrough) {
+		status = "closed"
+	}
+
+	return &Period{
+		ID:        start.Format("2006-01"),
+		EntityID:  entityID,
+		Name:      start.Format("January 2006"),
+		StartDate: start,
+		EndDate:   end,
+		Status:    status,
+	}
+}
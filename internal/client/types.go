@@ -1,5 +1,11 @@
 package client
 
+import (
+	"time"
+
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
 // Account represents a GL account
 type Account struct {
 	ID            string `json:"id"`
@@ -45,3 +51,60 @@ type ListAccountsResponse struct {
 	Page     int       `json:"page"`
 	PageSize int       `json:"pageSize"`
 }
+
+// Period represents an accounting period
+type Period struct {
+	ID        string    `json:"id"`
+	EntityID  string    `json:"entity_id"`
+	Name      string    `json:"name"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+	Status    string    `json:"status"` // "open" or "closed"
+}
+
+// IsOpen reports whether the period accepts postings
+func (p *Period) IsOpen() bool {
+	return p.Status == "open"
+}
+
+// Contains reports whether date falls within the period
+func (p *Period) Contains(date time.Time) bool {
+	return !date.Before(p.StartDate) && !date.After(p.EndDate)
+}
+
+// FXRate is an exchange rate effective on a date
+type FXRate struct {
+	FromCurrency string       `json:"from_currency"`
+	ToCurrency   string       `json:"to_currency"`
+	Date         time.Time    `json:"date"`
+	Rate         decimal.Rate `json:"rate"` // units of ToCurrency per unit of FromCurrency
+	Source       string       `json:"source,omitempty"`
+}
+
+// PurchaseOrder represents a purchase order invoices are matched against
+type PurchaseOrder struct {
+	ID        string               `json:"id"`
+	EntityID  string               `json:"entity_id"`
+	PONumber  string               `json:"po_number"`
+	VendorID  string               `json:"vendor_id"`
+	Currency  string               `json:"currency"`
+	Status    string               `json:"status"` // "open", "closed" or "cancelled"
+	OrderDate time.Time            `json:"order_date"`
+	Lines     []*PurchaseOrderLine `json:"lines"`
+}
+
+// IsOpen reports whether the purchase order accepts invoices
+func (po *PurchaseOrder) IsOpen() bool {
+	return po.Status == "open"
+}
+
+// PurchaseOrderLine is one ordered item of a purchase order. QuantityReceived
+// is the goods receipt recorded against the line so far.
+type PurchaseOrderLine struct {
+	LineNumber       int             `json:"line_number"`
+	ItemCode         *string         `json:"item_code,omitempty"`
+	Description      string          `json:"description"`
+	Quantity         decimal.Decimal `json:"quantity"`
+	UnitPrice        int64           `json:"unit_price"` // minor units of the PO currency
+	QuantityReceived decimal.Decimal `json:"quantity_received"`
+}
@@ -31,6 +31,18 @@ func (c *VendorsClient) ValidateVendor(ctx context.Context, vendorID, entityID s
 	return resp.Valid, resp.Message, nil
 }
 
+// GetVendor retrieves a vendor by ID
+func (c *VendorsClient) GetVendor(ctx context.Context, vendorID, entityID string) (*Vendor, error) {
+	path := fmt.Sprintf("/api/v1/vendors/get?id=%s&entity_id=%s", vendorID, entityID)
+
+	var vendor Vendor
+	if err := c.client.Get(ctx, path, &vendor); err != nil {
+		return nil, fmt.Errorf("failed to get vendor: %w", err)
+	}
+
+	return &vendor, nil
+}
+
 // UpdateBalanceRequest represents the update balance request
 type UpdateBalanceRequest struct {
 	VendorID string `json:"vendor_id"`
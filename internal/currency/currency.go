@@ -0,0 +1,125 @@
+// Package currency is the ISO 4217 currency registry. Amounts throughout the
+// service are integers in the minor unit of their currency, which is not
+// always a cent: JPY has no minor unit and BHD has three decimal places.
+package currency
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// Currency is an ISO 4217 currency
+type Currency struct {
+	Code       string `json:"code"`
+	MinorUnits int    `json:"minor_units"` // decimal places of the minor unit
+}
+
+// Currencies with a minor unit other than the usual two decimal places
+var exponents = map[string]int{
+	// No minor unit
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0,
+	"XAF": 0, "XOF": 0, "XPF": 0,
+
+	// Three decimal places
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+
+	// Four decimal places
+	"CLF": 4, "UYW": 4,
+}
+
+// Active ISO 4217 currencies with two decimal places
+var twoDecimal = []string{
+	"AED", "AFN", "ALL", "AMD", "ANG", "AOA", "ARS", "AUD", "AWG", "AZN",
+	"BAM", "BBD", "BDT", "BGN", "BMD", "BND", "BOB", "BRL", "BSD", "BTN",
+	"BWP", "BYN", "BZD", "CAD", "CDF", "CHF", "CNY", "COP", "CRC", "CUP",
+	"CVE", "CZK", "DKK", "DOP", "DZD", "EGP", "ERN", "ETB", "EUR", "FJD",
+	"FKP", "GBP", "GEL", "GHS", "GIP", "GMD", "GTQ", "GYD", "HKD", "HNL",
+	"HTG", "HUF", "IDR", "ILS", "INR", "IRR", "JMD", "KES", "KGS", "KHR",
+	"KPW", "KYD", "KZT", "LAK", "LBP", "LKR", "LRD", "LSL", "MAD", "MDL",
+	"MGA", "MKD", "MMK", "MNT", "MOP", "MRU", "MUR", "MVR", "MWK", "MXN",
+	"MYR", "MZN", "NAD", "NGN", "NIO", "NOK", "NPR", "NZD", "PAB", "PEN",
+	"PGK", "PHP", "PKR", "PLN", "QAR", "RON", "RSD", "RUB", "SAR", "SBD",
+	"SCR", "SDG", "SEK", "SGD", "SHP", "SLE", "SOS", "SRD", "SSP", "STN",
+	"SVC", "SYP", "SZL", "THB", "TJS", "TMT", "TOP", "TRY", "TTD", "TWD",
+	"TZS", "UAH", "USD", "UYU", "UZS", "VES", "WST", "XCD", "YER", "ZAR",
+	"ZMW", "ZWG",
+}
+
+var registry = buildRegistry()
+
+func buildRegistry() map[string]Currency {
+	currencies := make(map[string]Currency, len(twoDecimal)+len(exponents))
+	for _, code := range twoDecimal {
+		currencies[code] = Currency{Code: code, MinorUnits: 2}
+	}
+	for code, minorUnits := range exponents {
+		currencies[code] = Currency{Code: code, MinorUnits: minorUnits}
+	}
+	return currencies
+}
+
+// Lookup returns the currency with the given code, in any case
+func Lookup(code string) (Currency, error) {
+	c, ok := registry[strings.ToUpper(code)]
+	if !ok {
+		return Currency{}, fmt.Errorf("unknown ISO 4217 currency %q", code)
+	}
+	return c, nil
+}
+
+// ForCode returns the currency with the given code. A code missing from the
+// registry, which only invoices saved before currencies were validated can
+// carry, is treated as having two decimal places as amounts were then.
+func ForCode(code string) Currency {
+	c, err := Lookup(code)
+	if err != nil {
+		return Currency{Code: code, MinorUnits: 2}
+	}
+	return c
+}
+
+// Format renders an amount in minor units in major units with the
+// currency's decimal places, e.g. 1234500 BHD as "1234.500" and 1500 JPY
+// as "1500"
+func (c Currency) Format(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+	}
+	digits := strconv.FormatUint(absUint(amount), 10)
+	if c.MinorUnits == 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= c.MinorUnits {
+		digits = strings.Repeat("0", c.MinorUnits-len(digits)+1) + digits
+	}
+	split := len(digits) - c.MinorUnits
+	return sign + digits[:split] + "." + digits[split:]
+}
+
+// Convert converts an amount in minor units of from into minor units of to
+// at rate units of to per unit of from, rounding half away from zero
+func Convert(amount int64, from, to Currency, rate decimal.Rate) int64 {
+	converted := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), rate.Rat())
+	shift := to.MinorUnits - from.MinorUnits
+	for ; shift > 0; shift-- {
+		converted.Mul(converted, big.NewRat(10, 1))
+	}
+	for ; shift < 0; shift++ {
+		converted.Quo(converted, big.NewRat(10, 1))
+	}
+	return decimal.Round(converted)
+}
+
+func absUint(amount int64) uint64 {
+	if amount < 0 {
+		return uint64(-(amount + 1)) + 1
+	}
+	return uint64(amount)
+}
@@ -0,0 +1,291 @@
+// Package decimal provides the exact decimal types used for invoice line
+// quantities, tax rates and exchange rates, and the rounding rules shared by
+// line amount, tax and currency calculation.
+package decimal
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of fractional digits a Decimal holds, matching the
+// NUMERIC(15,4) quantity and NUMERIC(7,4) rate columns
+const Scale = 4
+
+// unit is 10^Scale
+const unit = 10000
+
+// Decimal is an exact decimal number with up to Scale fractional digits.
+// The zero value is 0.
+type Decimal struct {
+	units int64 // value * 10^Scale
+}
+
+// FromInt returns n as a Decimal. It panics if n is too large to hold with
+// Scale fractional digits; it is meant for constants.
+func FromInt(n int64) Decimal {
+	units, ok := scaleInt(n, unit)
+	if !ok {
+		panic(fmt.Sprintf("decimal: %d out of range", n))
+	}
+	return Decimal{units: units}
+}
+
+// FromFloat returns f rounded half away from zero to Scale fractional
+// digits. It is meant for values that arrive as floats, such as proto
+// fields; use Parse for text.
+func FromFloat(f float64) Decimal {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	if !ok {
+		return Decimal{}
+	}
+	return Decimal{units: Round(r.Mul(r, big.NewRat(unit, 1)))}
+}
+
+// Parse parses a decimal number such as "12", "-0.5", "8.875" or, as JSON
+// allows, "1.5e-3". More than Scale significant fractional digits is an
+// error rather than being rounded away; trailing zeros are ignored.
+func Parse(s string) (Decimal, error) {
+	units, err := parseUnits(s, Scale)
+	if err != nil {
+		return Decimal{}, err
+	}
+	return Decimal{units: units}, nil
+}
+
+// String formats d without trailing fractional zeros, e.g. "1.5"
+func (d Decimal) String() string {
+	return formatUnits(d.units, Scale)
+}
+
+// Float64 returns d as the nearest float64, for APIs that carry floats
+func (d Decimal) Float64() float64 {
+	f, _ := d.Rat().Float64()
+	return f
+}
+
+// Rat returns d as an exact rational
+func (d Decimal) Rat() *big.Rat {
+	return big.NewRat(d.units, unit)
+}
+
+// Sign returns -1, 0 or +1 as d is negative, zero or positive
+func (d Decimal) Sign() int {
+	switch {
+	case d.units < 0:
+		return -1
+	case d.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// Cmp compares d and e, returning -1, 0 or +1
+func (d Decimal) Cmp(e Decimal) int {
+	switch {
+	case d.units < e.units:
+		return -1
+	case d.units > e.units:
+		return 1
+	}
+	return 0
+}
+
+// Add returns d + e
+func (d Decimal) Add(e Decimal) Decimal {
+	return Decimal{units: d.units + e.units}
+}
+
+// Sub returns d - e
+func (d Decimal) Sub(e Decimal) Decimal {
+	return Decimal{units: d.units - e.units}
+}
+
+// MarshalJSON encodes d as a JSON number
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON decodes d from a JSON number or a string holding one. The
+// number is read from its text, so no precision is lost to float64.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "null" {
+		return nil
+	}
+	parsed, err := Parse(text)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner; pgx hands NUMERIC values over as text
+func (d *Decimal) Scan(src any) error {
+	units, err := scanUnits(src, Scale)
+	if err != nil {
+		return err
+	}
+	*d = Decimal{units: units}
+	return nil
+}
+
+// Value implements driver.Valuer, writing d as NUMERIC text
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// MulRound returns amount * d rounded half away from zero, e.g. the amount in
+// minor units of a quantity at a unit price
+func MulRound(amount int64, d Decimal) int64 {
+	return Round(new(big.Rat).Mul(new(big.Rat).SetInt64(amount), d.Rat()))
+}
+
+// PercentOf returns percent % of amount rounded half away from zero
+func PercentOf(amount int64, percent Decimal) int64 {
+	r := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), percent.Rat())
+	return Round(r.Quo(r, big.NewRat(100, 1)))
+}
+
+// Round rounds x half away from zero to an integer. Every amount in minor
+// units derived from a quantity or rate is rounded this way.
+func Round(x *big.Rat) int64 {
+	num := new(big.Int).Abs(x.Num())
+	quo, rem := new(big.Int).QuoRem(num, x.Denom(), new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(x.Denom()) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if x.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	return quo.Int64()
+}
+
+// Floor rounds x down to an integer
+func Floor(x *big.Rat) int64 {
+	// Euclidean division floors for the always positive denominator
+	return new(big.Int).Div(x.Num(), x.Denom()).Int64()
+}
+
+// maxExponent bounds the exponent accepted by parseUnits; larger ones
+// cannot produce a value that fits in an int64 anyway
+const maxExponent = 40
+
+// parseUnits parses s as a decimal number, optionally with an exponent, with
+// at most scale significant fractional digits, returning it multiplied by
+// 10^scale
+func parseUnits(s string, scale int) (int64, error) {
+	text := strings.TrimSpace(s)
+	neg := false
+	if strings.HasPrefix(text, "-") || strings.HasPrefix(text, "+") {
+		neg = text[0] == '-'
+		text = text[1:]
+	}
+
+	mantissa, exponent := text, 0
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		exp, err := strconv.Atoi(text[i+1:])
+		if err != nil || exp > maxExponent || exp < -maxExponent {
+			return 0, fmt.Errorf("invalid decimal %q", s)
+		}
+		mantissa, exponent = text[:i], exp
+	}
+
+	whole, frac, _ := strings.Cut(mantissa, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("invalid decimal %q", s)
+	}
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid decimal %q", s)
+		}
+	}
+
+	// Move the decimal point by the exponent
+	digits, point := whole+frac, len(whole)+exponent
+	if point < 0 {
+		digits = strings.Repeat("0", -point) + digits
+		point = 0
+	}
+	if point > len(digits) {
+		digits += strings.Repeat("0", point-len(digits))
+	}
+	whole, frac = digits[:point], strings.TrimRight(digits[point:], "0")
+
+	if len(frac) > scale {
+		return 0, fmt.Errorf("invalid decimal %q: more than %d decimal places", s, scale)
+	}
+
+	units, err := strconv.ParseInt("0"+whole+frac+strings.Repeat("0", scale-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid decimal %q: out of range", s)
+	}
+	if neg {
+		units = -units
+	}
+	return units, nil
+}
+
+// scaleInt returns n * pow and whether it fits in an int64
+func scaleInt(n, pow int64) (int64, bool) {
+	if n > math.MaxInt64/pow || n < math.MinInt64/pow {
+		return 0, false
+	}
+	return n * pow, true
+}
+
+// formatUnits formats units / 10^scale without trailing fractional zeros
+func formatUnits(units int64, scale int) string {
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+
+	pow := pow10(scale)
+	whole := strconv.FormatInt(units/pow, 10)
+	frac := strings.TrimRight(fmt.Sprintf("%0*d", scale, units%pow), "0")
+	if frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+// scanUnits converts a database value to units of 10^-scale
+func scanUnits(src any, scale int) (int64, error) {
+	switch v := src.(type) {
+	case string:
+		return parseUnits(v, scale)
+	case []byte:
+		return parseUnits(string(v), scale)
+	case int64:
+		units, ok := scaleInt(v, pow10(scale))
+		if !ok {
+			return 0, fmt.Errorf("cannot scan %d into decimal: out of range", v)
+		}
+		return units, nil
+	case float64:
+		r, ok := new(big.Rat).SetString(strconv.FormatFloat(v, 'f', -1, 64))
+		if !ok {
+			return 0, fmt.Errorf("cannot scan %v into decimal", v)
+		}
+		return Round(r.Mul(r, new(big.Rat).SetInt64(pow10(scale)))), nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("cannot scan %T into decimal", src)
+}
+
+// pow10 returns 10^n
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,245 @@
+package decimal
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "12", want: "12"},
+		{in: "-0.5", want: "-0.5"},
+		{in: "+8.875", want: "8.875"},
+		{in: " 1.25 ", want: "1.25"},
+		{in: ".5", want: "0.5"},
+		{in: "3.", want: "3"},
+		{in: "0.0001", want: "0.0001"},
+		{in: "1.50000", want: "1.5"},
+		{in: "1e2", want: "100"},
+		{in: "1.5E-3", want: "0.0015"},
+		{in: "-2.5e+1", want: "-25"},
+		{in: "12500e-4", want: "1.25"},
+		{in: "0.00001", wantErr: true},
+		{in: "1e-5", wantErr: true},
+		{in: "1.23456", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "-", wantErr: true},
+		{in: ".", wantErr: true},
+		{in: "--1", wantErr: true},
+		{in: "-+1", wantErr: true},
+		{in: "1.2.3", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "1e", wantErr: true},
+		{in: "e5", wantErr: true},
+		{in: "1e400", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %s, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "1.0834", want: "1.0834"},
+		{in: "0.0067452", want: "0.0067452"},
+		{in: "6.7452e-3", want: "0.0067452"},
+		{in: "1e-10", want: "0.0000000001"},
+		{in: "1e-11", wantErr: true},
+		{in: "1000000000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRate(%q) = %s, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRate(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("ParseRate(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFromInt(t *testing.T) {
+	if got := FromInt(-42).String(); got != "-42" {
+		t.Errorf("FromInt(-42) = %s, want -42", got)
+	}
+
+	max := int64(math.MaxInt64 / unit)
+	if got := FromInt(max).String(); got != "922337203685477" {
+		t.Errorf("FromInt(%d) = %s", max, got)
+	}
+
+	for _, n := range []int64{max + 1, -max - 1, math.MaxInt64, math.MinInt64} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("FromInt(%d) did not panic", n)
+				}
+			}()
+			FromInt(n)
+		}()
+	}
+}
+
+func TestRateFromIntOverflow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RateFromInt(1e9) did not panic")
+		}
+	}()
+	RateFromInt(1000000000)
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		num, denom int64
+		want       int64
+	}{
+		{num: 5, denom: 2, want: 3},
+		{num: -5, denom: 2, want: -3},
+		{num: 7, denom: 3, want: 2},
+		{num: -7, denom: 3, want: -2},
+		{num: 149, denom: 100, want: 1},
+		{num: 0, denom: 1, want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := Round(big.NewRat(tt.num, tt.denom)); got != tt.want {
+			t.Errorf("Round(%d/%d) = %d, want %d", tt.num, tt.denom, got, tt.want)
+		}
+	}
+}
+
+func TestFloor(t *testing.T) {
+	tests := []struct {
+		num, denom int64
+		want       int64
+	}{
+		{num: 5, denom: 2, want: 2},
+		{num: -5, denom: 2, want: -3},
+		{num: 4, denom: 2, want: 2},
+	}
+
+	for _, tt := range tests {
+		if got := Floor(big.NewRat(tt.num, tt.denom)); got != tt.want {
+			t.Errorf("Floor(%d/%d) = %d, want %d", tt.num, tt.denom, got, tt.want)
+		}
+	}
+}
+
+func TestMulRoundAndPercentOf(t *testing.T) {
+	qty, _ := Parse("2.5")
+	if got := MulRound(333, qty); got != 833 {
+		t.Errorf("MulRound(333, 2.5) = %d, want 833", got)
+	}
+
+	pct, _ := Parse("17.5")
+	if got := PercentOf(1001, pct); got != 175 {
+		t.Errorf("PercentOf(1001, 17.5) = %d, want 175", got)
+	}
+	if got := PercentOf(-1001, pct); got != -175 {
+		t.Errorf("PercentOf(-1001, 17.5) = %d, want -175", got)
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src     any
+		want    string
+		wantErr bool
+	}{
+		{src: "15.2500", want: "15.25"},
+		{src: []byte("0.1250"), want: "0.125"},
+		{src: int64(7), want: "7"},
+		{src: 0.5, want: "0.5"},
+		{src: nil, want: "0"},
+		{src: int64(math.MaxInt64), wantErr: true},
+		{src: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var d Decimal
+		err := d.Scan(tt.src)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Scan(%v) = %s, want error", tt.src, d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Scan(%v) error: %v", tt.src, err)
+			continue
+		}
+		if d.String() != tt.want {
+			t.Errorf("Scan(%v) = %s, want %s", tt.src, d, tt.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Quantity Decimal  `json:"quantity"`
+		Price    *Decimal `json:"price"`
+		Rate     Rate     `json:"rate"`
+	}
+	if err := json.Unmarshal([]byte(`{"quantity": "2.5", "price": 1e-2, "rate": 1.0834}`), &v); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if v.Quantity.String() != "2.5" || v.Price.String() != "0.01" || v.Rate.String() != "1.0834" {
+		t.Errorf("Unmarshal = %s, %s, %s", v.Quantity, v.Price, v.Rate)
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	if string(out) != `{"quantity":2.5,"price":0.01,"rate":1.0834}` {
+		t.Errorf("Marshal = %s", out)
+	}
+
+	if err := json.Unmarshal([]byte(`{"quantity": 1.23456}`), &v); err == nil {
+		t.Error("Unmarshal of 5 decimal places did not fail")
+	}
+}
+
+func TestRateInverse(t *testing.T) {
+	r, _ := ParseRate("4")
+	if got := r.Inverse().String(); got != "0.25" {
+		t.Errorf("Inverse(4) = %s, want 0.25", got)
+	}
+	if got := (Rate{}).Inverse(); got.Sign() != 0 {
+		t.Errorf("Inverse(0) = %s, want 0", got)
+	}
+}
@@ -0,0 +1,124 @@
+package decimal
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// RateScale is the number of fractional digits a Rate holds, matching the
+// NUMERIC(20,10) exchange rate columns
+const RateScale = 10
+
+// rateUnit is 10^RateScale
+const rateUnit = 10000000000
+
+// Rate is an exact exchange rate with up to RateScale fractional digits: the
+// number of units of one currency that one unit of another buys. The zero
+// value is not a valid rate.
+type Rate struct {
+	units int64 // value * 10^RateScale
+}
+
+// RateFromInt returns n as a Rate. It panics if n is too large to hold with
+// RateScale fractional digits; it is meant for constants.
+func RateFromInt(n int64) Rate {
+	units, ok := scaleInt(n, rateUnit)
+	if !ok {
+		panic(fmt.Sprintf("decimal: rate %d out of range", n))
+	}
+	return Rate{units: units}
+}
+
+// RateFromRat returns x rounded half away from zero to RateScale fractional
+// digits
+func RateFromRat(x *big.Rat) Rate {
+	scaled := new(big.Rat).Mul(x, new(big.Rat).SetInt64(rateUnit))
+	return Rate{units: Round(scaled)}
+}
+
+// ParseRate parses an exchange rate such as "1.0834" or "0.0067452". More
+// than RateScale fractional digits is an error.
+func ParseRate(s string) (Rate, error) {
+	units, err := parseUnits(s, RateScale)
+	if err != nil {
+		return Rate{}, err
+	}
+	return Rate{units: units}, nil
+}
+
+// String formats r without trailing fractional zeros
+func (r Rate) String() string {
+	return formatUnits(r.units, RateScale)
+}
+
+// Rat returns r as an exact rational
+func (r Rate) Rat() *big.Rat {
+	return big.NewRat(r.units, rateUnit)
+}
+
+// Sign returns -1, 0 or +1 as r is negative, zero or positive
+func (r Rate) Sign() int {
+	switch {
+	case r.units < 0:
+		return -1
+	case r.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// Cmp compares r and q, returning -1, 0 or +1
+func (r Rate) Cmp(q Rate) int {
+	switch {
+	case r.units < q.units:
+		return -1
+	case r.units > q.units:
+		return 1
+	}
+	return 0
+}
+
+// Inverse returns 1 / r rounded to RateScale fractional digits, or the zero
+// Rate if r is zero
+func (r Rate) Inverse() Rate {
+	if r.units == 0 {
+		return Rate{}
+	}
+	return RateFromRat(new(big.Rat).Inv(r.Rat()))
+}
+
+// MarshalJSON encodes r as a JSON number
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalJSON decodes r from a JSON number or a string holding one
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "null" {
+		return nil
+	}
+	parsed, err := ParseRate(text)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner; pgx hands NUMERIC values over as text
+func (r *Rate) Scan(src any) error {
+	units, err := scanUnits(src, RateScale)
+	if err != nil {
+		return err
+	}
+	*r = Rate{units: units}
+	return nil
+}
+
+// Value implements driver.Valuer, writing r as NUMERIC text
+func (r Rate) Value() (driver.Value, error) {
+	return r.String(), nil
+}
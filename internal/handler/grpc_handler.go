@@ -3,10 +3,15 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
@@ -14,11 +19,17 @@ import (
 	pb "github.com/pesio-ai/be-lib-proto/gen/go/ap"
 	"github.com/pesio-ai/be-lib-common/auth"
 	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
 	"github.com/pesio-ai/be-ap-invoices/internal/repository"
 	"github.com/pesio-ai/be-ap-invoices/internal/service"
 )
 
-// GRPCHandler implements the InvoicesService gRPC interface
+// GRPCHandler implements the InvoicesService gRPC interface. The service is
+// defined in the shared be-lib-proto module, which this repository does not
+// change, so features it has no RPCs for are served over HTTP only: entity
+// settings, posting previews, tax codes, goods receipts, holds, duplicate
+// review and split invoice review.
 type GRPCHandler struct {
 	pb.UnimplementedInvoicesServiceServer
 	invoiceService        *service.InvoiceService
@@ -53,6 +64,38 @@ func userID(ctx context.Context) string {
 	return ""
 }
 
+// invoiceVersionKey is the metadata key carrying an invoice's version. Clients
+// send it on writes to guard against concurrent changes, and the server
+// returns the current version under the same key in the response header.
+// The shared ap proto has no version field, so it travels as metadata.
+const invoiceVersionKey = "x-invoice-version"
+
+// expectedVersion reads the client's expected invoice version from incoming
+// metadata, returning nil when none was sent.
+func expectedVersion(ctx context.Context) (*int64, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	values := md.Get(invoiceVersionKey)
+	if len(values) == 0 || values[0] == "" {
+		return nil, nil
+	}
+	version, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s metadata: %q", invoiceVersionKey, values[0])
+	}
+	return &version, nil
+}
+
+// setVersionHeader sends the invoice's current version back to the client.
+func setVersionHeader(ctx context.Context, inv *repository.Invoice) {
+	if inv == nil {
+		return
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(invoiceVersionKey, strconv.FormatInt(inv.Version, 10)))
+}
+
 // CreateInvoice creates a new invoice
 func (h *GRPCHandler) CreateInvoice(ctx context.Context, req *pb.CreateInvoiceRequest) (*pb.Invoice, error) {
 	h.logger.Info().
@@ -69,6 +112,10 @@ func (h *GRPCHandler) CreateInvoice(ctx context.Context, req *pb.CreateInvoiceRe
 		InvoiceType:   "standard", // Default - proto doesn't have this field
 		PaymentTerms:  "net30",    // Default - proto doesn't have this field
 		Currency:      req.Currency,
+
+		// The proto has no duplicate override reason, so a likely duplicate
+		// the entity's policy would block is created with a warning instead
+		DuplicateWarnOnly: true,
 	}
 
 	// Set description if provided
@@ -97,19 +144,26 @@ func (h *GRPCHandler) CreateInvoice(ctx context.Context, req *pb.CreateInvoiceRe
 			LineNumber:  i + 1,
 			AccountID:   line.AccountId,
 			Description: line.Description,
-			Quantity:    1, // Default quantity
-			TaxCode:     &line.TaxCode,
+			Quantity:    decimal.FromInt(1), // Default quantity
+		}
+
+		// Convert empty string to NULL for TaxCode
+		if line.TaxCode != "" {
+			lineReq.TaxCode = &line.TaxCode
 		}
 
 		// Extract amount from Money message
-		if line.Amount != nil {
-			lineReq.UnitPrice = line.Amount.Amount
-			lineReq.LineAmount = line.Amount.Amount
+		amount, err := moneyAmount(line.Amount, req.Currency)
+		if err != nil {
+			return nil, err
 		}
+		lineReq.UnitPrice = amount
+		lineReq.LineAmount = amount
 
 		// Extract tax from Money message
-		if line.Tax != nil {
-			lineReq.TaxAmount = line.Tax.Amount
+		lineReq.TaxAmount, err = moneyAmount(line.Tax, req.Currency)
+		if err != nil {
+			return nil, err
 		}
 
 		serviceReq.Lines = append(serviceReq.Lines, lineReq)
@@ -122,6 +176,7 @@ func (h *GRPCHandler) CreateInvoice(ctx context.Context, req *pb.CreateInvoiceRe
 		return nil, mapErrorToGRPC(err)
 	}
 
+	setVersionHeader(ctx, invoice)
 	return invoiceToProto(invoice), nil
 }
 
@@ -138,6 +193,7 @@ func (h *GRPCHandler) GetInvoice(ctx context.Context, req *pb.GetInvoiceRequest)
 		return nil, mapErrorToGRPC(err)
 	}
 
+	setVersionHeader(ctx, invoice)
 	return invoiceToProto(invoice), nil
 }
 
@@ -148,9 +204,98 @@ func (h *GRPCHandler) UpdateInvoice(ctx context.Context, req *pb.UpdateInvoiceRe
 		Str("id", req.Id).
 		Msg("gRPC UpdateInvoice called")
 
-	// NOTE: The service doesn't have an UpdateInvoice method yet
-	// For now, return unimplemented
-	return nil, status.Error(codes.Unimplemented, "UpdateInvoice not implemented")
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceReq := &service.UpdateInvoiceRequest{
+		ID:              req.Id,
+		EntityID:        req.EntityId,
+		UpdatedBy:       userID(ctx),
+		ExpectedVersion: version,
+	}
+
+	if req.Description != "" {
+		serviceReq.Description = &req.Description
+	}
+
+	if req.DueDate != nil {
+		dueDate := req.DueDate.AsTime().Format("2006-01-02")
+		serviceReq.DueDate = &dueDate
+	}
+
+	// Proto lines carry no line IDs, so a non-empty line set replaces the
+	// existing lines wholesale. Each proto line edits the stored line with
+	// its line number, keeping what the proto cannot carry: the quantity,
+	// dimensions and item.
+	if len(req.Lines) > 0 {
+		invoice, err := h.invoiceService.GetInvoice(ctx, req.Id, req.EntityId)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("Failed to get invoice")
+			return nil, mapErrorToGRPC(err)
+		}
+		stored := make(map[int]*repository.InvoiceLine, len(invoice.Lines))
+		for _, line := range invoice.Lines {
+			stored[line.LineNumber] = line
+		}
+
+		serviceReq.ReplaceLines = true
+		for i, line := range req.Lines {
+			lineReq := &service.UpdateInvoiceLineRequest{
+				InvoiceLineRequest: service.InvoiceLineRequest{
+					LineNumber:  i + 1,
+					AccountID:   line.AccountId,
+					Description: line.Description,
+					Quantity:    decimal.FromInt(1), // Default quantity
+				},
+			}
+
+			// Convert empty string to NULL for TaxCode
+			if line.TaxCode != "" {
+				lineReq.TaxCode = &line.TaxCode
+			}
+
+			// Extract amount from Money message
+			amount, err := moneyAmount(line.Amount, invoice.Currency)
+			if err != nil {
+				return nil, err
+			}
+			lineReq.UnitPrice = amount
+			lineReq.LineAmount = amount
+
+			if existing, ok := stored[i+1]; ok {
+				lineReq.ID = existing.ID
+				lineReq.Dimension1 = existing.Dimension1
+				lineReq.Dimension2 = existing.Dimension2
+				lineReq.Dimension3 = existing.Dimension3
+				lineReq.Dimension4 = existing.Dimension4
+				lineReq.ItemCode = existing.ItemCode
+				lineReq.ItemName = existing.ItemName
+				if quantity, unitPrice, ok := keepQuantity(existing, amount); ok {
+					lineReq.Quantity = quantity
+					lineReq.UnitPrice = unitPrice
+				}
+			}
+
+			// Extract tax from Money message
+			lineReq.TaxAmount, err = moneyAmount(line.Tax, invoice.Currency)
+			if err != nil {
+				return nil, err
+			}
+
+			serviceReq.Lines = append(serviceReq.Lines, lineReq)
+		}
+	}
+
+	invoice, err := h.invoiceService.UpdateInvoice(ctx, serviceReq)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to update invoice")
+		return nil, mapErrorToGRPC(err)
+	}
+
+	setVersionHeader(ctx, invoice)
+	return invoiceToProto(invoice), nil
 }
 
 // DeleteInvoice deletes an invoice
@@ -160,7 +305,12 @@ func (h *GRPCHandler) DeleteInvoice(ctx context.Context, req *pb.DeleteInvoiceRe
 		Str("id", req.Id).
 		Msg("gRPC DeleteInvoice called")
 
-	err := h.invoiceService.DeleteInvoice(ctx, req.Id, req.EntityId)
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, err
+	}
+
+	err = h.invoiceService.DeleteInvoice(ctx, req.Id, req.EntityId, version)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to delete invoice")
 		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
@@ -246,8 +396,13 @@ func (h *GRPCHandler) SubmitForApproval(ctx context.Context, req *pb.SubmitForAp
 		Str("submitted_by", uid).
 		Msg("gRPC SubmitForApproval called")
 
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, err
+	}
+
 	// 1. Update invoice status to pending_approval
-	if err := h.invoiceService.SubmitForApproval(ctx, req.Id, req.EntityId, uid); err != nil {
+	if err := h.invoiceService.SubmitForApproval(ctx, req.Id, req.EntityId, uid, version); err != nil {
 		h.logger.Error().Err(err).Msg("Failed to submit for approval")
 		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
 	}
@@ -257,7 +412,13 @@ func (h *GRPCHandler) SubmitForApproval(ctx context.Context, req *pb.SubmitForAp
 	if err != nil {
 		h.logger.Warn().Err(err).Str("invoice_id", req.Id).Msg("Could not fetch invoice for workflow creation")
 	} else {
-		contextJSON := buildInvoiceContextJSON(invoice)
+		setVersionHeader(ctx, invoice)
+		// A split invoice escalation routes on the combined total (non-fatal)
+		escalation, err := h.invoiceService.ApprovalEscalation(ctx, invoice)
+		if err != nil {
+			h.logger.Warn().Err(err).Str("invoice_id", req.Id).Msg("Could not check split invoice escalation")
+		}
+		contextJSON := buildInvoiceContextJSON(invoice, escalation)
 		wf, err := h.approvalsClient.CreateWorkflow(ctx, req.EntityId, "INVOICE", req.Id, contextJSON, uid)
 		if err != nil {
 			h.logger.Warn().Err(err).Str("invoice_id", req.Id).Msg("Could not create approval workflow")
@@ -301,6 +462,19 @@ func (h *GRPCHandler) ApproveInvoice(ctx context.Context, req *pb.ApproveInvoice
 		Str("acted_by", uid).
 		Msg("gRPC ApproveInvoice called")
 
+	// Check the client's version before acting on the workflow, so a stale
+	// approval is not recorded against an invoice that has since changed
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, err
+	}
+	if err := h.invoiceService.CheckVersion(ctx, req.Id, req.EntityId, version); err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
+	}
+	if err := h.invoiceService.CheckNotOnHold(ctx, req.Id, req.EntityId, "approve"); err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
+	}
+
 	// Resolve active workflow from be-plt-approvals
 	wf, err := h.approvalsClient.GetActiveWorkflow(ctx, req.EntityId, "INVOICE", req.Id)
 	if err != nil {
@@ -323,15 +497,18 @@ func (h *GRPCHandler) ApproveInvoice(ctx context.Context, req *pb.ApproveInvoice
 		if workflowComplete {
 			// All steps done — mark invoice as approved
 			approveReq := &service.ApproveInvoiceRequest{
-				ID:         req.Id,
-				EntityID:   req.EntityId,
-				ApprovedBy: uid,
-				Notes:      notes,
+				ID:              req.Id,
+				EntityID:        req.EntityId,
+				ApprovedBy:      uid,
+				Notes:           notes,
+				ExpectedVersion: version,
 			}
-			if _, err := h.invoiceService.ApproveInvoice(ctx, approveReq); err != nil {
+			invoice, err := h.invoiceService.ApproveInvoice(ctx, approveReq)
+			if err != nil {
 				h.logger.Error().Err(err).Msg("Failed to update invoice status to approved")
 				return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
 			}
+			setVersionHeader(ctx, invoice)
 		}
 		if h.notificationPublisher != nil {
 			payload := map[string]interface{}{
@@ -365,15 +542,18 @@ func (h *GRPCHandler) ApproveInvoice(ctx context.Context, req *pb.ApproveInvoice
 		approvedBy = req.ApprovedBy
 	}
 	approveReq := &service.ApproveInvoiceRequest{
-		ID:         req.Id,
-		EntityID:   req.EntityId,
-		ApprovedBy: approvedBy,
-		Notes:      notes,
+		ID:              req.Id,
+		EntityID:        req.EntityId,
+		ApprovedBy:      approvedBy,
+		Notes:           notes,
+		ExpectedVersion: version,
 	}
-	if _, err := h.invoiceService.ApproveInvoice(ctx, approveReq); err != nil {
+	invoice, err := h.invoiceService.ApproveInvoice(ctx, approveReq)
+	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to approve invoice")
 		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
 	}
+	setVersionHeader(ctx, invoice)
 	return &commonpb.Response{Success: true, Message: "Invoice approved"}, nil
 }
 
@@ -390,6 +570,14 @@ func (h *GRPCHandler) RejectInvoice(ctx context.Context, req *pb.RejectInvoiceRe
 		return &commonpb.Response{Success: false, Message: "reason is required"}, status.Error(codes.InvalidArgument, "reason is required")
 	}
 
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, err
+	}
+	if err := h.invoiceService.CheckVersion(ctx, req.Id, req.EntityId, version); err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
+	}
+
 	wf, err := h.approvalsClient.GetActiveWorkflow(ctx, req.EntityId, "INVOICE", req.Id)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to get active workflow")
@@ -409,7 +597,7 @@ func (h *GRPCHandler) RejectInvoice(ctx context.Context, req *pb.RejectInvoiceRe
 	}
 
 	// Reset invoice to draft
-	if err := h.invoiceService.RejectInvoice(ctx, req.Id, req.EntityId, rejectedBy, req.Reason); err != nil {
+	if err := h.invoiceService.RejectInvoice(ctx, req.Id, req.EntityId, rejectedBy, req.Reason, version); err != nil {
 		h.logger.Error().Err(err).Msg("Failed to update invoice status after rejection")
 		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
 	}
@@ -437,6 +625,14 @@ func (h *GRPCHandler) RecallInvoice(ctx context.Context, req *pb.RecallInvoiceRe
 		Str("recalled_by", uid).
 		Msg("gRPC RecallInvoice called")
 
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, err
+	}
+	if err := h.invoiceService.CheckVersion(ctx, req.Id, req.EntityId, version); err != nil {
+		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
+	}
+
 	wf, err := h.approvalsClient.GetActiveWorkflow(ctx, req.EntityId, "INVOICE", req.Id)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to get active workflow for recall")
@@ -452,7 +648,7 @@ func (h *GRPCHandler) RecallInvoice(ctx context.Context, req *pb.RecallInvoiceRe
 	}
 
 	// Reset invoice to draft
-	if err := h.invoiceService.RecallInvoice(ctx, req.Id, req.EntityId, uid); err != nil {
+	if err := h.invoiceService.RecallInvoice(ctx, req.Id, req.EntityId, uid, version); err != nil {
 		h.logger.Error().Err(err).Msg("Failed to recall invoice")
 		return &commonpb.Response{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
 	}
@@ -589,10 +785,17 @@ func (h *GRPCHandler) PostToGL(ctx context.Context, req *pb.PostToGLRequest) (*p
 		Str("period_id", req.PeriodId).
 		Msg("gRPC PostToGL called")
 
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		return &pb.PostToGLResponse{Success: false, Message: err.Error()}, err
+	}
+
 	postReq := &service.PostInvoiceRequest{
-		ID:       req.Id,
-		EntityID: req.EntityId,
-		PostedBy: userID(ctx),
+		ID:              req.Id,
+		EntityID:        req.EntityId,
+		PostedBy:        userID(ctx),
+		PeriodID:        req.PeriodId,
+		ExpectedVersion: version,
 	}
 
 	invoice, err := h.invoiceService.PostInvoice(ctx, postReq)
@@ -600,44 +803,61 @@ func (h *GRPCHandler) PostToGL(ctx context.Context, req *pb.PostToGLRequest) (*p
 		h.logger.Error().Err(err).Msg("Failed to post to GL")
 		return &pb.PostToGLResponse{Success: false, Message: err.Error()}, mapErrorToGRPC(err)
 	}
+	setVersionHeader(ctx, invoice)
 
 	journalID := ""
 	if invoice.GLJournalID != nil {
 		journalID = *invoice.GLJournalID
 	}
 
+	message := "Invoice posted to GL"
+	if invoice.GLPostingStatus != nil && *invoice.GLPostingStatus == "pending" {
+		message = "Invoice GL posting queued and will be retried"
+	}
+
 	return &pb.PostToGLResponse{
 		Success:        true,
 		JournalEntryId: journalID,
-		Message:        "Invoice posted to GL",
+		Message:        message,
 	}, nil
 }
 
 // Helper functions
 
 // buildInvoiceContextJSON creates the JSON context string sent to the AI for approval routing.
-func buildInvoiceContextJSON(inv *repository.Invoice) string {
+// escalation, if set, is a split invoice finding whose combined total approval routes on.
+func buildInvoiceContextJSON(inv *repository.Invoice, escalation *repository.SplitInvoiceFinding) string {
+	// Amounts are formatted in major units so they read the same for every currency
+	cur := currency.ForCode(inv.Currency)
 	type lineItem struct {
 		Description string `json:"description"`
-		Amount      int64  `json:"amount"`
+		Amount      string `json:"amount"`
 	}
 	type ctx struct {
 		InvoiceNumber string     `json:"invoiceNumber"`
 		Vendor        string     `json:"vendor"`
-		Amount        int64      `json:"amount"`
+		Amount        string     `json:"amount"`
+		Currency      string     `json:"currency"`
 		Description   string     `json:"description,omitempty"`
 		LineItems     []lineItem `json:"lineItems,omitempty"`
+		RoutingAmount string     `json:"routingAmount,omitempty"`
+		SplitInvoices []string   `json:"splitInvoices,omitempty"`
 	}
 	c := ctx{
 		InvoiceNumber: inv.InvoiceNumber,
 		Vendor:        inv.VendorID,
-		Amount:        inv.TotalAmount,
+		Amount:        cur.Format(inv.TotalAmount),
+		Currency:      inv.Currency,
 	}
 	if inv.Description != nil {
 		c.Description = *inv.Description
 	}
 	for _, l := range inv.Lines {
-		c.LineItems = append(c.LineItems, lineItem{Description: l.Description, Amount: l.LineAmount})
+		c.LineItems = append(c.LineItems, lineItem{Description: l.Description, Amount: cur.Format(l.LineAmount)})
+	}
+	if escalation != nil {
+		c.RoutingAmount = cur.Format(escalation.CombinedTotal)
+		c.SplitInvoices = escalation.RelatedInvoiceNumbers
 	}
 	b, _ := json.Marshal(c)
 	return string(b)
@@ -707,6 +927,39 @@ func invoiceToProto(inv *repository.Invoice) *pb.Invoice {
 	return pbInvoice
 }
 
+// keepQuantity returns the stored quantity of a line with the unit price
+// that gives amount at that quantity: the stored unit price if the amount
+// is unchanged, or amount / quantity otherwise. It reports false if no unit
+// price gives amount exactly, in which case the amount is entered as one
+// unit.
+func keepQuantity(stored *repository.InvoiceLine, amount int64) (decimal.Decimal, int64, bool) {
+	if amount == stored.LineAmount {
+		return stored.Quantity, stored.UnitPrice, true
+	}
+	if stored.Quantity.Sign() <= 0 {
+		return decimal.Decimal{}, 0, false
+	}
+	unitPrice := decimal.Round(new(big.Rat).Quo(big.NewRat(amount, 1), stored.Quantity.Rat()))
+	if decimal.MulRound(unitPrice, stored.Quantity) != amount {
+		return decimal.Decimal{}, 0, false
+	}
+	return stored.Quantity, unitPrice, true
+}
+
+// moneyAmount returns the amount of an optional Money message in the minor
+// unit of the invoice currency. A Money message in another currency is
+// rejected rather than read in the wrong minor unit.
+func moneyAmount(m *commonpb.Money, invoiceCurrency string) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	if m.Currency != "" && !strings.EqualFold(m.Currency, invoiceCurrency) {
+		return 0, status.Errorf(codes.InvalidArgument,
+			"amount currency %s does not match invoice currency %s", m.Currency, invoiceCurrency)
+	}
+	return m.Amount, nil
+}
+
 func stringToStatus(s string) pb.InvoiceStatus {
 	switch s {
 	case "draft":
@@ -757,6 +1010,8 @@ func mapErrorToGRPC(err error) error {
 	errMsg := err.Error()
 
 	switch {
+	case contains(errMsg, "version conflict"):
+		return status.Error(codes.Aborted, errMsg)
 	case contains(errMsg, "not found"):
 		return status.Error(codes.NotFound, errMsg)
 	case contains(errMsg, "already exists"):
@@ -1,25 +1,57 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/pesio-ai/be-lib-common/auth"
+	apperrors "github.com/pesio-ai/be-lib-common/errors"
 	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
 	"github.com/pesio-ai/be-ap-invoices/internal/service"
 )
 
 // HTTPHandler handles HTTP requests
 type HTTPHandler struct {
-	service *service.InvoiceService
-	log     *logger.Logger
+	service   *service.InvoiceService
+	settings  *service.EntitySettingsService
+	taxes     *service.TaxService
+	fx        *service.FXService
+	revals    *service.FXRevaluationService
+	recurring *service.RecurringInvoiceService
+	terms     *service.PaymentTermsService
+	pos       *service.PurchaseOrderService
+	matching  *service.POMatchingService
+	receipts  *service.ReceiptService
+	holds     *service.HoldService
+	dups      *service.DuplicateDetectionService
+	splits    *service.SplitInvoiceService
+	log       *logger.Logger
 }
 
 // NewHTTPHandler creates a new HTTP handler
-func NewHTTPHandler(service *service.InvoiceService, log *logger.Logger) *HTTPHandler {
+func NewHTTPHandler(service *service.InvoiceService, settings *service.EntitySettingsService, taxes *service.TaxService, fx *service.FXService, revals *service.FXRevaluationService, recurring *service.RecurringInvoiceService, terms *service.PaymentTermsService, pos *service.PurchaseOrderService, matching *service.POMatchingService, receipts *service.ReceiptService, holds *service.HoldService, dups *service.DuplicateDetectionService, splits *service.SplitInvoiceService, log *logger.Logger) *HTTPHandler {
 	return &HTTPHandler{
-		service: service,
-		log:     log,
+		service:   service,
+		settings:  settings,
+		taxes:     taxes,
+		fx:        fx,
+		revals:    revals,
+		recurring: recurring,
+		terms:     terms,
+		pos:       pos,
+		matching:  matching,
+		receipts:  receipts,
+		holds:     holds,
+		dups:      dups,
+		splits:    splits,
+		log:       log,
 	}
 }
 
@@ -31,8 +63,8 @@ func (h *HTTPHandler) CreateInvoice(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req service.CreateInvoiceRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -45,9 +77,10 @@ func (h *HTTPHandler) CreateInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setETag(w, invoice)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(invoice)
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
 }
 
 // GetInvoice handles get invoice HTTP requests
@@ -71,8 +104,36 @@ func (h *HTTPHandler) GetInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setETag(w, invoice)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
+}
+
+// GetStatusHistory handles invoice status history HTTP requests
+func (h *HTTPHandler) GetStatusHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	history, err := h.service.GetStatusHistory(r.Context(), invoiceID, entityID)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoice)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"history": history,
+	})
 }
 
 // ListInvoices handles list invoices HTTP requests
@@ -131,13 +192,49 @@ func (h *HTTPHandler) ListInvoices(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"invoices": invoices,
+		"invoices": invoicesJSON(invoices),
 		"total":    total,
 		"page":     page,
 		"pageSize": pageSize,
 	})
 }
 
+// UpdateInvoice handles update invoice HTTP requests
+func (h *HTTPHandler) UpdateInvoice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.UpdateInvoiceRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.ID == "" || req.EntityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token once PLT-1 (Identity/Authentication) is implemented
+	req.UpdatedBy = ""
+
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
+	invoice, err := h.service.UpdateInvoice(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, invoice)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
+}
+
 // SubmitForApproval handles submit for approval HTTP requests
 func (h *HTTPHandler) SubmitForApproval(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -146,8 +243,9 @@ func (h *HTTPHandler) SubmitForApproval(w http.ResponseWriter, r *http.Request)
 	}
 
 	var req struct {
-		ID       string `json:"id"`
-		EntityID string `json:"entity_id"`
+		ID              string `json:"id"`
+		EntityID        string `json:"entity_id"`
+		ExpectedVersion *int64 `json:"version,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -157,8 +255,12 @@ func (h *HTTPHandler) SubmitForApproval(w http.ResponseWriter, r *http.Request)
 	// TODO: Get user ID from JWT token once PLT-1 (Identity/Authentication) is implemented
 	submittedBy := ""
 
-	if err := h.service.SubmitForApproval(r.Context(), req.ID, req.EntityID, submittedBy); err != nil{
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
+	if err := h.service.SubmitForApproval(r.Context(), req.ID, req.EntityID, submittedBy, req.ExpectedVersion); err != nil{
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -182,14 +284,19 @@ func (h *HTTPHandler) ApproveInvoice(w http.ResponseWriter, r *http.Request) {
 	// TODO: Get user ID from JWT token once PLT-1 (Identity/Authentication) is implemented
 	req.ApprovedBy = ""
 
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
 	invoice, err := h.service.ApproveInvoice(r.Context(), &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	setETag(w, invoice)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoice)
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
 }
 
 // PostInvoice handles post invoice HTTP requests
@@ -208,14 +315,48 @@ func (h *HTTPHandler) PostInvoice(w http.ResponseWriter, r *http.Request) {
 	// TODO: Get user ID from JWT token once PLT-1 (Identity/Authentication) is implemented
 	req.PostedBy = ""
 
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
 	invoice, err := h.service.PostInvoice(r.Context(), &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, invoice)
+	w.Header().Set("Content-Type", "application/json")
+
+	// GL posting is still being retried in the background
+	if invoice.GLPostingStatus != nil && *invoice.GLPostingStatus == "pending" {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
+}
+
+// PreviewPosting handles posting preview HTTP requests. It returns the
+// journal a post or payment would create without touching GL-2.
+func (h *HTTPHandler) PreviewPosting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.PreviewPostingRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	preview, err := h.service.PreviewPosting(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoice)
+	json.NewEncoder(w).Encode(preview)
 }
 
 // RecordPayment handles record payment HTTP requests
@@ -226,27 +367,95 @@ func (h *HTTPHandler) RecordPayment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req service.RecordPaymentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// TODO: Get user ID from JWT token
 	// req.CreatedBy = "system" // Leave empty for NULL
 
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
+	// Idempotency-Key header takes precedence over the body field
+	if key := strings.TrimSpace(r.Header.Get("Idempotency-Key")); key != "" {
+		req.IdempotencyKey = key
+	}
+
 	invoice, err := h.service.RecordPayment(r.Context(), &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	setETag(w, invoice)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoice)
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
 }
 
-// DeleteInvoice handles delete invoice HTTP requests
-func (h *HTTPHandler) DeleteInvoice(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
+// ApplyCreditMemo handles apply credit memo HTTP requests
+func (h *HTTPHandler) ApplyCreditMemo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.ApplyCreditMemoRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.CreatedBy = ""
+
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
+	creditMemo, err := h.service.ApplyCreditMemo(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, creditMemo)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceJSON(creditMemo))
+}
+
+// UnapplyCreditMemo handles unapply credit memo HTTP requests
+func (h *HTTPHandler) UnapplyCreditMemo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.UnapplyCreditMemoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.ReversedBy = ""
+
+	creditMemo, err := h.service.UnapplyCreditMemo(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
+	setETag(w, creditMemo)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceJSON(creditMemo))
+}
+
+// ListCreditApplications handles list credit applications HTTP requests
+func (h *HTTPHandler) ListCreditApplications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -259,10 +468,1335 @@ func (h *HTTPHandler) DeleteInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.service.DeleteInvoice(r.Context(), invoiceID, entityID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	applications, err := h.service.ListCreditApplications(r.Context(), invoiceID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"applications": applications,
+	})
+}
+
+// GetPaymentSchedule handles get installment schedule HTTP requests
+func (h *HTTPHandler) GetPaymentSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	installments, err := h.service.PaymentSchedule(r.Context(), invoiceID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"installments": installments,
+	})
+}
+
+// MatchInvoice handles match invoice to purchase order HTTP requests
+func (h *HTTPHandler) MatchInvoice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID       string `json:"id"`
+		EntityID string `json:"entity_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ID == "" || req.EntityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	matches, err := h.matching.MatchInvoice(r.Context(), req.ID, req.EntityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"matches": matches,
+	})
+}
+
+// ListInvoiceMatches handles list invoice match results HTTP requests
+func (h *HTTPHandler) ListInvoiceMatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	matches, err := h.matching.ListMatches(r.Context(), invoiceID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"matches": matches,
+	})
+}
+
+// AcceptMatchVariance handles accept PO match variance HTTP requests
+func (h *HTTPHandler) AcceptMatchVariance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.AcceptMatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.InvoiceID == "" || req.EntityID == "" || req.MatchID == "" {
+		http.Error(w, "Invoice ID, Entity ID and Match ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.ResolvedBy = ""
+
+	match, err := h.matching.AcceptVariance(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(match)
+}
+
+// ListInvoiceReceipts handles list the receipts of an invoice's purchase
+// order HTTP requests
+func (h *HTTPHandler) ListInvoiceReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	receipts, err := h.receipts.ListInvoiceReceipts(r.Context(), invoiceID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"receipts": receipts,
+	})
+}
+
+// CheckDuplicates handles check invoice for duplicates HTTP requests
+func (h *HTTPHandler) CheckDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.CheckDuplicatesRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	check, err := h.dups.CheckDuplicates(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
+
+// ListDuplicates handles list recorded invoice duplicates HTTP requests
+func (h *HTTPHandler) ListDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	duplicates, err := h.dups.ListDuplicates(r.Context(), invoiceID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"duplicates": duplicates,
+	})
+}
+
+// PlaceHold handles place invoice hold HTTP requests
+func (h *HTTPHandler) PlaceHold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.PlaceHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.InvoiceID == "" || req.EntityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// Identify the caller from the request context, never from the body.
+	// The HTTP API does not authenticate callers itself, so a hold only its
+	// owner can release is refused unless a caller is identified, as it
+	// could otherwise never be released.
+	req.PlacedBy = requestUserID(r)
+	if req.OwnerOnly && req.PlacedBy == "" {
+		http.Error(w, "An authenticated caller is required to place an owner-only hold", http.StatusUnauthorized)
+		return
+	}
+
+	hold, err := h.holds.PlaceHold(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hold)
+}
+
+// ListInvoiceHolds handles list invoice holds HTTP requests
+func (h *HTTPHandler) ListInvoiceHolds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	includeReleased := r.URL.Query().Get("include_released") == "true"
+
+	holds, err := h.holds.ListInvoiceHolds(r.Context(), invoiceID, entityID, includeReleased)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"holds": holds,
+	})
+}
+
+// ReleaseHold handles release invoice hold HTTP requests
+func (h *HTTPHandler) ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.ReleaseHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.HoldID == "" || req.EntityID == "" {
+		http.Error(w, "Hold ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// Identify the caller from the request context, never from the body,
+	// as an owner-only hold is released only by its owner
+	req.ReleasedBy = requestUserID(r)
+
+	hold, err := h.holds.ReleaseHold(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hold)
+}
+
+// ListOpenHolds handles list an entity's open invoice holds HTTP requests
+func (h *HTTPHandler) ListOpenHolds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	if entityID == "" {
+		http.Error(w, "Entity ID is required", http.StatusBadRequest)
+		return
+	}
+
+	filter := &repository.HoldFilter{}
+	if holdCode := r.URL.Query().Get("hold_code"); holdCode != "" {
+		filter.HoldCode = &holdCode
+	}
+	if holdType := r.URL.Query().Get("hold_type"); holdType != "" {
+		filter.HoldType = &holdType
+	}
+	if ownerID := r.URL.Query().Get("owner_id"); ownerID != "" {
+		filter.OwnerID = &ownerID
+	}
+
+	holds, err := h.holds.ListOpenHolds(r.Context(), entityID, filter)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"holds": holds,
+	})
+}
+
+// ListSplitFindings handles list an entity's split invoice findings HTTP requests
+func (h *HTTPHandler) ListSplitFindings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	if entityID == "" {
+		http.Error(w, "Entity ID is required", http.StatusBadRequest)
+		return
+	}
+
+	filter := &repository.SplitFindingFilter{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter.Status = &status
+	}
+	if vendorID := r.URL.Query().Get("vendor_id"); vendorID != "" {
+		filter.VendorID = &vendorID
+	}
+
+	findings, err := h.splits.ListFindings(r.Context(), entityID, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"findings": findings,
+	})
+}
+
+// ReviewSplitFinding handles review split invoice finding HTTP requests
+func (h *HTTPHandler) ReviewSplitFinding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.ReviewSplitFindingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.FindingID == "" || req.EntityID == "" {
+		http.Error(w, "Finding ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.ReviewedBy = ""
+
+	finding, err := h.splits.ReviewFinding(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finding)
+}
+
+// ApplyPrepayment handles apply prepayment HTTP requests
+func (h *HTTPHandler) ApplyPrepayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.ApplyPrepaymentRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.CreatedBy = ""
+
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
+	prepayment, err := h.service.ApplyPrepayment(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, prepayment)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceJSON(prepayment))
+}
+
+// ListPrepaymentApplications handles list prepayment applications HTTP requests
+func (h *HTTPHandler) ListPrepaymentApplications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	applications, err := h.service.ListPrepaymentApplications(r.Context(), invoiceID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"applications": applications,
+	})
+}
+
+// CancelInvoice handles cancel invoice HTTP requests (draft or approved invoices)
+func (h *HTTPHandler) CancelInvoice(w http.ResponseWriter, r *http.Request) {
+	h.cancelOrVoid(w, r, h.service.CancelInvoice)
+}
+
+// VoidInvoice handles void invoice HTTP requests (posted invoices)
+func (h *HTTPHandler) VoidInvoice(w http.ResponseWriter, r *http.Request) {
+	h.cancelOrVoid(w, r, h.service.VoidInvoice)
+}
+
+// cancelOrVoid decodes a cancel request and applies it with the given operation
+func (h *HTTPHandler) cancelOrVoid(w http.ResponseWriter, r *http.Request,
+	op func(context.Context, *service.CancelInvoiceRequest) (*repository.Invoice, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.CancelInvoiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ID == "" || req.EntityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token once PLT-1 (Identity/Authentication) is implemented
+	req.CancelledBy = ""
+
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
+	invoice, err := op(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, invoice)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
+}
+
+// VoidPayment handles void payment HTTP requests
+func (h *HTTPHandler) VoidPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.VoidPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.InvoiceID == "" || req.EntityID == "" || req.PaymentID == "" {
+		http.Error(w, "Invoice ID, Entity ID and Payment ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token once PLT-1 (Identity/Authentication) is implemented
+	req.VoidedBy = ""
+
+	if !applyIfMatch(w, r, &req.ExpectedVersion) {
+		return
+	}
+
+	invoice, err := h.service.VoidPayment(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setETag(w, invoice)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceJSON(invoice))
+}
+
+// DeleteInvoice handles delete invoice HTTP requests
+func (h *HTTPHandler) DeleteInvoice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoiceID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if invoiceID == "" || entityID == "" {
+		http.Error(w, "Invoice ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	var expectedVersion *int64
+	if !applyIfMatch(w, r, &expectedVersion) {
+		return
+	}
+
+	if err := h.service.DeleteInvoice(r.Context(), invoiceID, entityID, expectedVersion); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetEntitySettings handles get entity settings HTTP requests
+func (h *HTTPHandler) GetEntitySettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	if entityID == "" {
+		http.Error(w, "Entity ID is required", http.StatusBadRequest)
+		return
+	}
+
+	settings, err := h.settings.GetSettings(r.Context(), entityID)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// UpdateEntitySettings handles update entity settings HTTP requests
+func (h *HTTPHandler) UpdateEntitySettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.UpdateEntitySettingsRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.UpdatedBy = ""
+
+	settings, err := h.settings.UpdateSettings(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// ListTaxCodes handles list tax codes HTTP requests
+func (h *HTTPHandler) ListTaxCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	if entityID == "" {
+		http.Error(w, "Entity ID is required", http.StatusBadRequest)
+		return
+	}
+
+	taxCodes, err := h.taxes.ListTaxCodes(r.Context(), entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tax_codes": taxCodes,
+	})
+}
+
+// UpsertTaxCode handles create or replace tax code HTTP requests
+func (h *HTTPHandler) UpsertTaxCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.UpsertTaxCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.UpdatedBy = ""
+
+	taxCode, err := h.taxes.UpsertTaxCode(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(taxCode)
+}
+
+// ListPaymentTerms handles list payment terms HTTP requests
+func (h *HTTPHandler) ListPaymentTerms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	if entityID == "" {
+		http.Error(w, "Entity ID is required", http.StatusBadRequest)
+		return
+	}
+
+	terms, err := h.terms.ListTerms(r.Context(), entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payment_terms": terms,
+	})
+}
+
+// UpsertPaymentTerms handles create or replace payment terms HTTP requests
+func (h *HTTPHandler) UpsertPaymentTerms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.UpsertPaymentTermsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.UpdatedBy = ""
+
+	terms, err := h.terms.UpsertTerms(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(terms)
+}
+
+// GetPurchaseOrder handles get purchase order HTTP requests
+func (h *HTTPHandler) GetPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	poNumber := r.URL.Query().Get("po_number")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if poNumber == "" || entityID == "" {
+		http.Error(w, "PO number and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	po, err := h.pos.GetPurchaseOrder(r.Context(), poNumber, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+// UpsertPurchaseOrder handles create or replace purchase order HTTP requests
+func (h *HTTPHandler) UpsertPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.UpsertPurchaseOrderRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.UpdatedBy = ""
+
+	po, err := h.pos.UpsertPurchaseOrder(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+// RecordReceipt handles record goods receipt HTTP requests
+func (h *HTTPHandler) RecordReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.RecordReceiptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.CreatedBy = ""
+
+	receipt, err := h.receipts.RecordReceipt(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// RecordReturn handles record goods return HTTP requests
+func (h *HTTPHandler) RecordReturn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.RecordReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ReceiptID == "" || req.EntityID == "" {
+		http.Error(w, "Receipt ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.CreatedBy = ""
+
+	receipt, err := h.receipts.RecordReturn(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// GetReceipt handles get goods receipt HTTP requests
+func (h *HTTPHandler) GetReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receiptID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if receiptID == "" || entityID == "" {
+		http.Error(w, "Receipt ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	receipt, err := h.receipts.GetReceipt(r.Context(), receiptID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// ListPOReceipts handles list purchase order receipts HTTP requests
+func (h *HTTPHandler) ListPOReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	poNumber := r.URL.Query().Get("po_number")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if poNumber == "" || entityID == "" {
+		http.Error(w, "PO number and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	receipts, err := h.receipts.ListPOReceipts(r.Context(), poNumber, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"receipts": receipts,
+	})
+}
+
+// ListUninvoicedReceipts handles list uninvoiced receipts HTTP requests
+func (h *HTTPHandler) ListUninvoicedReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	vendorID := r.URL.Query().Get("vendor_id")
+
+	if entityID == "" || vendorID == "" {
+		http.Error(w, "Entity ID and Vendor ID are required", http.StatusBadRequest)
+		return
+	}
+
+	receipts, err := h.receipts.ListUninvoiced(r.Context(), entityID, vendorID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"receipts": receipts,
+	})
+}
+
+// AddTaxRate handles add tax rate HTTP requests
+func (h *HTTPHandler) AddTaxRate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.AddTaxRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.CreatedBy = ""
+
+	taxCode, err := h.taxes.AddTaxRate(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(taxCode)
+}
+
+// ListExchangeRates handles list exchange rates HTTP requests
+func (h *HTTPHandler) ListExchangeRates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		http.Error(w, "From and to currencies are required", http.StatusBadRequest)
+		return
+	}
+
+	rates, err := h.fx.ListExchangeRates(r.Context(), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"exchange_rates": rates,
+	})
+}
+
+// UpsertExchangeRate handles create or replace exchange rate HTTP requests
+func (h *HTTPHandler) UpsertExchangeRate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.UpsertExchangeRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.CreatedBy = ""
+
+	rate, err := h.fx.UpsertExchangeRate(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rate)
+}
+
+// RunFXRevaluation handles run period-end FX revaluation HTTP requests
+func (h *HTTPHandler) RunFXRevaluation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.RunFXRevaluationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// TODO: Get user ID from JWT token
+	req.CreatedBy = ""
+
+	run, err := h.revals.RunRevaluation(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(run)
+}
+
+// ListFXRevaluations handles list FX revaluation runs HTTP requests
+func (h *HTTPHandler) ListFXRevaluations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	if entityID == "" {
+		http.Error(w, "Entity ID is required", http.StatusBadRequest)
+		return
+	}
+
+	runs, err := h.revals.ListRuns(r.Context(), entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revaluations": runs,
+	})
+}
+
+// GetFXRevaluation handles get FX revaluation run HTTP requests
+func (h *HTTPHandler) GetFXRevaluation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	runID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if runID == "" || entityID == "" {
+		http.Error(w, "Run ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	run, err := h.revals.GetRun(r.Context(), runID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// CreateRecurringTemplate handles create recurring template HTTP requests
+func (h *HTTPHandler) CreateRecurringTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.CreateRecurringTemplateRequest
+	if err := decodeAmounts(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Identify the caller from the request context, never from the body.
+	// Invoices the template generates are created by the same user.
+	req.CreatedBy = requestUserID(r)
+
+	template, err := h.recurring.CreateTemplate(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(template)
+}
+
+// ListRecurringTemplates handles list recurring templates HTTP requests
+func (h *HTTPHandler) ListRecurringTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entityID := r.URL.Query().Get("entity_id")
+	if entityID == "" {
+		http.Error(w, "Entity ID is required", http.StatusBadRequest)
+		return
+	}
+
+	templates, err := h.recurring.ListTemplates(r.Context(), entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"templates": templates,
+	})
+}
+
+// GetRecurringTemplate handles get recurring template HTTP requests
+func (h *HTTPHandler) GetRecurringTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templateID := r.URL.Query().Get("id")
+	entityID := r.URL.Query().Get("entity_id")
+
+	if templateID == "" || entityID == "" {
+		http.Error(w, "Template ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	template, err := h.recurring.GetTemplate(r.Context(), templateID, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// PauseRecurringTemplate handles pause recurring template HTTP requests
+func (h *HTTPHandler) PauseRecurringTemplate(w http.ResponseWriter, r *http.Request) {
+	h.recurringAction(w, r, h.recurring.PauseTemplate)
+}
+
+// ResumeRecurringTemplate handles resume recurring template HTTP requests
+func (h *HTTPHandler) ResumeRecurringTemplate(w http.ResponseWriter, r *http.Request) {
+	h.recurringAction(w, r, h.recurring.ResumeTemplate)
+}
+
+// SkipRecurringOccurrence handles skip next recurring occurrence HTTP requests
+func (h *HTTPHandler) SkipRecurringOccurrence(w http.ResponseWriter, r *http.Request) {
+	h.recurringAction(w, r, h.recurring.SkipOccurrence)
+}
+
+// recurringAction decodes a recurring template action request and applies it
+// with the given operation
+func (h *HTTPHandler) recurringAction(w http.ResponseWriter, r *http.Request,
+	op func(context.Context, *service.RecurringTemplateActionRequest) (*repository.RecurringTemplate, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req service.RecurringTemplateActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ID == "" || req.EntityID == "" {
+		http.Error(w, "Template ID and Entity ID are required", http.StatusBadRequest)
+		return
+	}
+
+	// Identify the caller from the request context, never from the body
+	req.UpdatedBy = requestUserID(r)
+
+	template, err := op(r.Context(), &req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// invoiceResponse is the HTTP form of an invoice. Amounts stay integers in
+// the minor unit of the invoice currency; the currency's number of decimal
+// places and the header amounts formatted in major units are added so
+// clients need not know every currency's minor unit. The functional total is
+// formatted in the functional currency.
+type invoiceResponse struct {
+	*repository.Invoice
+	CurrencyMinorUnits int               `json:"currency_minor_units"`
+	FormattedAmounts   map[string]string `json:"formatted_amounts"`
+}
+
+// invoiceJSON converts an invoice to its HTTP form
+func invoiceJSON(invoice *repository.Invoice) *invoiceResponse {
+	cur := currency.ForCode(invoice.Currency)
+	functional := currency.ForCode(invoice.FunctionalCurrency)
+
+	return &invoiceResponse{
+		Invoice:            invoice,
+		CurrencyMinorUnits: cur.MinorUnits,
+		FormattedAmounts: map[string]string{
+			"subtotal":                cur.Format(invoice.Subtotal),
+			"tax_amount":              cur.Format(invoice.TaxAmount),
+			"total_amount":            cur.Format(invoice.TotalAmount),
+			"amount_paid":             cur.Format(invoice.AmountPaid),
+			"amount_due":              cur.Format(invoice.AmountDue),
+			"functional_total_amount": functional.Format(invoice.FunctionalTotalAmount),
+		},
+	}
+}
+
+// invoicesJSON converts invoices to their HTTP form
+func invoicesJSON(invoices []*repository.Invoice) []*invoiceResponse {
+	responses := make([]*invoiceResponse, len(invoices))
+	for i, invoice := range invoices {
+		responses[i] = invoiceJSON(invoice)
+	}
+	return responses
+}
+
+// setETag exposes the invoice version as a strong ETag
+func setETag(w http.ResponseWriter, invoice *repository.Invoice) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(invoice.Version, 10)))
+}
+
+// applyIfMatch copies the version from an If-Match header into version,
+// taking precedence over any version in the request body. A wildcard or
+// missing header leaves version unchanged. It writes a 400 response and
+// returns false if the header is not a version ETag.
+func applyIfMatch(w http.ResponseWriter, r *http.Request, version **int64) bool {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return true
+	}
+
+	tag, err := strconv.Unquote(strings.TrimPrefix(header, "W/"))
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return false
+	}
+	parsed, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return false
+	}
+
+	*version = &parsed
+	return true
+}
+
+// writeError writes err with the given status, except that stale-version
+// conflicts are always reported as 412 Precondition Failed
+func writeError(w http.ResponseWriter, err error, status int) {
+	if errors.Is(err, repository.ErrVersionConflict) {
+		status = http.StatusPreconditionFailed
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// decodeAmounts decodes a request body carrying amounts, which are whole
+// numbers of the currency's minor unit as in responses. An amount with a
+// fraction or exponent, as a client sending major units would, is refused
+// naming the field rather than as an invalid body.
+func decodeAmounts(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && strings.HasPrefix(typeErr.Value, "number") && amountField(typeErr.Field) {
+		return fmt.Errorf("%s must be a whole number of minor units of the currency, "+
+			"e.g. 12345 for 123.45 USD, 12345 JPY or 12.345 BHD", typeErr.Field)
+	}
+	return errors.New("Invalid request body")
+}
+
+// amountField reports whether a JSON field path such as "lines.unit_price"
+// names an amount
+func amountField(path string) bool {
+	name := path[strings.LastIndex(path, ".")+1:]
+	return strings.Contains(name, "amount") || strings.Contains(name, "price")
+}
+
+// requestUserID returns the authenticated caller of a request, or "" when
+// the request carries no user context
+func requestUserID(r *http.Request) string {
+	if uc, err := auth.GetUserContext(r.Context()); err == nil && uc != nil {
+		return uc.UserID
+	}
+	return ""
+}
+
+// errorStatus returns the HTTP status for a service error's code, or 500 if
+// it has none
+func errorStatus(err error) int {
+	var appErr *apperrors.AppError
+	if !errors.As(err, &appErr) {
+		return http.StatusInternalServerError
+	}
+
+	switch appErr.Code {
+	case apperrors.ErrCodeNotFound:
+		return http.StatusNotFound
+	case apperrors.ErrCodeInvalidInput:
+		return http.StatusBadRequest
+	case apperrors.ErrCodeConflict:
+		return http.StatusConflict
+	case apperrors.ErrCodeUnauthorized, apperrors.ErrCodeForbidden:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
 }
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pesio-ai/be-ap-invoices/internal/service"
+)
+
+func TestDecodeAmounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantErr   string
+		wantPrice int64
+	}{
+		{name: "minor units", body: `{"currency": "BHD", "lines": [{"unit_price": 12345}]}`, wantPrice: 12345},
+		{name: "fraction", body: `{"currency": "BHD", "lines": [{"unit_price": 12.345}]}`, wantErr: "lines.0.unit_price must be a whole number of minor units"},
+		{name: "exponent", body: `{"currency": "JPY", "lines": [{"unit_price": 1e3}]}`, wantErr: "lines.0.unit_price must be a whole number of minor units"},
+		{name: "header amount", body: `{"currency": "USD", "vendor_tax_amount": 1.5}`, wantErr: "vendor_tax_amount must be a whole number of minor units"},
+		{name: "not an amount", body: `{"currency": "USD", "vendor_id": 5}`, wantErr: "Invalid request body"},
+		{name: "malformed", body: `{"currency": `, wantErr: "Invalid request body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req service.CreateInvoiceRequest
+			err := decodeAmounts(httptest.NewRequest("POST", "/api/v1/invoices", strings.NewReader(tt.body)), &req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeAmounts error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeAmounts error: %v", err)
+			}
+			if len(req.Lines) != 1 || req.Lines[0].UnitPrice != tt.wantPrice {
+				t.Errorf("decodeAmounts lines = %+v, want unit_price %d", req.Lines, tt.wantPrice)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// DuplicateCandidate is an invoice that may duplicate another, with its
+// score out of 100 and what the two have in common
+type DuplicateCandidate struct {
+	ID             string     `json:"id,omitempty"`
+	EntityID       string     `json:"entity_id"`
+	InvoiceID      string     `json:"invoice_id,omitempty"` // the invoice checked; empty for one not yet created
+	CandidateID    string     `json:"candidate_id"`
+	InvoiceNumber  string     `json:"invoice_number"` // of the candidate
+	VendorID       string     `json:"vendor_id"`
+	InvoiceDate    time.Time  `json:"invoice_date"`
+	Currency       string     `json:"currency"`
+	TotalAmount    int64      `json:"total_amount"`
+	Status         string     `json:"status"`
+	Score          int        `json:"score"`
+	Reasons        []string   `json:"reasons"`
+	Action         string     `json:"action,omitempty"` // warned or overridden, once recorded
+	OverrideReason *string    `json:"override_reason,omitempty"`
+	OverriddenBy   *string    `json:"overridden_by,omitempty"`
+	DetectedAt     *time.Time `json:"detected_at,omitempty"`
+}
+
+// DuplicateSearch describes an invoice to find possible duplicates of
+type DuplicateSearch struct {
+	EntityID         string
+	ExcludeID        *string // the invoice itself, once created
+	VendorID         string
+	NormalizedNumber string
+	InvoiceDate      time.Time
+	Currency         string
+	TotalAmount      int64
+	CreditMemo       bool
+}
+
+// DuplicateRepository handles duplicate invoice detection data operations
+type DuplicateRepository struct {
+	db *database.DB
+}
+
+// NewDuplicateRepository creates a new duplicate repository
+func NewDuplicateRepository(db *database.DB) *DuplicateRepository {
+	return &DuplicateRepository{db: db}
+}
+
+// FindCandidates retrieves the entity's invoices, other than cancelled ones,
+// that may duplicate the one searched for: those with the same normalized
+// invoice number, and those in the same currency within 1% of its total
+// from the same vendor or dated within 30 days of it. Credit memos are
+// only compared with credit memos. The closest dates come first.
+func (r *DuplicateRepository) FindCandidates(ctx context.Context, search *DuplicateSearch) ([]*DuplicateCandidate, error) {
+	query := `
+		SELECT id, entity_id, invoice_number, vendor_id, invoice_date, currency, total_amount, status
+		FROM invoices
+		WHERE entity_id = $1
+		  AND ($2::uuid IS NULL OR id <> $2)
+		  AND status <> 'cancelled'
+		  AND (invoice_type = 'credit_memo') = $3
+		  AND (normalized_invoice_number = $4
+		       OR (currency = $5
+		           AND ABS(total_amount - $6::bigint) * 100 <= ABS($6::bigint)
+		           AND (vendor_id = $7 OR invoice_date BETWEEN $8::date - 30 AND $8::date + 30)))
+		ORDER BY ABS(invoice_date - $8::date), created_at DESC
+		LIMIT 200
+	`
+
+	rows, err := r.db.Query(ctx, query,
+		search.EntityID,
+		search.ExcludeID,
+		search.CreditMemo,
+		search.NormalizedNumber,
+		search.Currency,
+		search.TotalAmount,
+		search.VendorID,
+		search.InvoiceDate,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to find duplicate candidates")
+	}
+	defer rows.Close()
+
+	candidates := make([]*DuplicateCandidate, 0)
+	for rows.Next() {
+		candidate := &DuplicateCandidate{}
+		err := rows.Scan(
+			&candidate.CandidateID,
+			&candidate.EntityID,
+			&candidate.InvoiceNumber,
+			&candidate.VendorID,
+			&candidate.InvoiceDate,
+			&candidate.Currency,
+			&candidate.TotalAmount,
+			&candidate.Status,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan duplicate candidate")
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, nil
+}
+
+// insertDuplicateCandidates stores the candidates found for an invoice
+// within the transaction that creates it, so an invoice is never created
+// without the duplicates it was created over
+func insertDuplicateCandidates(ctx context.Context, tx pgx.Tx, invoiceID string, candidates []*DuplicateCandidate) error {
+	query := `
+		INSERT INTO ap_duplicate_candidates (entity_id, invoice_id, candidate_id, score, reasons,
+		                                     action, override_reason, overridden_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, detected_at
+	`
+
+	for _, candidate := range candidates {
+		candidate.InvoiceID = invoiceID
+		err := tx.QueryRow(ctx, query,
+			candidate.EntityID,
+			candidate.InvoiceID,
+			candidate.CandidateID,
+			candidate.Score,
+			candidate.Reasons,
+			candidate.Action,
+			candidate.OverrideReason,
+			candidate.OverriddenBy,
+		).Scan(&candidate.ID, &candidate.DetectedAt)
+
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to record duplicate candidate")
+		}
+	}
+
+	return nil
+}
+
+// ListByInvoice retrieves the candidates recorded when an invoice was
+// created, highest score first
+func (r *DuplicateRepository) ListByInvoice(ctx context.Context, invoiceID, entityID string) ([]*DuplicateCandidate, error) {
+	query := `
+		SELECT d.id, d.entity_id, d.invoice_id, d.candidate_id, i.invoice_number, i.vendor_id,
+		       i.invoice_date, i.currency, i.total_amount, i.status, d.score, d.reasons,
+		       d.action, d.override_reason, d.overridden_by, d.detected_at
+		FROM ap_duplicate_candidates d
+		JOIN invoices i ON i.id = d.candidate_id
+		WHERE d.invoice_id = $1 AND d.entity_id = $2
+		ORDER BY d.score DESC, i.invoice_date
+	`
+
+	rows, err := r.db.Query(ctx, query, invoiceID, entityID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list duplicate candidates")
+	}
+	defer rows.Close()
+
+	candidates := make([]*DuplicateCandidate, 0)
+	for rows.Next() {
+		candidate := &DuplicateCandidate{}
+		err := rows.Scan(
+			&candidate.ID,
+			&candidate.EntityID,
+			&candidate.InvoiceID,
+			&candidate.CandidateID,
+			&candidate.InvoiceNumber,
+			&candidate.VendorID,
+			&candidate.InvoiceDate,
+			&candidate.Currency,
+			&candidate.TotalAmount,
+			&candidate.Status,
+			&candidate.Score,
+			&candidate.Reasons,
+			&candidate.Action,
+			&candidate.OverrideReason,
+			&candidate.OverriddenBy,
+			&candidate.DetectedAt,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan duplicate candidate")
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, nil
+}
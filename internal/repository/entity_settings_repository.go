@@ -0,0 +1,189 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// EntitySettings holds the AP configuration of one entity
+type EntitySettings struct {
+	EntityID                  string    `json:"entity_id"`
+	APControlAccountID        *string   `json:"ap_control_account_id,omitempty"`
+	DefaultCashAccountID      *string   `json:"default_cash_account_id,omitempty"`
+	TaxPayableAccountID       *string   `json:"tax_payable_account_id,omitempty"`
+	TaxReceivableAccountID    *string   `json:"tax_receivable_account_id,omitempty"`
+	RoundingAccountID         *string   `json:"rounding_account_id,omitempty"`
+	DefaultPaymentTerms       string    `json:"default_payment_terms"`
+	AmountTolerance           int64     `json:"amount_tolerance"`
+	PercentTolerance          float64   `json:"percent_tolerance"`
+	ClosedPeriodPolicy        string    `json:"closed_period_policy"`
+	TaxRounding               string    `json:"tax_rounding"`
+	LineAmountTolerance       int64     `json:"line_amount_tolerance"`
+	FunctionalCurrency        *string   `json:"functional_currency,omitempty"`
+	RealizedFXGainAccountID   *string   `json:"realized_fx_gain_account_id,omitempty"`
+	RealizedFXLossAccountID   *string   `json:"realized_fx_loss_account_id,omitempty"`
+	UnrealizedFXGainAccountID *string   `json:"unrealized_fx_gain_account_id,omitempty"`
+	UnrealizedFXLossAccountID *string   `json:"unrealized_fx_loss_account_id,omitempty"`
+	PrepaymentAccountID       *string   `json:"prepayment_account_id,omitempty"`
+	POMatchLevel              string    `json:"po_match_level"`
+	QuantityTolerance         float64   `json:"quantity_tolerance"`
+	DuplicatePolicy           string    `json:"duplicate_policy"`
+	DuplicateThreshold        int       `json:"duplicate_threshold"`
+	SplitInvoicePolicy        string    `json:"split_invoice_policy"`
+	SplitInvoiceWindowDays    int       `json:"split_invoice_window_days"`
+	CreatedBy                 *string   `json:"created_by,omitempty"`
+	CreatedAt                 time.Time `json:"created_at"`
+	UpdatedBy                 *string   `json:"updated_by,omitempty"`
+	UpdatedAt                 time.Time `json:"updated_at"`
+}
+
+// EntitySettingsRepository handles entity settings data operations
+type EntitySettingsRepository struct {
+	db *database.DB
+}
+
+// NewEntitySettingsRepository creates a new entity settings repository
+func NewEntitySettingsRepository(db *database.DB) *EntitySettingsRepository {
+	return &EntitySettingsRepository{db: db}
+}
+
+// Get retrieves the settings of an entity, returning nil if none are saved
+func (r *EntitySettingsRepository) Get(ctx context.Context, entityID string) (*EntitySettings, error) {
+	query := `
+		SELECT entity_id, ap_control_account_id, default_cash_account_id,
+		       tax_payable_account_id, tax_receivable_account_id, rounding_account_id,
+		       default_payment_terms, amount_tolerance, percent_tolerance, closed_period_policy,
+		       tax_rounding, line_amount_tolerance, functional_currency,
+		       realized_fx_gain_account_id, realized_fx_loss_account_id,
+		       unrealized_fx_gain_account_id, unrealized_fx_loss_account_id,
+		       prepayment_account_id, po_match_level, quantity_tolerance,
+		       duplicate_policy, duplicate_threshold,
+		       split_invoice_policy, split_invoice_window_days,
+		       created_by, created_at, updated_by, updated_at
+		FROM ap_entity_settings
+		WHERE entity_id = $1
+	`
+
+	settings := &EntitySettings{}
+	err := r.db.QueryRow(ctx, query, entityID).Scan(
+		&settings.EntityID,
+		&settings.APControlAccountID,
+		&settings.DefaultCashAccountID,
+		&settings.TaxPayableAccountID,
+		&settings.TaxReceivableAccountID,
+		&settings.RoundingAccountID,
+		&settings.DefaultPaymentTerms,
+		&settings.AmountTolerance,
+		&settings.PercentTolerance,
+		&settings.ClosedPeriodPolicy,
+		&settings.TaxRounding,
+		&settings.LineAmountTolerance,
+		&settings.FunctionalCurrency,
+		&settings.RealizedFXGainAccountID,
+		&settings.RealizedFXLossAccountID,
+		&settings.UnrealizedFXGainAccountID,
+		&settings.UnrealizedFXLossAccountID,
+		&settings.PrepaymentAccountID,
+		&settings.POMatchLevel,
+		&settings.QuantityTolerance,
+		&settings.DuplicatePolicy,
+		&settings.DuplicateThreshold,
+		&settings.SplitInvoicePolicy,
+		&settings.SplitInvoiceWindowDays,
+		&settings.CreatedBy,
+		&settings.CreatedAt,
+		&settings.UpdatedBy,
+		&settings.UpdatedAt,
+	)
+
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get entity settings")
+	}
+
+	return settings, nil
+}
+
+// Upsert creates or replaces the settings of an entity
+func (r *EntitySettingsRepository) Upsert(ctx context.Context, settings *EntitySettings) error {
+	query := `
+		INSERT INTO ap_entity_settings (entity_id, ap_control_account_id, default_cash_account_id,
+		                                tax_payable_account_id, tax_receivable_account_id, rounding_account_id,
+		                                default_payment_terms, amount_tolerance, percent_tolerance,
+		                                closed_period_policy, tax_rounding, line_amount_tolerance,
+		                                functional_currency, realized_fx_gain_account_id,
+		                                realized_fx_loss_account_id, unrealized_fx_gain_account_id,
+		                                unrealized_fx_loss_account_id, prepayment_account_id,
+		                                po_match_level, quantity_tolerance, duplicate_policy,
+		                                duplicate_threshold, split_invoice_policy,
+		                                split_invoice_window_days, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $25)
+		ON CONFLICT (entity_id) DO UPDATE
+		SET ap_control_account_id = EXCLUDED.ap_control_account_id,
+		    default_cash_account_id = EXCLUDED.default_cash_account_id,
+		    tax_payable_account_id = EXCLUDED.tax_payable_account_id,
+		    tax_receivable_account_id = EXCLUDED.tax_receivable_account_id,
+		    rounding_account_id = EXCLUDED.rounding_account_id,
+		    default_payment_terms = EXCLUDED.default_payment_terms,
+		    amount_tolerance = EXCLUDED.amount_tolerance,
+		    percent_tolerance = EXCLUDED.percent_tolerance,
+		    closed_period_policy = EXCLUDED.closed_period_policy,
+		    tax_rounding = EXCLUDED.tax_rounding,
+		    line_amount_tolerance = EXCLUDED.line_amount_tolerance,
+		    functional_currency = EXCLUDED.functional_currency,
+		    realized_fx_gain_account_id = EXCLUDED.realized_fx_gain_account_id,
+		    realized_fx_loss_account_id = EXCLUDED.realized_fx_loss_account_id,
+		    unrealized_fx_gain_account_id = EXCLUDED.unrealized_fx_gain_account_id,
+		    unrealized_fx_loss_account_id = EXCLUDED.unrealized_fx_loss_account_id,
+		    prepayment_account_id = EXCLUDED.prepayment_account_id,
+		    po_match_level = EXCLUDED.po_match_level,
+		    quantity_tolerance = EXCLUDED.quantity_tolerance,
+		    duplicate_policy = EXCLUDED.duplicate_policy,
+		    duplicate_threshold = EXCLUDED.duplicate_threshold,
+		    split_invoice_policy = EXCLUDED.split_invoice_policy,
+		    split_invoice_window_days = EXCLUDED.split_invoice_window_days,
+		    updated_by = EXCLUDED.updated_by,
+		    updated_at = NOW()
+		RETURNING created_by, created_at, updated_by, updated_at
+	`
+
+	err := r.db.QueryRow(ctx, query,
+		settings.EntityID,
+		settings.APControlAccountID,
+		settings.DefaultCashAccountID,
+		settings.TaxPayableAccountID,
+		settings.TaxReceivableAccountID,
+		settings.RoundingAccountID,
+		settings.DefaultPaymentTerms,
+		settings.AmountTolerance,
+		settings.PercentTolerance,
+		settings.ClosedPeriodPolicy,
+		settings.TaxRounding,
+		settings.LineAmountTolerance,
+		settings.FunctionalCurrency,
+		settings.RealizedFXGainAccountID,
+		settings.RealizedFXLossAccountID,
+		settings.UnrealizedFXGainAccountID,
+		settings.UnrealizedFXLossAccountID,
+		settings.PrepaymentAccountID,
+		settings.POMatchLevel,
+		settings.QuantityTolerance,
+		settings.DuplicatePolicy,
+		settings.DuplicateThreshold,
+		settings.SplitInvoicePolicy,
+		settings.SplitInvoiceWindowDays,
+		settings.UpdatedBy,
+	).Scan(&settings.CreatedBy, &settings.CreatedAt, &settings.UpdatedBy, &settings.UpdatedAt)
+
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to save entity settings")
+	}
+
+	return nil
+}
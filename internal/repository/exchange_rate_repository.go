@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// ExchangeRate is the rate from one currency to another on a date. Spot
+// rates convert invoices and payments; period-end rates revalue open
+// balances.
+type ExchangeRate struct {
+	ID           string       `json:"id"`
+	FromCurrency string       `json:"from_currency"`
+	ToCurrency   string       `json:"to_currency"`
+	RateType     string       `json:"rate_type"`
+	RateDate     time.Time    `json:"rate_date"`
+	Rate         decimal.Rate `json:"rate"` // units of ToCurrency per unit of FromCurrency
+	Source       *string      `json:"source,omitempty"`
+	CreatedBy    *string      `json:"created_by,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+// ExchangeRateRepository handles exchange rate data operations
+type ExchangeRateRepository struct {
+	db *database.DB
+}
+
+// NewExchangeRateRepository creates a new exchange rate repository
+func NewExchangeRateRepository(db *database.DB) *ExchangeRateRepository {
+	return &ExchangeRateRepository{db: db}
+}
+
+// exchangeRateColumns is the column list read by scanExchangeRate
+const exchangeRateColumns = `
+	id, from_currency, to_currency, rate_type, rate_date, rate, source, created_by, created_at
+`
+
+// scanExchangeRate scans a row selected with exchangeRateColumns
+func scanExchangeRate(row pgx.Row) (*ExchangeRate, error) {
+	rate := &ExchangeRate{}
+	err := row.Scan(
+		&rate.ID,
+		&rate.FromCurrency,
+		&rate.ToCurrency,
+		&rate.RateType,
+		&rate.RateDate,
+		&rate.Rate,
+		&rate.Source,
+		&rate.CreatedBy,
+		&rate.CreatedAt,
+	)
+	return rate, err
+}
+
+// GetOnOrBefore retrieves the latest rate of a type from one currency to
+// another dated on or before date, returning nil if there is none
+func (r *ExchangeRateRepository) GetOnOrBefore(ctx context.Context, from, to, rateType string, date time.Time) (*ExchangeRate, error) {
+	query := `SELECT ` + exchangeRateColumns + `
+		FROM ap_exchange_rates
+		WHERE from_currency = $1 AND to_currency = $2 AND rate_type = $3 AND rate_date <= $4
+		ORDER BY rate_date DESC
+		LIMIT 1
+	`
+
+	rate, err := scanExchangeRate(r.db.QueryRow(ctx, query, from, to, rateType, date))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get exchange rate")
+	}
+
+	return rate, nil
+}
+
+// List retrieves the rates of every type from one currency to another,
+// newest first
+func (r *ExchangeRateRepository) List(ctx context.Context, from, to string) ([]*ExchangeRate, error) {
+	query := `SELECT ` + exchangeRateColumns + `
+		FROM ap_exchange_rates
+		WHERE from_currency = $1 AND to_currency = $2
+		ORDER BY rate_date DESC, rate_type
+	`
+
+	rows, err := r.db.Query(ctx, query, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list exchange rates")
+	}
+	defer rows.Close()
+
+	rates := make([]*ExchangeRate, 0)
+	for rows.Next() {
+		rate, err := scanExchangeRate(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan exchange rate")
+		}
+		rates = append(rates, rate)
+	}
+
+	return rates, nil
+}
+
+// Upsert creates or replaces the rate of a type for a currency pair on a date
+func (r *ExchangeRateRepository) Upsert(ctx context.Context, rate *ExchangeRate) error {
+	query := `
+		INSERT INTO ap_exchange_rates (from_currency, to_currency, rate_type, rate_date, rate, source, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (from_currency, to_currency, rate_type, rate_date) DO UPDATE
+		SET rate = EXCLUDED.rate,
+		    source = EXCLUDED.source,
+		    created_by = EXCLUDED.created_by,
+		    created_at = NOW()
+		RETURNING id, created_at
+	`
+
+	err := r.db.QueryRow(ctx, query,
+		rate.FromCurrency,
+		rate.ToCurrency,
+		rate.RateType,
+		rate.RateDate,
+		rate.Rate,
+		rate.Source,
+		rate.CreatedBy,
+	).Scan(&rate.ID, &rate.CreatedAt)
+
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to save exchange rate")
+	}
+
+	return nil
+}
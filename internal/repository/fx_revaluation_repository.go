@@ -0,0 +1,315 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// FXRevaluationRun is one period-end revaluation of an entity's open
+// foreign-currency invoices. Amounts are in minor units of the functional
+// currency.
+type FXRevaluationRun struct {
+	ID                 string               `json:"id"`
+	EntityID           string               `json:"entity_id"`
+	GLPeriodID         string               `json:"gl_period_id"`
+	PeriodEnd          time.Time            `json:"period_end"`
+	ReversalDate       time.Time            `json:"reversal_date"`
+	FunctionalCurrency string               `json:"functional_currency"`
+	Status             string               `json:"status"` // pending, posted or failed
+	InvoiceCount       int                  `json:"invoice_count"`
+	TotalGain          int64                `json:"total_gain"`
+	TotalLoss          int64                `json:"total_loss"`
+	GLJournalID        *string              `json:"gl_journal_id,omitempty"`
+	ReversalJournalID  *string              `json:"reversal_journal_id,omitempty"`
+	ErrorMessage       *string              `json:"error_message,omitempty"`
+	CreatedBy          *string              `json:"created_by,omitempty"`
+	CreatedAt          time.Time            `json:"created_at"`
+	CompletedAt        *time.Time           `json:"completed_at,omitempty"`
+	Lines              []*FXRevaluationLine `json:"lines,omitempty"`
+}
+
+// FXRevaluationLine is the revaluation of one invoice's open balance
+type FXRevaluationLine struct {
+	ID                 string       `json:"id"`
+	RunID              string       `json:"run_id"`
+	InvoiceID          string       `json:"invoice_id"`
+	InvoiceNumber      string       `json:"invoice_number"`
+	Currency           string       `json:"currency"`
+	AmountDue          int64        `json:"amount_due"` // minor units of Currency
+	BookedRate         decimal.Rate `json:"booked_rate"`
+	BookedFunctional   int64        `json:"booked_functional"`
+	PeriodEndRate      decimal.Rate `json:"period_end_rate"`
+	RevaluedFunctional int64        `json:"revalued_functional"`
+	Adjustment         int64        `json:"adjustment"` // change in the liability (RevaluedFunctional - BookedFunctional, negated for a credit memo); positive is a loss
+}
+
+// FXRevaluationRepository handles FX revaluation run data operations
+type FXRevaluationRepository struct {
+	db *database.DB
+}
+
+// NewFXRevaluationRepository creates a new FX revaluation repository
+func NewFXRevaluationRepository(db *database.DB) *FXRevaluationRepository {
+	return &FXRevaluationRepository{db: db}
+}
+
+// fxRevaluationRunColumns is the column list read by scanFXRevaluationRun
+const fxRevaluationRunColumns = `
+	id, entity_id, gl_period_id, period_end, reversal_date, functional_currency, status,
+	invoice_count, total_gain, total_loss,
+	gl_journal_id, reversal_journal_id, error_message,
+	created_by, created_at, completed_at
+`
+
+// scanFXRevaluationRun scans a row selected with fxRevaluationRunColumns
+func scanFXRevaluationRun(row pgx.Row) (*FXRevaluationRun, error) {
+	run := &FXRevaluationRun{}
+	err := row.Scan(
+		&run.ID,
+		&run.EntityID,
+		&run.GLPeriodID,
+		&run.PeriodEnd,
+		&run.ReversalDate,
+		&run.FunctionalCurrency,
+		&run.Status,
+		&run.InvoiceCount,
+		&run.TotalGain,
+		&run.TotalLoss,
+		&run.GLJournalID,
+		&run.ReversalJournalID,
+		&run.ErrorMessage,
+		&run.CreatedBy,
+		&run.CreatedAt,
+		&run.CompletedAt,
+	)
+	return run, err
+}
+
+// Create inserts a pending run and its lines in one transaction
+func (r *FXRevaluationRepository) Create(ctx context.Context, run *FXRevaluationRun) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			INSERT INTO ap_fx_revaluation_runs (entity_id, gl_period_id, period_end, reversal_date,
+			                                    functional_currency, status, invoice_count,
+			                                    total_gain, total_loss, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id, created_at
+		`
+
+		err := tx.QueryRow(ctx, query,
+			run.EntityID,
+			run.GLPeriodID,
+			run.PeriodEnd,
+			run.ReversalDate,
+			run.FunctionalCurrency,
+			run.Status,
+			run.InvoiceCount,
+			run.TotalGain,
+			run.TotalLoss,
+			run.CreatedBy,
+		).Scan(&run.ID, &run.CreatedAt)
+
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to create FX revaluation run")
+		}
+
+		lineQuery := `
+			INSERT INTO ap_fx_revaluation_lines (run_id, invoice_id, invoice_number, currency,
+			                                     amount_due, booked_rate, booked_functional,
+			                                     period_end_rate, revalued_functional, adjustment)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id
+		`
+
+		for _, line := range run.Lines {
+			line.RunID = run.ID
+			err := tx.QueryRow(ctx, lineQuery,
+				line.RunID,
+				line.InvoiceID,
+				line.InvoiceNumber,
+				line.Currency,
+				line.AmountDue,
+				line.BookedRate,
+				line.BookedFunctional,
+				line.PeriodEndRate,
+				line.RevaluedFunctional,
+				line.Adjustment,
+			).Scan(&line.ID)
+
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to create FX revaluation line")
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetByID retrieves a run with its lines
+func (r *FXRevaluationRepository) GetByID(ctx context.Context, id, entityID string) (*FXRevaluationRun, error) {
+	query := `SELECT ` + fxRevaluationRunColumns + `
+		FROM ap_fx_revaluation_runs
+		WHERE id = $1 AND entity_id = $2
+	`
+
+	run, err := scanFXRevaluationRun(r.db.QueryRow(ctx, query, id, entityID))
+	if err == pgx.ErrNoRows {
+		return nil, errors.NotFound("fx_revaluation_run", id)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get FX revaluation run")
+	}
+
+	run.Lines, err = r.getLines(ctx, run.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// GetActiveForPeriod retrieves the pending or posted run of an entity for a
+// period with its lines, returning nil if there is none
+func (r *FXRevaluationRepository) GetActiveForPeriod(ctx context.Context, entityID, periodID string) (*FXRevaluationRun, error) {
+	query := `SELECT ` + fxRevaluationRunColumns + `
+		FROM ap_fx_revaluation_runs
+		WHERE entity_id = $1 AND gl_period_id = $2 AND status <> 'failed'
+	`
+
+	run, err := scanFXRevaluationRun(r.db.QueryRow(ctx, query, entityID, periodID))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get FX revaluation run")
+	}
+
+	run.Lines, err = r.getLines(ctx, run.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// List retrieves the runs of an entity without their lines, newest period
+// first
+func (r *FXRevaluationRepository) List(ctx context.Context, entityID string) ([]*FXRevaluationRun, error) {
+	query := `SELECT ` + fxRevaluationRunColumns + `
+		FROM ap_fx_revaluation_runs
+		WHERE entity_id = $1
+		ORDER BY period_end DESC, created_at DESC
+	`
+
+	rows, err := r.db.Query(ctx, query, entityID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list FX revaluation runs")
+	}
+	defer rows.Close()
+
+	runs := make([]*FXRevaluationRun, 0)
+	for rows.Next() {
+		run, err := scanFXRevaluationRun(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan FX revaluation run")
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// getLines retrieves the lines of a run in invoice number order
+func (r *FXRevaluationRepository) getLines(ctx context.Context, runID string) ([]*FXRevaluationLine, error) {
+	query := `
+		SELECT id, run_id, invoice_id, invoice_number, currency,
+		       amount_due, booked_rate, booked_functional,
+		       period_end_rate, revalued_functional, adjustment
+		FROM ap_fx_revaluation_lines
+		WHERE run_id = $1
+		ORDER BY invoice_number
+	`
+
+	rows, err := r.db.Query(ctx, query, runID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get FX revaluation lines")
+	}
+	defer rows.Close()
+
+	lines := make([]*FXRevaluationLine, 0)
+	for rows.Next() {
+		line := &FXRevaluationLine{}
+		if err := rows.Scan(
+			&line.ID,
+			&line.RunID,
+			&line.InvoiceID,
+			&line.InvoiceNumber,
+			&line.Currency,
+			&line.AmountDue,
+			&line.BookedRate,
+			&line.BookedFunctional,
+			&line.PeriodEndRate,
+			&line.RevaluedFunctional,
+			&line.Adjustment,
+		); err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan FX revaluation line")
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// SetJournal records the posted revaluation journal of a run
+func (r *FXRevaluationRepository) SetJournal(ctx context.Context, id, glJournalID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE ap_fx_revaluation_runs SET gl_journal_id = $2 WHERE id = $1`,
+		id, glJournalID)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to set FX revaluation journal")
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.NotFound("fx_revaluation_run", id)
+	}
+	return nil
+}
+
+// Complete marks a run as posted with its reversal journal, if any
+func (r *FXRevaluationRepository) Complete(ctx context.Context, run *FXRevaluationRun) error {
+	query := `
+		UPDATE ap_fx_revaluation_runs
+		SET status = 'posted',
+		    reversal_journal_id = $2,
+		    error_message = NULL,
+		    completed_at = NOW()
+		WHERE id = $1
+		RETURNING status, completed_at
+	`
+
+	err := r.db.QueryRow(ctx, query, run.ID, run.ReversalJournalID).Scan(&run.Status, &run.CompletedAt)
+	if err == pgx.ErrNoRows {
+		return errors.NotFound("fx_revaluation_run", run.ID)
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to complete FX revaluation run")
+	}
+
+	run.ErrorMessage = nil
+	return nil
+}
+
+// RecordError records the error that stopped a run, moving it to status
+func (r *FXRevaluationRepository) RecordError(ctx context.Context, id, status, message string) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE ap_fx_revaluation_runs SET status = $2, error_message = $3 WHERE id = $1`,
+		id, status, message)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to record FX revaluation error")
+	}
+	return nil
+}
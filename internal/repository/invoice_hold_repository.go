@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// InvoiceHold stops an invoice from being submitted, approved, posted or
+// paid until it is released. A hold on a line holds the whole invoice.
+type InvoiceHold struct {
+	ID            string     `json:"id"`
+	EntityID      string     `json:"entity_id"`
+	InvoiceID     string     `json:"invoice_id"`
+	InvoiceNumber string     `json:"invoice_number"`
+	InvoiceLineID *string    `json:"invoice_line_id,omitempty"`
+	LineNumber    *int       `json:"line_number,omitempty"`
+	HoldCode      string     `json:"hold_code"`
+	HoldType      string     `json:"hold_type"` // manual or system
+	Reason        string     `json:"reason"`
+	OwnerID       *string    `json:"owner_id,omitempty"`
+	OwnerOnly     bool       `json:"owner_only"` // only the owner may release
+	Status        string     `json:"status"`     // open or released
+	PlacedBy      *string    `json:"placed_by,omitempty"`
+	PlacedAt      time.Time  `json:"placed_at"`
+	ReleasedBy    *string    `json:"released_by,omitempty"`
+	ReleasedAt    *time.Time `json:"released_at,omitempty"`
+	ReleaseNotes  *string    `json:"release_notes,omitempty"`
+}
+
+// HoldFilter narrows a list of an entity's open holds. Nil fields match all.
+type HoldFilter struct {
+	HoldCode *string
+	HoldType *string
+	OwnerID  *string
+}
+
+// InvoiceHoldRepository handles invoice hold data operations
+type InvoiceHoldRepository struct {
+	db *database.DB
+}
+
+// NewInvoiceHoldRepository creates a new invoice hold repository
+func NewInvoiceHoldRepository(db *database.DB) *InvoiceHoldRepository {
+	return &InvoiceHoldRepository{db: db}
+}
+
+// invoiceHoldColumns is the column list read by scanInvoiceHold, selected
+// from ap_invoice_holds h joined to invoices i and left joined to
+// invoice_lines l
+const invoiceHoldColumns = `
+	h.id, h.entity_id, h.invoice_id, i.invoice_number, h.invoice_line_id, l.line_number,
+	h.hold_code, h.hold_type, h.reason, h.owner_id, h.owner_only, h.status,
+	h.placed_by, h.placed_at, h.released_by, h.released_at, h.release_notes
+`
+
+// invoiceHoldFrom is the FROM clause for invoiceHoldColumns
+const invoiceHoldFrom = `
+	FROM ap_invoice_holds h
+	JOIN invoices i ON i.id = h.invoice_id
+	LEFT JOIN invoice_lines l ON l.id = h.invoice_line_id
+`
+
+// scanInvoiceHold scans a row selected with invoiceHoldColumns
+func scanInvoiceHold(row pgx.Row) (*InvoiceHold, error) {
+	hold := &InvoiceHold{}
+	err := row.Scan(
+		&hold.ID,
+		&hold.EntityID,
+		&hold.InvoiceID,
+		&hold.InvoiceNumber,
+		&hold.InvoiceLineID,
+		&hold.LineNumber,
+		&hold.HoldCode,
+		&hold.HoldType,
+		&hold.Reason,
+		&hold.OwnerID,
+		&hold.OwnerOnly,
+		&hold.Status,
+		&hold.PlacedBy,
+		&hold.PlacedAt,
+		&hold.ReleasedBy,
+		&hold.ReleasedAt,
+		&hold.ReleaseNotes,
+	)
+	return hold, err
+}
+
+// Create places a hold. It fails with a conflict if the invoice or line
+// already has an open hold with the same code.
+func (r *InvoiceHoldRepository) Create(ctx context.Context, hold *InvoiceHold) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		return insertInvoiceHold(ctx, tx, hold)
+	})
+}
+
+// insertInvoiceHold places a hold within a transaction, so it can be
+// stored together with the record it was placed for
+func insertInvoiceHold(ctx context.Context, tx pgx.Tx, hold *InvoiceHold) error {
+	query := `
+		INSERT INTO ap_invoice_holds (entity_id, invoice_id, invoice_line_id, hold_code, hold_type,
+		                              reason, owner_id, owner_only, placed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (invoice_id, COALESCE(invoice_line_id, '00000000-0000-0000-0000-000000000000'::uuid), hold_code)
+		    WHERE status = 'open'
+		    DO NOTHING
+		RETURNING id, status, placed_at
+	`
+
+	err := tx.QueryRow(ctx, query,
+		hold.EntityID,
+		hold.InvoiceID,
+		hold.InvoiceLineID,
+		hold.HoldCode,
+		hold.HoldType,
+		hold.Reason,
+		hold.OwnerID,
+		hold.OwnerOnly,
+		hold.PlacedBy,
+	).Scan(&hold.ID, &hold.Status, &hold.PlacedAt)
+
+	if err == pgx.ErrNoRows {
+		return errors.New(errors.ErrCodeConflict, fmt.Sprintf("invoice already has an open %s hold", hold.HoldCode))
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to create invoice hold")
+	}
+
+	return nil
+}
+
+// GetByID retrieves a hold
+func (r *InvoiceHoldRepository) GetByID(ctx context.Context, id, entityID string) (*InvoiceHold, error) {
+	query := `SELECT ` + invoiceHoldColumns + invoiceHoldFrom + `
+		WHERE h.id = $1 AND h.entity_id = $2
+	`
+
+	hold, err := scanInvoiceHold(r.db.QueryRow(ctx, query, id, entityID))
+	if err == pgx.ErrNoRows {
+		return nil, errors.NotFound("invoice_hold", id)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get invoice hold")
+	}
+
+	return hold, nil
+}
+
+// ListByInvoice retrieves the holds of an invoice in the order they were
+// placed, only the open ones if openOnly is set
+func (r *InvoiceHoldRepository) ListByInvoice(ctx context.Context, invoiceID, entityID string, openOnly bool) ([]*InvoiceHold, error) {
+	query := `SELECT ` + invoiceHoldColumns + invoiceHoldFrom + `
+		WHERE h.invoice_id = $1 AND h.entity_id = $2
+		  AND (NOT $3 OR h.status = 'open')
+		ORDER BY h.placed_at
+	`
+
+	return r.list(ctx, query, invoiceID, entityID, openOnly)
+}
+
+// ListOpen retrieves an entity's open holds matching the filter, oldest first
+func (r *InvoiceHoldRepository) ListOpen(ctx context.Context, entityID string, filter *HoldFilter) ([]*InvoiceHold, error) {
+	query := `SELECT ` + invoiceHoldColumns + invoiceHoldFrom + `
+		WHERE h.entity_id = $1 AND h.status = 'open'
+		  AND ($2::text IS NULL OR h.hold_code = $2)
+		  AND ($3::text IS NULL OR h.hold_type = $3)
+		  AND ($4::uuid IS NULL OR h.owner_id = $4)
+		ORDER BY h.placed_at
+	`
+
+	return r.list(ctx, query, entityID, filter.HoldCode, filter.HoldType, filter.OwnerID)
+}
+
+// list runs a query selecting invoiceHoldColumns
+func (r *InvoiceHoldRepository) list(ctx context.Context, query string, args ...interface{}) ([]*InvoiceHold, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list invoice holds")
+	}
+	defer rows.Close()
+
+	holds := make([]*InvoiceHold, 0)
+	for rows.Next() {
+		hold, err := scanInvoiceHold(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan invoice hold")
+		}
+		holds = append(holds, hold)
+	}
+
+	return holds, nil
+}
+
+// Release releases an open hold, recording who released it and why. It
+// fails with a conflict if the hold has already been released.
+func (r *InvoiceHoldRepository) Release(ctx context.Context, hold *InvoiceHold) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		return releaseInvoiceHold(ctx, tx, hold)
+	})
+}
+
+// releaseInvoiceHold releases a hold within a transaction, so it can be
+// released together with the review of the record it was placed for
+func releaseInvoiceHold(ctx context.Context, tx pgx.Tx, hold *InvoiceHold) error {
+	query := `
+		UPDATE ap_invoice_holds
+		SET status = 'released',
+		    released_by = $3,
+		    released_at = NOW(),
+		    release_notes = $4
+		WHERE id = $1 AND entity_id = $2 AND status = 'open'
+		RETURNING status, released_at
+	`
+
+	err := tx.QueryRow(ctx, query,
+		hold.ID,
+		hold.EntityID,
+		hold.ReleasedBy,
+		hold.ReleaseNotes,
+	).Scan(&hold.Status, &hold.ReleasedAt)
+
+	if err == pgx.ErrNoRows {
+		return errors.New(errors.ErrCodeConflict, "invoice hold is already released")
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to release invoice hold")
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// LineMatch is the result of matching one invoice line to its purchase
+// order line
+type LineMatch struct {
+	ID                         string           `json:"id"`
+	EntityID                   string           `json:"entity_id"`
+	InvoiceID                  string           `json:"invoice_id"`
+	InvoiceLineID              string           `json:"invoice_line_id"`
+	LineNumber                 int              `json:"line_number"`
+	PONumber                   string           `json:"po_number"`
+	POLineNumber               *int             `json:"po_line_number,omitempty"`
+	MatchLevel                 string           `json:"match_level"` // two_way or three_way
+	Status                     string           `json:"status"`      // matched, variance, unmatched or accepted
+	Quantity                   decimal.Decimal  `json:"quantity"`
+	UnitPrice                  int64            `json:"unit_price"`
+	POQuantity                 *decimal.Decimal `json:"po_quantity,omitempty"`
+	POUnitPrice                *int64           `json:"po_unit_price,omitempty"`
+	ReceivedQuantity           *decimal.Decimal `json:"received_quantity,omitempty"`
+	PreviouslyInvoicedQuantity decimal.Decimal  `json:"previously_invoiced_quantity"`
+	QuantityVariance           decimal.Decimal  `json:"quantity_variance"` // billed beyond the PO or received quantity
+	PriceVariance              int64            `json:"price_variance"`    // UnitPrice - POUnitPrice
+	Reasons                    []string         `json:"reasons"`
+	ResolvedBy                 *string          `json:"resolved_by,omitempty"`
+	ResolvedAt                 *time.Time       `json:"resolved_at,omitempty"`
+	ResolutionNotes            *string          `json:"resolution_notes,omitempty"`
+	MatchedAt                  time.Time        `json:"matched_at"`
+}
+
+// InvoiceMatchRepository handles PO match result data operations
+type InvoiceMatchRepository struct {
+	db *database.DB
+}
+
+// NewInvoiceMatchRepository creates a new invoice match repository
+func NewInvoiceMatchRepository(db *database.DB) *InvoiceMatchRepository {
+	return &InvoiceMatchRepository{db: db}
+}
+
+// lineMatchColumns is the column list read by scanLineMatch
+const lineMatchColumns = `
+	id, entity_id, invoice_id, invoice_line_id, line_number, po_number, po_line_number,
+	match_level, status, quantity, unit_price, po_quantity, po_unit_price, received_quantity,
+	previously_invoiced_quantity, quantity_variance, price_variance, reasons,
+	resolved_by, resolved_at, resolution_notes, matched_at
+`
+
+// scanLineMatch scans a row selected with lineMatchColumns
+func scanLineMatch(row pgx.Row) (*LineMatch, error) {
+	match := &LineMatch{}
+	err := row.Scan(
+		&match.ID,
+		&match.EntityID,
+		&match.InvoiceID,
+		&match.InvoiceLineID,
+		&match.LineNumber,
+		&match.PONumber,
+		&match.POLineNumber,
+		&match.MatchLevel,
+		&match.Status,
+		&match.Quantity,
+		&match.UnitPrice,
+		&match.POQuantity,
+		&match.POUnitPrice,
+		&match.ReceivedQuantity,
+		&match.PreviouslyInvoicedQuantity,
+		&match.QuantityVariance,
+		&match.PriceVariance,
+		&match.Reasons,
+		&match.ResolvedBy,
+		&match.ResolvedAt,
+		&match.ResolutionNotes,
+		&match.MatchedAt,
+	)
+	return match, err
+}
+
+// ListByInvoice retrieves the match results of an invoice's lines in line
+// number order
+func (r *InvoiceMatchRepository) ListByInvoice(ctx context.Context, invoiceID, entityID string) ([]*LineMatch, error) {
+	query := `SELECT ` + lineMatchColumns + `
+		FROM ap_invoice_line_matches
+		WHERE invoice_id = $1 AND entity_id = $2
+		ORDER BY line_number
+	`
+
+	rows, err := r.db.Query(ctx, query, invoiceID, entityID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list invoice matches")
+	}
+	defer rows.Close()
+
+	matches := make([]*LineMatch, 0)
+	for rows.Next() {
+		match, err := scanLineMatch(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan invoice match")
+		}
+		matches = append(matches, match)
+	}
+
+	return matches, nil
+}
+
+// ReplaceForInvoice replaces the match results of an invoice with matches
+// in one transaction
+func (r *InvoiceMatchRepository) ReplaceForInvoice(ctx context.Context, invoiceID string, matches []*LineMatch) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM ap_invoice_line_matches WHERE invoice_id = $1`, invoiceID); err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to replace invoice matches")
+		}
+
+		query := `
+			INSERT INTO ap_invoice_line_matches (entity_id, invoice_id, invoice_line_id, line_number,
+			                                     po_number, po_line_number, match_level, status,
+			                                     quantity, unit_price, po_quantity, po_unit_price,
+			                                     received_quantity, previously_invoiced_quantity,
+			                                     quantity_variance, price_variance, reasons,
+			                                     resolved_by, resolved_at, resolution_notes)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+			RETURNING id, matched_at
+		`
+
+		for _, match := range matches {
+			match.InvoiceID = invoiceID
+			err := tx.QueryRow(ctx, query,
+				match.EntityID,
+				match.InvoiceID,
+				match.InvoiceLineID,
+				match.LineNumber,
+				match.PONumber,
+				match.POLineNumber,
+				match.MatchLevel,
+				match.Status,
+				match.Quantity,
+				match.UnitPrice,
+				match.POQuantity,
+				match.POUnitPrice,
+				match.ReceivedQuantity,
+				match.PreviouslyInvoicedQuantity,
+				match.QuantityVariance,
+				match.PriceVariance,
+				match.Reasons,
+				match.ResolvedBy,
+				match.ResolvedAt,
+				match.ResolutionNotes,
+			).Scan(&match.ID, &match.MatchedAt)
+
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to save invoice match")
+			}
+		}
+
+		return nil
+	})
+}
+
+// InvoicedQuantities returns the quantity billed against each line of a
+// purchase order by the entity's other invoices that have been submitted
+// and not cancelled, keyed by PO line number
+func (r *InvoiceMatchRepository) InvoicedQuantities(ctx context.Context, entityID, poNumber, excludeInvoiceID string) (map[int]decimal.Decimal, error) {
+	query := `
+		SELECT m.po_line_number, SUM(m.quantity)
+		FROM ap_invoice_line_matches m
+		JOIN invoices i ON i.id = m.invoice_id
+		WHERE m.entity_id = $1 AND m.po_number = $2 AND m.invoice_id <> $3
+		  AND m.po_line_number IS NOT NULL
+		  AND i.status NOT IN ('draft', 'cancelled')
+		GROUP BY m.po_line_number
+	`
+
+	rows, err := r.db.Query(ctx, query, entityID, poNumber, excludeInvoiceID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get invoiced quantities")
+	}
+	defer rows.Close()
+
+	quantities := make(map[int]decimal.Decimal)
+	for rows.Next() {
+		var lineNumber int
+		var quantity decimal.Decimal
+		if err := rows.Scan(&lineNumber, &quantity); err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan invoiced quantity")
+		}
+		quantities[lineNumber] = quantity
+	}
+
+	return quantities, nil
+}
+
+// Accept marks an unresolved match result as accepted by a reviewer. It
+// fails with a conflict if the result is no longer unresolved.
+func (r *InvoiceMatchRepository) Accept(ctx context.Context, match *LineMatch) error {
+	query := `
+		UPDATE ap_invoice_line_matches
+		SET status = 'accepted',
+		    resolved_by = $3,
+		    resolved_at = NOW(),
+		    resolution_notes = $4
+		WHERE id = $1 AND invoice_id = $2 AND status IN ('variance', 'unmatched')
+		RETURNING status, resolved_at
+	`
+
+	err := r.db.QueryRow(ctx, query,
+		match.ID,
+		match.InvoiceID,
+		match.ResolvedBy,
+		match.ResolutionNotes,
+	).Scan(&match.Status, &match.ResolvedAt)
+
+	if err == pgx.ErrNoRows {
+		return errors.New(errors.ErrCodeConflict, "invoice match is no longer unresolved")
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to accept invoice match")
+	}
+
+	return nil
+}
@@ -3,90 +3,201 @@ package repository
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/pesio-ai/be-lib-common/database"
 	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
 )
 
 // Invoice represents an invoice header
 type Invoice struct {
-	ID                string         `json:"id"`
-	EntityID          string         `json:"entity_id"`
-	VendorID          string         `json:"vendor_id"`
-	InvoiceNumber     string         `json:"invoice_number"`
-	InvoiceDate       time.Time      `json:"invoice_date"`
-	DueDate           time.Time      `json:"due_date"`
-	InvoiceType       string         `json:"invoice_type"`
-	Status            string         `json:"status"`
-	PaymentTerms      string         `json:"payment_terms"`
-	DiscountPercent   *float64       `json:"discount_percent,omitempty"`
-	DiscountDueDate   *time.Time     `json:"discount_due_date,omitempty"`
-	Currency          string         `json:"currency"`
-	Subtotal          int64          `json:"subtotal"`
-	TaxAmount         int64          `json:"tax_amount"`
-	TotalAmount       int64          `json:"total_amount"`
-	AmountPaid        int64          `json:"amount_paid"`
-	AmountDue         int64          `json:"amount_due"`
-	PostedToGL        bool           `json:"posted_to_gl"`
-	GLJournalID       *string        `json:"gl_journal_id,omitempty"`
-	PostedDate        *time.Time     `json:"posted_date,omitempty"`
-	PostedBy          *string        `json:"posted_by,omitempty"`
-	ApprovedBy        *string        `json:"approved_by,omitempty"`
-	ApprovedAt        *time.Time     `json:"approved_at,omitempty"`
-	ApprovalNotes     *string        `json:"approval_notes,omitempty"`
-	PaymentMethod     *string        `json:"payment_method,omitempty"`
-	PaymentReference  *string        `json:"payment_reference,omitempty"`
-	PaymentDate       *time.Time     `json:"payment_date,omitempty"`
-	PONumber          *string        `json:"po_number,omitempty"`
-	ReferenceNumber   *string        `json:"reference_number,omitempty"`
-	Description       *string        `json:"description,omitempty"`
-	Notes             *string        `json:"notes,omitempty"`
-	AttachmentURLs    []string       `json:"attachment_urls,omitempty"`
-	CreatedBy         *string        `json:"created_by,omitempty"`
-	CreatedAt         time.Time      `json:"created_at"`
-	UpdatedBy         *string        `json:"updated_by,omitempty"`
-	UpdatedAt         time.Time      `json:"updated_at"`
-	Lines             []*InvoiceLine `json:"lines,omitempty"`
+	ID                    string         `json:"id"`
+	EntityID              string         `json:"entity_id"`
+	VendorID              string         `json:"vendor_id"`
+	InvoiceNumber         string         `json:"invoice_number"`
+	InvoiceDate           time.Time      `json:"invoice_date"`
+	DueDate               time.Time      `json:"due_date"`
+	InvoiceType           string         `json:"invoice_type"`
+	Status                string         `json:"status"`
+	PaymentTerms          string         `json:"payment_terms"`
+	DiscountPercent       *float64       `json:"discount_percent,omitempty"`
+	DiscountDueDate       *time.Time     `json:"discount_due_date,omitempty"`
+	Currency              string         `json:"currency"`
+	Subtotal              int64          `json:"subtotal"`
+	TaxAmount             int64          `json:"tax_amount"`
+	PricesIncludeTax      bool           `json:"prices_include_tax"`
+	VendorTaxAmount       *int64         `json:"vendor_tax_amount,omitempty"`
+	TaxDiscrepancy        *int64         `json:"tax_discrepancy,omitempty"`
+	TaxFlagged            bool           `json:"tax_discrepancy_flagged"`
+	TotalAmount           int64          `json:"total_amount"`
+	FunctionalCurrency    string         `json:"functional_currency"`
+	ExchangeRate          decimal.Rate   `json:"exchange_rate"` // functional currency units per unit of Currency
+	FunctionalSubtotal    int64          `json:"functional_subtotal"`
+	FunctionalTaxAmount   int64          `json:"functional_tax_amount"`
+	FunctionalTotalAmount int64          `json:"functional_total_amount"`
+	PostedExchangeRate    *decimal.Rate  `json:"posted_exchange_rate,omitempty"` // rate the liability was booked at
+	AmountPaid            int64          `json:"amount_paid"`
+	AmountDue             int64          `json:"amount_due"`
+	FunctionalAmountPaid  int64          `json:"functional_amount_paid"`        // liability settled, at PostedExchangeRate
+	PrepaymentApplied     int64          `json:"prepayment_applied"`            // prepayments only: paid advance applied to final invoices
+	FunctionalApplied     int64          `json:"functional_prepayment_applied"` // prepayments only: PrepaymentApplied at PostedExchangeRate
+	PrepaymentBalance     int64          `json:"prepayment_balance"`            // prepayments only: AmountPaid - PrepaymentApplied
+	PostedToGL            bool           `json:"posted_to_gl"`
+	GLJournalID           *string        `json:"gl_journal_id,omitempty"`
+	GLPostingStatus       *string        `json:"gl_posting_status,omitempty"`
+	GLDate                *time.Time     `json:"gl_date,omitempty"`
+	GLPeriodID            *string        `json:"gl_period_id,omitempty"`
+	PostedDate            *time.Time     `json:"posted_date,omitempty"`
+	PostedBy              *string        `json:"posted_by,omitempty"`
+	ApprovedBy            *string        `json:"approved_by,omitempty"`
+	ApprovedAt            *time.Time     `json:"approved_at,omitempty"`
+	ApprovalNotes         *string        `json:"approval_notes,omitempty"`
+	PaymentMethod         *string        `json:"payment_method,omitempty"`
+	PaymentReference      *string        `json:"payment_reference,omitempty"`
+	PaymentDate           *time.Time     `json:"payment_date,omitempty"`
+	CancelledBy           *string        `json:"cancelled_by,omitempty"`
+	CancelledAt           *time.Time     `json:"cancelled_at,omitempty"`
+	CancelReason          *string        `json:"cancel_reason,omitempty"`
+	ReversalJournalID     *string        `json:"reversal_journal_id,omitempty"`
+	PONumber              *string        `json:"po_number,omitempty"`
+	ReferenceNumber       *string        `json:"reference_number,omitempty"`
+	Description           *string        `json:"description,omitempty"`
+	Notes                 *string        `json:"notes,omitempty"`
+	AttachmentURLs        []string       `json:"attachment_urls,omitempty"`
+	CreatedBy             *string        `json:"created_by,omitempty"`
+	CreatedAt             time.Time      `json:"created_at"`
+	UpdatedBy             *string        `json:"updated_by,omitempty"`
+	UpdatedAt             time.Time      `json:"updated_at"`
+	Version               int64          `json:"version"`
+	Lines                 []*InvoiceLine `json:"lines,omitempty"`
+
+	// Likely duplicates found when the invoice was created; Create records
+	// them in ap_duplicate_candidates, not on the invoice
+	DuplicateWarnings []*DuplicateCandidate `json:"duplicate_warnings,omitempty"`
 }
 
 // InvoiceLine represents an invoice line item
 type InvoiceLine struct {
-	ID          string   `json:"id"`
-	InvoiceID   string   `json:"invoice_id"`
-	LineNumber  int      `json:"line_number"`
-	AccountID   string   `json:"account_id"`
-	Description string   `json:"description"`
-	Quantity    float64  `json:"quantity"`
-	UnitPrice   int64    `json:"unit_price"`
-	LineAmount  int64    `json:"line_amount"`
-	TaxCode     *string  `json:"tax_code,omitempty"`
-	TaxRate     *float64 `json:"tax_rate,omitempty"`
-	TaxAmount   int64    `json:"tax_amount"`
-	Dimension1  *string  `json:"dimension1,omitempty"`
-	Dimension2  *string  `json:"dimension2,omitempty"`
-	Dimension3  *string    `json:"dimension3,omitempty"`
-	Dimension4  *string    `json:"dimension4,omitempty"`
-	ItemCode    *string    `json:"item_code,omitempty"`
-	ItemName    *string    `json:"item_name,omitempty"`
-	CreatedAt   time.Time  `json:"created_at"`
-	UpdatedAt   time.Time  `json:"updated_at"`
+	ID                   string           `json:"id"`
+	InvoiceID            string           `json:"invoice_id"`
+	LineNumber           int              `json:"line_number"`
+	AccountID            string           `json:"account_id"`
+	Description          string           `json:"description"`
+	Quantity             decimal.Decimal  `json:"quantity"`
+	UnitPrice            int64            `json:"unit_price"`
+	LineAmount           int64            `json:"line_amount"`
+	TaxCode              *string          `json:"tax_code,omitempty"`
+	TaxRate              *decimal.Decimal `json:"tax_rate,omitempty"`
+	TaxAmount            int64            `json:"tax_amount"`
+	FunctionalLineAmount int64            `json:"functional_line_amount"`
+	FunctionalTaxAmount  int64            `json:"functional_tax_amount"`
+	Dimension1           *string          `json:"dimension1,omitempty"`
+	Dimension2           *string          `json:"dimension2,omitempty"`
+	Dimension3           *string          `json:"dimension3,omitempty"`
+	Dimension4           *string          `json:"dimension4,omitempty"`
+	ItemCode             *string          `json:"item_code,omitempty"`
+	ItemName             *string          `json:"item_name,omitempty"`
+	CreatedAt            time.Time        `json:"created_at"`
+	UpdatedAt            time.Time        `json:"updated_at"`
 }
 
 // InvoicePayment represents a payment record
 type InvoicePayment struct {
-	ID               string
-	InvoiceID        string
-	PaymentDate      time.Time
-	PaymentAmount    int64
-	PaymentMethod    *string
-	PaymentReference *string
-	Notes            *string
-	CreatedBy        *string
-	CreatedAt        time.Time
+	ID                 string
+	InvoiceID          string
+	PaymentDate        time.Time
+	PaymentAmount      int64
+	ExchangeRate       decimal.Rate // functional currency units per unit of invoice currency
+	FunctionalAmount   int64        // cash paid, at ExchangeRate
+	FunctionalAPAmount int64        // liability settled, at the invoice's posted exchange rate
+	RealizedFXGainLoss int64        // FunctionalAPAmount - FunctionalAmount; positive is a gain
+	PaymentMethod      *string
+	PaymentReference   *string
+	Notes              *string
+	GLJournalID        *string
+	VoidedAt           *time.Time
+	VoidedBy           *string
+	VoidReason         *string
+	ReversalJournalID  *string
+	GLDate             *time.Time
+	GLPeriodID         *string
+	IdempotencyKey     *string
+	CreatedBy          *string
+	CreatedAt          time.Time
+}
+
+// CreditApplication is part of a credit memo's balance applied to an open
+// invoice of the same vendor and currency
+type CreditApplication struct {
+	ID                      string     `json:"id"`
+	EntityID                string     `json:"entity_id"`
+	CreditMemoID            string     `json:"credit_memo_id"`
+	InvoiceID               string     `json:"invoice_id"`
+	ApplicationDate         time.Time  `json:"application_date"`
+	Amount                  int64      `json:"amount"`
+	FunctionalInvoiceAmount int64      `json:"functional_invoice_amount"` // liability settled, at the invoice's posted exchange rate
+	FunctionalCreditAmount  int64      `json:"functional_credit_amount"`  // credit consumed, at the credit memo's posted exchange rate
+	RealizedFXGainLoss      int64      `json:"realized_fx_gain_loss"`     // FunctionalInvoiceAmount - FunctionalCreditAmount; positive is a gain
+	GLDate                  time.Time  `json:"gl_date"`
+	GLPeriodID              string     `json:"gl_period_id"`
+	GLJournalID             *string    `json:"gl_journal_id,omitempty"`
+	ReversedAt              *time.Time `json:"reversed_at,omitempty"`
+	ReversedBy              *string    `json:"reversed_by,omitempty"`
+	ReversalReason          *string    `json:"reversal_reason,omitempty"`
+	ReversalJournalID       *string    `json:"reversal_journal_id,omitempty"`
+	CreatedBy               *string    `json:"created_by,omitempty"`
+	CreatedAt               time.Time  `json:"created_at"`
+}
+
+// PrepaymentApplication is part of a paid prepayment applied to a later
+// standard invoice of the same vendor and currency
+type PrepaymentApplication struct {
+	ID                         string    `json:"id"`
+	EntityID                   string    `json:"entity_id"`
+	PrepaymentID               string    `json:"prepayment_id"`
+	InvoiceID                  string    `json:"invoice_id"`
+	ApplicationDate            time.Time `json:"application_date"`
+	Amount                     int64     `json:"amount"`
+	FunctionalInvoiceAmount    int64     `json:"functional_invoice_amount"`    // liability settled, at the invoice's posted exchange rate
+	FunctionalPrepaymentAmount int64     `json:"functional_prepayment_amount"` // advance reclassified, at the prepayment's posted exchange rate
+	RealizedFXGainLoss         int64     `json:"realized_fx_gain_loss"`        // FunctionalInvoiceAmount - FunctionalPrepaymentAmount; positive is a gain
+	GLDate                     time.Time `json:"gl_date"`
+	GLPeriodID                 string    `json:"gl_period_id"`
+	GLJournalID                *string   `json:"gl_journal_id,omitempty"`
+	CreatedBy                  *string   `json:"created_by,omitempty"`
+	CreatedAt                  time.Time `json:"created_at"`
+}
+
+// StatusTransition is a single invoice status change, applied only if the
+// invoice is still in From, and recorded in the status history
+type StatusTransition struct {
+	From   string
+	To     string
+	Event  string
+	Actor  *string
+	Reason *string
 }
 
+// StatusHistoryEntry is one recorded invoice status change
+type StatusHistoryEntry struct {
+	ID         string    `json:"id"`
+	InvoiceID  string    `json:"invoice_id"`
+	EntityID   string    `json:"entity_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Event      string    `json:"event"`
+	ChangedBy  *string   `json:"changed_by,omitempty"`
+	ChangedAt  time.Time `json:"changed_at"`
+	Reason     *string   `json:"reason,omitempty"`
+}
+
+// ErrVersionConflict is returned when a write is based on a stale invoice
+// version, i.e. the invoice was modified after the caller read it
+var ErrVersionConflict = errors.New(errors.ErrCodeConflict, "version conflict: invoice was modified by another request")
+
 // InvoiceRepository handles invoice data operations
 type InvoiceRepository struct {
 	db *database.DB
@@ -105,10 +216,12 @@ func (r *InvoiceRepository) Create(ctx context.Context, invoice *Invoice) error
 			INSERT INTO invoices (entity_id, vendor_id, invoice_number, invoice_date, due_date,
 			                      invoice_type, status, payment_terms, discount_percent, discount_due_date,
 			                      currency, po_number, reference_number, description, notes,
-			                      attachment_urls, created_by)
+			                      attachment_urls, created_by, gl_date,
+			                      prices_include_tax, vendor_tax_amount, tax_discrepancy, tax_discrepancy_flagged,
+			                      functional_currency, exchange_rate)
 			VALUES ($1, $2, $3, $4, $5, $6::invoice_type, $7::invoice_status, $8, $9, $10,
-			        $11, $12, $13, $14, $15, $16, $17)
-			RETURNING id, created_at, updated_at, subtotal, tax_amount, total_amount, amount_paid, amount_due
+			        $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)
+			RETURNING id, created_at, updated_at, subtotal, tax_amount, total_amount, amount_paid, amount_due, version
 		`
 
 		err := tx.QueryRow(ctx, query,
@@ -129,9 +242,16 @@ func (r *InvoiceRepository) Create(ctx context.Context, invoice *Invoice) error
 			invoice.Notes,
 			invoice.AttachmentURLs,
 			invoice.CreatedBy,
+			invoice.GLDate,
+			invoice.PricesIncludeTax,
+			invoice.VendorTaxAmount,
+			invoice.TaxDiscrepancy,
+			invoice.TaxFlagged,
+			invoice.FunctionalCurrency,
+			invoice.ExchangeRate,
 		).Scan(&invoice.ID, &invoice.CreatedAt, &invoice.UpdatedAt,
 			&invoice.Subtotal, &invoice.TaxAmount, &invoice.TotalAmount,
-			&invoice.AmountPaid, &invoice.AmountDue)
+			&invoice.AmountPaid, &invoice.AmountDue, &invoice.Version)
 
 		if err != nil {
 			return errors.Wrap(err, errors.ErrCodeInternal, "failed to create invoice")
@@ -139,17 +259,150 @@ func (r *InvoiceRepository) Create(ctx context.Context, invoice *Invoice) error
 
 		// Insert invoice lines
 		for _, line := range invoice.Lines {
+			if err := r.insertLine(ctx, tx, invoice.ID, line); err != nil {
+				return err
+			}
+		}
+
+		// Refresh totals (trigger will update, but we need to read back)
+		if err := r.refreshTotals(ctx, tx, invoice); err != nil {
+			return err
+		}
+
+		// Record the likely duplicates it was created over
+		return insertDuplicateCandidates(ctx, tx, invoice.ID, invoice.DuplicateWarnings)
+	})
+}
+
+// Update replaces the header of a draft invoice and reconciles its lines in a
+// single transaction. invoice.Lines must hold the complete set of lines after
+// the update: lines with an empty ID are inserted, lines with an ID are
+// rewritten in place, and deletedLineIDs are removed. invoice.Version must be
+// the version the caller read; on success it holds the new version.
+func (r *InvoiceRepository) Update(ctx context.Context, invoice *Invoice, deletedLineIDs []string) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE invoices
+			SET vendor_id = $3,
+			    invoice_number = $4,
+			    invoice_date = $5,
+			    due_date = $6,
+			    invoice_type = $7::invoice_type,
+			    payment_terms = $8,
+			    discount_percent = $9,
+			    discount_due_date = $10,
+			    currency = $11,
+			    po_number = $12,
+			    reference_number = $13,
+			    description = $14,
+			    notes = $15,
+			    attachment_urls = $16,
+			    updated_by = $17,
+			    gl_date = $19,
+			    prices_include_tax = $20,
+			    vendor_tax_amount = $21,
+			    tax_discrepancy = $22,
+			    tax_discrepancy_flagged = $23,
+			    functional_currency = $24,
+			    exchange_rate = $25,
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND status = 'draft' AND version = $18
+			RETURNING updated_at, version
+		`
+
+		err := tx.QueryRow(ctx, query,
+			invoice.ID,
+			invoice.EntityID,
+			invoice.VendorID,
+			invoice.InvoiceNumber,
+			invoice.InvoiceDate,
+			invoice.DueDate,
+			invoice.InvoiceType,
+			invoice.PaymentTerms,
+			invoice.DiscountPercent,
+			invoice.DiscountDueDate,
+			invoice.Currency,
+			invoice.PONumber,
+			invoice.ReferenceNumber,
+			invoice.Description,
+			invoice.Notes,
+			invoice.AttachmentURLs,
+			invoice.UpdatedBy,
+			invoice.Version,
+			invoice.GLDate,
+			invoice.PricesIncludeTax,
+			invoice.VendorTaxAmount,
+			invoice.TaxDiscrepancy,
+			invoice.TaxFlagged,
+			invoice.FunctionalCurrency,
+			invoice.ExchangeRate,
+		).Scan(&invoice.UpdatedAt, &invoice.Version)
+
+		if err == pgx.ErrNoRows {
+			return r.staleWriteError(ctx, invoice.ID, invoice.EntityID, invoice.Version,
+				errors.New(errors.ErrCodeConflict, "cannot update invoice that is not in draft status"))
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to update invoice")
+		}
+
+		// Remove deleted lines
+		if len(deletedLineIDs) > 0 {
+			tag, err := tx.Exec(ctx,
+				`DELETE FROM invoice_lines WHERE invoice_id = $1 AND id = ANY($2)`,
+				invoice.ID, deletedLineIDs)
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to delete invoice lines")
+			}
+			if tag.RowsAffected() != int64(len(deletedLineIDs)) {
+				return errors.InvalidInput("lines", "one or more lines to delete do not belong to this invoice")
+			}
+		}
+
+		// Park surviving line numbers out of range so renumbered lines cannot
+		// collide on invoice_lines_invoice_line_unique mid-transaction
+		if _, err := tx.Exec(ctx,
+			`UPDATE invoice_lines SET line_number = -line_number WHERE invoice_id = $1`,
+			invoice.ID); err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to renumber invoice lines")
+		}
+
+		// Rewrite existing lines and insert new ones
+		for _, line := range invoice.Lines {
+			if line.ID == "" {
+				if err := r.insertLine(ctx, tx, invoice.ID, line); err != nil {
+					return err
+				}
+				continue
+			}
+
 			lineQuery := `
-				INSERT INTO invoice_lines (invoice_id, line_number, account_id, description,
-				                          quantity, unit_price, line_amount,
-				                          tax_code, tax_rate, tax_amount,
-				                          dimension_1, dimension_2, dimension_3, dimension_4,
-				                          item_code, item_name)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-				RETURNING id, created_at, updated_at
+				UPDATE invoice_lines
+				SET line_number = $3,
+				    account_id = $4,
+				    description = $5,
+				    quantity = $6,
+				    unit_price = $7,
+				    line_amount = $8,
+				    tax_code = $9,
+				    tax_rate = $10,
+				    tax_amount = $11,
+				    dimension_1 = $12,
+				    dimension_2 = $13,
+				    dimension_3 = $14,
+				    dimension_4 = $15,
+				    item_code = $16,
+				    item_name = $17,
+				    functional_line_amount = $18,
+				    functional_tax_amount = $19,
+				    updated_at = NOW()
+				WHERE id = $1 AND invoice_id = $2
+				RETURNING updated_at
 			`
 
 			err := tx.QueryRow(ctx, lineQuery,
+				line.ID,
 				invoice.ID,
 				line.LineNumber,
 				line.AccountID,
@@ -166,52 +419,109 @@ func (r *InvoiceRepository) Create(ctx context.Context, invoice *Invoice) error
 				line.Dimension4,
 				line.ItemCode,
 				line.ItemName,
-			).Scan(&line.ID, &line.CreatedAt, &line.UpdatedAt)
+				line.FunctionalLineAmount,
+				line.FunctionalTaxAmount,
+			).Scan(&line.UpdatedAt)
 
+			if err == pgx.ErrNoRows {
+				return errors.NotFound("invoice_line", line.ID)
+			}
 			if err != nil {
-				return errors.Wrap(err, errors.ErrCodeInternal, "failed to create invoice line")
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to update invoice line")
 			}
-
-			line.InvoiceID = invoice.ID
 		}
 
-		// Refresh totals (trigger will update, but we need to read back)
-		refreshQuery := `
-			SELECT subtotal, tax_amount, total_amount, amount_paid, amount_due
-			FROM invoices
-			WHERE id = $1
-		`
-		err = tx.QueryRow(ctx, refreshQuery, invoice.ID).Scan(
-			&invoice.Subtotal, &invoice.TaxAmount, &invoice.TotalAmount,
-			&invoice.AmountPaid, &invoice.AmountDue)
-		if err != nil {
-			return errors.Wrap(err, errors.ErrCodeInternal, "failed to refresh invoice totals")
-		}
-
-		return nil
+		// Read back totals recomputed by the line trigger
+		return r.refreshTotals(ctx, tx, invoice)
 	})
 }
 
-// GetByID retrieves an invoice by ID with all lines
-func (r *InvoiceRepository) GetByID(ctx context.Context, id, entityID string) (*Invoice, error) {
-	invoice := &Invoice{}
+// insertLine inserts a single invoice line within a transaction
+func (r *InvoiceRepository) insertLine(ctx context.Context, tx pgx.Tx, invoiceID string, line *InvoiceLine) error {
+	query := `
+		INSERT INTO invoice_lines (invoice_id, line_number, account_id, description,
+		                          quantity, unit_price, line_amount,
+		                          tax_code, tax_rate, tax_amount,
+		                          dimension_1, dimension_2, dimension_3, dimension_4,
+		                          item_code, item_name,
+		                          functional_line_amount, functional_tax_amount)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		RETURNING id, created_at, updated_at
+	`
+
+	err := tx.QueryRow(ctx, query,
+		invoiceID,
+		line.LineNumber,
+		line.AccountID,
+		line.Description,
+		line.Quantity,
+		line.UnitPrice,
+		line.LineAmount,
+		line.TaxCode,
+		line.TaxRate,
+		line.TaxAmount,
+		line.Dimension1,
+		line.Dimension2,
+		line.Dimension3,
+		line.Dimension4,
+		line.ItemCode,
+		line.ItemName,
+		line.FunctionalLineAmount,
+		line.FunctionalTaxAmount,
+	).Scan(&line.ID, &line.CreatedAt, &line.UpdatedAt)
+
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to create invoice line")
+	}
+
+	line.InvoiceID = invoiceID
+	return nil
+}
 
+// refreshTotals reads back the trigger-maintained totals within a transaction
+func (r *InvoiceRepository) refreshTotals(ctx context.Context, tx pgx.Tx, invoice *Invoice) error {
 	query := `
-		SELECT id, entity_id, vendor_id, invoice_number,
-		       invoice_date, due_date,
-		       invoice_type, status, payment_terms, discount_percent,
-		       discount_due_date,
-		       currency, subtotal, tax_amount, total_amount, amount_paid, amount_due,
-		       posted_to_gl, gl_journal_id, posted_date, posted_by,
-		       approved_by, approved_at, approval_notes,
-		       payment_method, payment_reference, payment_date,
-		       po_number, reference_number, description, notes, attachment_urls,
-		       created_by, created_at, updated_by, updated_at
+		SELECT subtotal, tax_amount, total_amount, amount_paid, amount_due,
+		       functional_subtotal, functional_tax_amount, functional_total_amount
 		FROM invoices
-		WHERE id = $1 AND entity_id = $2
+		WHERE id = $1
 	`
+	err := tx.QueryRow(ctx, query, invoice.ID).Scan(
+		&invoice.Subtotal, &invoice.TaxAmount, &invoice.TotalAmount,
+		&invoice.AmountPaid, &invoice.AmountDue,
+		&invoice.FunctionalSubtotal, &invoice.FunctionalTaxAmount, &invoice.FunctionalTotalAmount)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to refresh invoice totals")
+	}
+	return nil
+}
+
+// invoiceColumns is the column list read by scanInvoice
+const invoiceColumns = `
+	id, entity_id, vendor_id, invoice_number,
+	invoice_date, due_date,
+	invoice_type, status, payment_terms, discount_percent,
+	discount_due_date,
+	currency, subtotal, tax_amount,
+	prices_include_tax, vendor_tax_amount, tax_discrepancy, tax_discrepancy_flagged,
+	total_amount, amount_paid, amount_due,
+	functional_currency, exchange_rate,
+	functional_subtotal, functional_tax_amount, functional_total_amount,
+	posted_exchange_rate, functional_amount_paid,
+	prepayment_applied, functional_prepayment_applied, prepayment_balance,
+	posted_to_gl, gl_journal_id, gl_posting_status, gl_date, gl_period_id,
+	posted_date, posted_by,
+	approved_by, approved_at, approval_notes,
+	payment_method, payment_reference, payment_date,
+	cancelled_by, cancelled_at, cancel_reason, reversal_journal_id,
+	po_number, reference_number, description, notes, attachment_urls,
+	created_by, created_at, updated_by, updated_at, version
+`
 
-	err := r.db.QueryRow(ctx, query, id, entityID).Scan(
+// scanInvoice scans a row selected with invoiceColumns
+func scanInvoice(row pgx.Row) (*Invoice, error) {
+	invoice := &Invoice{}
+	err := row.Scan(
 		&invoice.ID,
 		&invoice.EntityID,
 		&invoice.VendorID,
@@ -226,11 +536,28 @@ func (r *InvoiceRepository) GetByID(ctx context.Context, id, entityID string) (*
 		&invoice.Currency,
 		&invoice.Subtotal,
 		&invoice.TaxAmount,
+		&invoice.PricesIncludeTax,
+		&invoice.VendorTaxAmount,
+		&invoice.TaxDiscrepancy,
+		&invoice.TaxFlagged,
 		&invoice.TotalAmount,
 		&invoice.AmountPaid,
 		&invoice.AmountDue,
+		&invoice.FunctionalCurrency,
+		&invoice.ExchangeRate,
+		&invoice.FunctionalSubtotal,
+		&invoice.FunctionalTaxAmount,
+		&invoice.FunctionalTotalAmount,
+		&invoice.PostedExchangeRate,
+		&invoice.FunctionalAmountPaid,
+		&invoice.PrepaymentApplied,
+		&invoice.FunctionalApplied,
+		&invoice.PrepaymentBalance,
 		&invoice.PostedToGL,
 		&invoice.GLJournalID,
+		&invoice.GLPostingStatus,
+		&invoice.GLDate,
+		&invoice.GLPeriodID,
 		&invoice.PostedDate,
 		&invoice.PostedBy,
 		&invoice.ApprovedBy,
@@ -239,6 +566,10 @@ func (r *InvoiceRepository) GetByID(ctx context.Context, id, entityID string) (*
 		&invoice.PaymentMethod,
 		&invoice.PaymentReference,
 		&invoice.PaymentDate,
+		&invoice.CancelledBy,
+		&invoice.CancelledAt,
+		&invoice.CancelReason,
+		&invoice.ReversalJournalID,
 		&invoice.PONumber,
 		&invoice.ReferenceNumber,
 		&invoice.Description,
@@ -248,7 +579,22 @@ func (r *InvoiceRepository) GetByID(ctx context.Context, id, entityID string) (*
 		&invoice.CreatedAt,
 		&invoice.UpdatedBy,
 		&invoice.UpdatedAt,
+		&invoice.Version,
 	)
+	if err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// GetByID retrieves an invoice by ID with all lines
+func (r *InvoiceRepository) GetByID(ctx context.Context, id, entityID string) (*Invoice, error) {
+	query := `SELECT ` + invoiceColumns + `
+		FROM invoices
+		WHERE id = $1 AND entity_id = $2
+	`
+
+	invoice, err := scanInvoice(r.db.QueryRow(ctx, query, id, entityID))
 
 	if err == pgx.ErrNoRows {
 		return nil, errors.NotFound("invoice", id)
@@ -267,6 +613,32 @@ func (r *InvoiceRepository) GetByID(ctx context.Context, id, entityID string) (*
 	return invoice, nil
 }
 
+// FindByNumber retrieves a vendor's invoice by its number, with all lines,
+// or nil if the vendor has no invoice with that number
+func (r *InvoiceRepository) FindByNumber(ctx context.Context, entityID, vendorID, invoiceNumber string) (*Invoice, error) {
+	query := `SELECT ` + invoiceColumns + `
+		FROM invoices
+		WHERE entity_id = $1 AND vendor_id = $2 AND invoice_number = $3
+	`
+
+	invoice, err := scanInvoice(r.db.QueryRow(ctx, query, entityID, vendorID, invoiceNumber))
+
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get invoice")
+	}
+
+	lines, err := r.GetLines(ctx, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	invoice.Lines = lines
+
+	return invoice, nil
+}
+
 // GetLines retrieves all lines for an invoice
 func (r *InvoiceRepository) GetLines(ctx context.Context, invoiceID string) ([]*InvoiceLine, error) {
 	query := `
@@ -275,6 +647,7 @@ func (r *InvoiceRepository) GetLines(ctx context.Context, invoiceID string) ([]*
 		       tax_code, tax_rate, tax_amount,
 		       dimension_1, dimension_2, dimension_3, dimension_4,
 		       item_code, item_name,
+		       functional_line_amount, functional_tax_amount,
 		       created_at, updated_at
 		FROM invoice_lines
 		WHERE invoice_id = $1
@@ -308,6 +681,8 @@ func (r *InvoiceRepository) GetLines(ctx context.Context, invoiceID string) ([]*
 			&line.Dimension4,
 			&line.ItemCode,
 			&line.ItemName,
+			&line.FunctionalLineAmount,
+			&line.FunctionalTaxAmount,
 			&line.CreatedAt,
 			&line.UpdatedAt,
 		)
@@ -323,17 +698,7 @@ func (r *InvoiceRepository) GetLines(ctx context.Context, invoiceID string) ([]*
 
 // List retrieves invoices with filtering and pagination
 func (r *InvoiceRepository) List(ctx context.Context, entityID string, vendorID, status *string, fromDate, toDate *string, limit, offset int) ([]*Invoice, int64, error) {
-	query := `
-		SELECT id, entity_id, vendor_id, invoice_number,
-		       invoice_date, due_date,
-		       invoice_type, status, payment_terms, discount_percent,
-		       discount_due_date,
-		       currency, subtotal, tax_amount, total_amount, amount_paid, amount_due,
-		       posted_to_gl, gl_journal_id, posted_date, posted_by,
-		       approved_by, approved_at, approval_notes,
-		       payment_method, payment_reference, payment_date,
-		       po_number, reference_number, description, notes, attachment_urls,
-		       created_by, created_at, updated_by, updated_at
+	query := `SELECT ` + invoiceColumns + `
 		FROM invoices
 		WHERE entity_id = $1
 	`
@@ -392,45 +757,7 @@ func (r *InvoiceRepository) List(ctx context.Context, entityID string, vendorID,
 
 	invoices := make([]*Invoice, 0)
 	for rows.Next() {
-		invoice := &Invoice{}
-		err := rows.Scan(
-			&invoice.ID,
-			&invoice.EntityID,
-			&invoice.VendorID,
-			&invoice.InvoiceNumber,
-			&invoice.InvoiceDate,
-			&invoice.DueDate,
-			&invoice.InvoiceType,
-			&invoice.Status,
-			&invoice.PaymentTerms,
-			&invoice.DiscountPercent,
-			&invoice.DiscountDueDate,
-			&invoice.Currency,
-			&invoice.Subtotal,
-			&invoice.TaxAmount,
-			&invoice.TotalAmount,
-			&invoice.AmountPaid,
-			&invoice.AmountDue,
-			&invoice.PostedToGL,
-			&invoice.GLJournalID,
-			&invoice.PostedDate,
-			&invoice.PostedBy,
-			&invoice.ApprovedBy,
-			&invoice.ApprovedAt,
-			&invoice.ApprovalNotes,
-			&invoice.PaymentMethod,
-			&invoice.PaymentReference,
-			&invoice.PaymentDate,
-			&invoice.PONumber,
-			&invoice.ReferenceNumber,
-			&invoice.Description,
-			&invoice.Notes,
-			&invoice.AttachmentURLs,
-			&invoice.CreatedBy,
-			&invoice.CreatedAt,
-			&invoice.UpdatedBy,
-			&invoice.UpdatedAt,
-		)
+		invoice, err := scanInvoice(rows)
 		if err != nil {
 			return nil, 0, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan invoice")
 		}
@@ -441,124 +768,862 @@ func (r *InvoiceRepository) List(ctx context.Context, entityID string, vendorID,
 	return invoices, total, nil
 }
 
-// UpdateStatus updates the status of an invoice
-func (r *InvoiceRepository) UpdateStatus(ctx context.Context, id, entityID, status string, updatedBy *string) error {
+// ListOpenForeignCurrency retrieves, without lines, the posted invoices of an
+// entity with an amount due in a currency other than the functional
+// currency, booked through asOf
+func (r *InvoiceRepository) ListOpenForeignCurrency(ctx context.Context, entityID, functionalCurrency string, asOf time.Time) ([]*Invoice, error) {
+	query := `SELECT ` + invoiceColumns + `
+		FROM invoices
+		WHERE entity_id = $1
+		  AND status = 'posted'
+		  AND gl_posting_status = 'posted'
+		  AND amount_due > 0
+		  AND functional_currency = $2
+		  AND currency <> $2
+		  AND posted_exchange_rate IS NOT NULL
+		  AND gl_date <= $3
+		ORDER BY invoice_number
+	`
+
+	rows, err := r.db.Query(ctx, query, entityID, functionalCurrency, asOf)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list open foreign-currency invoices")
+	}
+	defer rows.Close()
+
+	invoices := make([]*Invoice, 0)
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan invoice")
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// UpdateStatus applies a status transition to an invoice if it is still at
+// the given version and in the transition's from status
+func (r *InvoiceRepository) UpdateStatus(ctx context.Context, id, entityID string, version int64, t StatusTransition) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE invoices
+			SET status = $3::invoice_status,
+			    updated_by = $4,
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND version = $5 AND status = $6::invoice_status
+			RETURNING id
+		`
+
+		var returnedID string
+		err := tx.QueryRow(ctx, query, id, entityID, t.To, t.Actor, version, t.From).Scan(&returnedID)
+
+		if err == pgx.ErrNoRows {
+			return r.staleWriteError(ctx, id, entityID, version, transitionConflict(t))
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to update invoice status")
+		}
+
+		return r.recordTransition(ctx, tx, id, entityID, t)
+	})
+}
+
+// Approve applies an approval transition, stamping the approver and notes
+// from the transition's actor and reason
+func (r *InvoiceRepository) Approve(ctx context.Context, id, entityID string, version int64, t StatusTransition) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE invoices
+			SET status = $3::invoice_status,
+			    approved_by = $4,
+			    approved_at = NOW(),
+			    approval_notes = $5,
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND version = $6 AND status = $7::invoice_status
+			RETURNING id
+		`
+
+		var returnedID string
+		err := tx.QueryRow(ctx, query, id, entityID, t.To, t.Actor, t.Reason, version, t.From).Scan(&returnedID)
+
+		if err == pgx.ErrNoRows {
+			return r.staleWriteError(ctx, id, entityID, version, transitionConflict(t))
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to approve invoice")
+		}
+
+		return r.recordTransition(ctx, tx, id, entityID, t)
+	})
+}
+
+// QueuePosting applies a posting transition, fixing the GL date and period
+// the invoice posts into, and in the same transaction writes the outbox entry
+// that drives the GL posting saga. The invoice's exchange rate is captured as
+// the rate its liability is booked at. The invoice is posted with
+// gl_posting_status 'pending' until CompletePosting or FailPosting settles
+// it. On success entry holds the stored outbox row.
+func (r *InvoiceRepository) QueuePosting(ctx context.Context, id, entityID string, version int64, t StatusTransition, glDate time.Time, glPeriodID string, entry *PostingOutboxEntry) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE invoices
+			SET status = $3::invoice_status,
+			    gl_posting_status = 'pending',
+			    gl_date = $7,
+			    gl_period_id = $8,
+			    posted_exchange_rate = exchange_rate,
+			    posted_by = $4,
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND version = $5 AND status = $6::invoice_status
+			RETURNING id
+		`
+
+		var returnedID string
+		err := tx.QueryRow(ctx, query, id, entityID, t.To, t.Actor, version, t.From, glDate, glPeriodID).Scan(&returnedID)
+
+		if err == pgx.ErrNoRows {
+			return r.staleWriteError(ctx, id, entityID, version, transitionConflict(t))
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to queue invoice posting")
+		}
+
+		if err := r.recordTransition(ctx, tx, id, entityID, t); err != nil {
+			return err
+		}
+
+		return insertPostingOutboxEntry(ctx, tx, entry)
+	})
+}
+
+// CompletePosting records the GL journal on an invoice whose posting saga has
+// finished and closes the outbox entry in the same transaction
+func (r *InvoiceRepository) CompletePosting(ctx context.Context, entry *PostingOutboxEntry) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE invoices
+			SET posted_to_gl = TRUE,
+			    gl_journal_id = $3,
+			    gl_posting_status = 'posted',
+			    posted_date = CURRENT_DATE,
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND gl_posting_status = 'pending'
+			RETURNING id
+		`
+
+		var returnedID string
+		err := tx.QueryRow(ctx, query, entry.InvoiceID, entry.EntityID, entry.JournalID).Scan(&returnedID)
+
+		if err == pgx.ErrNoRows {
+			return errors.New(errors.ErrCodeConflict, "invoice has no GL posting in progress")
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to mark invoice as posted")
+		}
+
+		return finishPostingOutboxEntry(ctx, tx, entry, "completed")
+	})
+}
+
+// FailPosting applies the transition returning an invoice whose posting saga
+// was compensated to its pre-posting status, and closes the outbox entry as
+// failed in the same transaction
+func (r *InvoiceRepository) FailPosting(ctx context.Context, entry *PostingOutboxEntry, t StatusTransition) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE invoices
+			SET status = $3::invoice_status,
+			    gl_posting_status = 'failed',
+			    posted_exchange_rate = NULL,
+			    posted_by = NULL,
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND status = $4::invoice_status AND gl_posting_status = 'pending'
+			RETURNING id
+		`
+
+		var returnedID string
+		err := tx.QueryRow(ctx, query, entry.InvoiceID, entry.EntityID, t.To, t.From).Scan(&returnedID)
+
+		if err == pgx.ErrNoRows {
+			return errors.New(errors.ErrCodeConflict, "invoice has no GL posting in progress")
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to revert invoice posting")
+		}
+
+		if err := r.recordTransition(ctx, tx, entry.InvoiceID, entry.EntityID, t); err != nil {
+			return err
+		}
+
+		return finishPostingOutboxEntry(ctx, tx, entry, "failed")
+	})
+}
+
+// recordTransition appends a status history row within a transaction
+func (r *InvoiceRepository) recordTransition(ctx context.Context, tx pgx.Tx, invoiceID, entityID string, t StatusTransition) error {
 	query := `
-		UPDATE invoices
-		SET status = $3::invoice_status,
-		    updated_by = $4,
-		    updated_at = NOW()
-		WHERE id = $1 AND entity_id = $2
-		RETURNING id
+		INSERT INTO invoice_status_history
+		    (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+		VALUES ($1, $2, $3::invoice_status, $4::invoice_status, $5, $6, $7)
 	`
 
-	var returnedID string
-	err := r.db.QueryRow(ctx, query, id, entityID, status, updatedBy).Scan(&returnedID)
+	if _, err := tx.Exec(ctx, query, invoiceID, entityID, t.From, t.To, t.Event, t.Actor, t.Reason); err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to record invoice status history")
+	}
+	return nil
+}
+
+// GetStatusHistory returns the status changes of an invoice, oldest first
+func (r *InvoiceRepository) GetStatusHistory(ctx context.Context, invoiceID, entityID string) ([]*StatusHistoryEntry, error) {
+	query := `
+		SELECT id, invoice_id, entity_id, from_status, to_status, event,
+		       changed_by, changed_at, reason
+		FROM invoice_status_history
+		WHERE invoice_id = $1 AND entity_id = $2
+		ORDER BY changed_at ASC
+	`
+
+	rows, err := r.db.Query(ctx, query, invoiceID, entityID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get invoice status history")
+	}
+	defer rows.Close()
+
+	entries := make([]*StatusHistoryEntry, 0)
+	for rows.Next() {
+		e := &StatusHistoryEntry{}
+		if err := rows.Scan(
+			&e.ID,
+			&e.InvoiceID,
+			&e.EntityID,
+			&e.FromStatus,
+			&e.ToStatus,
+			&e.Event,
+			&e.ChangedBy,
+			&e.ChangedAt,
+			&e.Reason,
+		); err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan invoice status history")
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// transitionConflict reports a transition whose from status no longer holds
+func transitionConflict(t StatusTransition) error {
+	return errors.New(errors.ErrCodeConflict,
+		fmt.Sprintf("cannot %s invoice: status is no longer '%s'", t.Event, t.From))
+}
+
+// RecordPayment records a payment against an invoice. The invoice version is
+// checked and bumped in the same transaction as the payment insert.
+func (r *InvoiceRepository) RecordPayment(ctx context.Context, payment *InvoicePayment, entityID string, version int64) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			UPDATE invoices
+			SET version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND version = $3
+		`, payment.InvoiceID, entityID, version)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to lock invoice for payment")
+		}
+		if tag.RowsAffected() == 0 {
+			return r.staleWriteError(ctx, payment.InvoiceID, entityID, version, ErrVersionConflict)
+		}
+
+		query := `
+			INSERT INTO invoice_payments (invoice_id, payment_date, payment_amount,
+			                               exchange_rate, functional_payment_amount,
+			                               functional_ap_amount, realized_fx_gain_loss,
+			                               payment_method, payment_reference, notes,
+			                               gl_date, gl_period_id, idempotency_key, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			RETURNING id, created_at
+		`
+
+		err = tx.QueryRow(ctx, query,
+			payment.InvoiceID,
+			payment.PaymentDate,
+			payment.PaymentAmount,
+			payment.ExchangeRate,
+			payment.FunctionalAmount,
+			payment.FunctionalAPAmount,
+			payment.RealizedFXGainLoss,
+			payment.PaymentMethod,
+			payment.PaymentReference,
+			payment.Notes,
+			payment.GLDate,
+			payment.GLPeriodID,
+			payment.IdempotencyKey,
+			payment.CreatedBy,
+		).Scan(&payment.ID, &payment.CreatedAt)
+
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to record payment")
+		}
+
+		return nil
+	})
+}
+
+// SetPaymentJournal records the GL journal created for a payment
+func (r *InvoiceRepository) SetPaymentJournal(ctx context.Context, paymentID, glJournalID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE invoice_payments SET gl_journal_id = $2 WHERE id = $1`,
+		paymentID, glJournalID)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to set payment journal")
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.NotFound("payment", paymentID)
+	}
+	return nil
+}
+
+// paymentColumns is the column list read by scanPayment
+const paymentColumns = `
+	id, invoice_id, payment_date, payment_amount,
+	exchange_rate, functional_payment_amount,
+	functional_ap_amount, realized_fx_gain_loss,
+	payment_method, payment_reference, notes,
+	gl_journal_id, voided_at, voided_by, void_reason, reversal_journal_id,
+	gl_date, gl_period_id, idempotency_key, created_by, created_at
+`
+
+// scanPayment scans a row selected with paymentColumns
+func scanPayment(row pgx.Row) (*InvoicePayment, error) {
+	payment := &InvoicePayment{}
+	err := row.Scan(
+		&payment.ID,
+		&payment.InvoiceID,
+		&payment.PaymentDate,
+		&payment.PaymentAmount,
+		&payment.ExchangeRate,
+		&payment.FunctionalAmount,
+		&payment.FunctionalAPAmount,
+		&payment.RealizedFXGainLoss,
+		&payment.PaymentMethod,
+		&payment.PaymentReference,
+		&payment.Notes,
+		&payment.GLJournalID,
+		&payment.VoidedAt,
+		&payment.VoidedBy,
+		&payment.VoidReason,
+		&payment.ReversalJournalID,
+		&payment.GLDate,
+		&payment.GLPeriodID,
+		&payment.IdempotencyKey,
+		&payment.CreatedBy,
+		&payment.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+// GetPayment retrieves a payment recorded against an invoice
+func (r *InvoiceRepository) GetPayment(ctx context.Context, paymentID, invoiceID string) (*InvoicePayment, error) {
+	query := `SELECT ` + paymentColumns + `
+		FROM invoice_payments
+		WHERE id = $1 AND invoice_id = $2
+	`
+
+	payment, err := scanPayment(r.db.QueryRow(ctx, query, paymentID, invoiceID))
 
 	if err == pgx.ErrNoRows {
-		return errors.NotFound("invoice", id)
+		return nil, errors.NotFound("payment", paymentID)
 	}
 	if err != nil {
-		return errors.Wrap(err, errors.ErrCodeInternal, "failed to update invoice status")
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get payment")
 	}
 
-	return nil
+	return payment, nil
 }
 
-// Approve approves an invoice
-func (r *InvoiceRepository) Approve(ctx context.Context, id, entityID string, approvedBy *string, notes *string) error {
-	query := `
-		UPDATE invoices
-		SET status = 'approved'::invoice_status,
-		    approved_by = $3,
-		    approved_at = NOW(),
-		    approval_notes = $4,
-		    updated_at = NOW()
-		WHERE id = $1 AND entity_id = $2
-		RETURNING id
+// GetPaymentByIdempotencyKey retrieves the payment recorded against an
+// invoice under a client idempotency key, returning nil if there is none
+func (r *InvoiceRepository) GetPaymentByIdempotencyKey(ctx context.Context, invoiceID, key string) (*InvoicePayment, error) {
+	query := `SELECT ` + paymentColumns + `
+		FROM invoice_payments
+		WHERE invoice_id = $1 AND idempotency_key = $2
 	`
 
-	var returnedID string
-	err := r.db.QueryRow(ctx, query, id, entityID, approvedBy, notes).Scan(&returnedID)
+	payment, err := scanPayment(r.db.QueryRow(ctx, query, invoiceID, key))
 
 	if err == pgx.ErrNoRows {
-		return errors.NotFound("invoice", id)
+		return nil, nil
 	}
 	if err != nil {
-		return errors.Wrap(err, errors.ErrCodeInternal, "failed to approve invoice")
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get payment")
+	}
+
+	return payment, nil
+}
+
+// VoidPayment marks a payment as voided. The invoice version is checked and
+// bumped in the same transaction; the payment trigger recomputes amount_paid
+// and returns a paid invoice to posted.
+func (r *InvoiceRepository) VoidPayment(ctx context.Context, payment *InvoicePayment, entityID string, version int64) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			UPDATE invoices
+			SET version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND version = $3
+		`, payment.InvoiceID, entityID, version)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to lock invoice for payment void")
+		}
+		if tag.RowsAffected() == 0 {
+			return r.staleWriteError(ctx, payment.InvoiceID, entityID, version, ErrVersionConflict)
+		}
+
+		query := `
+			UPDATE invoice_payments
+			SET voided_at = NOW(),
+			    voided_by = $3,
+			    void_reason = $4,
+			    reversal_journal_id = $5
+			WHERE id = $1 AND invoice_id = $2 AND voided_at IS NULL
+			RETURNING voided_at
+		`
+
+		err = tx.QueryRow(ctx, query,
+			payment.ID,
+			payment.InvoiceID,
+			payment.VoidedBy,
+			payment.VoidReason,
+			payment.ReversalJournalID,
+		).Scan(&payment.VoidedAt)
+
+		if err == pgx.ErrNoRows {
+			return errors.New(errors.ErrCodeConflict, "cannot void payment that is already voided")
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to void payment")
+		}
+
+		return nil
+	})
+}
+
+// ApplyCredit records the applications of a credit memo to invoices. The
+// credit memo and every invoice are checked at the version they were read at
+// and bumped in the same transaction, in ID order so concurrent applications
+// cannot deadlock; the application trigger recomputes amount_paid on both
+// sides and moves fully settled documents to paid.
+func (r *InvoiceRepository) ApplyCredit(ctx context.Context, creditMemo *Invoice, invoices []*Invoice, applications []*CreditApplication) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		if err := r.lockDocuments(ctx, tx, append([]*Invoice{creditMemo}, invoices...)); err != nil {
+			return err
+		}
+
+		query := `
+			INSERT INTO ap_credit_applications (entity_id, credit_memo_id, invoice_id, application_date, amount,
+			                                    functional_invoice_amount, functional_credit_amount,
+			                                    realized_fx_gain_loss, gl_date, gl_period_id, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING id, created_at
+		`
+
+		for _, application := range applications {
+			err := tx.QueryRow(ctx, query,
+				application.EntityID,
+				application.CreditMemoID,
+				application.InvoiceID,
+				application.ApplicationDate,
+				application.Amount,
+				application.FunctionalInvoiceAmount,
+				application.FunctionalCreditAmount,
+				application.RealizedFXGainLoss,
+				application.GLDate,
+				application.GLPeriodID,
+				application.CreatedBy,
+			).Scan(&application.ID, &application.CreatedAt)
+
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to record credit application")
+			}
+		}
+
+		return nil
+	})
+}
+
+// lockDocuments checks that each invoice is still at the version it was read
+// at and bumps it, in ID order so concurrent writers cannot deadlock
+func (r *InvoiceRepository) lockDocuments(ctx context.Context, tx pgx.Tx, documents []*Invoice) error {
+	sorted := make([]*Invoice, len(documents))
+	copy(sorted, documents)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	for _, document := range sorted {
+		tag, err := tx.Exec(ctx, `
+			UPDATE invoices
+			SET version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND version = $3
+		`, document.ID, document.EntityID, document.Version)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to lock invoice")
+		}
+		if tag.RowsAffected() == 0 {
+			return r.staleWriteError(ctx, document.ID, document.EntityID, document.Version, ErrVersionConflict)
+		}
 	}
 
 	return nil
 }
 
-// MarkAsPosted marks invoice as posted to GL
-func (r *InvoiceRepository) MarkAsPosted(ctx context.Context, id, entityID, glJournalID string, postedBy *string) error {
-	query := `
-		UPDATE invoices
-		SET status = 'posted'::invoice_status,
-		    posted_to_gl = TRUE,
-		    gl_journal_id = $3,
-		    posted_date = CURRENT_DATE,
-		    posted_by = $4,
-		    updated_at = NOW()
+// SetCreditApplicationJournal records the GL journal created for a credit
+// application
+func (r *InvoiceRepository) SetCreditApplicationJournal(ctx context.Context, applicationID, glJournalID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE ap_credit_applications SET gl_journal_id = $2 WHERE id = $1`,
+		applicationID, glJournalID)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to set credit application journal")
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.NotFound("credit_application", applicationID)
+	}
+	return nil
+}
+
+// creditApplicationColumns is the column list read by scanCreditApplication
+const creditApplicationColumns = `
+	id, entity_id, credit_memo_id, invoice_id, application_date, amount,
+	functional_invoice_amount, functional_credit_amount, realized_fx_gain_loss,
+	gl_date, gl_period_id, gl_journal_id, reversed_at, reversed_by,
+	reversal_reason, reversal_journal_id, created_by, created_at
+`
+
+// scanCreditApplication scans a row selected with creditApplicationColumns
+func scanCreditApplication(row pgx.Row) (*CreditApplication, error) {
+	application := &CreditApplication{}
+	err := row.Scan(
+		&application.ID,
+		&application.EntityID,
+		&application.CreditMemoID,
+		&application.InvoiceID,
+		&application.ApplicationDate,
+		&application.Amount,
+		&application.FunctionalInvoiceAmount,
+		&application.FunctionalCreditAmount,
+		&application.RealizedFXGainLoss,
+		&application.GLDate,
+		&application.GLPeriodID,
+		&application.GLJournalID,
+		&application.ReversedAt,
+		&application.ReversedBy,
+		&application.ReversalReason,
+		&application.ReversalJournalID,
+		&application.CreatedBy,
+		&application.CreatedAt,
+	)
+	return application, err
+}
+
+// GetCreditApplication retrieves a credit application by ID
+func (r *InvoiceRepository) GetCreditApplication(ctx context.Context, id, entityID string) (*CreditApplication, error) {
+	query := `SELECT ` + creditApplicationColumns + `
+		FROM ap_credit_applications
 		WHERE id = $1 AND entity_id = $2
-		RETURNING id
 	`
 
-	var returnedID string
-	err := r.db.QueryRow(ctx, query, id, entityID, glJournalID, postedBy).Scan(&returnedID)
-
+	application, err := scanCreditApplication(r.db.QueryRow(ctx, query, id, entityID))
 	if err == pgx.ErrNoRows {
-		return errors.NotFound("invoice", id)
+		return nil, errors.NotFound("credit_application", id)
 	}
 	if err != nil {
-		return errors.Wrap(err, errors.ErrCodeInternal, "failed to mark invoice as posted")
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get credit application")
 	}
+	return application, nil
+}
 
-	return nil
+// ReverseCreditApplication marks a credit application reversed. The credit
+// memo and the invoice are checked at the version they were read at and
+// bumped in the same transaction; the reversal trigger recomputes
+// amount_paid on both sides and returns a paid document to posted.
+func (r *InvoiceRepository) ReverseCreditApplication(ctx context.Context, creditMemo, invoice *Invoice, application *CreditApplication) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		if err := r.lockDocuments(ctx, tx, []*Invoice{creditMemo, invoice}); err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx, `
+			UPDATE ap_credit_applications
+			SET reversed_at = NOW(), reversed_by = $3, reversal_reason = $4, reversal_journal_id = $5
+			WHERE id = $1 AND entity_id = $2 AND reversed_at IS NULL
+		`, application.ID, application.EntityID, application.ReversedBy, application.ReversalReason, application.ReversalJournalID)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to reverse credit application")
+		}
+		if tag.RowsAffected() == 0 {
+			return errors.New(errors.ErrCodeConflict, "credit application is already reversed")
+		}
+
+		return nil
+	})
 }
 
-// RecordPayment records a payment against an invoice
-func (r *InvoiceRepository) RecordPayment(ctx context.Context, payment *InvoicePayment) error {
-	query := `
-		INSERT INTO invoice_payments (invoice_id, payment_date, payment_amount,
-		                               payment_method, payment_reference, notes, created_by)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, created_at
+// ListCreditApplications retrieves the credit applied to or from an invoice,
+// oldest first
+func (r *InvoiceRepository) ListCreditApplications(ctx context.Context, invoiceID, entityID string) ([]*CreditApplication, error) {
+	query := `SELECT ` + creditApplicationColumns + `
+		FROM ap_credit_applications
+		WHERE (invoice_id = $1 OR credit_memo_id = $1) AND entity_id = $2
+		ORDER BY created_at
+	`
+
+	return r.queryCreditApplications(ctx, query, invoiceID, entityID)
+}
+
+// ListUnpostedCreditApplications retrieves the applications of a credit memo
+// with a realized FX gain or loss whose GL journal was never recorded
+func (r *InvoiceRepository) ListUnpostedCreditApplications(ctx context.Context, creditMemoID, entityID string) ([]*CreditApplication, error) {
+	query := `SELECT ` + creditApplicationColumns + `
+		FROM ap_credit_applications
+		WHERE credit_memo_id = $1 AND entity_id = $2
+		  AND realized_fx_gain_loss <> 0 AND gl_journal_id IS NULL
+		ORDER BY created_at
 	`
 
-	err := r.db.QueryRow(ctx, query,
-		payment.InvoiceID,
-		payment.PaymentDate,
-		payment.PaymentAmount,
-		payment.PaymentMethod,
-		payment.PaymentReference,
-		payment.Notes,
-		payment.CreatedBy,
-	).Scan(&payment.ID, &payment.CreatedAt)
+	return r.queryCreditApplications(ctx, query, creditMemoID, entityID)
+}
 
+// queryCreditApplications runs a query selecting creditApplicationColumns
+func (r *InvoiceRepository) queryCreditApplications(ctx context.Context, query string, args ...interface{}) ([]*CreditApplication, error) {
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
-		return errors.Wrap(err, errors.ErrCodeInternal, "failed to record payment")
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list credit applications")
 	}
+	defer rows.Close()
+
+	applications := make([]*CreditApplication, 0)
+	for rows.Next() {
+		application, err := scanCreditApplication(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan credit application")
+		}
+		applications = append(applications, application)
+	}
+
+	return applications, nil
+}
+
+// ApplyPrepayment records the applications of a prepayment to final
+// invoices, checking and bumping the version of the prepayment and every
+// invoice in the same transaction. The application trigger recomputes the
+// invoices' amount_paid and the prepayment's applied amount.
+func (r *InvoiceRepository) ApplyPrepayment(ctx context.Context, prepayment *Invoice, invoices []*Invoice, applications []*PrepaymentApplication) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		if err := r.lockDocuments(ctx, tx, append([]*Invoice{prepayment}, invoices...)); err != nil {
+			return err
+		}
+
+		query := `
+			INSERT INTO ap_prepayment_applications (entity_id, prepayment_id, invoice_id, application_date, amount,
+			                                        functional_invoice_amount, functional_prepayment_amount,
+			                                        realized_fx_gain_loss, gl_date, gl_period_id, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING id, created_at
+		`
+
+		for _, application := range applications {
+			err := tx.QueryRow(ctx, query,
+				application.EntityID,
+				application.PrepaymentID,
+				application.InvoiceID,
+				application.ApplicationDate,
+				application.Amount,
+				application.FunctionalInvoiceAmount,
+				application.FunctionalPrepaymentAmount,
+				application.RealizedFXGainLoss,
+				application.GLDate,
+				application.GLPeriodID,
+				application.CreatedBy,
+			).Scan(&application.ID, &application.CreatedAt)
+
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to record prepayment application")
+			}
+		}
+
+		return nil
+	})
+}
 
+// SetPrepaymentApplicationJournal records the GL journal created for a
+// prepayment application
+func (r *InvoiceRepository) SetPrepaymentApplicationJournal(ctx context.Context, applicationID, glJournalID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE ap_prepayment_applications SET gl_journal_id = $2 WHERE id = $1`,
+		applicationID, glJournalID)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to set prepayment application journal")
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.NotFound("prepayment_application", applicationID)
+	}
 	return nil
 }
 
-// Delete deletes a draft invoice
-func (r *InvoiceRepository) Delete(ctx context.Context, id, entityID string) error {
+// prepaymentApplicationColumns is the column list read by
+// scanPrepaymentApplication
+const prepaymentApplicationColumns = `
+	id, entity_id, prepayment_id, invoice_id, application_date, amount,
+	functional_invoice_amount, functional_prepayment_amount, realized_fx_gain_loss,
+	gl_date, gl_period_id, gl_journal_id, created_by, created_at
+`
+
+// scanPrepaymentApplication scans a row selected with
+// prepaymentApplicationColumns
+func scanPrepaymentApplication(row pgx.Row) (*PrepaymentApplication, error) {
+	application := &PrepaymentApplication{}
+	err := row.Scan(
+		&application.ID,
+		&application.EntityID,
+		&application.PrepaymentID,
+		&application.InvoiceID,
+		&application.ApplicationDate,
+		&application.Amount,
+		&application.FunctionalInvoiceAmount,
+		&application.FunctionalPrepaymentAmount,
+		&application.RealizedFXGainLoss,
+		&application.GLDate,
+		&application.GLPeriodID,
+		&application.GLJournalID,
+		&application.CreatedBy,
+		&application.CreatedAt,
+	)
+	return application, err
+}
+
+// ListPrepaymentApplications retrieves the prepayments applied to an
+// invoice, or the applications of a prepayment, oldest first
+func (r *InvoiceRepository) ListPrepaymentApplications(ctx context.Context, invoiceID, entityID string) ([]*PrepaymentApplication, error) {
+	query := `SELECT ` + prepaymentApplicationColumns + `
+		FROM ap_prepayment_applications
+		WHERE (invoice_id = $1 OR prepayment_id = $1) AND entity_id = $2
+		ORDER BY created_at
+	`
+
+	return r.queryPrepaymentApplications(ctx, query, invoiceID, entityID)
+}
+
+// ListUnpostedPrepaymentApplications retrieves the applications of a
+// prepayment whose GL journal was never recorded
+func (r *InvoiceRepository) ListUnpostedPrepaymentApplications(ctx context.Context, prepaymentID, entityID string) ([]*PrepaymentApplication, error) {
+	query := `SELECT ` + prepaymentApplicationColumns + `
+		FROM ap_prepayment_applications
+		WHERE prepayment_id = $1 AND entity_id = $2 AND gl_journal_id IS NULL
+		ORDER BY created_at
+	`
+
+	return r.queryPrepaymentApplications(ctx, query, prepaymentID, entityID)
+}
+
+// queryPrepaymentApplications runs a query selecting
+// prepaymentApplicationColumns
+func (r *InvoiceRepository) queryPrepaymentApplications(ctx context.Context, query string, args ...interface{}) ([]*PrepaymentApplication, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list prepayment applications")
+	}
+	defer rows.Close()
+
+	applications := make([]*PrepaymentApplication, 0)
+	for rows.Next() {
+		application, err := scanPrepaymentApplication(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan prepayment application")
+		}
+		applications = append(applications, application)
+	}
+
+	return applications, nil
+}
+
+// Cancel applies a cancel or void transition, stamping the actor, reason and,
+// for voided invoices, the reversing GL journal
+func (r *InvoiceRepository) Cancel(ctx context.Context, id, entityID string, version int64, t StatusTransition, reversalJournalID *string) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE invoices
+			SET status = $3::invoice_status,
+			    cancelled_by = $4,
+			    cancelled_at = NOW(),
+			    cancel_reason = $5,
+			    reversal_journal_id = $6,
+			    updated_by = $4,
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND entity_id = $2 AND version = $7 AND status = $8::invoice_status
+			RETURNING id
+		`
+
+		var returnedID string
+		err := tx.QueryRow(ctx, query, id, entityID, t.To, t.Actor, t.Reason, reversalJournalID, version, t.From).Scan(&returnedID)
+
+		if err == pgx.ErrNoRows {
+			return r.staleWriteError(ctx, id, entityID, version, transitionConflict(t))
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to cancel invoice")
+		}
+
+		return r.recordTransition(ctx, tx, id, entityID, t)
+	})
+}
+
+// Delete deletes a draft invoice if it is still at the given version
+func (r *InvoiceRepository) Delete(ctx context.Context, id, entityID string, version int64) error {
 	query := `
 		DELETE FROM invoices
-		WHERE id = $1 AND entity_id = $2 AND status = 'draft'
+		WHERE id = $1 AND entity_id = $2 AND status = 'draft' AND version = $3
 	`
 
-	tag, err := r.db.Exec(ctx, query, id, entityID)
+	tag, err := r.db.Exec(ctx, query, id, entityID, version)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrCodeInternal, "failed to delete invoice")
 	}
 
 	if tag.RowsAffected() == 0 {
-		return errors.New(errors.ErrCodeConflict, "cannot delete approved or posted invoice")
+		return r.staleWriteError(ctx, id, entityID, version,
+			errors.New(errors.ErrCodeConflict, "cannot delete approved or posted invoice"))
 	}
 
 	return nil
 }
+
+// staleWriteError explains why a version-guarded write matched no rows: the
+// invoice does not exist, its version has moved on, or the version still
+// matches and some other guard (such as status) failed, reported as guardErr.
+func (r *InvoiceRepository) staleWriteError(ctx context.Context, id, entityID string, version int64, guardErr error) error {
+	var current int64
+	err := r.db.QueryRow(ctx,
+		`SELECT version FROM invoices WHERE id = $1 AND entity_id = $2`,
+		id, entityID).Scan(&current)
+
+	if err == pgx.ErrNoRows {
+		return errors.NotFound("invoice", id)
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to check invoice version")
+	}
+
+	if current != version {
+		return ErrVersionConflict
+	}
+	return guardErr
+}
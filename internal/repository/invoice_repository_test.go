@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/database"
+)
+
+// testDB connects to the database named by the TEST_DB_* environment
+// variables, migrated to the latest schema. Tests using it are skipped
+// unless TEST_DB_HOST is set.
+func testDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST not set")
+	}
+	port, err := strconv.Atoi(os.Getenv("TEST_DB_PORT"))
+	if err != nil {
+		port = 5432
+	}
+
+	db, err := database.New(context.Background(), database.Config{
+		Host:        host,
+		Port:        port,
+		User:        os.Getenv("TEST_DB_USER"),
+		Password:    os.Getenv("TEST_DB_PASSWORD"),
+		Database:    os.Getenv("TEST_DB_NAME"),
+		SSLMode:     "disable",
+		MaxConns:    2,
+		MinConns:    1,
+		MaxConnTime: time.Hour,
+		MaxIdleTime: 30 * time.Minute,
+		HealthCheck: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("connect to test database: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// insertTestInvoice inserts a bare invoice of a type, returning its ID.
+// The invoice is deleted when the test ends.
+func insertTestInvoice(t *testing.T, db *database.DB, entityID, vendorID, number, invoiceType string, total, paid int64) string {
+	t.Helper()
+	ctx := context.Background()
+
+	var id string
+	err := db.QueryRow(ctx, `
+		INSERT INTO invoices (entity_id, vendor_id, invoice_number, invoice_date, due_date, invoice_type,
+		                      payment_terms, currency, functional_currency, subtotal, total_amount,
+		                      functional_subtotal, functional_total_amount, amount_paid)
+		VALUES ($1, $2, $3, '2024-03-01', '2024-03-31', $4, 'NET30', 'USD', 'USD', $5, $5, $5, $5, $6)
+		RETURNING id
+	`, entityID, vendorID, number, invoiceType, total, paid).Scan(&id)
+	if err != nil {
+		t.Fatalf("insert %s invoice: %v", invoiceType, err)
+	}
+
+	t.Cleanup(func() {
+		if _, err := db.Exec(ctx, `DELETE FROM invoices WHERE id = $1`, id); err != nil {
+			t.Errorf("delete invoice %s: %v", id, err)
+		}
+	})
+	return id
+}
+
+func TestPrepaymentApplicationQueries(t *testing.T) {
+	db := testDB(t)
+	repo := NewInvoiceRepository(db)
+	ctx := context.Background()
+
+	var entityID, vendorID, journalID string
+	if err := db.QueryRow(ctx, `SELECT uuid_generate_v4(), uuid_generate_v4(), uuid_generate_v4()`).Scan(&entityID, &vendorID, &journalID); err != nil {
+		t.Fatalf("generate IDs: %v", err)
+	}
+	prepaymentID := insertTestInvoice(t, db, entityID, vendorID, "PRE-1", "prepayment", 100000, 100000)
+	invoiceID := insertTestInvoice(t, db, entityID, vendorID, "INV-1", "standard", 80000, 0)
+
+	var applicationID string
+	err := db.QueryRow(ctx, `
+		INSERT INTO ap_prepayment_applications (entity_id, prepayment_id, invoice_id, application_date, amount,
+		                                        functional_invoice_amount, functional_prepayment_amount,
+		                                        gl_date, gl_period_id)
+		VALUES ($1, $2, $3, '2024-03-05', 50000, 50000, 50000, '2024-03-05', '2024-03')
+		RETURNING id
+	`, entityID, prepaymentID, invoiceID).Scan(&applicationID)
+	if err != nil {
+		t.Fatalf("insert prepayment application: %v", err)
+	}
+	// Registered after the invoices' cleanups, so it runs before them
+	t.Cleanup(func() {
+		if _, err := db.Exec(ctx, `DELETE FROM ap_prepayment_applications WHERE id = $1`, applicationID); err != nil {
+			t.Errorf("delete prepayment application: %v", err)
+		}
+	})
+
+	for _, id := range []string{prepaymentID, invoiceID} {
+		applications, err := repo.ListPrepaymentApplications(ctx, id, entityID)
+		if err != nil {
+			t.Fatalf("ListPrepaymentApplications(%s) error: %v", id, err)
+		}
+		if len(applications) != 1 || applications[0].ID != applicationID {
+			t.Fatalf("ListPrepaymentApplications(%s) = %d applications, want %s", id, len(applications), applicationID)
+		}
+		if got := applications[0]; got.PrepaymentID != prepaymentID || got.InvoiceID != invoiceID || got.Amount != 50000 {
+			t.Errorf("ListPrepaymentApplications(%s) = %+v", id, got)
+		}
+	}
+
+	unposted, err := repo.ListUnpostedPrepaymentApplications(ctx, prepaymentID, entityID)
+	if err != nil {
+		t.Fatalf("ListUnpostedPrepaymentApplications error: %v", err)
+	}
+	if len(unposted) != 1 || unposted[0].ID != applicationID {
+		t.Fatalf("ListUnpostedPrepaymentApplications = %d applications, want %s", len(unposted), applicationID)
+	}
+
+	if err := repo.SetPrepaymentApplicationJournal(ctx, applicationID, journalID); err != nil {
+		t.Fatalf("SetPrepaymentApplicationJournal error: %v", err)
+	}
+	unposted, err = repo.ListUnpostedPrepaymentApplications(ctx, prepaymentID, entityID)
+	if err != nil {
+		t.Fatalf("ListUnpostedPrepaymentApplications error: %v", err)
+	}
+	if len(unposted) != 0 {
+		t.Errorf("ListUnpostedPrepaymentApplications after journal = %d applications, want 0", len(unposted))
+	}
+}
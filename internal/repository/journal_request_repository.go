@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// JournalRequest is the local record of a journal requested from GL-2 under
+// an idempotency key
+type JournalRequest struct {
+	ID             string
+	EntityID       string
+	IdempotencyKey string
+	JournalNumber  string
+	JournalID      *string
+	Request        json.RawMessage // the journal as sent to GL-2; nil for requests recorded before it was kept
+	PostedAt       *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// JournalRequestRepository records GL-2 journal requests by idempotency key
+type JournalRequestRepository struct {
+	db *database.DB
+}
+
+// NewJournalRequestRepository creates a new journal request repository
+func NewJournalRequestRepository(db *database.DB) *JournalRequestRepository {
+	return &JournalRequestRepository{db: db}
+}
+
+// journalRequestColumns is the column list read by scanJournalRequest
+const journalRequestColumns = `
+	id, entity_id, idempotency_key, journal_number,
+	journal_id, request, posted_at, created_at, updated_at
+`
+
+// scanJournalRequest scans a row selected with journalRequestColumns
+func scanJournalRequest(row pgx.Row) (*JournalRequest, error) {
+	jr := &JournalRequest{}
+	err := row.Scan(
+		&jr.ID,
+		&jr.EntityID,
+		&jr.IdempotencyKey,
+		&jr.JournalNumber,
+		&jr.JournalID,
+		&jr.Request,
+		&jr.PostedAt,
+		&jr.CreatedAt,
+		&jr.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return jr, nil
+}
+
+// Reserve claims the right to create the journal for key, recording the
+// journal request about to be sent. It returns the request and true when the
+// caller should create the journal: the key is new, or an earlier
+// reservation never recorded a journal and has been idle longer than
+// staleAfter. Otherwise it returns the existing request and false; its
+// JournalID is set if the journal was already created.
+func (r *JournalRequestRepository) Reserve(ctx context.Context, entityID, key, journalNumber string, request json.RawMessage, staleAfter time.Duration) (*JournalRequest, bool, error) {
+	query := `
+		INSERT INTO journal_requests (entity_id, idempotency_key, journal_number, request)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (entity_id, idempotency_key) DO UPDATE
+		SET journal_number = EXCLUDED.journal_number,
+		    request = EXCLUDED.request,
+		    updated_at = NOW()
+		WHERE journal_requests.journal_id IS NULL
+		  AND journal_requests.updated_at < NOW() - $5 * INTERVAL '1 millisecond'
+		RETURNING ` + journalRequestColumns
+
+	jr, err := scanJournalRequest(r.db.QueryRow(ctx, query, entityID, key, journalNumber, request, staleAfter.Milliseconds()))
+	if err == nil {
+		return jr, true, nil
+	}
+	if err != pgx.ErrNoRows {
+		return nil, false, errors.Wrap(err, errors.ErrCodeInternal, "failed to reserve journal request")
+	}
+
+	// Conflict left the existing row in place
+	jr, err = r.GetByKey(ctx, entityID, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return jr, false, nil
+}
+
+// GetByKey retrieves a journal request by idempotency key
+func (r *JournalRequestRepository) GetByKey(ctx context.Context, entityID, key string) (*JournalRequest, error) {
+	query := `SELECT ` + journalRequestColumns + `
+		FROM journal_requests
+		WHERE entity_id = $1 AND idempotency_key = $2
+	`
+
+	jr, err := scanJournalRequest(r.db.QueryRow(ctx, query, entityID, key))
+	if err == pgx.ErrNoRows {
+		return nil, errors.NotFound("journal_request", key)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get journal request")
+	}
+	return jr, nil
+}
+
+// GetByJournalID retrieves the journal request that created a GL-2 journal,
+// returning nil if the journal was not created through a keyed request
+func (r *JournalRequestRepository) GetByJournalID(ctx context.Context, entityID, journalID string) (*JournalRequest, error) {
+	query := `SELECT ` + journalRequestColumns + `
+		FROM journal_requests
+		WHERE entity_id = $1 AND journal_id = $2
+	`
+
+	jr, err := scanJournalRequest(r.db.QueryRow(ctx, query, entityID, journalID))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get journal request")
+	}
+	return jr, nil
+}
+
+// SetJournalID records the GL-2 journal created for a reserved request
+func (r *JournalRequestRepository) SetJournalID(ctx context.Context, id, journalID string) error {
+	tag, err := r.db.Exec(ctx,
+		`UPDATE journal_requests SET journal_id = $2 WHERE id = $1`,
+		id, journalID)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to record journal request")
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.NotFound("journal_request", id)
+	}
+	return nil
+}
+
+// MarkPosted records that GL-2 has posted the journal
+func (r *JournalRequestRepository) MarkPosted(ctx context.Context, id string) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE journal_requests SET posted_at = NOW() WHERE id = $1 AND posted_at IS NULL`,
+		id)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to mark journal request posted")
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// PaymentTerms are payment terms configured for an entity
+type PaymentTerms struct {
+	ID              string             `json:"id"`
+	EntityID        string             `json:"entity_id"`
+	Code            string             `json:"code"`
+	Description     *string            `json:"description,omitempty"`
+	TermType        string             `json:"term_type"` // net, eom, day_of_month or installment
+	NetDays         int                `json:"net_days"`
+	DayOfMonth      *int               `json:"day_of_month,omitempty"`
+	CutoffDay       *int               `json:"cutoff_day,omitempty"`
+	Installments    []*InstallmentTerm `json:"installments,omitempty"`
+	DiscountPercent decimal.Decimal    `json:"discount_percent"`
+	DiscountDays    *int               `json:"discount_days,omitempty"`
+	IsActive        bool               `json:"is_active"`
+	CreatedBy       *string            `json:"created_by,omitempty"`
+	CreatedAt       time.Time          `json:"created_at"`
+	UpdatedBy       *string            `json:"updated_by,omitempty"`
+	UpdatedAt       time.Time          `json:"updated_at"`
+}
+
+// InstallmentTerm is one part of installment payment terms
+type InstallmentTerm struct {
+	Percent decimal.Decimal `json:"percent"` // of the invoice total
+	NetDays int             `json:"net_days"`
+}
+
+// PaymentTermsRepository handles payment terms data operations
+type PaymentTermsRepository struct {
+	db *database.DB
+}
+
+// NewPaymentTermsRepository creates a new payment terms repository
+func NewPaymentTermsRepository(db *database.DB) *PaymentTermsRepository {
+	return &PaymentTermsRepository{db: db}
+}
+
+// paymentTermsColumns is the column list read by scanPaymentTerms
+const paymentTermsColumns = `
+	id, entity_id, code, description, term_type, net_days, day_of_month, cutoff_day,
+	installments, discount_percent, discount_days,
+	is_active, created_by, created_at, updated_by, updated_at
+`
+
+// scanPaymentTerms scans a row selected with paymentTermsColumns
+func scanPaymentTerms(row pgx.Row) (*PaymentTerms, error) {
+	terms := &PaymentTerms{}
+	err := row.Scan(
+		&terms.ID,
+		&terms.EntityID,
+		&terms.Code,
+		&terms.Description,
+		&terms.TermType,
+		&terms.NetDays,
+		&terms.DayOfMonth,
+		&terms.CutoffDay,
+		&terms.Installments,
+		&terms.DiscountPercent,
+		&terms.DiscountDays,
+		&terms.IsActive,
+		&terms.CreatedBy,
+		&terms.CreatedAt,
+		&terms.UpdatedBy,
+		&terms.UpdatedAt,
+	)
+	return terms, err
+}
+
+// GetByCode retrieves payment terms of an entity by code, returning nil if
+// they do not exist
+func (r *PaymentTermsRepository) GetByCode(ctx context.Context, entityID, code string) (*PaymentTerms, error) {
+	query := `SELECT ` + paymentTermsColumns + ` FROM ap_payment_terms WHERE entity_id = $1 AND code = $2`
+
+	terms, err := scanPaymentTerms(r.db.QueryRow(ctx, query, entityID, code))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get payment terms")
+	}
+
+	return terms, nil
+}
+
+// List retrieves all payment terms of an entity, ordered by code
+func (r *PaymentTermsRepository) List(ctx context.Context, entityID string) ([]*PaymentTerms, error) {
+	query := `SELECT ` + paymentTermsColumns + ` FROM ap_payment_terms WHERE entity_id = $1 ORDER BY code`
+
+	rows, err := r.db.Query(ctx, query, entityID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list payment terms")
+	}
+	defer rows.Close()
+
+	list := make([]*PaymentTerms, 0)
+	for rows.Next() {
+		terms, err := scanPaymentTerms(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan payment terms")
+		}
+		list = append(list, terms)
+	}
+
+	return list, nil
+}
+
+// Upsert creates or replaces payment terms, keyed by entity and code
+func (r *PaymentTermsRepository) Upsert(ctx context.Context, terms *PaymentTerms) error {
+	query := `
+		INSERT INTO ap_payment_terms (entity_id, code, description, term_type, net_days,
+		                              day_of_month, cutoff_day, installments, discount_percent,
+		                              discount_days, is_active, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12)
+		ON CONFLICT (entity_id, code) DO UPDATE
+		SET description = EXCLUDED.description,
+		    term_type = EXCLUDED.term_type,
+		    net_days = EXCLUDED.net_days,
+		    day_of_month = EXCLUDED.day_of_month,
+		    cutoff_day = EXCLUDED.cutoff_day,
+		    installments = EXCLUDED.installments,
+		    discount_percent = EXCLUDED.discount_percent,
+		    discount_days = EXCLUDED.discount_days,
+		    is_active = EXCLUDED.is_active,
+		    updated_by = EXCLUDED.updated_by,
+		    updated_at = NOW()
+		RETURNING id, created_by, created_at, updated_by, updated_at
+	`
+
+	// A nil slice is stored as NULL rather than a JSON null
+	var installments interface{}
+	if terms.Installments != nil {
+		installments = terms.Installments
+	}
+
+	err := r.db.QueryRow(ctx, query,
+		terms.EntityID,
+		terms.Code,
+		terms.Description,
+		terms.TermType,
+		terms.NetDays,
+		terms.DayOfMonth,
+		terms.CutoffDay,
+		installments,
+		terms.DiscountPercent,
+		terms.DiscountDays,
+		terms.IsActive,
+		terms.UpdatedBy,
+	).Scan(&terms.ID, &terms.CreatedBy, &terms.CreatedAt, &terms.UpdatedBy, &terms.UpdatedAt)
+
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to save payment terms")
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// PostingOutboxEntry is the durable state of one GL posting saga. Step is the
+// next step to run; JournalPosted and VendorBalanceApplied record which side
+// effects have been applied so retries and compensation neither repeat nor
+// miss one. An entry read from the repository remembers the lease it was read
+// with, and is only saved or finished while the stored lease is still that
+// one, so a dispatcher whose lease ran out cannot overwrite the progress of
+// the one that took the entry over.
+type PostingOutboxEntry struct {
+	ID                   string
+	InvoiceID            string
+	EntityID             string
+	Status               string
+	Step                 string
+	JournalID            *string
+	JournalPosted        bool
+	VendorBalanceApplied bool
+	ReversalJournalID    *string
+	Attempts             int
+	MaxAttempts          int
+	NextAttemptAt        time.Time
+	LockedUntil          *time.Time
+	LastError            *string
+	PostedBy             *string
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+	CompletedAt          *time.Time
+
+	lease *time.Time // locked_until as last read or written by this process
+}
+
+// PostingOutboxRepository reads and advances GL posting outbox entries.
+// Entries are created and finished together with the invoice they post, see
+// InvoiceRepository.QueuePosting, CompletePosting and FailPosting.
+type PostingOutboxRepository struct {
+	db *database.DB
+}
+
+// NewPostingOutboxRepository creates a new posting outbox repository
+func NewPostingOutboxRepository(db *database.DB) *PostingOutboxRepository {
+	return &PostingOutboxRepository{db: db}
+}
+
+// postingOutboxColumns is the column list read by scanPostingOutboxEntry
+const postingOutboxColumns = `
+	id, invoice_id, entity_id, status, step,
+	journal_id, journal_posted, vendor_balance_applied, reversal_journal_id,
+	attempts, max_attempts, next_attempt_at, locked_until, last_error,
+	posted_by, created_at, updated_at, completed_at
+`
+
+// scanPostingOutboxEntry scans a row selected with postingOutboxColumns
+func scanPostingOutboxEntry(row pgx.Row) (*PostingOutboxEntry, error) {
+	e := &PostingOutboxEntry{}
+	err := row.Scan(
+		&e.ID,
+		&e.InvoiceID,
+		&e.EntityID,
+		&e.Status,
+		&e.Step,
+		&e.JournalID,
+		&e.JournalPosted,
+		&e.VendorBalanceApplied,
+		&e.ReversalJournalID,
+		&e.Attempts,
+		&e.MaxAttempts,
+		&e.NextAttemptAt,
+		&e.LockedUntil,
+		&e.LastError,
+		&e.PostedBy,
+		&e.CreatedAt,
+		&e.UpdatedAt,
+		&e.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	e.lease = e.LockedUntil
+	return e, nil
+}
+
+// Claim leases up to limit unfinished entries that are due for an attempt.
+// Rows already leased by another dispatcher are skipped, so several service
+// instances can dispatch concurrently without driving the same posting.
+func (r *PostingOutboxRepository) Claim(ctx context.Context, limit int, lease time.Duration) ([]*PostingOutboxEntry, error) {
+	query := `
+		UPDATE invoice_posting_outbox
+		SET locked_until = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id
+			FROM invoice_posting_outbox
+			WHERE status IN ('pending', 'compensating')
+			  AND next_attempt_at <= NOW()
+			  AND (locked_until IS NULL OR locked_until < NOW())
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + postingOutboxColumns
+
+	rows, err := r.db.Query(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to claim posting outbox entries")
+	}
+	defer rows.Close()
+
+	entries := make([]*PostingOutboxEntry, 0)
+	for rows.Next() {
+		e, err := scanPostingOutboxEntry(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan posting outbox entry")
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Save persists the progress of an unfinished entry. It fails with a
+// conflict if the entry is finished or its lease has passed to another
+// dispatcher.
+func (r *PostingOutboxRepository) Save(ctx context.Context, entry *PostingOutboxEntry) error {
+	query := `
+		UPDATE invoice_posting_outbox
+		SET status = $2::posting_outbox_status,
+		    step = $3,
+		    journal_id = $4,
+		    journal_posted = $5,
+		    vendor_balance_applied = $6,
+		    reversal_journal_id = $7,
+		    attempts = $8,
+		    next_attempt_at = $9,
+		    locked_until = $10,
+		    last_error = $11
+		WHERE id = $1 AND status IN ('pending', 'compensating')
+		  AND locked_until IS NOT DISTINCT FROM $12
+	`
+
+	tag, err := r.db.Exec(ctx, query,
+		entry.ID,
+		entry.Status,
+		entry.Step,
+		entry.JournalID,
+		entry.JournalPosted,
+		entry.VendorBalanceApplied,
+		entry.ReversalJournalID,
+		entry.Attempts,
+		entry.NextAttemptAt,
+		entry.LockedUntil,
+		entry.LastError,
+		entry.lease,
+	)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to save posting outbox entry")
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New(errors.ErrCodeConflict, "posting outbox entry is finished or leased by another dispatcher")
+	}
+
+	entry.lease = entry.LockedUntil
+	return nil
+}
+
+// insertPostingOutboxEntry inserts a new entry within a transaction
+func insertPostingOutboxEntry(ctx context.Context, tx pgx.Tx, entry *PostingOutboxEntry) error {
+	query := `
+		INSERT INTO invoice_posting_outbox
+		    (invoice_id, entity_id, max_attempts, locked_until, posted_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + postingOutboxColumns
+
+	e, err := scanPostingOutboxEntry(tx.QueryRow(ctx, query,
+		entry.InvoiceID,
+		entry.EntityID,
+		entry.MaxAttempts,
+		entry.LockedUntil,
+		entry.PostedBy,
+	))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to create posting outbox entry")
+	}
+
+	*entry = *e
+	return nil
+}
+
+// finishPostingOutboxEntry closes an entry as completed or failed within a
+// transaction, releasing its lease. It fails with a conflict if the entry is
+// already finished or its lease has passed to another dispatcher.
+func finishPostingOutboxEntry(ctx context.Context, tx pgx.Tx, entry *PostingOutboxEntry, status string) error {
+	query := `
+		UPDATE invoice_posting_outbox
+		SET status = $2::posting_outbox_status,
+		    step = $3,
+		    journal_id = $4,
+		    journal_posted = $5,
+		    vendor_balance_applied = $6,
+		    reversal_journal_id = $7,
+		    last_error = $8,
+		    locked_until = NULL,
+		    completed_at = NOW()
+		WHERE id = $1 AND status IN ('pending', 'compensating')
+		  AND locked_until IS NOT DISTINCT FROM $9
+		RETURNING completed_at
+	`
+
+	err := tx.QueryRow(ctx, query,
+		entry.ID,
+		status,
+		entry.Step,
+		entry.JournalID,
+		entry.JournalPosted,
+		entry.VendorBalanceApplied,
+		entry.ReversalJournalID,
+		entry.LastError,
+		entry.lease,
+	).Scan(&entry.CompletedAt)
+
+	if err == pgx.ErrNoRows {
+		return errors.New(errors.ErrCodeConflict, "posting outbox entry is finished or leased by another dispatcher")
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to finish posting outbox entry")
+	}
+
+	entry.Status = status
+	entry.LockedUntil = nil
+	entry.lease = nil
+	return nil
+}
@@ -0,0 +1,191 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// PurchaseOrder is a purchase order held in the local stand-in tables
+type PurchaseOrder struct {
+	ID        string               `json:"id"`
+	EntityID  string               `json:"entity_id"`
+	PONumber  string               `json:"po_number"`
+	VendorID  string               `json:"vendor_id"`
+	Currency  string               `json:"currency"`
+	Status    string               `json:"status"` // open, closed or cancelled
+	OrderDate time.Time            `json:"order_date"`
+	CreatedBy *string              `json:"created_by,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedBy *string              `json:"updated_by,omitempty"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	Lines     []*PurchaseOrderLine `json:"lines"`
+}
+
+// PurchaseOrderLine is one ordered item of a stand-in purchase order
+type PurchaseOrderLine struct {
+	ID               string          `json:"id"`
+	PurchaseOrderID  string          `json:"purchase_order_id"`
+	LineNumber       int             `json:"line_number"`
+	ItemCode         *string         `json:"item_code,omitempty"`
+	Description      string          `json:"description"`
+	Quantity         decimal.Decimal `json:"quantity"`
+	UnitPrice        int64           `json:"unit_price"` // minor units of the PO currency
+	QuantityReceived decimal.Decimal `json:"quantity_received"`
+}
+
+// PurchaseOrderRepository handles stand-in purchase order data operations
+type PurchaseOrderRepository struct {
+	db *database.DB
+}
+
+// NewPurchaseOrderRepository creates a new purchase order repository
+func NewPurchaseOrderRepository(db *database.DB) *PurchaseOrderRepository {
+	return &PurchaseOrderRepository{db: db}
+}
+
+// GetByNumber retrieves a purchase order of an entity with its lines,
+// returning nil if it does not exist
+func (r *PurchaseOrderRepository) GetByNumber(ctx context.Context, entityID, poNumber string) (*PurchaseOrder, error) {
+	query := `
+		SELECT id, entity_id, po_number, vendor_id, currency, status, order_date,
+		       created_by, created_at, updated_by, updated_at
+		FROM ap_purchase_orders
+		WHERE entity_id = $1 AND po_number = $2
+	`
+
+	po := &PurchaseOrder{}
+	err := r.db.QueryRow(ctx, query, entityID, poNumber).Scan(
+		&po.ID,
+		&po.EntityID,
+		&po.PONumber,
+		&po.VendorID,
+		&po.Currency,
+		&po.Status,
+		&po.OrderDate,
+		&po.CreatedBy,
+		&po.CreatedAt,
+		&po.UpdatedBy,
+		&po.UpdatedAt,
+	)
+
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get purchase order")
+	}
+
+	po.Lines, err = r.getLines(ctx, po.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return po, nil
+}
+
+// getLines retrieves the lines of a purchase order in line number order
+func (r *PurchaseOrderRepository) getLines(ctx context.Context, purchaseOrderID string) ([]*PurchaseOrderLine, error) {
+	query := `
+		SELECT id, purchase_order_id, line_number, item_code, description,
+		       quantity, unit_price, quantity_received
+		FROM ap_purchase_order_lines
+		WHERE purchase_order_id = $1
+		ORDER BY line_number
+	`
+
+	rows, err := r.db.Query(ctx, query, purchaseOrderID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get purchase order lines")
+	}
+	defer rows.Close()
+
+	lines := make([]*PurchaseOrderLine, 0)
+	for rows.Next() {
+		line := &PurchaseOrderLine{}
+		err := rows.Scan(
+			&line.ID,
+			&line.PurchaseOrderID,
+			&line.LineNumber,
+			&line.ItemCode,
+			&line.Description,
+			&line.Quantity,
+			&line.UnitPrice,
+			&line.QuantityReceived,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan purchase order line")
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// Upsert creates or replaces a purchase order, keyed by entity and PO
+// number, together with all of its lines
+func (r *PurchaseOrderRepository) Upsert(ctx context.Context, po *PurchaseOrder) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			INSERT INTO ap_purchase_orders (entity_id, po_number, vendor_id, currency, status,
+			                                order_date, created_by, updated_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+			ON CONFLICT (entity_id, po_number) DO UPDATE
+			SET vendor_id = EXCLUDED.vendor_id,
+			    currency = EXCLUDED.currency,
+			    status = EXCLUDED.status,
+			    order_date = EXCLUDED.order_date,
+			    updated_by = EXCLUDED.updated_by,
+			    updated_at = NOW()
+			RETURNING id, created_by, created_at, updated_by, updated_at
+		`
+
+		err := tx.QueryRow(ctx, query,
+			po.EntityID,
+			po.PONumber,
+			po.VendorID,
+			po.Currency,
+			po.Status,
+			po.OrderDate,
+			po.UpdatedBy,
+		).Scan(&po.ID, &po.CreatedBy, &po.CreatedAt, &po.UpdatedBy, &po.UpdatedAt)
+
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to save purchase order")
+		}
+
+		if _, err := tx.Exec(ctx, `DELETE FROM ap_purchase_order_lines WHERE purchase_order_id = $1`, po.ID); err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to replace purchase order lines")
+		}
+
+		lineQuery := `
+			INSERT INTO ap_purchase_order_lines (purchase_order_id, line_number, item_code, description,
+			                                     quantity, unit_price, quantity_received)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id
+		`
+
+		for _, line := range po.Lines {
+			line.PurchaseOrderID = po.ID
+			err := tx.QueryRow(ctx, lineQuery,
+				line.PurchaseOrderID,
+				line.LineNumber,
+				line.ItemCode,
+				line.Description,
+				line.Quantity,
+				line.UnitPrice,
+				line.QuantityReceived,
+			).Scan(&line.ID)
+
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to save purchase order line")
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,353 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// GoodsReceipt records goods received against a purchase order, or a return
+// of goods from an earlier receipt
+type GoodsReceipt struct {
+	ID            string              `json:"id"`
+	EntityID      string              `json:"entity_id"`
+	ReceiptNumber string              `json:"receipt_number"`
+	ReceiptType   string              `json:"receipt_type"` // receipt or return
+	PONumber      string              `json:"po_number"`
+	VendorID      string              `json:"vendor_id"`
+	ReceiptDate   time.Time           `json:"receipt_date"`
+	ReturnOfID    *string             `json:"return_of_id,omitempty"` // returns only
+	Notes         *string             `json:"notes,omitempty"`
+	CreatedBy     *string             `json:"created_by,omitempty"`
+	CreatedAt     time.Time           `json:"created_at"`
+	Lines         []*GoodsReceiptLine `json:"lines"`
+}
+
+// GoodsReceiptLine is the quantity of one PO line received or returned
+type GoodsReceiptLine struct {
+	ID           string          `json:"id"`
+	ReceiptID    string          `json:"receipt_id"`
+	LineNumber   int             `json:"line_number"`
+	POLineNumber int             `json:"po_line_number"`
+	ItemCode     *string         `json:"item_code,omitempty"`
+	Description  string          `json:"description"`
+	Quantity     decimal.Decimal `json:"quantity"` // always positive
+}
+
+// UninvoicedReceipt is the quantity received on a PO line that submitted
+// invoices have not yet billed
+type UninvoicedReceipt struct {
+	PONumber           string          `json:"po_number"`
+	POLineNumber       int             `json:"po_line_number"`
+	ItemCode           *string         `json:"item_code,omitempty"`
+	Description        string          `json:"description"`
+	ReceivedQuantity   decimal.Decimal `json:"received_quantity"` // net of returns
+	InvoicedQuantity   decimal.Decimal `json:"invoiced_quantity"`
+	UninvoicedQuantity decimal.Decimal `json:"uninvoiced_quantity"`
+	FirstReceiptDate   time.Time       `json:"first_receipt_date"`
+	LastReceiptDate    time.Time       `json:"last_receipt_date"`
+}
+
+// ReceiptRepository handles goods receipt data operations
+type ReceiptRepository struct {
+	db *database.DB
+}
+
+// NewReceiptRepository creates a new receipt repository
+func NewReceiptRepository(db *database.DB) *ReceiptRepository {
+	return &ReceiptRepository{db: db}
+}
+
+// goodsReceiptColumns is the column list read by scanGoodsReceipt
+const goodsReceiptColumns = `
+	id, entity_id, receipt_number, receipt_type, po_number, vendor_id, receipt_date,
+	return_of_id, notes, created_by, created_at
+`
+
+// scanGoodsReceipt scans a row selected with goodsReceiptColumns
+func scanGoodsReceipt(row pgx.Row) (*GoodsReceipt, error) {
+	receipt := &GoodsReceipt{}
+	err := row.Scan(
+		&receipt.ID,
+		&receipt.EntityID,
+		&receipt.ReceiptNumber,
+		&receipt.ReceiptType,
+		&receipt.PONumber,
+		&receipt.VendorID,
+		&receipt.ReceiptDate,
+		&receipt.ReturnOfID,
+		&receipt.Notes,
+		&receipt.CreatedBy,
+		&receipt.CreatedAt,
+	)
+	return receipt, err
+}
+
+// Create inserts a receipt or return and its lines in one transaction. It
+// fails with a conflict if the entity already has the receipt number.
+func (r *ReceiptRepository) Create(ctx context.Context, receipt *GoodsReceipt) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			INSERT INTO ap_goods_receipts (entity_id, receipt_number, receipt_type, po_number, vendor_id,
+			                               receipt_date, return_of_id, notes, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (entity_id, receipt_number) DO NOTHING
+			RETURNING id, created_at
+		`
+
+		err := tx.QueryRow(ctx, query,
+			receipt.EntityID,
+			receipt.ReceiptNumber,
+			receipt.ReceiptType,
+			receipt.PONumber,
+			receipt.VendorID,
+			receipt.ReceiptDate,
+			receipt.ReturnOfID,
+			receipt.Notes,
+			receipt.CreatedBy,
+		).Scan(&receipt.ID, &receipt.CreatedAt)
+
+		if err == pgx.ErrNoRows {
+			return errors.New(errors.ErrCodeConflict, fmt.Sprintf("receipt number %s already exists", receipt.ReceiptNumber))
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to create goods receipt")
+		}
+
+		lineQuery := `
+			INSERT INTO ap_goods_receipt_lines (receipt_id, line_number, po_line_number, item_code,
+			                                    description, quantity)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id
+		`
+
+		for _, line := range receipt.Lines {
+			line.ReceiptID = receipt.ID
+			err := tx.QueryRow(ctx, lineQuery,
+				line.ReceiptID,
+				line.LineNumber,
+				line.POLineNumber,
+				line.ItemCode,
+				line.Description,
+				line.Quantity,
+			).Scan(&line.ID)
+
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to create goods receipt line")
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetByID retrieves a receipt or return with its lines
+func (r *ReceiptRepository) GetByID(ctx context.Context, id, entityID string) (*GoodsReceipt, error) {
+	query := `SELECT ` + goodsReceiptColumns + `
+		FROM ap_goods_receipts
+		WHERE id = $1 AND entity_id = $2
+	`
+
+	receipt, err := scanGoodsReceipt(r.db.QueryRow(ctx, query, id, entityID))
+	if err == pgx.ErrNoRows {
+		return nil, errors.NotFound("goods_receipt", id)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get goods receipt")
+	}
+
+	receipt.Lines, err = r.getLines(ctx, receipt.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+// ListByPO retrieves the receipts and returns of a purchase order with
+// their lines, in the order they happened
+func (r *ReceiptRepository) ListByPO(ctx context.Context, entityID, poNumber string) ([]*GoodsReceipt, error) {
+	query := `SELECT ` + goodsReceiptColumns + `
+		FROM ap_goods_receipts
+		WHERE entity_id = $1 AND po_number = $2
+		ORDER BY receipt_date, created_at
+	`
+
+	rows, err := r.db.Query(ctx, query, entityID, poNumber)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list goods receipts")
+	}
+	defer rows.Close()
+
+	receipts := make([]*GoodsReceipt, 0)
+	for rows.Next() {
+		receipt, err := scanGoodsReceipt(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan goods receipt")
+		}
+		receipts = append(receipts, receipt)
+	}
+	rows.Close()
+
+	for _, receipt := range receipts {
+		receipt.Lines, err = r.getLines(ctx, receipt.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return receipts, nil
+}
+
+// getLines retrieves the lines of a receipt in line number order
+func (r *ReceiptRepository) getLines(ctx context.Context, receiptID string) ([]*GoodsReceiptLine, error) {
+	query := `
+		SELECT id, receipt_id, line_number, po_line_number, item_code, description, quantity
+		FROM ap_goods_receipt_lines
+		WHERE receipt_id = $1
+		ORDER BY line_number
+	`
+
+	rows, err := r.db.Query(ctx, query, receiptID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get goods receipt lines")
+	}
+	defer rows.Close()
+
+	lines := make([]*GoodsReceiptLine, 0)
+	for rows.Next() {
+		line := &GoodsReceiptLine{}
+		err := rows.Scan(
+			&line.ID,
+			&line.ReceiptID,
+			&line.LineNumber,
+			&line.POLineNumber,
+			&line.ItemCode,
+			&line.Description,
+			&line.Quantity,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan goods receipt line")
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// ReceivedQuantities returns the net quantity received on each line of a
+// purchase order, receipts less returns, keyed by PO line number. The map
+// is empty if no receipt of the PO is recorded.
+func (r *ReceiptRepository) ReceivedQuantities(ctx context.Context, entityID, poNumber string) (map[int]decimal.Decimal, error) {
+	query := `
+		SELECT l.po_line_number,
+		       SUM(CASE WHEN g.receipt_type = 'return' THEN -l.quantity ELSE l.quantity END)
+		FROM ap_goods_receipts g
+		JOIN ap_goods_receipt_lines l ON l.receipt_id = g.id
+		WHERE g.entity_id = $1 AND g.po_number = $2
+		GROUP BY l.po_line_number
+	`
+
+	return r.quantities(ctx, "failed to get received quantities", query, entityID, poNumber)
+}
+
+// ReturnedQuantities returns the quantity of each PO line already returned
+// against a receipt, keyed by PO line number
+func (r *ReceiptRepository) ReturnedQuantities(ctx context.Context, receiptID string) (map[int]decimal.Decimal, error) {
+	query := `
+		SELECT l.po_line_number, SUM(l.quantity)
+		FROM ap_goods_receipts g
+		JOIN ap_goods_receipt_lines l ON l.receipt_id = g.id
+		WHERE g.return_of_id = $1
+		GROUP BY l.po_line_number
+	`
+
+	return r.quantities(ctx, "failed to get returned quantities", query, receiptID)
+}
+
+// quantities runs a query selecting PO line numbers and quantities and
+// returns them as a map
+func (r *ReceiptRepository) quantities(ctx context.Context, message, query string, args ...interface{}) (map[int]decimal.Decimal, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, message)
+	}
+	defer rows.Close()
+
+	quantities := make(map[int]decimal.Decimal)
+	for rows.Next() {
+		var lineNumber int
+		var quantity decimal.Decimal
+		if err := rows.Scan(&lineNumber, &quantity); err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, message)
+		}
+		quantities[lineNumber] = quantity
+	}
+
+	return quantities, nil
+}
+
+// ListUninvoiced retrieves the PO lines of a vendor with more received than
+// the vendor's submitted invoices have billed, oldest receipt first
+func (r *ReceiptRepository) ListUninvoiced(ctx context.Context, entityID, vendorID string) ([]*UninvoicedReceipt, error) {
+	query := `
+		WITH received AS (
+			SELECT g.po_number, l.po_line_number,
+			       MAX(l.item_code) AS item_code, MAX(l.description) AS description,
+			       SUM(CASE WHEN g.receipt_type = 'return' THEN -l.quantity ELSE l.quantity END) AS quantity,
+			       MIN(g.receipt_date) AS first_receipt_date, MAX(g.receipt_date) AS last_receipt_date
+			FROM ap_goods_receipts g
+			JOIN ap_goods_receipt_lines l ON l.receipt_id = g.id
+			WHERE g.entity_id = $1 AND g.vendor_id = $2
+			GROUP BY g.po_number, l.po_line_number
+		), invoiced AS (
+			SELECT m.po_number, m.po_line_number, SUM(m.quantity) AS quantity
+			FROM ap_invoice_line_matches m
+			JOIN invoices i ON i.id = m.invoice_id
+			WHERE m.entity_id = $1 AND i.vendor_id = $2
+			  AND m.po_line_number IS NOT NULL
+			  AND i.status NOT IN ('draft', 'cancelled')
+			GROUP BY m.po_number, m.po_line_number
+		)
+		SELECT rc.po_number, rc.po_line_number, rc.item_code, rc.description,
+		       rc.quantity, COALESCE(iv.quantity, 0), rc.quantity - COALESCE(iv.quantity, 0),
+		       rc.first_receipt_date, rc.last_receipt_date
+		FROM received rc
+		LEFT JOIN invoiced iv ON iv.po_number = rc.po_number AND iv.po_line_number = rc.po_line_number
+		WHERE rc.quantity > COALESCE(iv.quantity, 0)
+		ORDER BY rc.first_receipt_date, rc.po_number, rc.po_line_number
+	`
+
+	rows, err := r.db.Query(ctx, query, entityID, vendorID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list uninvoiced receipts")
+	}
+	defer rows.Close()
+
+	receipts := make([]*UninvoicedReceipt, 0)
+	for rows.Next() {
+		receipt := &UninvoicedReceipt{}
+		err := rows.Scan(
+			&receipt.PONumber,
+			&receipt.POLineNumber,
+			&receipt.ItemCode,
+			&receipt.Description,
+			&receipt.ReceivedQuantity,
+			&receipt.InvoicedQuantity,
+			&receipt.UninvoicedQuantity,
+			&receipt.FirstReceiptDate,
+			&receipt.LastReceiptDate,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan uninvoiced receipt")
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	return receipts, nil
+}
@@ -0,0 +1,440 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// RecurringTemplate is a vendor's regular charge and the schedule draft
+// invoices are generated from it on
+type RecurringTemplate struct {
+	ID               string                   `json:"id"`
+	EntityID         string                   `json:"entity_id"`
+	VendorID         string                   `json:"vendor_id"`
+	Name             string                   `json:"name"`
+	NumberPrefix     string                   `json:"number_prefix"`
+	Currency         string                   `json:"currency"`
+	PaymentTerms     *string                  `json:"payment_terms,omitempty"`
+	DueDays          *int                     `json:"due_days,omitempty"` // nil when the payment terms set the due date
+	PricesIncludeTax bool                     `json:"prices_include_tax"`
+	Description      *string                  `json:"description,omitempty"`
+	Notes            *string                  `json:"notes,omitempty"`
+	Lines            []*RecurringTemplateLine `json:"lines"`
+	Frequency        string                   `json:"frequency"` // weekly, monthly, quarterly, annually or custom
+	CronExpression   *string                  `json:"cron_expression,omitempty"`
+	StartDate        time.Time                `json:"start_date"`
+	EndDate          *time.Time               `json:"end_date,omitempty"`
+	NextRunDate      *time.Time               `json:"next_run_date,omitempty"`
+	LastRunDate      *time.Time               `json:"last_run_date,omitempty"`
+	AutoSubmit       bool                     `json:"auto_submit"`
+	Status           string                   `json:"status"` // active, paused or ended
+	CreatedBy        *string                  `json:"created_by,omitempty"`
+	CreatedAt        time.Time                `json:"created_at"`
+	UpdatedBy        *string                  `json:"updated_by,omitempty"`
+	UpdatedAt        time.Time                `json:"updated_at"`
+	Occurrences      []*RecurringOccurrence   `json:"occurrences,omitempty"`
+}
+
+// RecurringTemplateLine is an invoice line copied onto each generated invoice
+type RecurringTemplateLine struct {
+	AccountID   string           `json:"account_id"`
+	Description string           `json:"description"`
+	Quantity    decimal.Decimal  `json:"quantity"`
+	UnitPrice   int64            `json:"unit_price"`
+	LineAmount  int64            `json:"line_amount"`
+	TaxCode     *string          `json:"tax_code,omitempty"`
+	TaxRate     *decimal.Decimal `json:"tax_rate,omitempty"`
+	TaxAmount   int64            `json:"tax_amount"`
+	Dimension1  *string          `json:"dimension1,omitempty"`
+	Dimension2  *string          `json:"dimension2,omitempty"`
+	Dimension3  *string          `json:"dimension3,omitempty"`
+	Dimension4  *string          `json:"dimension4,omitempty"`
+	ItemCode    *string          `json:"item_code,omitempty"`
+	ItemName    *string          `json:"item_name,omitempty"`
+}
+
+// RecurringOccurrence is one scheduled date of a template and the invoice
+// generated for it
+type RecurringOccurrence struct {
+	ID             string     `json:"id"`
+	TemplateID     string     `json:"template_id"`
+	EntityID       string     `json:"entity_id"`
+	OccurrenceDate time.Time  `json:"occurrence_date"`
+	Status         string     `json:"status"` // pending, generated, skipped or failed
+	InvoiceID      *string    `json:"invoice_id,omitempty"`
+	ErrorMessage   *string    `json:"error_message,omitempty"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"` // failed only; nil once out of attempts
+	CreatedBy      *string    `json:"created_by,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// RecurringTemplateRepository handles recurring template data operations
+type RecurringTemplateRepository struct {
+	db *database.DB
+}
+
+// NewRecurringTemplateRepository creates a new recurring template repository
+func NewRecurringTemplateRepository(db *database.DB) *RecurringTemplateRepository {
+	return &RecurringTemplateRepository{db: db}
+}
+
+// recurringTemplateColumns is the column list read by scanRecurringTemplate
+const recurringTemplateColumns = `
+	id, entity_id, vendor_id, name, number_prefix,
+	currency, payment_terms, due_days, prices_include_tax, description, notes, lines,
+	frequency, cron_expression, start_date, end_date, next_run_date, last_run_date,
+	auto_submit, status, created_by, created_at, updated_by, updated_at
+`
+
+// scanRecurringTemplate scans a row selected with recurringTemplateColumns
+func scanRecurringTemplate(row pgx.Row) (*RecurringTemplate, error) {
+	template := &RecurringTemplate{}
+	err := row.Scan(
+		&template.ID,
+		&template.EntityID,
+		&template.VendorID,
+		&template.Name,
+		&template.NumberPrefix,
+		&template.Currency,
+		&template.PaymentTerms,
+		&template.DueDays,
+		&template.PricesIncludeTax,
+		&template.Description,
+		&template.Notes,
+		&template.Lines,
+		&template.Frequency,
+		&template.CronExpression,
+		&template.StartDate,
+		&template.EndDate,
+		&template.NextRunDate,
+		&template.LastRunDate,
+		&template.AutoSubmit,
+		&template.Status,
+		&template.CreatedBy,
+		&template.CreatedAt,
+		&template.UpdatedBy,
+		&template.UpdatedAt,
+	)
+	return template, err
+}
+
+// Create inserts a new template
+func (r *RecurringTemplateRepository) Create(ctx context.Context, template *RecurringTemplate) error {
+	query := `
+		INSERT INTO ap_recurring_templates (entity_id, vendor_id, name, number_prefix,
+		                                    currency, payment_terms, due_days, prices_include_tax,
+		                                    description, notes, lines, frequency, cron_expression,
+		                                    start_date, end_date, next_run_date, auto_submit,
+		                                    status, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $19)
+		RETURNING id, created_at, updated_at
+	`
+
+	err := r.db.QueryRow(ctx, query,
+		template.EntityID,
+		template.VendorID,
+		template.Name,
+		template.NumberPrefix,
+		template.Currency,
+		template.PaymentTerms,
+		template.DueDays,
+		template.PricesIncludeTax,
+		template.Description,
+		template.Notes,
+		template.Lines,
+		template.Frequency,
+		template.CronExpression,
+		template.StartDate,
+		template.EndDate,
+		template.NextRunDate,
+		template.AutoSubmit,
+		template.Status,
+		template.CreatedBy,
+	).Scan(&template.ID, &template.CreatedAt, &template.UpdatedAt)
+
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to create recurring template")
+	}
+
+	template.UpdatedBy = template.CreatedBy
+	return nil
+}
+
+// GetByID retrieves a template with its occurrences, newest first
+func (r *RecurringTemplateRepository) GetByID(ctx context.Context, id, entityID string) (*RecurringTemplate, error) {
+	query := `SELECT ` + recurringTemplateColumns + `
+		FROM ap_recurring_templates
+		WHERE id = $1 AND entity_id = $2
+	`
+
+	template, err := scanRecurringTemplate(r.db.QueryRow(ctx, query, id, entityID))
+	if err == pgx.ErrNoRows {
+		return nil, errors.NotFound("recurring_template", id)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get recurring template")
+	}
+
+	template.Occurrences, err = r.getOccurrences(ctx, template.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// List retrieves the templates of an entity without their occurrences, by
+// name
+func (r *RecurringTemplateRepository) List(ctx context.Context, entityID string) ([]*RecurringTemplate, error) {
+	query := `SELECT ` + recurringTemplateColumns + `
+		FROM ap_recurring_templates
+		WHERE entity_id = $1
+		ORDER BY name, created_at
+	`
+
+	return r.queryTemplates(ctx, query, entityID)
+}
+
+// ListDue retrieves up to limit active templates of any entity with an
+// occurrence on or before asOf, the longest overdue first
+func (r *RecurringTemplateRepository) ListDue(ctx context.Context, asOf time.Time, limit int) ([]*RecurringTemplate, error) {
+	query := `SELECT ` + recurringTemplateColumns + `
+		FROM ap_recurring_templates
+		WHERE status = 'active' AND next_run_date <= $1
+		ORDER BY next_run_date, id
+		LIMIT $2
+	`
+
+	return r.queryTemplates(ctx, query, asOf, limit)
+}
+
+// queryTemplates runs a query selecting recurringTemplateColumns
+func (r *RecurringTemplateRepository) queryTemplates(ctx context.Context, query string, args ...interface{}) ([]*RecurringTemplate, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list recurring templates")
+	}
+	defer rows.Close()
+
+	templates := make([]*RecurringTemplate, 0)
+	for rows.Next() {
+		template, err := scanRecurringTemplate(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan recurring template")
+		}
+		templates = append(templates, template)
+	}
+
+	return templates, nil
+}
+
+// recurringOccurrenceColumns is the column list read by scanRecurringOccurrence
+const recurringOccurrenceColumns = `
+	id, template_id, entity_id, occurrence_date, status, invoice_id,
+	error_message, attempts, next_attempt_at, created_by, created_at, updated_at
+`
+
+// scanRecurringOccurrence scans a row selected with recurringOccurrenceColumns
+func scanRecurringOccurrence(row pgx.Row) (*RecurringOccurrence, error) {
+	occurrence := &RecurringOccurrence{}
+	err := row.Scan(
+		&occurrence.ID,
+		&occurrence.TemplateID,
+		&occurrence.EntityID,
+		&occurrence.OccurrenceDate,
+		&occurrence.Status,
+		&occurrence.InvoiceID,
+		&occurrence.ErrorMessage,
+		&occurrence.Attempts,
+		&occurrence.NextAttemptAt,
+		&occurrence.CreatedBy,
+		&occurrence.CreatedAt,
+		&occurrence.UpdatedAt,
+	)
+	return occurrence, err
+}
+
+// getOccurrences retrieves the occurrences of a template, newest first
+func (r *RecurringTemplateRepository) getOccurrences(ctx context.Context, templateID string) ([]*RecurringOccurrence, error) {
+	query := `SELECT ` + recurringOccurrenceColumns + `
+		FROM ap_recurring_occurrences
+		WHERE template_id = $1
+		ORDER BY occurrence_date DESC
+	`
+
+	return r.queryOccurrences(ctx, query, templateID)
+}
+
+// ListRetryable retrieves up to limit occurrences of templates that are not
+// paused that should be generated again: pending ones idle since before
+// staleBefore, whose scheduler is presumed to have stopped, and failed ones
+// whose next attempt has come. The oldest occurrence comes first.
+func (r *RecurringTemplateRepository) ListRetryable(ctx context.Context, staleBefore time.Time, limit int) ([]*RecurringOccurrence, error) {
+	query := `SELECT ` + recurringOccurrenceColumns + `
+		FROM ap_recurring_occurrences
+		WHERE ((status = 'pending' AND updated_at < $1)
+		    OR (status = 'failed' AND next_attempt_at <= NOW()))
+		  AND template_id IN (SELECT id FROM ap_recurring_templates WHERE status <> 'paused')
+		ORDER BY occurrence_date, id
+		LIMIT $2
+	`
+
+	return r.queryOccurrences(ctx, query, staleBefore, limit)
+}
+
+// queryOccurrences runs a query selecting recurringOccurrenceColumns
+func (r *RecurringTemplateRepository) queryOccurrences(ctx context.Context, query string, args ...interface{}) ([]*RecurringOccurrence, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get recurring occurrences")
+	}
+	defer rows.Close()
+
+	occurrences := make([]*RecurringOccurrence, 0)
+	for rows.Next() {
+		occurrence, err := scanRecurringOccurrence(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan recurring occurrence")
+		}
+		occurrences = append(occurrences, occurrence)
+	}
+
+	return occurrences, nil
+}
+
+// ClaimOccurrence records the template's next occurrence and moves the
+// schedule on to next, or ends it when next is nil, in one transaction. The
+// claim only succeeds while the template is still in its expected status
+// and the occurrence is still its next one, so a date is claimed once even
+// by concurrent schedulers; it returns false if the template has moved on.
+func (r *RecurringTemplateRepository) ClaimOccurrence(ctx context.Context, template *RecurringTemplate, occurrence *RecurringOccurrence, next *time.Time) (bool, error) {
+	claimed := false
+
+	err := r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		query := `
+			UPDATE ap_recurring_templates
+			SET next_run_date = $4,
+			    last_run_date = $3,
+			    status = CASE WHEN $4::date IS NULL THEN 'ended' ELSE status END,
+			    updated_by = $5
+			WHERE id = $1 AND status = $2 AND next_run_date = $3
+			RETURNING status, next_run_date, last_run_date, updated_by, updated_at
+		`
+
+		err := tx.QueryRow(ctx, query,
+			template.ID,
+			template.Status,
+			occurrence.OccurrenceDate,
+			next,
+			occurrence.CreatedBy,
+		).Scan(&template.Status, &template.NextRunDate, &template.LastRunDate, &template.UpdatedBy, &template.UpdatedAt)
+
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to advance recurring template")
+		}
+
+		occurrenceQuery := `
+			INSERT INTO ap_recurring_occurrences (template_id, entity_id, occurrence_date,
+			                                      status, attempts, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at, updated_at
+		`
+
+		err = tx.QueryRow(ctx, occurrenceQuery,
+			template.ID,
+			template.EntityID,
+			occurrence.OccurrenceDate,
+			occurrence.Status,
+			occurrence.Attempts,
+			occurrence.CreatedBy,
+		).Scan(&occurrence.ID, &occurrence.CreatedAt, &occurrence.UpdatedAt)
+
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to record recurring occurrence")
+		}
+
+		occurrence.TemplateID = template.ID
+		occurrence.EntityID = template.EntityID
+		claimed = true
+		return nil
+	})
+
+	return claimed, err
+}
+
+// ReclaimOccurrence claims an occurrence listed by ListRetryable for
+// another attempt, marking it pending and counting the attempt. The claim
+// only succeeds while the occurrence is still retryable, so concurrent
+// schedulers retry it once; it returns false if another has claimed it.
+func (r *RecurringTemplateRepository) ReclaimOccurrence(ctx context.Context, occurrence *RecurringOccurrence, staleBefore time.Time) (bool, error) {
+	query := `
+		UPDATE ap_recurring_occurrences
+		SET status = 'pending', attempts = attempts + 1, next_attempt_at = NULL
+		WHERE id = $1
+		  AND ((status = 'pending' AND updated_at < $2)
+		    OR (status = 'failed' AND next_attempt_at <= NOW()))
+		RETURNING status, attempts, next_attempt_at, updated_at
+	`
+
+	err := r.db.QueryRow(ctx, query, occurrence.ID, staleBefore).
+		Scan(&occurrence.Status, &occurrence.Attempts, &occurrence.NextAttemptAt, &occurrence.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, errors.ErrCodeInternal, "failed to reclaim recurring occurrence")
+	}
+	return true, nil
+}
+
+// CompleteOccurrence records the outcome of a claimed occurrence: its
+// status, the invoice generated, any error and, for a failed occurrence,
+// when it is retried
+func (r *RecurringTemplateRepository) CompleteOccurrence(ctx context.Context, occurrence *RecurringOccurrence) error {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE ap_recurring_occurrences
+		SET status = $2, invoice_id = $3, error_message = $4, next_attempt_at = $5
+		WHERE id = $1
+	`, occurrence.ID, occurrence.Status, occurrence.InvoiceID, occurrence.ErrorMessage, occurrence.NextAttemptAt)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to complete recurring occurrence")
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.NotFound("recurring_occurrence", occurrence.ID)
+	}
+	return nil
+}
+
+// SetStatus moves a template from one status to another with its next
+// occurrence, ending it instead when next is nil. It returns a conflict if
+// the template is no longer in the from status.
+func (r *RecurringTemplateRepository) SetStatus(ctx context.Context, template *RecurringTemplate, from, to string, next *time.Time, updatedBy *string) error {
+	query := `
+		UPDATE ap_recurring_templates
+		SET status = CASE WHEN $4::date IS NULL THEN 'ended' ELSE $3 END,
+		    next_run_date = $4,
+		    updated_by = $5
+		WHERE id = $1 AND status = $2
+		RETURNING status, next_run_date, updated_by, updated_at
+	`
+
+	err := r.db.QueryRow(ctx, query, template.ID, from, to, next, updatedBy).
+		Scan(&template.Status, &template.NextRunDate, &template.UpdatedBy, &template.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return errors.New(errors.ErrCodeConflict, "recurring template status has changed")
+	}
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to update recurring template status")
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// SplitInvoiceFinding records an invoice whose total combined with the same
+// vendor's other invoices crosses an approval threshold none of them
+// reaches alone
+type SplitInvoiceFinding struct {
+	ID                    string     `json:"id"`
+	EntityID              string     `json:"entity_id"`
+	InvoiceID             string     `json:"invoice_id"`
+	InvoiceNumber         string     `json:"invoice_number"`
+	VendorID              string     `json:"vendor_id"`
+	Currency              string     `json:"currency"`
+	RelatedInvoiceIDs     []string   `json:"related_invoice_ids"`
+	RelatedInvoiceNumbers []string   `json:"related_invoice_numbers"`
+	CombinedTotal         int64      `json:"combined_total"`
+	Threshold             int64      `json:"threshold"` // the approval rule min_amount crossed
+	EscalatedRuleID       *string    `json:"escalated_rule_id,omitempty"`
+	EscalatedRuleName     string     `json:"escalated_rule_name"` // the rule the combined total routes to
+	WindowStart           time.Time  `json:"window_start"`
+	WindowEnd             time.Time  `json:"window_end"`
+	Action                string     `json:"action"` // held or escalated; a confirmed hold becomes escalated
+	Status                string     `json:"status"` // open, cleared or confirmed
+	DetectedAt            time.Time  `json:"detected_at"`
+	ReviewedBy            *string    `json:"reviewed_by,omitempty"`
+	ReviewedAt            *time.Time `json:"reviewed_at,omitempty"`
+	ReviewNotes           *string    `json:"review_notes,omitempty"`
+}
+
+// SplitInvoiceMember is one of a vendor's invoices considered for a split
+type SplitInvoiceMember struct {
+	InvoiceID     string
+	InvoiceNumber string
+	InvoiceDate   time.Time
+	TotalAmount   int64
+}
+
+// SplitInvoiceSearch describes the vendor invoices to combine with one
+// being submitted
+type SplitInvoiceSearch struct {
+	EntityID  string
+	ExcludeID string // the invoice being submitted
+	VendorID  string
+	Currency  string
+	DateFrom  time.Time
+	DateTo    time.Time
+}
+
+// SplitFindingFilter narrows a list of an entity's findings. Nil fields
+// match all.
+type SplitFindingFilter struct {
+	Status   *string
+	VendorID *string
+}
+
+// SplitInvoiceRepository handles split invoice detection data operations
+type SplitInvoiceRepository struct {
+	db *database.DB
+}
+
+// NewSplitInvoiceRepository creates a new split invoice repository
+func NewSplitInvoiceRepository(db *database.DB) *SplitInvoiceRepository {
+	return &SplitInvoiceRepository{db: db}
+}
+
+// splitFindingColumns is the column list read by scanSplitFinding, selected
+// from ap_split_invoice_findings f joined to invoices i
+const splitFindingColumns = `
+	f.id, f.entity_id, f.invoice_id, i.invoice_number, f.vendor_id, f.currency,
+	f.related_invoice_ids,
+	ARRAY(SELECT r.invoice_number FROM invoices r
+	      WHERE r.id = ANY(f.related_invoice_ids) ORDER BY r.invoice_date, r.invoice_number),
+	f.combined_total, f.threshold, f.escalated_rule_id, f.escalated_rule_name,
+	f.window_start, f.window_end, f.action, f.status, f.detected_at,
+	f.reviewed_by, f.reviewed_at, f.review_notes
+`
+
+// splitFindingFrom is the FROM clause for splitFindingColumns
+const splitFindingFrom = `
+	FROM ap_split_invoice_findings f
+	JOIN invoices i ON i.id = f.invoice_id
+`
+
+// scanSplitFinding scans a row selected with splitFindingColumns
+func scanSplitFinding(row pgx.Row) (*SplitInvoiceFinding, error) {
+	finding := &SplitInvoiceFinding{}
+	err := row.Scan(
+		&finding.ID,
+		&finding.EntityID,
+		&finding.InvoiceID,
+		&finding.InvoiceNumber,
+		&finding.VendorID,
+		&finding.Currency,
+		&finding.RelatedInvoiceIDs,
+		&finding.RelatedInvoiceNumbers,
+		&finding.CombinedTotal,
+		&finding.Threshold,
+		&finding.EscalatedRuleID,
+		&finding.EscalatedRuleName,
+		&finding.WindowStart,
+		&finding.WindowEnd,
+		&finding.Action,
+		&finding.Status,
+		&finding.DetectedAt,
+		&finding.ReviewedBy,
+		&finding.ReviewedAt,
+		&finding.ReviewNotes,
+	)
+	return finding, err
+}
+
+// ListVendorInvoices retrieves a vendor's invoices in one currency, dated
+// within the search's range, that have been submitted for approval and not
+// cancelled. Credit memos are left out.
+func (r *SplitInvoiceRepository) ListVendorInvoices(ctx context.Context, search *SplitInvoiceSearch) ([]*SplitInvoiceMember, error) {
+	query := `
+		SELECT id, invoice_number, invoice_date, total_amount
+		FROM invoices
+		WHERE entity_id = $1
+		  AND id <> $2
+		  AND vendor_id = $3
+		  AND currency = $4
+		  AND invoice_date BETWEEN $5 AND $6
+		  AND invoice_type <> 'credit_memo'
+		  AND status IN ('pending_approval', 'approved', 'posted', 'paid')
+		ORDER BY invoice_date, invoice_number
+	`
+
+	rows, err := r.db.Query(ctx, query,
+		search.EntityID,
+		search.ExcludeID,
+		search.VendorID,
+		search.Currency,
+		search.DateFrom,
+		search.DateTo,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list vendor invoices")
+	}
+	defer rows.Close()
+
+	members := make([]*SplitInvoiceMember, 0)
+	for rows.Next() {
+		member := &SplitInvoiceMember{}
+		if err := rows.Scan(&member.InvoiceID, &member.InvoiceNumber, &member.InvoiceDate, &member.TotalAmount); err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan vendor invoice")
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// Create records a finding and, if hold is not nil, places the hold on its
+// invoice in the same transaction, so a held finding is never recorded
+// without its hold. It fails with a conflict if the invoice already has a
+// finding.
+func (r *SplitInvoiceRepository) Create(ctx context.Context, finding *SplitInvoiceFinding, hold *InvoiceHold) error {
+	query := `
+		INSERT INTO ap_split_invoice_findings (entity_id, invoice_id, vendor_id, currency, related_invoice_ids,
+		                                       combined_total, threshold, escalated_rule_id, escalated_rule_name,
+		                                       window_start, window_end, action)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (invoice_id) DO NOTHING
+		RETURNING id, status, detected_at
+	`
+
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, query,
+			finding.EntityID,
+			finding.InvoiceID,
+			finding.VendorID,
+			finding.Currency,
+			finding.RelatedInvoiceIDs,
+			finding.CombinedTotal,
+			finding.Threshold,
+			finding.EscalatedRuleID,
+			finding.EscalatedRuleName,
+			finding.WindowStart,
+			finding.WindowEnd,
+			finding.Action,
+		).Scan(&finding.ID, &finding.Status, &finding.DetectedAt)
+
+		if err == pgx.ErrNoRows {
+			return errors.New(errors.ErrCodeConflict, "invoice already has a split invoice finding")
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to create split invoice finding")
+		}
+
+		if hold == nil {
+			return nil
+		}
+		return insertInvoiceHold(ctx, tx, hold)
+	})
+}
+
+// GetByID retrieves a finding
+func (r *SplitInvoiceRepository) GetByID(ctx context.Context, id, entityID string) (*SplitInvoiceFinding, error) {
+	query := `SELECT ` + splitFindingColumns + splitFindingFrom + `
+		WHERE f.id = $1 AND f.entity_id = $2
+	`
+
+	finding, err := scanSplitFinding(r.db.QueryRow(ctx, query, id, entityID))
+	if err == pgx.ErrNoRows {
+		return nil, errors.NotFound("split_invoice_finding", id)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get split invoice finding")
+	}
+
+	return finding, nil
+}
+
+// GetByInvoice retrieves an invoice's finding. Returns nil (no error) if it
+// has none.
+func (r *SplitInvoiceRepository) GetByInvoice(ctx context.Context, invoiceID, entityID string) (*SplitInvoiceFinding, error) {
+	query := `SELECT ` + splitFindingColumns + splitFindingFrom + `
+		WHERE f.invoice_id = $1 AND f.entity_id = $2
+	`
+
+	finding, err := scanSplitFinding(r.db.QueryRow(ctx, query, invoiceID, entityID))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get split invoice finding")
+	}
+
+	return finding, nil
+}
+
+// List retrieves an entity's findings matching the filter, newest first
+func (r *SplitInvoiceRepository) List(ctx context.Context, entityID string, filter *SplitFindingFilter) ([]*SplitInvoiceFinding, error) {
+	query := `SELECT ` + splitFindingColumns + splitFindingFrom + `
+		WHERE f.entity_id = $1
+		  AND ($2::text IS NULL OR f.status = $2)
+		  AND ($3::uuid IS NULL OR f.vendor_id = $3)
+		ORDER BY f.detected_at DESC
+	`
+
+	rows, err := r.db.Query(ctx, query, entityID, filter.Status, filter.VendorID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list split invoice findings")
+	}
+	defer rows.Close()
+
+	findings := make([]*SplitInvoiceFinding, 0)
+	for rows.Next() {
+		finding, err := scanSplitFinding(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan split invoice finding")
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// Review records the review of an open finding as cleared or confirmed,
+// with who reviewed it and why, and the action it is left with, and, if
+// hold is not nil, releases the hold on its invoice in the same
+// transaction, so a hold is never released for a review that was not
+// recorded. It fails with a conflict if the finding has already been
+// reviewed.
+func (r *SplitInvoiceRepository) Review(ctx context.Context, finding *SplitInvoiceFinding, hold *InvoiceHold) error {
+	query := `
+		UPDATE ap_split_invoice_findings
+		SET status = $3,
+		    action = $4,
+		    reviewed_by = $5,
+		    reviewed_at = NOW(),
+		    review_notes = $6
+		WHERE id = $1 AND entity_id = $2 AND status = 'open'
+		RETURNING reviewed_at
+	`
+
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, query,
+			finding.ID,
+			finding.EntityID,
+			finding.Status,
+			finding.Action,
+			finding.ReviewedBy,
+			finding.ReviewNotes,
+		).Scan(&finding.ReviewedAt)
+
+		if err == pgx.ErrNoRows {
+			return errors.New(errors.ErrCodeConflict, "split invoice finding has already been reviewed")
+		}
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to review split invoice finding")
+		}
+
+		if hold == nil {
+			return nil
+		}
+		return releaseInvoiceHold(ctx, tx, hold)
+	})
+}
@@ -0,0 +1,255 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// TaxCode is a tax code configured for an entity
+type TaxCode struct {
+	ID                 string          `json:"id"`
+	EntityID           string          `json:"entity_id"`
+	Code               string          `json:"code"`
+	Description        *string         `json:"description,omitempty"`
+	Jurisdiction       *string         `json:"jurisdiction,omitempty"`
+	RecoverablePercent decimal.Decimal `json:"recoverable_percent"`
+	InputTaxAccountID  *string         `json:"input_tax_account_id,omitempty"`
+	IsActive           bool            `json:"is_active"`
+	CreatedBy          *string         `json:"created_by,omitempty"`
+	CreatedAt          time.Time       `json:"created_at"`
+	UpdatedBy          *string         `json:"updated_by,omitempty"`
+	UpdatedAt          time.Time       `json:"updated_at"`
+	Rates              []*TaxRate      `json:"rates,omitempty"`
+}
+
+// TaxRate is the rate of a tax code over a range of dates
+type TaxRate struct {
+	ID            string          `json:"id"`
+	TaxCodeID     string          `json:"tax_code_id"`
+	Rate          decimal.Decimal `json:"rate"` // percent
+	EffectiveFrom time.Time       `json:"effective_from"`
+	EffectiveTo   *time.Time      `json:"effective_to,omitempty"` // inclusive
+	CreatedBy     *string         `json:"created_by,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// RateOn returns the rate effective on date, or nil if none is
+func (t *TaxCode) RateOn(date time.Time) *TaxRate {
+	for _, rate := range t.Rates {
+		if date.Before(rate.EffectiveFrom) {
+			continue
+		}
+		if rate.EffectiveTo != nil && date.After(*rate.EffectiveTo) {
+			continue
+		}
+		return rate
+	}
+	return nil
+}
+
+// TaxCodeRepository handles tax code data operations
+type TaxCodeRepository struct {
+	db *database.DB
+}
+
+// NewTaxCodeRepository creates a new tax code repository
+func NewTaxCodeRepository(db *database.DB) *TaxCodeRepository {
+	return &TaxCodeRepository{db: db}
+}
+
+// taxCodeColumns is the column list read by scanTaxCode
+const taxCodeColumns = `
+	id, entity_id, code, description, jurisdiction, recoverable_percent, input_tax_account_id,
+	is_active, created_by, created_at, updated_by, updated_at
+`
+
+// scanTaxCode scans a row selected with taxCodeColumns
+func scanTaxCode(row pgx.Row) (*TaxCode, error) {
+	taxCode := &TaxCode{}
+	err := row.Scan(
+		&taxCode.ID,
+		&taxCode.EntityID,
+		&taxCode.Code,
+		&taxCode.Description,
+		&taxCode.Jurisdiction,
+		&taxCode.RecoverablePercent,
+		&taxCode.InputTaxAccountID,
+		&taxCode.IsActive,
+		&taxCode.CreatedBy,
+		&taxCode.CreatedAt,
+		&taxCode.UpdatedBy,
+		&taxCode.UpdatedAt,
+	)
+	return taxCode, err
+}
+
+// GetByCode retrieves a tax code of an entity with its rates, returning nil
+// if it does not exist
+func (r *TaxCodeRepository) GetByCode(ctx context.Context, entityID, code string) (*TaxCode, error) {
+	query := `SELECT ` + taxCodeColumns + ` FROM ap_tax_codes WHERE entity_id = $1 AND code = $2`
+
+	taxCode, err := scanTaxCode(r.db.QueryRow(ctx, query, entityID, code))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to get tax code")
+	}
+
+	if err := r.loadRates(ctx, entityID, []*TaxCode{taxCode}); err != nil {
+		return nil, err
+	}
+
+	return taxCode, nil
+}
+
+// List retrieves all tax codes of an entity with their rates, ordered by code
+func (r *TaxCodeRepository) List(ctx context.Context, entityID string) ([]*TaxCode, error) {
+	query := `SELECT ` + taxCodeColumns + ` FROM ap_tax_codes WHERE entity_id = $1 ORDER BY code`
+
+	rows, err := r.db.Query(ctx, query, entityID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to list tax codes")
+	}
+	defer rows.Close()
+
+	taxCodes := make([]*TaxCode, 0)
+	for rows.Next() {
+		taxCode, err := scanTaxCode(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to scan tax code")
+		}
+		taxCodes = append(taxCodes, taxCode)
+	}
+	rows.Close()
+
+	if err := r.loadRates(ctx, entityID, taxCodes); err != nil {
+		return nil, err
+	}
+
+	return taxCodes, nil
+}
+
+// loadRates attaches their rates, oldest first, to tax codes of an entity
+func (r *TaxCodeRepository) loadRates(ctx context.Context, entityID string, taxCodes []*TaxCode) error {
+	query := `
+		SELECT tr.id, tr.tax_code_id, tr.rate, tr.effective_from, tr.effective_to,
+		       tr.created_by, tr.created_at
+		FROM ap_tax_rates tr
+		JOIN ap_tax_codes tc ON tc.id = tr.tax_code_id
+		WHERE tc.entity_id = $1
+		ORDER BY tr.effective_from
+	`
+
+	rows, err := r.db.Query(ctx, query, entityID)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to get tax rates")
+	}
+	defer rows.Close()
+
+	byID := make(map[string]*TaxCode, len(taxCodes))
+	for _, taxCode := range taxCodes {
+		taxCode.Rates = make([]*TaxRate, 0)
+		byID[taxCode.ID] = taxCode
+	}
+
+	for rows.Next() {
+		rate := &TaxRate{}
+		if err := rows.Scan(
+			&rate.ID,
+			&rate.TaxCodeID,
+			&rate.Rate,
+			&rate.EffectiveFrom,
+			&rate.EffectiveTo,
+			&rate.CreatedBy,
+			&rate.CreatedAt,
+		); err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to scan tax rate")
+		}
+		if taxCode, ok := byID[rate.TaxCodeID]; ok {
+			taxCode.Rates = append(taxCode.Rates, rate)
+		}
+	}
+
+	return nil
+}
+
+// AddRate adds a rate to a tax code. The caller checks that it does not
+// overlap the code's existing rates. If supersededID is set, that open-ended
+// rate is ended the day before the new rate starts in the same transaction,
+// so the code is never left without a current rate.
+func (r *TaxCodeRepository) AddRate(ctx context.Context, rate *TaxRate, supersededID *string) error {
+	return r.db.InTransaction(ctx, func(tx pgx.Tx) error {
+		if supersededID != nil {
+			tag, err := tx.Exec(ctx,
+				`UPDATE ap_tax_rates SET effective_to = $2 WHERE id = $1 AND effective_to IS NULL`,
+				*supersededID, rate.EffectiveFrom.AddDate(0, 0, -1))
+			if err != nil {
+				return errors.Wrap(err, errors.ErrCodeInternal, "failed to close tax rate")
+			}
+			if tag.RowsAffected() == 0 {
+				return errors.New(errors.ErrCodeConflict, "superseded tax rate was changed by another request")
+			}
+		}
+
+		query := `
+			INSERT INTO ap_tax_rates (tax_code_id, rate, effective_from, effective_to, created_by)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, created_at
+		`
+
+		err := tx.QueryRow(ctx, query,
+			rate.TaxCodeID,
+			rate.Rate,
+			rate.EffectiveFrom,
+			rate.EffectiveTo,
+			rate.CreatedBy,
+		).Scan(&rate.ID, &rate.CreatedAt)
+
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "failed to add tax rate")
+		}
+
+		return nil
+	})
+}
+
+// Upsert creates or replaces a tax code, keyed by entity and code
+func (r *TaxCodeRepository) Upsert(ctx context.Context, taxCode *TaxCode) error {
+	query := `
+		INSERT INTO ap_tax_codes (entity_id, code, description, jurisdiction, recoverable_percent,
+		                          input_tax_account_id, is_active, created_by, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		ON CONFLICT (entity_id, code) DO UPDATE
+		SET description = EXCLUDED.description,
+		    jurisdiction = EXCLUDED.jurisdiction,
+		    recoverable_percent = EXCLUDED.recoverable_percent,
+		    input_tax_account_id = EXCLUDED.input_tax_account_id,
+		    is_active = EXCLUDED.is_active,
+		    updated_by = EXCLUDED.updated_by,
+		    updated_at = NOW()
+		RETURNING id, created_by, created_at, updated_by, updated_at
+	`
+
+	err := r.db.QueryRow(ctx, query,
+		taxCode.EntityID,
+		taxCode.Code,
+		taxCode.Description,
+		taxCode.Jurisdiction,
+		taxCode.RecoverablePercent,
+		taxCode.InputTaxAccountID,
+		taxCode.IsActive,
+		taxCode.UpdatedBy,
+	).Scan(&taxCode.ID, &taxCode.CreatedBy, &taxCode.CreatedAt, &taxCode.UpdatedBy, &taxCode.UpdatedAt)
+
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to save tax code")
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pesio-ai/be-lib-common/database"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// VendorBalanceUpdate is the local record of an AP-1 vendor balance change
+// made under an idempotency key
+type VendorBalanceUpdate struct {
+	ID             string
+	EntityID       string
+	IdempotencyKey string
+	VendorID       string
+	Amount         int64
+	AppliedAt      *time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// VendorBalanceUpdateRepository records AP-1 vendor balance changes by
+// idempotency key
+type VendorBalanceUpdateRepository struct {
+	db *database.DB
+}
+
+// NewVendorBalanceUpdateRepository creates a new vendor balance update repository
+func NewVendorBalanceUpdateRepository(db *database.DB) *VendorBalanceUpdateRepository {
+	return &VendorBalanceUpdateRepository{db: db}
+}
+
+// vendorBalanceUpdateColumns is the column list read by scanVendorBalanceUpdate
+const vendorBalanceUpdateColumns = `
+	id, entity_id, idempotency_key, vendor_id, amount,
+	applied_at, created_at, updated_at
+`
+
+// scanVendorBalanceUpdate scans a row selected with vendorBalanceUpdateColumns
+func scanVendorBalanceUpdate(row pgx.Row) (*VendorBalanceUpdate, error) {
+	update := &VendorBalanceUpdate{}
+	err := row.Scan(
+		&update.ID,
+		&update.EntityID,
+		&update.IdempotencyKey,
+		&update.VendorID,
+		&update.Amount,
+		&update.AppliedAt,
+		&update.CreatedAt,
+		&update.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// Reserve claims the right to apply the balance change for key. It returns
+// the update and true when the caller should apply it: the key is new, or
+// an earlier reservation was never marked applied and has been idle longer
+// than staleAfter. Otherwise it returns the existing update and false; its
+// AppliedAt is set if the change was already applied.
+func (r *VendorBalanceUpdateRepository) Reserve(ctx context.Context, entityID, key, vendorID string, amount int64, staleAfter time.Duration) (*VendorBalanceUpdate, bool, error) {
+	query := `
+		INSERT INTO vendor_balance_updates (entity_id, idempotency_key, vendor_id, amount)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (entity_id, idempotency_key) DO UPDATE
+		SET updated_at = NOW()
+		WHERE vendor_balance_updates.applied_at IS NULL
+		  AND vendor_balance_updates.updated_at < NOW() - $5 * INTERVAL '1 millisecond'
+		RETURNING ` + vendorBalanceUpdateColumns
+
+	update, err := scanVendorBalanceUpdate(r.db.QueryRow(ctx, query, entityID, key, vendorID, amount, staleAfter.Milliseconds()))
+	if err == nil {
+		return update, true, nil
+	}
+	if err != pgx.ErrNoRows {
+		return nil, false, errors.Wrap(err, errors.ErrCodeInternal, "failed to reserve vendor balance update")
+	}
+
+	// Conflict left the existing row in place
+	query = `SELECT ` + vendorBalanceUpdateColumns + `
+		FROM vendor_balance_updates
+		WHERE entity_id = $1 AND idempotency_key = $2
+	`
+	update, err = scanVendorBalanceUpdate(r.db.QueryRow(ctx, query, entityID, key))
+	if err != nil {
+		return nil, false, errors.Wrap(err, errors.ErrCodeInternal, "failed to get vendor balance update")
+	}
+	return update, false, nil
+}
+
+// MarkApplied records that AP-1 has applied the balance change
+func (r *VendorBalanceUpdateRepository) MarkApplied(ctx context.Context, id string) error {
+	_, err := r.db.Exec(ctx,
+		`UPDATE vendor_balance_updates SET applied_at = NOW() WHERE id = $1 AND applied_at IS NULL`,
+		id)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrCodeInternal, "failed to mark vendor balance update applied")
+	}
+	return nil
+}
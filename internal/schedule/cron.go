@@ -0,0 +1,139 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a standard five-field cron expression: minute, hour, day of month,
+// month and day of week. Each field is *, a value, a range a-b or a list of
+// these separated by commas, optionally stepped with /n. Days of the week
+// run from 0 (Sunday) to 6, with 7 also accepted for Sunday. When both day
+// fields are restricted a date matching either of them matches, as in cron;
+// a day field starting with *, such as */2, counts as unrestricted, so it
+// narrows the other day field rather than widening it.
+//
+// Schedules have a granularity of one day, so the minute and hour fields are
+// validated but do not affect which dates match.
+type Cron struct {
+	daysOfMonth   uint64
+	months        uint64
+	daysOfWeek    uint64
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+// ParseCron parses a five-field cron expression
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	if _, err := parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if _, err := parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+
+	c := &Cron{
+		anyDayOfMonth: strings.HasPrefix(fields[2], "*"),
+		anyDayOfWeek:  strings.HasPrefix(fields[4], "*"),
+	}
+
+	var err error
+	if c.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+
+	// Sunday is both 0 and 7
+	if c.daysOfWeek&(1<<7) != 0 {
+		c.daysOfWeek |= 1
+	}
+
+	return c, nil
+}
+
+// parseCronField parses one field into a bit set of the values it matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangePart)
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns the first date after the given date that the expression
+// matches, or the zero time if it matches none
+func (c *Cron) Next(after time.Time) time.Time {
+	date := Date(after)
+	for i := 0; i < maxSearchDays; i++ {
+		date = date.AddDate(0, 0, 1)
+		if c.matches(date) {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+// matches reports whether the expression matches a date
+func (c *Cron) matches(date time.Time) bool {
+	if c.months&(1<<uint(date.Month())) == 0 {
+		return false
+	}
+
+	dayOfMonth := c.daysOfMonth&(1<<uint(date.Day())) != 0
+	dayOfWeek := c.daysOfWeek&(1<<uint(date.Weekday())) != 0
+
+	if c.anyDayOfMonth || c.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
@@ -0,0 +1,77 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "0 9 1 * *"},
+		{expr: "*/15 9-17 1,15 * 1-5"},
+		{expr: "0 0 * * 7"},
+		{expr: "0 0 1-31/2 * *"},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * 32 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "* * */0 * *", wantErr: true},
+		{expr: "* * 5-3 * *", wantErr: true},
+		{expr: "* * a * *", wantErr: true},
+		{expr: "* * 1-a * *", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCron(tt.expr)
+		if tt.wantErr && err == nil {
+			t.Errorf("ParseCron(%q) did not fail", tt.expr)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("ParseCron(%q) error: %v", tt.expr, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{name: "day of month", expr: "0 9 1 * *", after: date(2024, 1, 15), want: date(2024, 2, 1)},
+		{name: "day of week", expr: "0 9 * * 1", after: date(2024, 1, 1), want: date(2024, 1, 8)},
+		{name: "sunday as 7", expr: "0 0 * * 7", after: date(2024, 1, 1), want: date(2024, 1, 7)},
+		{name: "stepped days", expr: "0 9 */10 * *", after: date(2024, 1, 21), want: date(2024, 1, 31)},
+		{name: "stepped days wrap", expr: "0 9 */10 * *", after: date(2024, 1, 31), want: date(2024, 2, 1)},
+		{name: "month list", expr: "0 0 1 1,7 *", after: date(2024, 1, 1), want: date(2024, 7, 1)},
+		{name: "either day field", expr: "0 9 15 * 5", after: date(2024, 1, 1), want: date(2024, 1, 5)},
+		{name: "stepped day of month narrows weekday", expr: "0 9 */2 * 1", after: date(2024, 1, 1), want: date(2024, 1, 15)},
+		{name: "stepped weekday narrows day of month", expr: "0 9 13 * */7", after: date(2024, 1, 1), want: date(2024, 10, 13)},
+		{name: "leap day", expr: "0 0 29 2 *", after: date(2024, 3, 1), want: date(2028, 2, 29)},
+		{name: "never", expr: "0 0 30 2 *", after: date(2024, 1, 1), want: time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q) error: %v", tt.expr, err)
+			}
+			if got := c.Next(tt.after); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.after.Format("2006-01-02"), got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+		})
+	}
+}
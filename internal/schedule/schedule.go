@@ -0,0 +1,114 @@
+// Package schedule computes the occurrence dates of recurring invoice
+// templates. Occurrences are calendar dates: a schedule falls due at most
+// once a day, and times of day play no part.
+package schedule
+
+import (
+	"fmt"
+	"time"
+)
+
+// Frequencies a schedule may repeat at
+const (
+	Weekly    = "weekly"
+	Monthly   = "monthly"
+	Quarterly = "quarterly"
+	Annually  = "annually"
+	Custom    = "custom" // a cron expression
+)
+
+// maxSearchDays bounds the search for the next day a cron expression
+// matches. Four years and a day covers any 29 February.
+const maxSearchDays = 4*366 + 1
+
+// Schedule is a repeating series of dates from a start date
+type Schedule struct {
+	frequency string
+	start     time.Time
+	cron      *Cron
+}
+
+// New returns the schedule of a frequency from a start date. A custom
+// schedule takes its dates from cronExpression and ignores the others.
+func New(frequency, cronExpression string, start time.Time) (*Schedule, error) {
+	s := &Schedule{frequency: frequency, start: Date(start)}
+
+	switch frequency {
+	case Weekly, Monthly, Quarterly, Annually:
+	case Custom:
+		cron, err := ParseCron(cronExpression)
+		if err != nil {
+			return nil, err
+		}
+		s.cron = cron
+	default:
+		return nil, fmt.Errorf("unknown frequency %q", frequency)
+	}
+
+	return s, nil
+}
+
+// First returns the first occurrence on or after the start date, or the
+// zero time if there is none
+func (s *Schedule) First() time.Time {
+	return s.Next(s.start.AddDate(0, 0, -1))
+}
+
+// Next returns the first occurrence after the given date, or the zero time
+// if there is none. Weekly schedules repeat on the start date's weekday.
+// Monthly, quarterly and annual schedules repeat on the start date's day of
+// the month, falling back to the last day of shorter months.
+func (s *Schedule) Next(after time.Time) time.Time {
+	after = Date(after)
+	if s.cron != nil {
+		if after.Before(s.start) {
+			after = s.start.AddDate(0, 0, -1)
+		}
+		return s.cron.Next(after)
+	}
+	if after.Before(s.start) {
+		return s.start
+	}
+
+	switch s.frequency {
+	case Weekly:
+		weeks := int(after.Sub(s.start).Hours()/24)/7 + 1
+		return s.start.AddDate(0, 0, 7*weeks)
+	case Monthly:
+		return s.nextMonthly(after, 1)
+	case Quarterly:
+		return s.nextMonthly(after, 3)
+	default:
+		return s.nextMonthly(after, 12)
+	}
+}
+
+// nextMonthly returns the first date every step months from the start date
+// that falls after the given date, which is not before the start date
+func (s *Schedule) nextMonthly(after time.Time, step int) time.Time {
+	months := (after.Year()-s.start.Year())*12 + int(after.Month()) - int(s.start.Month())
+	for n := months / step; ; n++ {
+		date := addMonths(s.start, n*step)
+		if date.After(after) {
+			return date
+		}
+	}
+}
+
+// addMonths adds n months to a date, clamping the day to the end of the
+// resulting month
+func addMonths(date time.Time, n int) time.Time {
+	first := time.Date(date.Year(), date.Month()+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+
+	day := date.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// Date returns the calendar date of t as midnight UTC
+func Date(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,84 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	start := date(2024, 1, 1)
+
+	if _, err := New("daily", "", start); err == nil {
+		t.Error("New with an unknown frequency did not fail")
+	}
+	if _, err := New(Custom, "0 0 * *", start); err == nil {
+		t.Error("New with an invalid cron expression did not fail")
+	}
+	if _, err := New(Monthly, "not a cron expression", start); err != nil {
+		t.Errorf("New(monthly) with an ignored cron expression error: %v", err)
+	}
+}
+
+func TestScheduleFirst(t *testing.T) {
+	tests := []struct {
+		name      string
+		frequency string
+		cron      string
+		start     time.Time
+		want      time.Time
+	}{
+		{name: "weekly", frequency: Weekly, start: date(2024, 1, 3), want: date(2024, 1, 3)},
+		{name: "monthly", frequency: Monthly, start: date(2024, 1, 31), want: date(2024, 1, 31)},
+		{name: "custom on start", frequency: Custom, cron: "0 0 * * 3", start: date(2024, 1, 3), want: date(2024, 1, 3)},
+		{name: "custom after start", frequency: Custom, cron: "0 0 1 * *", start: date(2024, 1, 10), want: date(2024, 2, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.frequency, tt.cron, tt.start)
+			if err != nil {
+				t.Fatalf("New error: %v", err)
+			}
+			if got := s.First(); !got.Equal(tt.want) {
+				t.Errorf("First() = %s, want %s", got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		name      string
+		frequency string
+		cron      string
+		start     time.Time
+		after     time.Time
+		want      time.Time
+	}{
+		{name: "weekly before start", frequency: Weekly, start: date(2024, 1, 3), after: date(2023, 12, 1), want: date(2024, 1, 3)},
+		{name: "weekly on occurrence", frequency: Weekly, start: date(2024, 1, 3), after: date(2024, 1, 3), want: date(2024, 1, 10)},
+		{name: "weekly between", frequency: Weekly, start: date(2024, 1, 3), after: date(2024, 1, 9), want: date(2024, 1, 10)},
+		{name: "monthly clamps to short month", frequency: Monthly, start: date(2024, 1, 31), after: date(2024, 1, 31), want: date(2024, 2, 29)},
+		{name: "monthly returns to start day", frequency: Monthly, start: date(2024, 1, 31), after: date(2024, 2, 29), want: date(2024, 3, 31)},
+		{name: "monthly thirty days", frequency: Monthly, start: date(2024, 1, 31), after: date(2024, 4, 15), want: date(2024, 4, 30)},
+		{name: "quarterly on occurrence", frequency: Quarterly, start: date(2024, 1, 15), after: date(2024, 1, 15), want: date(2024, 4, 15)},
+		{name: "quarterly between", frequency: Quarterly, start: date(2024, 1, 15), after: date(2024, 5, 1), want: date(2024, 7, 15)},
+		{name: "annually from leap day", frequency: Annually, start: date(2024, 2, 29), after: date(2024, 2, 29), want: date(2025, 2, 28)},
+		{name: "annually to leap day", frequency: Annually, start: date(2024, 2, 29), after: date(2027, 3, 1), want: date(2028, 2, 29)},
+		{name: "custom before start", frequency: Custom, cron: "0 0 1 * *", start: date(2024, 1, 10), after: date(2023, 6, 1), want: date(2024, 2, 1)},
+		{name: "custom", frequency: Custom, cron: "0 0 1 * *", start: date(2024, 1, 10), after: date(2024, 2, 1), want: date(2024, 3, 1)},
+		{name: "ignores time of day", frequency: Weekly, start: date(2024, 1, 3), after: date(2024, 1, 9).Add(23 * time.Hour), want: date(2024, 1, 10)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.frequency, tt.cron, tt.start)
+			if err != nil {
+				t.Fatalf("New error: %v", err)
+			}
+			if got := s.Next(tt.after); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.after.Format("2006-01-02"), got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+		})
+	}
+}
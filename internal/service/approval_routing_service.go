@@ -30,6 +30,8 @@ type ApprovalRoutingService struct {
 	auditRepo      *repository.ApprovalAuditRepository
 	invoiceRepo    *repository.InvoiceRepository
 	identityClient IdentityClientInterface
+	splits         *SplitInvoiceService
+	stateMachine   *InvoiceStateMachine
 	log            *logger.Logger
 }
 
@@ -41,6 +43,7 @@ func NewApprovalRoutingService(
 	auditRepo *repository.ApprovalAuditRepository,
 	invoiceRepo *repository.InvoiceRepository,
 	identityClient IdentityClientInterface,
+	splits *SplitInvoiceService,
 	log *logger.Logger,
 ) *ApprovalRoutingService {
 	return &ApprovalRoutingService{
@@ -50,6 +53,8 @@ func NewApprovalRoutingService(
 		auditRepo:      auditRepo,
 		invoiceRepo:    invoiceRepo,
 		identityClient: identityClient,
+		splits:         splits,
+		stateMachine:   NewInvoiceStateMachine(),
 		log:            log,
 	}
 }
@@ -69,8 +74,18 @@ func (s *ApprovalRoutingService) CreateApprovalWorkflow(
 		department = invoice.Lines[0].Dimension2
 	}
 
+	// Route on the combined total of a split the invoice is escalated for
+	amount := invoice.TotalAmount
+	escalation, err := s.splits.escalation(ctx, invoice)
+	if err != nil {
+		return nil, nil, err
+	}
+	if escalation != nil {
+		amount = escalation.CombinedTotal
+	}
+
 	// Resolve matching rule
-	rule, err := s.rulesRepo.FindMatchingRule(ctx, invoice.EntityID, invoice.TotalAmount, &invoice.VendorID, department)
+	rule, err := s.rulesRepo.FindMatchingRule(ctx, invoice.EntityID, amount, &invoice.VendorID, department)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -108,6 +123,7 @@ func (s *ApprovalRoutingService) CreateApprovalWorkflow(
 		Str("invoice_id", invoice.ID).
 		Str("workflow_id", wf.ID).
 		Int("total_steps", wf.TotalSteps).
+		Int64("routing_amount", amount).
 		Msg("Approval workflow created")
 
 	return wf, steps, nil
@@ -161,12 +177,14 @@ func (s *ApprovalRoutingService) buildSteps(
 
 // ApproveStep records approval for a workflow step. Returns true when the
 // entire workflow is now complete (all required steps approved).
+// expectedVersion, when set, must match the invoice's current version.
 func (s *ApprovalRoutingService) ApproveStep(
 	ctx context.Context,
 	invoiceID, workflowID string,
 	stepNumber int,
 	actedBy string,
 	notes *string,
+	expectedVersion *int64,
 ) (workflowComplete bool, err error) {
 	wf, err := s.workflowRepo.GetByID(ctx, workflowID)
 	if err != nil {
@@ -189,6 +207,16 @@ func (s *ApprovalRoutingService) ApproveStep(
 		return false, err
 	}
 
+	// Check the caller's version before recording the step; the invoice is
+	// then approved at this version, so a change made since conflicts
+	invoice, err := s.invoiceRepo.GetByID(ctx, invoiceID, wf.EntityID)
+	if err != nil {
+		return false, err
+	}
+	if err := checkVersion(invoice, expectedVersion); err != nil {
+		return false, err
+	}
+
 	// Persist the approval action
 	if err := s.stepsRepo.UpdateStepAction(ctx, step.ID, "approved", actedBy, notes); err != nil {
 		return false, err
@@ -203,18 +231,21 @@ func (s *ApprovalRoutingService) ApproveStep(
 		workflowComplete = false
 	} else {
 		// All steps done — complete the workflow and approve the invoice
+		transition, err := s.stateMachine.Transition(invoice, EventApprove, &actedBy, notes)
+		if err != nil {
+			return false, err
+		}
 		now := time.Now()
 		if err := s.workflowRepo.UpdateStatus(ctx, workflowID, "approved", &now); err != nil {
 			return false, err
 		}
-		if err := s.invoiceRepo.Approve(ctx, invoiceID, wf.EntityID, &actedBy, notes); err != nil {
+		if err := s.invoiceRepo.Approve(ctx, invoiceID, wf.EntityID, invoice.Version, transition); err != nil {
 			return false, err
 		}
 		workflowComplete = true
 	}
 
 	// Audit log
-	invoice, _ := s.invoiceRepo.GetByID(ctx, invoiceID, wf.EntityID)
 	statusBefore := "pending_approval"
 	statusAfter := "pending_approval"
 	if workflowComplete {
@@ -241,11 +272,13 @@ func (s *ApprovalRoutingService) ApproveStep(
 // ── Reject ────────────────────────────────────────────────────────────────────
 
 // RejectWorkflow rejects the invoice at the given step, returning it to draft.
+// expectedVersion, when set, must match the invoice's current version.
 func (s *ApprovalRoutingService) RejectWorkflow(
 	ctx context.Context,
 	invoiceID, workflowID string,
 	stepNumber int,
 	actedBy, reason string,
+	expectedVersion *int64,
 ) error {
 	wf, err := s.workflowRepo.GetByID(ctx, workflowID)
 	if err != nil {
@@ -271,18 +304,33 @@ func (s *ApprovalRoutingService) RejectWorkflow(
 		return errors.InvalidInput("reason", "rejection reason is required")
 	}
 
+	// Check the caller's version before recording the step; the invoice is
+	// then returned to draft at this version, so a change made since conflicts
+	invoice, err := s.invoiceRepo.GetByID(ctx, invoiceID, wf.EntityID)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(invoice, expectedVersion); err != nil {
+		return err
+	}
+
 	notesPtr := &reason
 	if err := s.stepsRepo.UpdateStepAction(ctx, step.ID, "rejected", actedBy, notesPtr); err != nil {
 		return err
 	}
 
+	transition, err := s.stateMachine.Transition(invoice, EventReject, &actedBy, &reason)
+	if err != nil {
+		return err
+	}
+
 	now := time.Now()
 	if err := s.workflowRepo.UpdateStatus(ctx, workflowID, "rejected", &now); err != nil {
 		return err
 	}
 
 	// Return invoice to draft
-	if err := s.invoiceRepo.UpdateStatus(ctx, invoiceID, wf.EntityID, "draft", &actedBy); err != nil {
+	if err := s.invoiceRepo.UpdateStatus(ctx, invoiceID, wf.EntityID, invoice.Version, transition); err != nil {
 		return err
 	}
 
@@ -306,9 +354,11 @@ func (s *ApprovalRoutingService) RejectWorkflow(
 // ── Recall ────────────────────────────────────────────────────────────────────
 
 // RecallWorkflow lets the original submitter cancel a pending workflow.
+// expectedVersion, when set, must match the invoice's current version.
 func (s *ApprovalRoutingService) RecallWorkflow(
 	ctx context.Context,
 	invoiceID, workflowID, recalledBy string,
+	expectedVersion *int64,
 ) error {
 	wf, err := s.workflowRepo.GetByID(ctx, workflowID)
 	if err != nil {
@@ -323,6 +373,18 @@ func (s *ApprovalRoutingService) RecallWorkflow(
 			fmt.Sprintf("workflow cannot be recalled from status '%s'", wf.Status))
 	}
 
+	invoice, err := s.invoiceRepo.GetByID(ctx, invoiceID, wf.EntityID)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(invoice, expectedVersion); err != nil {
+		return err
+	}
+	transition, err := s.stateMachine.Transition(invoice, EventRecall, &recalledBy, nil)
+	if err != nil {
+		return err
+	}
+
 	// Mark all pending steps as recalled
 	if err := s.stepsRepo.RecallSteps(ctx, workflowID); err != nil {
 		return err
@@ -334,7 +396,7 @@ func (s *ApprovalRoutingService) RecallWorkflow(
 	}
 
 	// Return invoice to draft
-	if err := s.invoiceRepo.UpdateStatus(ctx, invoiceID, wf.EntityID, "draft", &recalledBy); err != nil {
+	if err := s.invoiceRepo.UpdateStatus(ctx, invoiceID, wf.EntityID, invoice.Version, transition); err != nil {
 		return err
 	}
 
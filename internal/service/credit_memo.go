@@ -0,0 +1,362 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// ApplyCreditMemoRequest represents an apply credit memo request. Each
+// application allocates part of the credit memo's balance to one invoice.
+type ApplyCreditMemoRequest struct {
+	CreditMemoID    string                      `json:"credit_memo_id"`
+	EntityID        string                      `json:"entity_id"`
+	ApplicationDate string                      `json:"application_date"`
+	GLDate          *string                     `json:"gl_date,omitempty"` // defaults to application_date
+	Applications    []*CreditApplicationRequest `json:"applications"`
+	CreatedBy       string                      `json:"created_by,omitempty"`
+	ExpectedVersion *int64                      `json:"version,omitempty"`
+}
+
+// CreditApplicationRequest represents the allocation of credit to one invoice
+type CreditApplicationRequest struct {
+	InvoiceID       string `json:"invoice_id"`
+	Amount          int64  `json:"amount"`
+	ExpectedVersion *int64 `json:"version,omitempty"`
+}
+
+// ApplyCreditMemo applies a posted credit memo's balance to open invoices of
+// the same vendor and currency. Each application settles part of an invoice
+// and consumes as much of the credit memo, so both documents' amount paid
+// rise together and either moves to paid once nothing is left. Vendor
+// balances are unchanged: the credit memo reduced the balance when it
+// posted. An application between documents booked at different exchange
+// rates posts its realized FX gain or loss to GL-2; a repeated request
+// first finishes any such journal an earlier attempt stopped short of.
+func (s *InvoiceService) ApplyCreditMemo(ctx context.Context, req *ApplyCreditMemoRequest) (*repository.Invoice, error) {
+	creditMemo, err := s.invoiceRepo.GetByID(ctx, req.CreditMemoID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if creditMemo.InvoiceType != "credit_memo" {
+		return nil, errors.InvalidInput("credit_memo_id",
+			fmt.Sprintf("invoice %s is not a credit memo", creditMemo.InvoiceNumber))
+	}
+
+	// The journals are keyed by application, so one GL-2 already created for
+	// an earlier attempt is reused rather than duplicated
+	if err := s.postPendingCreditApplications(ctx, creditMemo); err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(creditMemo, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if creditMemo.Status == "paid" {
+		return nil, errors.New(errors.ErrCodeConflict, "credit memo is already fully applied")
+	}
+	if creditMemo.Status != "posted" {
+		return nil, errors.New(errors.ErrCodeConflict, "can only apply posted credit memos")
+	}
+	if err := checkPostingSettled(creditMemo); err != nil {
+		return nil, err
+	}
+
+	if len(req.Applications) == 0 {
+		return nil, errors.InvalidInput("applications", "at least one application is required")
+	}
+
+	// Validate and parse application date
+	applicationDate, err := time.Parse("2006-01-02", req.ApplicationDate)
+	if err != nil {
+		return nil, errors.InvalidInput("application_date", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	// Fix the GL date in an open period, defaulting to the application date
+	glDate := applicationDate
+	if req.GLDate != nil && *req.GLDate != "" {
+		glDate, err = time.Parse("2006-01-02", *req.GLDate)
+		if err != nil {
+			return nil, errors.InvalidInput("gl_date", "invalid date format, expected YYYY-MM-DD")
+		}
+	}
+	glDate, period, err := s.resolvePostingDate(ctx, req.EntityID, glDate, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert empty string to NULL for CreatedBy
+	var createdBy *string
+	if req.CreatedBy != "" {
+		createdBy = &req.CreatedBy
+	}
+
+	var total int64
+	for _, appReq := range req.Applications {
+		if appReq.Amount <= 0 {
+			return nil, errors.InvalidInput("amount", "application amount must be positive")
+		}
+		total += appReq.Amount
+	}
+	if total > creditMemo.AmountDue {
+		return nil, errors.InvalidInput("applications",
+			fmt.Sprintf("applications total (%d) exceeds credit memo balance (%d)", total, creditMemo.AmountDue))
+	}
+
+	// The credit memo's balance is consumed application by application, so
+	// the one that uses up the balance settles the rest of its functional
+	// amount
+	creditDue := creditMemo.AmountDue
+	creditFunctionalPaid := creditMemo.FunctionalAmountPaid
+
+	invoices := make([]*repository.Invoice, 0, len(req.Applications))
+	applications := make([]*repository.CreditApplication, 0, len(req.Applications))
+	seen := make(map[string]bool)
+
+	for _, appReq := range req.Applications {
+		if seen[appReq.InvoiceID] {
+			return nil, errors.InvalidInput("invoice_id",
+				fmt.Sprintf("invoice %s is listed more than once", appReq.InvoiceID))
+		}
+		seen[appReq.InvoiceID] = true
+
+		invoice, err := s.invoiceRepo.GetByID(ctx, appReq.InvoiceID, req.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCreditTarget(creditMemo, invoice, appReq); err != nil {
+			return nil, err
+		}
+
+		application := &repository.CreditApplication{
+			EntityID:                req.EntityID,
+			CreditMemoID:            creditMemo.ID,
+			InvoiceID:               invoice.ID,
+			ApplicationDate:         applicationDate,
+			Amount:                  appReq.Amount,
+			FunctionalInvoiceAmount: functionalSettlement(invoice, appReq.Amount, invoice.AmountDue, invoice.FunctionalAmountPaid),
+			FunctionalCreditAmount:  functionalSettlement(creditMemo, appReq.Amount, creditDue, creditFunctionalPaid),
+			GLDate:                  glDate,
+			GLPeriodID:              period.ID,
+			CreatedBy:               createdBy,
+		}
+		application.RealizedFXGainLoss = application.FunctionalInvoiceAmount - application.FunctionalCreditAmount
+
+		// Check the account for any realized FX gain or loss before recording
+		if application.RealizedFXGainLoss != 0 {
+			if _, err := s.settings.RealizedFXAccountID(ctx, req.EntityID, application.RealizedFXGainLoss > 0); err != nil {
+				return nil, err
+			}
+		}
+
+		creditDue -= application.Amount
+		creditFunctionalPaid += application.FunctionalCreditAmount
+		invoices = append(invoices, invoice)
+		applications = append(applications, application)
+	}
+
+	if err := s.invoiceRepo.ApplyCredit(ctx, creditMemo, invoices, applications); err != nil {
+		return nil, err
+	}
+
+	for i, application := range applications {
+		if application.RealizedFXGainLoss == 0 {
+			continue
+		}
+		if err := s.postCreditApplication(ctx, creditMemo, invoices[i], application); err != nil {
+			return nil, err
+		}
+	}
+
+	s.log.Info().
+		Str("credit_memo_id", creditMemo.ID).
+		Str("credit_memo_number", creditMemo.InvoiceNumber).
+		Int("invoice_count", len(applications)).
+		Int64("amount_applied", total).
+		Msg("Credit memo applied")
+
+	return s.invoiceRepo.GetByID(ctx, creditMemo.ID, req.EntityID)
+}
+
+// checkCreditTarget rejects an application to an invoice the credit memo
+// cannot settle
+func checkCreditTarget(creditMemo, invoice *repository.Invoice, appReq *CreditApplicationRequest) error {
+	if err := checkVersion(invoice, appReq.ExpectedVersion); err != nil {
+		return err
+	}
+	if invoice.InvoiceType == "credit_memo" {
+		return errors.InvalidInput("invoice_id",
+			fmt.Sprintf("invoice %s is a credit memo", invoice.InvoiceNumber))
+	}
+	if invoice.Status != "posted" {
+		return errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("invoice %s is not open: status '%s'", invoice.InvoiceNumber, invoice.Status))
+	}
+	if err := checkPostingSettled(invoice); err != nil {
+		return err
+	}
+	if invoice.VendorID != creditMemo.VendorID {
+		return errors.InvalidInput("invoice_id",
+			fmt.Sprintf("invoice %s belongs to a different vendor than the credit memo", invoice.InvoiceNumber))
+	}
+	if invoice.Currency != creditMemo.Currency || invoice.FunctionalCurrency != creditMemo.FunctionalCurrency {
+		return errors.InvalidInput("invoice_id",
+			fmt.Sprintf("invoice %s is in %s, the credit memo in %s", invoice.InvoiceNumber, invoice.Currency, creditMemo.Currency))
+	}
+	if appReq.Amount > invoice.AmountDue {
+		return errors.InvalidInput("amount",
+			fmt.Sprintf("application amount (%d) exceeds amount due (%d) on invoice %s", appReq.Amount, invoice.AmountDue, invoice.InvoiceNumber))
+	}
+	return nil
+}
+
+// postPendingCreditApplications posts the FX journals of a credit memo's
+// applications that were recorded without one
+func (s *InvoiceService) postPendingCreditApplications(ctx context.Context, creditMemo *repository.Invoice) error {
+	pending, err := s.invoiceRepo.ListUnpostedCreditApplications(ctx, creditMemo.ID, creditMemo.EntityID)
+	if err != nil {
+		return err
+	}
+
+	for _, application := range pending {
+		invoice, err := s.invoiceRepo.GetByID(ctx, application.InvoiceID, creditMemo.EntityID)
+		if err != nil {
+			return err
+		}
+		if err := s.postCreditApplication(ctx, creditMemo, invoice, application); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// postCreditApplication creates and posts the GL-2 journal for the realized
+// FX gain or loss of a credit application. The journal ID is stored last,
+// so an application without one may be posted again.
+func (s *InvoiceService) postCreditApplication(ctx context.Context, creditMemo, invoice *repository.Invoice, application *repository.CreditApplication) error {
+	journalReq, err := s.journalBuilder.CreditApplicationJournal(ctx, creditMemo, invoice, application)
+	if err != nil {
+		return err
+	}
+	if err := checkJournalBalanced(journalReq); err != nil {
+		return err
+	}
+
+	glJournalID, err := s.journalsClient.CreateJournal(ctx, journalReq)
+	if err != nil {
+		return fmt.Errorf("failed to create credit application journal entry: %w", err)
+	}
+	if err := s.journalsClient.PostJournal(ctx, glJournalID, creditMemo.EntityID); err != nil {
+		return fmt.Errorf("failed to post credit application journal entry: %w", err)
+	}
+
+	if err := s.invoiceRepo.SetCreditApplicationJournal(ctx, application.ID, glJournalID); err != nil {
+		return err
+	}
+	application.GLJournalID = &glJournalID
+
+	return nil
+}
+
+// UnapplyCreditMemoRequest represents a request to reverse a credit
+// application
+type UnapplyCreditMemoRequest struct {
+	ApplicationID string `json:"application_id"`
+	EntityID      string `json:"entity_id"`
+	Reason        string `json:"reason"`
+	ReversedBy    string `json:"reversed_by,omitempty"`
+}
+
+// UnapplyCreditMemo reverses a credit application: the credit returns to
+// the credit memo's balance and the invoice's amount due, either document
+// that was paid returns to posted, and a realized FX journal posted for the
+// application is reversed in GL-2, today or in the next open period. Once
+// an invoice's applications are reversed it can be voided. A reversal that
+// fails part way is retried by unapplying again; the reversal journal is
+// keyed by application.
+func (s *InvoiceService) UnapplyCreditMemo(ctx context.Context, req *UnapplyCreditMemoRequest) (*repository.Invoice, error) {
+	if req.Reason == "" {
+		return nil, errors.InvalidInput("reason", "unapply reason is required")
+	}
+
+	application, err := s.invoiceRepo.GetCreditApplication(ctx, req.ApplicationID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if application.ReversedAt != nil {
+		return nil, errors.New(errors.ErrCodeConflict, "credit application is already reversed")
+	}
+
+	creditMemo, err := s.invoiceRepo.GetByID(ctx, application.CreditMemoID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	invoice, err := s.invoiceRepo.GetByID(ctx, application.InvoiceID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if application.RealizedFXGainLoss != 0 {
+		// Finish a journal an earlier application attempt stopped short
+		// of, so there is a recorded journal to reverse
+		if application.GLJournalID == nil {
+			if err := s.postCreditApplication(ctx, creditMemo, invoice, application); err != nil {
+				return nil, err
+			}
+		}
+
+		reversalDate, _, err := s.resolvePostingDate(ctx, req.EntityID, time.Now(), "")
+		if err != nil {
+			return nil, err
+		}
+		journalReq, err := recordedJournal(ctx, s.journalRequests, req.EntityID, *application.GLJournalID)
+		if err != nil {
+			return nil, err
+		}
+		reversalReq := reversalJournalRequest(journalReq, reversalDate.Format("2006-01-02"), req.Reason)
+		reversalReq.IdempotencyKey = "credit-unapply:" + application.ID
+
+		reversalJournalID, err := s.journalsClient.CreateJournal(ctx, reversalReq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create credit application reversal journal entry: %w", err)
+		}
+		if err := s.journalsClient.PostJournal(ctx, reversalJournalID, req.EntityID); err != nil {
+			return nil, fmt.Errorf("failed to post credit application reversal journal entry: %w", err)
+		}
+		application.ReversalJournalID = &reversalJournalID
+	}
+
+	// Convert empty string to NULL for ReversedBy
+	if req.ReversedBy != "" {
+		application.ReversedBy = &req.ReversedBy
+	}
+	application.ReversalReason = &req.Reason
+
+	if err := s.invoiceRepo.ReverseCreditApplication(ctx, creditMemo, invoice, application); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("application_id", application.ID).
+		Str("credit_memo_id", creditMemo.ID).
+		Str("invoice_id", invoice.ID).
+		Int64("amount", application.Amount).
+		Str("reason", req.Reason).
+		Msg("Credit application reversed")
+
+	return s.invoiceRepo.GetByID(ctx, creditMemo.ID, req.EntityID)
+}
+
+// ListCreditApplications returns the credit applied to an invoice, or from
+// a credit memo, oldest first
+func (s *InvoiceService) ListCreditApplications(ctx context.Context, invoiceID, entityID string) ([]*repository.CreditApplication, error) {
+	if _, err := s.invoiceRepo.GetByID(ctx, invoiceID, entityID); err != nil {
+		return nil, err
+	}
+	return s.invoiceRepo.ListCreditApplications(ctx, invoiceID, entityID)
+}
@@ -0,0 +1,422 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Duplicate policies, set per entity
+const (
+	DuplicatePolicyOff   = "off"   // invoices are not checked when created
+	DuplicatePolicyWarn  = "warn"  // invoices are created and likely duplicates recorded
+	DuplicatePolicyBlock = "block" // likely duplicates are refused unless overridden with a reason
+)
+
+// defaultDuplicateThreshold is the score, out of 100, from which another
+// invoice is a likely duplicate for entities without saved settings
+const defaultDuplicateThreshold = 70
+
+// Recorded duplicate candidate actions
+const (
+	DuplicateWarned     = "warned"
+	DuplicateOverridden = "overridden"
+)
+
+// Duplicate score weights, adding up to at most 100. Invoice numbers one
+// character apart with the same vendor and amount but a month apart, as
+// recurring bills are, score 65.
+const (
+	scoreSameNumber    = 45 // same normalized invoice number
+	scoreSimilarNumber = 20 // normalized invoice numbers one character apart
+	scoreSameVendor    = 20
+	scoreSameTaxID     = 15 // another vendor record with the same tax ID
+	scoreSameAmount    = 25
+	scoreNearAmount    = 10 // within 1%
+	scoreSameDate      = 10
+	scoreNearDate      = 5 // within 7 days
+)
+
+// DuplicateDetectionService finds invoices that may duplicate another
+// beyond the exact invoice number the unique constraint rejects: numbers
+// keyed differently, the same invoice under another vendor record, or the
+// same amount and date with a typo in the number
+type DuplicateDetectionService struct {
+	duplicateRepo *repository.DuplicateRepository
+	invoiceRepo   *repository.InvoiceRepository
+	vendorsClient client.VendorsClientInterface
+	settings      *EntitySettingsService
+	log           *logger.Logger
+}
+
+// NewDuplicateDetectionService creates a new duplicate detection service
+func NewDuplicateDetectionService(
+	duplicateRepo *repository.DuplicateRepository,
+	invoiceRepo *repository.InvoiceRepository,
+	vendorsClient client.VendorsClientInterface,
+	settings *EntitySettingsService,
+	log *logger.Logger,
+) *DuplicateDetectionService {
+	return &DuplicateDetectionService{
+		duplicateRepo: duplicateRepo,
+		invoiceRepo:   invoiceRepo,
+		vendorsClient: vendorsClient,
+		settings:      settings,
+		log:           log,
+	}
+}
+
+// CheckDuplicatesRequest represents a request to check an invoice for
+// duplicates: an existing invoice by ID, or one about to be entered
+// described by its vendor, number, date, currency and total
+type CheckDuplicatesRequest struct {
+	EntityID      string `json:"entity_id"`
+	InvoiceID     string `json:"id,omitempty"`
+	VendorID      string `json:"vendor_id,omitempty"`
+	InvoiceNumber string `json:"invoice_number,omitempty"`
+	InvoiceDate   string `json:"invoice_date,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	TotalAmount   int64  `json:"total_amount,omitempty"`
+	InvoiceType   string `json:"invoice_type,omitempty"`
+}
+
+// DuplicateCheck is the result of checking an invoice for duplicates under
+// the entity's policy
+type DuplicateCheck struct {
+	Policy           string                           `json:"policy"`
+	Threshold        int                              `json:"threshold"`
+	OverrideRequired bool                             `json:"override_required"` // creating the invoice needs an override reason
+	Candidates       []*repository.DuplicateCandidate `json:"candidates"`
+}
+
+// CheckDuplicates returns the likely duplicates of an invoice, whatever the
+// entity's policy, and whether creating it would need an override
+func (s *DuplicateDetectionService) CheckDuplicates(ctx context.Context, req *CheckDuplicatesRequest) (*DuplicateCheck, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+
+	var invoice *repository.Invoice
+	var total int64
+	if req.InvoiceID != "" {
+		var err error
+		invoice, err = s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		total = invoice.TotalAmount
+	} else {
+		if req.VendorID == "" || req.InvoiceNumber == "" {
+			return nil, errors.InvalidInput("invoice_number", "id, or vendor_id and invoice_number, are required")
+		}
+		invoiceDate, err := time.Parse("2006-01-02", req.InvoiceDate)
+		if err != nil {
+			return nil, errors.InvalidInput("invoice_date", "invalid date format, expected YYYY-MM-DD")
+		}
+		cur, err := currency.Lookup(req.Currency)
+		if err != nil {
+			return nil, errors.InvalidInput("currency", "currency must be an ISO 4217 code")
+		}
+		invoice = &repository.Invoice{
+			EntityID:      req.EntityID,
+			VendorID:      req.VendorID,
+			InvoiceNumber: req.InvoiceNumber,
+			InvoiceDate:   invoiceDate,
+			Currency:      cur.Code,
+			InvoiceType:   strings.ToLower(req.InvoiceType),
+		}
+		total = req.TotalAmount
+	}
+
+	settings, err := s.settings.GetSettings(ctx, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := s.find(ctx, invoice, total, settings.DuplicateThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DuplicateCheck{
+		Policy:           settings.DuplicatePolicy,
+		Threshold:        settings.DuplicateThreshold,
+		OverrideRequired: settings.DuplicatePolicy == DuplicatePolicyBlock && len(candidates) > 0,
+		Candidates:       candidates,
+	}, nil
+}
+
+// ListDuplicates returns the likely duplicates recorded when an invoice
+// was created, with any override
+func (s *DuplicateDetectionService) ListDuplicates(ctx context.Context, invoiceID, entityID string) ([]*repository.DuplicateCandidate, error) {
+	if _, err := s.invoiceRepo.GetByID(ctx, invoiceID, entityID); err != nil {
+		return nil, err
+	}
+	return s.duplicateRepo.ListByInvoice(ctx, invoiceID, entityID)
+}
+
+// screen checks an invoice about to be created under the entity's policy
+// and returns its likely duplicates. Under the block policy an invoice with
+// any is refused unless overrideReason is given, or warnOnly is set for a
+// caller that cannot give one.
+func (s *DuplicateDetectionService) screen(ctx context.Context, invoice *repository.Invoice, overrideReason string, warnOnly bool) ([]*repository.DuplicateCandidate, error) {
+	settings, err := s.settings.GetSettings(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if settings.DuplicatePolicy == DuplicatePolicyOff {
+		return nil, nil
+	}
+
+	candidates, err := s.find(ctx, invoice, linesTotal(invoice), settings.DuplicateThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(candidates) > 0 && settings.DuplicatePolicy == DuplicatePolicyBlock && !warnOnly && strings.TrimSpace(overrideReason) == "" {
+		found := make([]string, 0, len(candidates))
+		for _, candidate := range candidates {
+			found = append(found, fmt.Sprintf("%s (score %d: %s)",
+				candidate.InvoiceNumber, candidate.Score, strings.Join(candidate.Reasons, ", ")))
+		}
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("invoice is a likely duplicate of %s; give a duplicate_override_reason to create it anyway",
+				strings.Join(found, "; ")))
+	}
+
+	return candidates, nil
+}
+
+// markDuplicates sets the action the likely duplicates of an invoice about
+// to be created are recorded with: overridden if a reason was given and
+// warned otherwise
+func markDuplicates(candidates []*repository.DuplicateCandidate, overrideReason string, overriddenBy *string) []*repository.DuplicateCandidate {
+	reason := strings.TrimSpace(overrideReason)
+	for _, candidate := range candidates {
+		candidate.Action = DuplicateWarned
+		if reason != "" {
+			candidate.Action = DuplicateOverridden
+			candidate.OverrideReason = &reason
+			candidate.OverriddenBy = overriddenBy
+		}
+	}
+	return candidates
+}
+
+// logCreated logs a newly created invoice's recorded likely duplicates
+func (s *DuplicateDetectionService) logCreated(invoice *repository.Invoice) {
+	candidates := invoice.DuplicateWarnings
+	if len(candidates) == 0 {
+		return
+	}
+
+	s.log.Info().
+		Str("invoice_id", invoice.ID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Str("duplicate_of", candidates[0].InvoiceNumber).
+		Int("score", candidates[0].Score).
+		Int("candidates", len(candidates)).
+		Bool("overridden", candidates[0].Action == DuplicateOverridden).
+		Msg("Likely duplicate invoice created")
+}
+
+// find returns the invoices scoring at least threshold as duplicates of an
+// invoice with the given total, highest score first
+func (s *DuplicateDetectionService) find(ctx context.Context, invoice *repository.Invoice, total int64, threshold int) ([]*repository.DuplicateCandidate, error) {
+	number := normalizeInvoiceNumber(invoice.InvoiceNumber)
+	search := &repository.DuplicateSearch{
+		EntityID:         invoice.EntityID,
+		VendorID:         invoice.VendorID,
+		NormalizedNumber: number,
+		InvoiceDate:      invoice.InvoiceDate,
+		Currency:         invoice.Currency,
+		TotalAmount:      total,
+		CreditMemo:       invoice.InvoiceType == "credit_memo",
+	}
+	if invoice.ID != "" {
+		search.ExcludeID = &invoice.ID
+	}
+
+	found, err := s.duplicateRepo.FindCandidates(ctx, search)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tax IDs by vendor ID, looked up only for candidates another vendor
+	// record could make a likely duplicate
+	taxIDs := make(map[string]string)
+	taxID := func(vendorID string) (string, error) {
+		if id, ok := taxIDs[vendorID]; ok {
+			return id, nil
+		}
+		vendor, err := s.vendorsClient.GetVendor(ctx, vendorID, invoice.EntityID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get vendor: %w", err)
+		}
+		taxIDs[vendorID] = strings.TrimSpace(vendor.TaxID)
+		return taxIDs[vendorID], nil
+	}
+
+	candidates := make([]*repository.DuplicateCandidate, 0)
+	for _, candidate := range found {
+		score, reasons := scoreDuplicate(number, total, invoice, candidate)
+
+		if candidate.VendorID == invoice.VendorID {
+			score += scoreSameVendor
+			reasons = append(reasons, "same vendor")
+		} else if score+scoreSameTaxID >= threshold {
+			own, err := taxID(invoice.VendorID)
+			if err != nil {
+				return nil, err
+			}
+			other, err := taxID(candidate.VendorID)
+			if err != nil {
+				return nil, err
+			}
+			if own != "" && strings.EqualFold(own, other) {
+				score += scoreSameTaxID
+				reasons = append(reasons, "vendor record with the same tax ID")
+			}
+		}
+
+		if score >= threshold {
+			candidate.Score = score
+			candidate.Reasons = reasons
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	return candidates, nil
+}
+
+// scoreDuplicate scores how alike an invoice and a candidate are on number,
+// amount and date, with why; the vendor is scored by the caller
+func scoreDuplicate(number string, total int64, invoice *repository.Invoice, candidate *repository.DuplicateCandidate) (int, []string) {
+	score := 0
+	reasons := make([]string, 0, 4)
+
+	other := normalizeInvoiceNumber(candidate.InvoiceNumber)
+	switch {
+	case number == other:
+		score += scoreSameNumber
+		if invoice.InvoiceNumber == candidate.InvoiceNumber {
+			reasons = append(reasons, "same invoice number")
+		} else {
+			reasons = append(reasons, fmt.Sprintf("invoice number %s matches once normalized", candidate.InvoiceNumber))
+		}
+	case oneEditApart(number, other):
+		score += scoreSimilarNumber
+		reasons = append(reasons, fmt.Sprintf("invoice number %s differs by one character", candidate.InvoiceNumber))
+	}
+
+	if candidate.Currency == invoice.Currency {
+		diff := candidate.TotalAmount - total
+		if diff < 0 {
+			diff = -diff
+		}
+		magnitude := total
+		if magnitude < 0 {
+			magnitude = -magnitude
+		}
+		switch {
+		case diff == 0:
+			score += scoreSameAmount
+			reasons = append(reasons, "same amount")
+		case diff*100 <= magnitude:
+			score += scoreNearAmount
+			reasons = append(reasons, "amount within 1%")
+		}
+	}
+
+	days := candidate.InvoiceDate.Sub(invoice.InvoiceDate).Hours() / 24
+	if days < 0 {
+		days = -days
+	}
+	switch {
+	case days < 1:
+		score += scoreSameDate
+		reasons = append(reasons, "same invoice date")
+	case days <= 7:
+		score += scoreNearDate
+		reasons = append(reasons, "invoice date within 7 days")
+	}
+
+	return score, reasons
+}
+
+var (
+	invoiceNumberZeros      = regexp.MustCompile(`(^|[^0-9])0+([0-9])`)
+	invoiceNumberSeparators = regexp.MustCompile(`[^A-Z0-9]`)
+)
+
+// normalizeInvoiceNumber reduces an invoice number to upper case letters
+// and digits, dropping leading zeros from each run of digits first, so
+// "inv-001", "INV 1" and "INV0001" compare equal, as do "INV-2024-001" and
+// "INV-2024-1". It must agree with the normalized_invoice_number column
+// (migration 024).
+func normalizeInvoiceNumber(number string) string {
+	normalized := invoiceNumberZeros.ReplaceAllString(strings.ToUpper(number), "${1}${2}")
+	return invoiceNumberSeparators.ReplaceAllString(normalized, "")
+}
+
+// oneEditApart reports whether two normalized invoice numbers of at least
+// four characters differ by one inserted, deleted, replaced or swapped
+// adjacent character
+func oneEditApart(a, b string) bool {
+	if len(a) < 4 || len(b) < 4 || a == b {
+		return false
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+
+	switch len(b) - len(a) {
+	case 0:
+		diffs := make([]int, 0, 2)
+		for i := 0; i < len(a); i++ {
+			if a[i] != b[i] {
+				diffs = append(diffs, i)
+				if len(diffs) > 2 {
+					return false
+				}
+			}
+		}
+		if len(diffs) == 1 {
+			return true
+		}
+		// Adjacent characters swapped
+		i := diffs[0]
+		return diffs[1] == i+1 && a[i] == b[i+1] && a[i+1] == b[i]
+	case 1:
+		// b is a with one character inserted
+		i := 0
+		for i < len(a) && a[i] == b[i] {
+			i++
+		}
+		return a[i:] == b[i+1:]
+	}
+	return false
+}
+
+// linesTotal returns the total of an invoice from its lines, as the
+// invoice totals trigger computes it on saving
+func linesTotal(invoice *repository.Invoice) int64 {
+	var total int64
+	for _, line := range invoice.Lines {
+		total += line.LineAmount + line.TaxAmount
+	}
+	return total
+}
@@ -0,0 +1,57 @@
+package service
+
+import "testing"
+
+func TestNormalizeInvoiceNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "inv-001", want: "INV1"},
+		{in: "INV 1", want: "INV1"},
+		{in: "INV0001", want: "INV1"},
+		{in: "INV-2024-001", want: "INV20241"},
+		{in: "INV-2024-1", want: "INV20241"},
+		{in: "001", want: "1"},
+		{in: "000", want: "0"},
+		{in: "100", want: "100"},
+		{in: "A-0-B", want: "A0B"},
+		{in: "ab.c/d_e", want: "ABCDE"},
+		{in: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeInvoiceNumber(tt.in); got != tt.want {
+			t.Errorf("normalizeInvoiceNumber(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOneEditApart(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "INV1234", b: "INV1235", want: true},
+		{a: "INV1234", b: "INV12X4", want: true},
+		{a: "INV1234", b: "INV1243", want: true},
+		{a: "INV1234", b: "INV12345", want: true},
+		{a: "INV12345", b: "INV1234", want: true},
+		{a: "INV1234", b: "NV1234", want: true},
+		{a: "INV1234", b: "INV11234", want: true},
+		{a: "INV1234", b: "INV1234", want: false},
+		{a: "INV1234", b: "INV0235", want: false},
+		{a: "INV1234", b: "INV2143", want: false},
+		{a: "INV1234", b: "INV4321", want: false},
+		{a: "INV1234", b: "INV123456", want: false},
+		{a: "INV1234", b: "XINV12345", want: false},
+		{a: "ABC", b: "ABD", want: false},
+		{a: "ABCD", b: "ABC", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := oneEditApart(tt.a, tt.b); got != tt.want {
+			t.Errorf("oneEditApart(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
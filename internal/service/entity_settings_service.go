@@ -0,0 +1,360 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Chart-of-accounts codes used when an entity has not configured the
+// corresponding control account
+const (
+	fallbackAPAccountCode   = "2000" // Accounts Payable
+	fallbackCashAccountCode = "1010" // Cash
+)
+
+// defaultPaymentTerms applies to entities without saved settings
+const defaultPaymentTerms = "net30"
+
+// EntitySettingsService manages per-entity AP configuration and resolves
+// the control accounts used by every posting path
+type EntitySettingsService struct {
+	settingsRepo   *repository.EntitySettingsRepository
+	accountsClient client.AccountsClientInterface
+	log            *logger.Logger
+}
+
+// NewEntitySettingsService creates a new entity settings service
+func NewEntitySettingsService(
+	settingsRepo *repository.EntitySettingsRepository,
+	accountsClient client.AccountsClientInterface,
+	log *logger.Logger,
+) *EntitySettingsService {
+	return &EntitySettingsService{
+		settingsRepo:   settingsRepo,
+		accountsClient: accountsClient,
+		log:            log,
+	}
+}
+
+// UpdateEntitySettingsRequest represents an update entity settings request.
+// Nil fields are left unchanged; an empty account ID clears that account.
+type UpdateEntitySettingsRequest struct {
+	EntityID                  string   `json:"entity_id"`
+	APControlAccountID        *string  `json:"ap_control_account_id,omitempty"`
+	DefaultCashAccountID      *string  `json:"default_cash_account_id,omitempty"`
+	TaxPayableAccountID       *string  `json:"tax_payable_account_id,omitempty"`
+	TaxReceivableAccountID    *string  `json:"tax_receivable_account_id,omitempty"`
+	RoundingAccountID         *string  `json:"rounding_account_id,omitempty"`
+	DefaultPaymentTerms       *string  `json:"default_payment_terms,omitempty"`
+	AmountTolerance           *int64   `json:"amount_tolerance,omitempty"`
+	PercentTolerance          *float64 `json:"percent_tolerance,omitempty"`
+	ClosedPeriodPolicy        *string  `json:"closed_period_policy,omitempty"`
+	TaxRounding               *string  `json:"tax_rounding,omitempty"`
+	LineAmountTolerance       *int64   `json:"line_amount_tolerance,omitempty"`
+	FunctionalCurrency        *string  `json:"functional_currency,omitempty"`
+	RealizedFXGainAccountID   *string  `json:"realized_fx_gain_account_id,omitempty"`
+	RealizedFXLossAccountID   *string  `json:"realized_fx_loss_account_id,omitempty"`
+	UnrealizedFXGainAccountID *string  `json:"unrealized_fx_gain_account_id,omitempty"`
+	UnrealizedFXLossAccountID *string  `json:"unrealized_fx_loss_account_id,omitempty"`
+	PrepaymentAccountID       *string  `json:"prepayment_account_id,omitempty"`
+	POMatchLevel              *string  `json:"po_match_level,omitempty"`
+	QuantityTolerance         *float64 `json:"quantity_tolerance,omitempty"`
+	DuplicatePolicy           *string  `json:"duplicate_policy,omitempty"`
+	DuplicateThreshold        *int     `json:"duplicate_threshold,omitempty"`
+	SplitInvoicePolicy        *string  `json:"split_invoice_policy,omitempty"`
+	SplitInvoiceWindowDays    *int     `json:"split_invoice_window_days,omitempty"`
+	UpdatedBy                 string   `json:"updated_by,omitempty"`
+}
+
+// GetSettings returns the saved settings of an entity, or the defaults if
+// none have been saved
+func (s *EntitySettingsService) GetSettings(ctx context.Context, entityID string) (*repository.EntitySettings, error) {
+	settings, err := s.settingsRepo.Get(ctx, entityID)
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		settings = &repository.EntitySettings{
+			EntityID:               entityID,
+			DefaultPaymentTerms:    defaultPaymentTerms,
+			ClosedPeriodPolicy:     ClosedPeriodReject,
+			TaxRounding:            TaxRoundingLine,
+			POMatchLevel:           MatchTwoWay,
+			DuplicatePolicy:        DuplicatePolicyWarn,
+			DuplicateThreshold:     defaultDuplicateThreshold,
+			SplitInvoicePolicy:     SplitPolicyEscalate,
+			SplitInvoiceWindowDays: defaultSplitWindowDays,
+		}
+	}
+	return settings, nil
+}
+
+// UpdateSettings applies a partial update to an entity's settings. Every
+// account being set is validated against GL-1 before anything is saved.
+func (s *EntitySettingsService) UpdateSettings(ctx context.Context, req *UpdateEntitySettingsRequest) (*repository.EntitySettings, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+
+	settings, err := s.GetSettings(ctx, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []struct {
+		field  string
+		value  *string
+		target **string
+	}{
+		{"ap_control_account_id", req.APControlAccountID, &settings.APControlAccountID},
+		{"default_cash_account_id", req.DefaultCashAccountID, &settings.DefaultCashAccountID},
+		{"tax_payable_account_id", req.TaxPayableAccountID, &settings.TaxPayableAccountID},
+		{"tax_receivable_account_id", req.TaxReceivableAccountID, &settings.TaxReceivableAccountID},
+		{"rounding_account_id", req.RoundingAccountID, &settings.RoundingAccountID},
+		{"realized_fx_gain_account_id", req.RealizedFXGainAccountID, &settings.RealizedFXGainAccountID},
+		{"realized_fx_loss_account_id", req.RealizedFXLossAccountID, &settings.RealizedFXLossAccountID},
+		{"unrealized_fx_gain_account_id", req.UnrealizedFXGainAccountID, &settings.UnrealizedFXGainAccountID},
+		{"unrealized_fx_loss_account_id", req.UnrealizedFXLossAccountID, &settings.UnrealizedFXLossAccountID},
+		{"prepayment_account_id", req.PrepaymentAccountID, &settings.PrepaymentAccountID},
+	}
+
+	for _, a := range accounts {
+		if a.value == nil {
+			continue
+		}
+		if *a.value == "" {
+			*a.target = nil
+			continue
+		}
+
+		valid, message, err := s.accountsClient.ValidateAccount(ctx, *a.value, req.EntityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate account %s: %w", *a.value, err)
+		}
+		if !valid {
+			return nil, errors.InvalidInput(a.field, fmt.Sprintf("account %s: %s", *a.value, message))
+		}
+
+		accountID := *a.value
+		*a.target = &accountID
+	}
+
+	if req.DefaultPaymentTerms != nil {
+		if *req.DefaultPaymentTerms == "" {
+			return nil, errors.InvalidInput("default_payment_terms", "default payment terms cannot be empty")
+		}
+		settings.DefaultPaymentTerms = *req.DefaultPaymentTerms
+	}
+
+	if req.AmountTolerance != nil {
+		if *req.AmountTolerance < 0 {
+			return nil, errors.InvalidInput("amount_tolerance", "amount tolerance cannot be negative")
+		}
+		settings.AmountTolerance = *req.AmountTolerance
+	}
+
+	if req.PercentTolerance != nil {
+		if *req.PercentTolerance < 0 || *req.PercentTolerance > 100 {
+			return nil, errors.InvalidInput("percent_tolerance", "percent tolerance must be between 0 and 100")
+		}
+		settings.PercentTolerance = *req.PercentTolerance
+	}
+
+	if req.ClosedPeriodPolicy != nil {
+		switch *req.ClosedPeriodPolicy {
+		case ClosedPeriodReject, ClosedPeriodRollForward:
+			settings.ClosedPeriodPolicy = *req.ClosedPeriodPolicy
+		default:
+			return nil, errors.InvalidInput("closed_period_policy",
+				fmt.Sprintf("closed period policy must be %s or %s", ClosedPeriodReject, ClosedPeriodRollForward))
+		}
+	}
+
+	if req.TaxRounding != nil {
+		switch *req.TaxRounding {
+		case TaxRoundingLine, TaxRoundingInvoice:
+			settings.TaxRounding = *req.TaxRounding
+		default:
+			return nil, errors.InvalidInput("tax_rounding",
+				fmt.Sprintf("tax rounding must be %s or %s", TaxRoundingLine, TaxRoundingInvoice))
+		}
+	}
+
+	if req.LineAmountTolerance != nil {
+		if *req.LineAmountTolerance < 0 {
+			return nil, errors.InvalidInput("line_amount_tolerance", "line amount tolerance cannot be negative")
+		}
+		settings.LineAmountTolerance = *req.LineAmountTolerance
+	}
+
+	if req.POMatchLevel != nil {
+		switch *req.POMatchLevel {
+		case MatchTwoWay, MatchThreeWay:
+			settings.POMatchLevel = *req.POMatchLevel
+		default:
+			return nil, errors.InvalidInput("po_match_level",
+				fmt.Sprintf("PO match level must be %s or %s", MatchTwoWay, MatchThreeWay))
+		}
+	}
+
+	if req.QuantityTolerance != nil {
+		if *req.QuantityTolerance < 0 || *req.QuantityTolerance > 100 {
+			return nil, errors.InvalidInput("quantity_tolerance", "quantity tolerance must be between 0 and 100")
+		}
+		settings.QuantityTolerance = *req.QuantityTolerance
+	}
+
+	if req.DuplicatePolicy != nil {
+		switch *req.DuplicatePolicy {
+		case DuplicatePolicyOff, DuplicatePolicyWarn, DuplicatePolicyBlock:
+			settings.DuplicatePolicy = *req.DuplicatePolicy
+		default:
+			return nil, errors.InvalidInput("duplicate_policy",
+				fmt.Sprintf("duplicate policy must be %s, %s or %s", DuplicatePolicyOff, DuplicatePolicyWarn, DuplicatePolicyBlock))
+		}
+	}
+
+	if req.DuplicateThreshold != nil {
+		if *req.DuplicateThreshold < 1 || *req.DuplicateThreshold > 100 {
+			return nil, errors.InvalidInput("duplicate_threshold", "duplicate threshold must be between 1 and 100")
+		}
+		settings.DuplicateThreshold = *req.DuplicateThreshold
+	}
+
+	if req.SplitInvoicePolicy != nil {
+		switch *req.SplitInvoicePolicy {
+		case SplitPolicyOff, SplitPolicyHold, SplitPolicyEscalate:
+			settings.SplitInvoicePolicy = *req.SplitInvoicePolicy
+		default:
+			return nil, errors.InvalidInput("split_invoice_policy",
+				fmt.Sprintf("split invoice policy must be %s, %s or %s", SplitPolicyOff, SplitPolicyHold, SplitPolicyEscalate))
+		}
+	}
+
+	if req.SplitInvoiceWindowDays != nil {
+		if *req.SplitInvoiceWindowDays < 1 || *req.SplitInvoiceWindowDays > 90 {
+			return nil, errors.InvalidInput("split_invoice_window_days", "split invoice window must be between 1 and 90 days")
+		}
+		settings.SplitInvoiceWindowDays = *req.SplitInvoiceWindowDays
+	}
+
+	if req.FunctionalCurrency != nil {
+		cur, err := currency.Lookup(*req.FunctionalCurrency)
+		if err != nil {
+			return nil, errors.InvalidInput("functional_currency", "functional currency must be an ISO 4217 code")
+		}
+		settings.FunctionalCurrency = &cur.Code
+	}
+
+	// Convert empty string to NULL for UpdatedBy
+	settings.UpdatedBy = nil
+	if req.UpdatedBy != "" {
+		settings.UpdatedBy = &req.UpdatedBy
+	}
+
+	if err := s.settingsRepo.Upsert(ctx, settings); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("entity_id", req.EntityID).
+		Str("updated_by", req.UpdatedBy).
+		Msg("Entity settings updated")
+
+	return settings, nil
+}
+
+// APControlAccountID returns the Accounts Payable control account of an
+// entity, falling back to account code 2000 if none is configured
+func (s *EntitySettingsService) APControlAccountID(ctx context.Context, entityID string) (string, error) {
+	settings, err := s.GetSettings(ctx, entityID)
+	if err != nil {
+		return "", err
+	}
+	return s.accountOrFallback(ctx, entityID, settings.APControlAccountID, fallbackAPAccountCode, "AP")
+}
+
+// CashAccountID returns the default cash/bank account of an entity, falling
+// back to account code 1010 if none is configured
+func (s *EntitySettingsService) CashAccountID(ctx context.Context, entityID string) (string, error) {
+	settings, err := s.GetSettings(ctx, entityID)
+	if err != nil {
+		return "", err
+	}
+	return s.accountOrFallback(ctx, entityID, settings.DefaultCashAccountID, fallbackCashAccountCode, "cash")
+}
+
+// RealizedFXAccountID returns the account a realized FX gain, or loss, is
+// posted to. There is no fallback account; an entity paying foreign-currency
+// invoices at a rate other than the booked one must configure both.
+func (s *EntitySettingsService) RealizedFXAccountID(ctx context.Context, entityID string, gain bool) (string, error) {
+	settings, err := s.GetSettings(ctx, entityID)
+	if err != nil {
+		return "", err
+	}
+
+	if gain {
+		if settings.RealizedFXGainAccountID == nil {
+			return "", errors.InvalidInput("realized_fx_gain_account_id", "payment has a realized FX gain but no realized FX gain account is configured")
+		}
+		return *settings.RealizedFXGainAccountID, nil
+	}
+
+	if settings.RealizedFXLossAccountID == nil {
+		return "", errors.InvalidInput("realized_fx_loss_account_id", "payment has a realized FX loss but no realized FX loss account is configured")
+	}
+	return *settings.RealizedFXLossAccountID, nil
+}
+
+// UnrealizedFXAccountIDs returns the accounts period-end revaluation posts
+// unrealized FX gains and losses to. Both must be configured; there is no
+// fallback account.
+func (s *EntitySettingsService) UnrealizedFXAccountIDs(ctx context.Context, entityID string) (gainAccountID, lossAccountID string, err error) {
+	settings, err := s.GetSettings(ctx, entityID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if settings.UnrealizedFXGainAccountID == nil {
+		return "", "", errors.InvalidInput("unrealized_fx_gain_account_id", "no unrealized FX gain account is configured")
+	}
+	if settings.UnrealizedFXLossAccountID == nil {
+		return "", "", errors.InvalidInput("unrealized_fx_loss_account_id", "no unrealized FX loss account is configured")
+	}
+	return *settings.UnrealizedFXGainAccountID, *settings.UnrealizedFXLossAccountID, nil
+}
+
+// PrepaymentAccountID returns the asset account prepayment invoices post to.
+// There is no fallback account; an entity must configure one before posting
+// a prepayment.
+func (s *EntitySettingsService) PrepaymentAccountID(ctx context.Context, entityID string) (string, error) {
+	settings, err := s.GetSettings(ctx, entityID)
+	if err != nil {
+		return "", err
+	}
+
+	if settings.PrepaymentAccountID == nil {
+		return "", errors.InvalidInput("prepayment_account_id", "no prepayment account is configured")
+	}
+	return *settings.PrepaymentAccountID, nil
+}
+
+// accountOrFallback returns accountID if configured, otherwise the ID of
+// the account with fallbackCode in the entity's chart of accounts
+func (s *EntitySettingsService) accountOrFallback(ctx context.Context, entityID string, accountID *string, fallbackCode, name string) (string, error) {
+	if accountID != nil {
+		return *accountID, nil
+	}
+
+	account, err := s.accountsClient.GetAccountByCode(ctx, fallbackCode, entityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s account: %w", name, err)
+	}
+	return account.ID, nil
+}
@@ -0,0 +1,373 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// FXRevaluationService revalues the open balances of posted foreign-currency
+// invoices at period end. Each invoice's open liability, carried at the rate
+// captured when it was posted, is restated at the period-end rate; the
+// differences post as unrealized FX gain/loss in a journal on the last day of
+// the period that reverses on the first day of the next, so payments keep
+// settling the liability at the booked rate.
+type FXRevaluationService struct {
+	revaluationRepo *repository.FXRevaluationRepository
+	invoiceRepo     *repository.InvoiceRepository
+	journalsClient  client.JournalsClientInterface
+	periodsClient   client.PeriodsClientInterface
+	settings        *EntitySettingsService
+	fx              *FXService
+	log             *logger.Logger
+}
+
+// NewFXRevaluationService creates a new FX revaluation service
+func NewFXRevaluationService(
+	revaluationRepo *repository.FXRevaluationRepository,
+	invoiceRepo *repository.InvoiceRepository,
+	journalsClient client.JournalsClientInterface,
+	periodsClient client.PeriodsClientInterface,
+	settings *EntitySettingsService,
+	fx *FXService,
+	log *logger.Logger,
+) *FXRevaluationService {
+	return &FXRevaluationService{
+		revaluationRepo: revaluationRepo,
+		invoiceRepo:     invoiceRepo,
+		journalsClient:  journalsClient,
+		periodsClient:   periodsClient,
+		settings:        settings,
+		fx:              fx,
+		log:             log,
+	}
+}
+
+// RunFXRevaluationRequest represents a run period-end FX revaluation request
+type RunFXRevaluationRequest struct {
+	EntityID  string `json:"entity_id"`
+	PeriodID  string `json:"period_id"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// RunRevaluation revalues an entity's open foreign-currency invoices as of
+// the end of a period. A period is revalued once: a posted run is a
+// conflict, and a run stopped after its revaluation journal was posted is
+// resumed rather than recalculated. A run that failed before its journal
+// was sent to GL-2 is marked failed and the period may be run again.
+func (s *FXRevaluationService) RunRevaluation(ctx context.Context, req *RunFXRevaluationRequest) (*repository.FXRevaluationRun, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+	if req.PeriodID == "" {
+		return nil, errors.InvalidInput("period_id", "period_id is required")
+	}
+
+	existing, err := s.revaluationRepo.GetActiveForPeriod(ctx, req.EntityID, req.PeriodID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.Status == "posted" {
+			return nil, errors.New(errors.ErrCodeConflict,
+				fmt.Sprintf("period %s was already revalued by run %s", req.PeriodID, existing.ID))
+		}
+		s.log.Info().
+			Str("run_id", existing.ID).
+			Str("entity_id", req.EntityID).
+			Str("gl_period_id", req.PeriodID).
+			Msg("Resuming FX revaluation run")
+		return s.postRun(ctx, existing)
+	}
+
+	settings, err := s.settings.GetSettings(ctx, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if settings.FunctionalCurrency == nil {
+		return nil, errors.InvalidInput("functional_currency", "entity has no functional currency to revalue into")
+	}
+	functional := *settings.FunctionalCurrency
+
+	// The revaluation posts on the last day of the period and reverses on
+	// the first day of the next; both periods must be open
+	period, err := s.periodsClient.GetPeriod(ctx, req.PeriodID, req.EntityID)
+	if err != nil {
+		return nil, errors.InvalidInput("period_id", err.Error())
+	}
+	if !period.IsOpen() {
+		return nil, errors.New(errors.ErrCodeConflict, fmt.Sprintf("accounting period %s is closed", period.Name))
+	}
+	reversalDate := period.EndDate.AddDate(0, 0, 1)
+	nextPeriod, err := s.periodsClient.GetPeriodForDate(ctx, req.EntityID, reversalDate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accounting period: %w", err)
+	}
+	if !nextPeriod.IsOpen() {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("accounting period %s, where the revaluation reverses, is closed", nextPeriod.Name))
+	}
+
+	invoices, err := s.invoiceRepo.ListOpenForeignCurrency(ctx, req.EntityID, functional, period.EndDate)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &repository.FXRevaluationRun{
+		EntityID:           req.EntityID,
+		GLPeriodID:         period.ID,
+		PeriodEnd:          period.EndDate,
+		ReversalDate:       reversalDate,
+		FunctionalCurrency: functional,
+		Status:             "pending",
+		Lines:              make([]*repository.FXRevaluationLine, 0, len(invoices)),
+	}
+
+	// Convert empty string to NULL for CreatedBy
+	if req.CreatedBy != "" {
+		run.CreatedBy = &req.CreatedBy
+	}
+
+	rates := make(map[string]decimal.Rate)
+	for _, invoice := range invoices {
+		rate, ok := rates[invoice.Currency]
+		if !ok {
+			rate, err = s.fx.PeriodEndRate(ctx, invoice.Currency, functional, period.StartDate, period.EndDate)
+			if err != nil {
+				return nil, err
+			}
+			rates[invoice.Currency] = rate
+		}
+
+		line := revaluationLine(invoice, rate)
+		run.Lines = append(run.Lines, line)
+		if line.Adjustment > 0 {
+			run.TotalLoss += line.Adjustment
+		} else {
+			run.TotalGain -= line.Adjustment
+		}
+	}
+	run.InvoiceCount = len(run.Lines)
+
+	// Check the accounts before recording anything
+	if run.TotalGain != 0 || run.TotalLoss != 0 {
+		if _, _, err := s.settings.UnrealizedFXAccountIDs(ctx, req.EntityID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.revaluationRepo.Create(ctx, run); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("run_id", run.ID).
+		Str("entity_id", req.EntityID).
+		Str("gl_period_id", run.GLPeriodID).
+		Int("invoice_count", run.InvoiceCount).
+		Int64("total_gain", run.TotalGain).
+		Int64("total_loss", run.TotalLoss).
+		Msg("FX revaluation run created")
+
+	return s.postRun(ctx, run)
+}
+
+// revaluationLine restates an invoice's open balance at rate. The booked
+// liability still open is what its payments have not yet settled at the
+// posted rate. A credit memo's open balance reduces the liability, so its
+// adjustment has the opposite sign.
+func revaluationLine(invoice *repository.Invoice, rate decimal.Rate) *repository.FXRevaluationLine {
+	booked := invoice.FunctionalTotalAmount - invoice.FunctionalAmountPaid
+	revalued := convertAmount(invoice.AmountDue, invoice.Currency, invoice.FunctionalCurrency, rate)
+	adjustment := revalued - booked
+	if invoice.InvoiceType == "credit_memo" {
+		adjustment = -adjustment
+	}
+
+	return &repository.FXRevaluationLine{
+		InvoiceID:          invoice.ID,
+		InvoiceNumber:      invoice.InvoiceNumber,
+		Currency:           invoice.Currency,
+		AmountDue:          invoice.AmountDue,
+		BookedRate:         bookedRate(invoice),
+		BookedFunctional:   booked,
+		PeriodEndRate:      rate,
+		RevaluedFunctional: revalued,
+		Adjustment:         adjustment,
+	}
+}
+
+// postRun creates and posts the revaluation journal of a run and its
+// reversal, and marks the run posted. A run with nothing to adjust is
+// completed without journals. Each journal is keyed by run, so resuming a
+// run reuses a journal GL-2 already created for it.
+func (s *FXRevaluationService) postRun(ctx context.Context, run *repository.FXRevaluationRun) (*repository.FXRevaluationRun, error) {
+	if sent, err := s.postJournals(ctx, run); err != nil {
+		// Once the journal has been sent GL-2 may have created or posted it
+		// even though the call failed, and only a retry of this run, keyed
+		// the same, can find it again. Only a run stopped before then can be
+		// discarded and the period run again.
+		status := "pending"
+		if !sent {
+			status = "failed"
+		}
+		if recordErr := s.revaluationRepo.RecordError(ctx, run.ID, status, err.Error()); recordErr != nil {
+			s.log.Error().Err(recordErr).Str("run_id", run.ID).Msg("Failed to record FX revaluation error")
+		}
+		return nil, err
+	}
+
+	if err := s.revaluationRepo.Complete(ctx, run); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("run_id", run.ID).
+		Str("entity_id", run.EntityID).
+		Str("gl_period_id", run.GLPeriodID).
+		Msg("FX revaluation run posted")
+
+	return run, nil
+}
+
+// postJournals posts the revaluation journal, unless an earlier attempt
+// did, and then its reversal. It reports whether the journal was sent to
+// GL-2, by this attempt or an earlier one, so a failed run is only
+// discarded when GL-2 cannot hold anything for it.
+func (s *FXRevaluationService) postJournals(ctx context.Context, run *repository.FXRevaluationRun) (bool, error) {
+	if run.TotalGain == 0 && run.TotalLoss == 0 {
+		return false, nil
+	}
+
+	journal, err := s.revaluationJournal(ctx, run)
+	if err != nil {
+		return run.GLJournalID != nil, err
+	}
+	if err := checkJournalBalanced(journal); err != nil {
+		return run.GLJournalID != nil, err
+	}
+
+	if run.GLJournalID == nil {
+		glJournalID, err := s.journalsClient.CreateJournal(ctx, journal)
+		if err != nil {
+			return true, fmt.Errorf("failed to create FX revaluation journal entry: %w", err)
+		}
+		if err := s.journalsClient.PostJournal(ctx, glJournalID, run.EntityID); err != nil {
+			return true, fmt.Errorf("failed to post FX revaluation journal entry: %w", err)
+		}
+		if err := s.revaluationRepo.SetJournal(ctx, run.ID, glJournalID); err != nil {
+			return true, err
+		}
+		run.GLJournalID = &glJournalID
+	}
+
+	reversal := reversalJournalRequest(journal, run.ReversalDate.Format("2006-01-02"), "automatic reversal at the start of the next period")
+	reversal.IdempotencyKey = "fx-revaluation-reversal:" + run.ID
+
+	reversalJournalID, err := s.journalsClient.CreateJournal(ctx, reversal)
+	if err != nil {
+		return true, fmt.Errorf("failed to create FX revaluation reversal journal entry: %w", err)
+	}
+	if err := s.journalsClient.PostJournal(ctx, reversalJournalID, run.EntityID); err != nil {
+		return true, fmt.Errorf("failed to post FX revaluation reversal journal entry: %w", err)
+	}
+	run.ReversalJournalID = &reversalJournalID
+
+	return true, nil
+}
+
+// revaluationJournal builds the journal of a run, in the functional currency
+// only: per invoice, a credit to Accounts Payable for a liability that grew
+// or a debit for one that shrank, balanced by one debit to the unrealized
+// FX loss account and one credit to the unrealized FX gain account
+func (s *FXRevaluationService) revaluationJournal(ctx context.Context, run *repository.FXRevaluationRun) (*client.CreateJournalRequest, error) {
+	apAccountID, err := s.settings.APControlAccountID(ctx, run.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	gainAccountID, lossAccountID, err := s.settings.UnrealizedFXAccountIDs(ctx, run.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	functional := currency.ForCode(run.FunctionalCurrency)
+	journalLines := make([]*client.JournalLineRequest, 0, len(run.Lines)+2)
+
+	for _, line := range run.Lines {
+		if line.Adjustment == 0 {
+			continue
+		}
+
+		lineType, amount := "credit", line.Adjustment
+		if line.Adjustment < 0 {
+			lineType, amount = "debit", -line.Adjustment
+		}
+
+		desc := fmt.Sprintf("FX revaluation of invoice %s: %s %s at %s",
+			line.InvoiceNumber, currency.ForCode(line.Currency).Format(line.AmountDue), line.Currency, line.PeriodEndRate)
+		journalLines = append(journalLines, &client.JournalLineRequest{
+			LineNumber:       len(journalLines) + 1,
+			AccountID:        apAccountID,
+			LineType:         lineType,
+			Amount:           amount,
+			FunctionalAmount: amount,
+			Description:      &desc,
+			Reference:        &line.InvoiceNumber,
+		})
+	}
+
+	if run.TotalLoss != 0 {
+		lossDesc := fmt.Sprintf("Unrealized FX loss %s %s", functional.Format(run.TotalLoss), functional.Code)
+		journalLines = append(journalLines, &client.JournalLineRequest{
+			LineNumber:       len(journalLines) + 1,
+			AccountID:        lossAccountID,
+			LineType:         "debit",
+			Amount:           run.TotalLoss,
+			FunctionalAmount: run.TotalLoss,
+			Description:      &lossDesc,
+		})
+	}
+
+	if run.TotalGain != 0 {
+		gainDesc := fmt.Sprintf("Unrealized FX gain %s %s", functional.Format(run.TotalGain), functional.Code)
+		journalLines = append(journalLines, &client.JournalLineRequest{
+			LineNumber:       len(journalLines) + 1,
+			AccountID:        gainAccountID,
+			LineType:         "credit",
+			Amount:           run.TotalGain,
+			FunctionalAmount: run.TotalGain,
+			Description:      &gainDesc,
+		})
+	}
+
+	desc := fmt.Sprintf("Period-end FX revaluation of open payables, period %s", run.GLPeriodID)
+	reference := fmt.Sprintf("FXREV-%s", run.ID)
+	return &client.CreateJournalRequest{
+		EntityID:           run.EntityID,
+		JournalNumber:      fmt.Sprintf("AP-FXREV-%s", run.ID),
+		JournalDate:        run.PeriodEnd.Format("2006-01-02"),
+		JournalType:        "adjusting",
+		Description:        &desc,
+		Reference:          &reference,
+		Currency:           run.FunctionalCurrency,
+		FunctionalCurrency: run.FunctionalCurrency,
+		Lines:              journalLines,
+		IdempotencyKey:     "fx-revaluation:" + run.ID,
+	}, nil
+}
+
+// GetRun returns a revaluation run with its per-invoice detail
+func (s *FXRevaluationService) GetRun(ctx context.Context, id, entityID string) (*repository.FXRevaluationRun, error) {
+	return s.revaluationRepo.GetByID(ctx, id, entityID)
+}
+
+// ListRuns returns the revaluation runs of an entity, newest period first
+func (s *FXRevaluationService) ListRuns(ctx context.Context, entityID string) ([]*repository.FXRevaluationRun, error) {
+	return s.revaluationRepo.List(ctx, entityID)
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Exchange rate types
+const (
+	RateTypeSpot      = "spot"       // converts invoices and payments
+	RateTypePeriodEnd = "period_end" // revalues open balances at period end
+)
+
+// TableFXRateProvider is the exchange rate provider backed by the spot rates
+// of the local ap_exchange_rates table
+type TableFXRateProvider struct {
+	rateRepo *repository.ExchangeRateRepository
+}
+
+// NewTableFXRateProvider creates a table-backed exchange rate provider
+func NewTableFXRateProvider(rateRepo *repository.ExchangeRateRepository) *TableFXRateProvider {
+	return &TableFXRateProvider{rateRepo: rateRepo}
+}
+
+// GetRate returns the latest rate dated on or before date. If only the
+// opposite pair has a rate, its inverse is returned.
+func (p *TableFXRateProvider) GetRate(ctx context.Context, from, to string, date time.Time) (*client.FXRate, error) {
+	return tableRate(ctx, p.rateRepo, from, to, RateTypeSpot, date)
+}
+
+// tableRate returns the latest stored rate of a type dated on or before
+// date, or the inverse of the opposite pair's rate if only that is stored
+func tableRate(ctx context.Context, rateRepo *repository.ExchangeRateRepository, from, to, rateType string, date time.Time) (*client.FXRate, error) {
+	rate, err := rateRepo.GetOnOrBefore(ctx, from, to, rateType, date)
+	if err != nil {
+		return nil, err
+	}
+	if rate != nil {
+		return tableFXRate(rate, from, to, rate.Rate), nil
+	}
+
+	inverse, err := rateRepo.GetOnOrBefore(ctx, to, from, rateType, date)
+	if err != nil {
+		return nil, err
+	}
+	if inverse != nil {
+		return tableFXRate(inverse, from, to, inverse.Rate.Inverse()), nil
+	}
+
+	return nil, nil
+}
+
+// tableFXRate converts a stored rate to a provider rate from one currency to another
+func tableFXRate(stored *repository.ExchangeRate, from, to string, rate decimal.Rate) *client.FXRate {
+	source := "table"
+	if stored.Source != nil {
+		source = *stored.Source
+	}
+	return &client.FXRate{
+		FromCurrency: from,
+		ToCurrency:   to,
+		Date:         stored.RateDate,
+		Rate:         rate,
+		Source:       source,
+	}
+}
+
+// FXService maintains the local exchange rate table and converts invoice and
+// payment amounts into the entity's functional currency
+type FXService struct {
+	rateRepo *repository.ExchangeRateRepository
+	rates    client.FXRateProviderInterface
+	settings *EntitySettingsService
+	log      *logger.Logger
+}
+
+// NewFXService creates a new FX service
+func NewFXService(
+	rateRepo *repository.ExchangeRateRepository,
+	rates client.FXRateProviderInterface,
+	settings *EntitySettingsService,
+	log *logger.Logger,
+) *FXService {
+	return &FXService{
+		rateRepo: rateRepo,
+		rates:    rates,
+		settings: settings,
+		log:      log,
+	}
+}
+
+// UpsertExchangeRateRequest represents a create or replace exchange rate request
+type UpsertExchangeRateRequest struct {
+	FromCurrency string       `json:"from_currency"`
+	ToCurrency   string       `json:"to_currency"`
+	RateType     string       `json:"rate_type,omitempty"` // spot (default) or period_end
+	RateDate     string       `json:"rate_date"`
+	Rate         decimal.Rate `json:"rate"` // units of to_currency per unit of from_currency
+	Source       *string      `json:"source,omitempty"`
+	CreatedBy    string       `json:"created_by,omitempty"`
+}
+
+// ListExchangeRates returns the rates of a currency pair, newest first
+func (s *FXService) ListExchangeRates(ctx context.Context, from, to string) ([]*repository.ExchangeRate, error) {
+	fromCurrency, err := currency.Lookup(from)
+	if err != nil {
+		return nil, errors.InvalidInput("from_currency", "from currency must be an ISO 4217 code")
+	}
+	toCurrency, err := currency.Lookup(to)
+	if err != nil {
+		return nil, errors.InvalidInput("to_currency", "to currency must be an ISO 4217 code")
+	}
+	return s.rateRepo.List(ctx, fromCurrency.Code, toCurrency.Code)
+}
+
+// UpsertExchangeRate creates or replaces the rate of a currency pair on a date
+func (s *FXService) UpsertExchangeRate(ctx context.Context, req *UpsertExchangeRateRequest) (*repository.ExchangeRate, error) {
+	fromCurrency, err := currency.Lookup(req.FromCurrency)
+	if err != nil {
+		return nil, errors.InvalidInput("from_currency", "from currency must be an ISO 4217 code")
+	}
+	toCurrency, err := currency.Lookup(req.ToCurrency)
+	if err != nil {
+		return nil, errors.InvalidInput("to_currency", "to currency must be an ISO 4217 code")
+	}
+	if fromCurrency.Code == toCurrency.Code {
+		return nil, errors.InvalidInput("to_currency", "to currency must differ from from currency")
+	}
+	if req.Rate.Sign() <= 0 {
+		return nil, errors.InvalidInput("rate", "rate must be positive")
+	}
+
+	rateType := req.RateType
+	switch rateType {
+	case "":
+		rateType = RateTypeSpot
+	case RateTypeSpot, RateTypePeriodEnd:
+	default:
+		return nil, errors.InvalidInput("rate_type",
+			fmt.Sprintf("rate type must be %s or %s", RateTypeSpot, RateTypePeriodEnd))
+	}
+
+	rateDate, err := time.Parse("2006-01-02", req.RateDate)
+	if err != nil {
+		return nil, errors.InvalidInput("rate_date", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	rate := &repository.ExchangeRate{
+		FromCurrency: fromCurrency.Code,
+		ToCurrency:   toCurrency.Code,
+		RateType:     rateType,
+		RateDate:     rateDate,
+		Rate:         req.Rate,
+		Source:       req.Source,
+	}
+
+	// Convert empty string to NULL for CreatedBy
+	if req.CreatedBy != "" {
+		rate.CreatedBy = &req.CreatedBy
+	}
+
+	if err := s.rateRepo.Upsert(ctx, rate); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("from_currency", rate.FromCurrency).
+		Str("to_currency", rate.ToCurrency).
+		Str("rate_type", rate.RateType).
+		Str("rate_date", req.RateDate).
+		Str("rate", rate.Rate.String()).
+		Msg("Exchange rate saved")
+
+	return rate, nil
+}
+
+// FunctionalCurrency returns the currency an entity keeps its ledger in. It
+// must be configured: falling back to each invoice's own currency would mix
+// currencies in one ledger.
+func (s *FXService) FunctionalCurrency(ctx context.Context, entityID string) (string, error) {
+	settings, err := s.settings.GetSettings(ctx, entityID)
+	if err != nil {
+		return "", err
+	}
+	if settings.FunctionalCurrency == nil {
+		return "", errors.InvalidInput("functional_currency",
+			"entity has no functional currency; set functional_currency in its AP settings")
+	}
+	return *settings.FunctionalCurrency, nil
+}
+
+// Rate returns the rate from one currency to another effective on date
+func (s *FXService) Rate(ctx context.Context, from, to string, date time.Time) (decimal.Rate, error) {
+	if from == to {
+		return decimal.RateFromInt(1), nil
+	}
+
+	rate, err := s.rates.GetRate(ctx, from, to, date)
+	if err != nil {
+		return decimal.Rate{}, fmt.Errorf("failed to get exchange rate: %w", err)
+	}
+	if rate == nil {
+		return decimal.Rate{}, errors.InvalidInput("exchange_rate",
+			fmt.Sprintf("no exchange rate from %s to %s on or before %s", from, to, date.Format("2006-01-02")))
+	}
+	return rate.Rate, nil
+}
+
+// PeriodEndRate returns the period-end rate from one currency to another for
+// the period ending on periodEnd. The rate must be dated within the period,
+// from periodStart on, so a missing closing rate is not silently replaced by
+// an earlier period's.
+func (s *FXService) PeriodEndRate(ctx context.Context, from, to string, periodStart, periodEnd time.Time) (decimal.Rate, error) {
+	if from == to {
+		return decimal.RateFromInt(1), nil
+	}
+
+	rate, err := tableRate(ctx, s.rateRepo, from, to, RateTypePeriodEnd, periodEnd)
+	if err != nil {
+		return decimal.Rate{}, err
+	}
+	if rate == nil || rate.Date.Before(periodStart) {
+		return decimal.Rate{}, errors.InvalidInput("exchange_rate",
+			fmt.Sprintf("no period-end exchange rate from %s to %s for the period ending %s", from, to, periodEnd.Format("2006-01-02")))
+	}
+	return rate.Rate, nil
+}
+
+// ApplyInvoiceRate fixes the functional currency and exchange rate of an
+// invoice and converts each line's amount and tax into the functional
+// currency. rate, if set, is used instead of the provider's rate on the
+// invoice date; it is ignored for an invoice in the functional currency.
+// The functional header totals are the sums of the converted lines, so the
+// AP credit always equals the debits it balances.
+func (s *FXService) ApplyInvoiceRate(ctx context.Context, invoice *repository.Invoice, rate *decimal.Rate) error {
+	functional, err := s.FunctionalCurrency(ctx, invoice.EntityID)
+	if err != nil {
+		return err
+	}
+
+	var applied decimal.Rate
+	switch {
+	case functional == invoice.Currency:
+		applied = decimal.RateFromInt(1)
+	case rate != nil:
+		if rate.Sign() <= 0 {
+			return errors.InvalidInput("exchange_rate", "exchange rate must be positive")
+		}
+		applied = *rate
+	default:
+		applied, err = s.Rate(ctx, invoice.Currency, functional, invoice.InvoiceDate)
+		if err != nil {
+			return err
+		}
+	}
+
+	invoice.FunctionalCurrency = functional
+	invoice.ExchangeRate = applied
+	invoice.FunctionalSubtotal, invoice.FunctionalTaxAmount = 0, 0
+	for _, line := range invoice.Lines {
+		line.FunctionalLineAmount = convertAmount(line.LineAmount, invoice.Currency, functional, applied)
+		line.FunctionalTaxAmount = convertAmount(line.TaxAmount, invoice.Currency, functional, applied)
+		invoice.FunctionalSubtotal += line.FunctionalLineAmount
+		invoice.FunctionalTaxAmount += line.FunctionalTaxAmount
+	}
+	invoice.FunctionalTotalAmount = invoice.FunctionalSubtotal + invoice.FunctionalTaxAmount
+
+	return nil
+}
+
+// ConvertPayment converts a payment into the invoice's functional currency:
+// the cash paid at the rate on its payment date, and the liability it
+// settles at the rate the invoice was posted at. A payment of the whole
+// amount due settles the rest of the booked liability, so rounding over
+// partial payments leaves no functional balance behind. The difference
+// between the two is the payment's realized FX gain or loss.
+func (s *FXService) ConvertPayment(ctx context.Context, invoice *repository.Invoice, payment *repository.InvoicePayment) error {
+	rate, err := s.Rate(ctx, invoice.Currency, invoice.FunctionalCurrency, payment.PaymentDate)
+	if err != nil {
+		return err
+	}
+
+	payment.ExchangeRate = rate
+	payment.FunctionalAmount = convertAmount(payment.PaymentAmount, invoice.Currency, invoice.FunctionalCurrency, rate)
+
+	payment.FunctionalAPAmount = functionalSettlement(invoice, payment.PaymentAmount, invoice.AmountDue, invoice.FunctionalAmountPaid)
+	payment.RealizedFXGainLoss = payment.FunctionalAPAmount - payment.FunctionalAmount
+	return nil
+}
+
+// functionalSettlement returns the share of an invoice's booked functional
+// balance that amount settles, given the amount still due and the functional
+// amount already settled: the rest of the balance when amount clears what is
+// due, otherwise amount at the booked rate
+func functionalSettlement(invoice *repository.Invoice, amount, due, functionalPaid int64) int64 {
+	if amount == due {
+		return invoice.FunctionalTotalAmount - functionalPaid
+	}
+	return convertAmount(amount, invoice.Currency, invoice.FunctionalCurrency, bookedRate(invoice))
+}
+
+// bookedRate returns the rate an invoice's liability is carried at: the rate
+// captured when it was posted, or its current rate if it is not yet posted
+func bookedRate(invoice *repository.Invoice) decimal.Rate {
+	if invoice.PostedExchangeRate != nil {
+		return *invoice.PostedExchangeRate
+	}
+	return invoice.ExchangeRate
+}
+
+// convertAmount converts an amount in minor units of one currency into minor
+// units of another at rate
+func convertAmount(amount int64, from, to string, rate decimal.Rate) int64 {
+	return currency.Convert(amount, currency.ForCode(from), currency.ForCode(to), rate)
+}
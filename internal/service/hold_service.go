@@ -0,0 +1,475 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Hold types
+const (
+	HoldTypeManual = "manual" // placed and released by AP users
+	HoldTypeSystem = "system" // placed and released by PO matching or split invoice detection
+)
+
+// Hold codes
+const (
+	HoldPriceVariance    = "price_variance"
+	HoldQuantityVariance = "quantity_variance"
+	HoldMissingReceipt   = "missing_receipt"
+	HoldPOMismatch       = "po_mismatch"
+	HoldSplitInvoice     = "split_invoice"
+	HoldDisputed         = "disputed"
+	HoldVendorOnHold     = "vendor_on_hold"
+	HoldOther            = "other"
+)
+
+// holdCodes lists the hold codes with what each means. Any code can be
+// placed manually; PO matching places the first four and split invoice
+// detection the fifth.
+var holdCodes = map[string]string{
+	HoldPriceVariance:    "unit price billed exceeds the purchase order",
+	HoldQuantityVariance: "quantity billed exceeds the quantity ordered",
+	HoldMissingReceipt:   "quantity billed exceeds the quantity received",
+	HoldPOMismatch:       "billed item or purchase order does not match",
+	HoldSplitInvoice:     "invoice may split a purchase to stay under an approval threshold",
+	HoldDisputed:         "invoice is disputed with the vendor",
+	HoldVendorOnHold:     "vendor is on hold",
+	HoldOther:            "see reason",
+}
+
+// holdableStatuses are the invoice statuses a hold can be placed in: those
+// with a submission, approval, posting or payment still to come
+var holdableStatuses = map[string]bool{
+	"draft":            true,
+	"pending_approval": true,
+	"approved":         true,
+	"posted":           true,
+}
+
+// HoldService places and releases invoice holds. An invoice with an open
+// hold cannot be submitted for approval, approved, posted or paid.
+type HoldService struct {
+	holdRepo      *repository.InvoiceHoldRepository
+	invoiceRepo   *repository.InvoiceRepository
+	notifications *client.NotificationPublisher
+	log           *logger.Logger
+}
+
+// NewHoldService creates a new hold service. notifications may be nil, in
+// which case hold events are not published.
+func NewHoldService(
+	holdRepo *repository.InvoiceHoldRepository,
+	invoiceRepo *repository.InvoiceRepository,
+	notifications *client.NotificationPublisher,
+	log *logger.Logger,
+) *HoldService {
+	return &HoldService{
+		holdRepo:      holdRepo,
+		invoiceRepo:   invoiceRepo,
+		notifications: notifications,
+		log:           log,
+	}
+}
+
+// PlaceHoldRequest represents a request to place a manual hold on an
+// invoice, or on one of its lines when LineNumber is set
+type PlaceHoldRequest struct {
+	InvoiceID  string  `json:"invoice_id"`
+	EntityID   string  `json:"entity_id"`
+	LineNumber *int    `json:"line_number,omitempty"`
+	HoldCode   string  `json:"hold_code"`
+	Reason     string  `json:"reason"`
+	OwnerID    *string `json:"owner_id,omitempty"`
+	OwnerOnly  bool    `json:"owner_only,omitempty"`
+	PlacedBy   string  `json:"placed_by,omitempty"`
+}
+
+// ReleaseHoldRequest represents a request to release a manual hold
+type ReleaseHoldRequest struct {
+	HoldID     string `json:"hold_id"`
+	EntityID   string `json:"entity_id"`
+	Notes      string `json:"notes"`
+	ReleasedBy string `json:"released_by,omitempty"`
+}
+
+// PlaceHold places a manual hold and notifies its owner and the invoice's
+// creator
+func (s *HoldService) PlaceHold(ctx context.Context, req *PlaceHoldRequest) (*repository.InvoiceHold, error) {
+	if _, ok := holdCodes[req.HoldCode]; !ok {
+		return nil, errors.InvalidInput("hold_code", fmt.Sprintf("unknown hold code %s", req.HoldCode))
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		return nil, errors.InvalidInput("reason", "reason is required")
+	}
+	// Convert empty string to NULL for OwnerID
+	if req.OwnerID != nil && *req.OwnerID == "" {
+		req.OwnerID = nil
+	}
+	if req.OwnerOnly && req.OwnerID == nil {
+		return nil, errors.InvalidInput("owner_id", "owner_id is required for a hold only its owner can release")
+	}
+	// A hold only its owner can release needs callers to be identified, or
+	// it could never be released
+	if req.OwnerOnly && req.PlacedBy == "" {
+		return nil, errors.InvalidInput("owner_only",
+			"holds only their owner can release need an authenticated caller")
+	}
+
+	invoice, err := s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if !holdableStatuses[invoice.Status] {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot place a hold on an invoice with status '%s'", invoice.Status))
+	}
+
+	hold := &repository.InvoiceHold{
+		EntityID:      invoice.EntityID,
+		InvoiceID:     invoice.ID,
+		InvoiceNumber: invoice.InvoiceNumber,
+		HoldCode:      req.HoldCode,
+		HoldType:      HoldTypeManual,
+		Reason:        reason,
+		OwnerID:       req.OwnerID,
+		OwnerOnly:     req.OwnerOnly,
+	}
+
+	if req.LineNumber != nil {
+		for _, line := range invoice.Lines {
+			if line.LineNumber == *req.LineNumber {
+				hold.InvoiceLineID = &line.ID
+				hold.LineNumber = &line.LineNumber
+				break
+			}
+		}
+		if hold.InvoiceLineID == nil {
+			return nil, errors.InvalidInput("line_number", fmt.Sprintf("invoice has no line %d", *req.LineNumber))
+		}
+	}
+
+	// Convert empty string to NULL for PlacedBy
+	if req.PlacedBy != "" {
+		hold.PlacedBy = &req.PlacedBy
+	}
+
+	if err := s.holdRepo.Create(ctx, hold); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("invoice_id", invoice.ID).
+		Str("hold_id", hold.ID).
+		Str("hold_code", hold.HoldCode).
+		Str("placed_by", req.PlacedBy).
+		Msg("Invoice hold placed")
+
+	s.notify(ctx, "invoice_hold_placed", invoice, hold, req.PlacedBy)
+
+	return hold, nil
+}
+
+// ReleaseHold releases a manual hold with notes and notifies its owner, the
+// user who placed it and the invoice's creator. A hold only its owner can
+// release is refused to anyone else. System holds are released by PO
+// matching once the variance is corrected or accepted, or by reviewing their
+// split invoice finding.
+func (s *HoldService) ReleaseHold(ctx context.Context, req *ReleaseHoldRequest) (*repository.InvoiceHold, error) {
+	notes := strings.TrimSpace(req.Notes)
+	if notes == "" {
+		return nil, errors.InvalidInput("notes", "notes are required to release a hold")
+	}
+
+	hold, err := s.holdRepo.GetByID(ctx, req.HoldID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if hold.Status != "open" {
+		return nil, errors.New(errors.ErrCodeConflict, "invoice hold is already released")
+	}
+	if hold.HoldType == HoldTypeSystem && hold.HoldCode == HoldSplitInvoice {
+		return nil, errors.New(errors.ErrCodeConflict, "split_invoice hold is released by reviewing its split invoice finding")
+	}
+	if hold.HoldType == HoldTypeSystem {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("%s hold is released by PO matching once the variance is corrected or accepted", hold.HoldCode))
+	}
+	if hold.OwnerOnly && (hold.OwnerID == nil || *hold.OwnerID != req.ReleasedBy) {
+		return nil, errors.New(errors.ErrCodeUnauthorized, "only the hold's owner can release it")
+	}
+
+	invoice, err := s.invoiceRepo.GetByID(ctx, hold.InvoiceID, hold.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	hold.ReleaseNotes = &notes
+	// Convert empty string to NULL for ReleasedBy
+	if req.ReleasedBy != "" {
+		hold.ReleasedBy = &req.ReleasedBy
+	}
+
+	if err := s.holdRepo.Release(ctx, hold); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("invoice_id", hold.InvoiceID).
+		Str("hold_id", hold.ID).
+		Str("hold_code", hold.HoldCode).
+		Str("released_by", req.ReleasedBy).
+		Msg("Invoice hold released")
+
+	s.notify(ctx, "invoice_hold_released", invoice, hold, req.ReleasedBy)
+
+	return hold, nil
+}
+
+// ListInvoiceHolds returns the holds of an invoice, including released ones
+// if includeReleased is set
+func (s *HoldService) ListInvoiceHolds(ctx context.Context, invoiceID, entityID string, includeReleased bool) ([]*repository.InvoiceHold, error) {
+	if _, err := s.invoiceRepo.GetByID(ctx, invoiceID, entityID); err != nil {
+		return nil, err
+	}
+	return s.holdRepo.ListByInvoice(ctx, invoiceID, entityID, !includeReleased)
+}
+
+// ListOpenHolds returns an entity's open holds, oldest first
+func (s *HoldService) ListOpenHolds(ctx context.Context, entityID string, filter *repository.HoldFilter) ([]*repository.InvoiceHold, error) {
+	if filter.HoldType != nil && *filter.HoldType != HoldTypeManual && *filter.HoldType != HoldTypeSystem {
+		return nil, errors.InvalidInput("hold_type", "hold type must be manual or system")
+	}
+	return s.holdRepo.ListOpen(ctx, entityID, filter)
+}
+
+// checkReleased returns a conflict error naming the open holds of an
+// invoice if it has any, so that action cannot go ahead
+func (s *HoldService) checkReleased(ctx context.Context, invoice *repository.Invoice, action string) error {
+	holds, err := s.holdRepo.ListByInvoice(ctx, invoice.ID, invoice.EntityID, true)
+	if err != nil {
+		return err
+	}
+	if len(holds) == 0 {
+		return nil
+	}
+
+	open := make([]string, 0, len(holds))
+	for _, hold := range holds {
+		if hold.LineNumber != nil {
+			open = append(open, fmt.Sprintf("line %d %s (%s)", *hold.LineNumber, hold.HoldCode, hold.Reason))
+		} else {
+			open = append(open, fmt.Sprintf("%s (%s)", hold.HoldCode, hold.Reason))
+		}
+	}
+	return errors.New(errors.ErrCodeConflict,
+		fmt.Sprintf("cannot %s invoice while it is on hold: %s", action, strings.Join(open, ", ")))
+}
+
+// syncMatchHolds brings an invoice's system holds in line with its latest
+// PO match: want holds the codes each line should be held with, by invoice
+// line ID. Holds no longer wanted are released and missing ones placed.
+func (s *HoldService) syncMatchHolds(ctx context.Context, invoice *repository.Invoice, want map[string]map[string]string) error {
+	holds, err := s.holdRepo.ListByInvoice(ctx, invoice.ID, invoice.EntityID, true)
+	if err != nil {
+		return err
+	}
+
+	held := make(map[string]bool)
+	for _, hold := range holds {
+		if hold.HoldType != HoldTypeSystem || hold.InvoiceLineID == nil {
+			continue
+		}
+		if _, ok := want[*hold.InvoiceLineID][hold.HoldCode]; ok {
+			held[*hold.InvoiceLineID+"/"+hold.HoldCode] = true
+			continue
+		}
+
+		if err := s.releaseSystemHold(ctx, invoice, hold, "PO match variance corrected"); err != nil {
+			return err
+		}
+	}
+
+	for _, line := range invoice.Lines {
+		codes := make([]string, 0, len(want[line.ID]))
+		for code := range want[line.ID] {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+
+		for _, code := range codes {
+			if held[line.ID+"/"+code] {
+				continue
+			}
+			hold := &repository.InvoiceHold{
+				EntityID:      invoice.EntityID,
+				InvoiceID:     invoice.ID,
+				InvoiceNumber: invoice.InvoiceNumber,
+				InvoiceLineID: &line.ID,
+				LineNumber:    &line.LineNumber,
+				HoldCode:      code,
+				HoldType:      HoldTypeSystem,
+				Reason:        want[line.ID][code],
+			}
+			if err := s.holdRepo.Create(ctx, hold); err != nil {
+				return err
+			}
+			s.log.Info().
+				Str("invoice_id", invoice.ID).
+				Str("hold_id", hold.ID).
+				Str("hold_code", hold.HoldCode).
+				Int("line_number", line.LineNumber).
+				Msg("Invoice hold placed by PO matching")
+			s.notify(ctx, "invoice_hold_placed", invoice, hold, "")
+		}
+	}
+
+	return nil
+}
+
+// releaseLineHolds releases the system holds on an invoice line whose PO
+// match variance has been resolved
+func (s *HoldService) releaseLineHolds(ctx context.Context, invoice *repository.Invoice, lineID, notes string) error {
+	holds, err := s.holdRepo.ListByInvoice(ctx, invoice.ID, invoice.EntityID, true)
+	if err != nil {
+		return err
+	}
+
+	for _, hold := range holds {
+		if hold.HoldType != HoldTypeSystem || hold.InvoiceLineID == nil || *hold.InvoiceLineID != lineID {
+			continue
+		}
+		if err := s.releaseSystemHold(ctx, invoice, hold, notes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newInvoiceHold returns a system hold on an invoice as a whole, not yet
+// placed
+func newInvoiceHold(invoice *repository.Invoice, code, reason string) *repository.InvoiceHold {
+	return &repository.InvoiceHold{
+		EntityID:      invoice.EntityID,
+		InvoiceID:     invoice.ID,
+		InvoiceNumber: invoice.InvoiceNumber,
+		HoldCode:      code,
+		HoldType:      HoldTypeSystem,
+		Reason:        reason,
+	}
+}
+
+// placeInvoiceHold places a system hold on an invoice as a whole, unless it
+// already has an open one with the code
+func (s *HoldService) placeInvoiceHold(ctx context.Context, invoice *repository.Invoice, code, reason string) error {
+	holds, err := s.holdRepo.ListByInvoice(ctx, invoice.ID, invoice.EntityID, true)
+	if err != nil {
+		return err
+	}
+	for _, hold := range holds {
+		if hold.HoldType == HoldTypeSystem && hold.InvoiceLineID == nil && hold.HoldCode == code {
+			return nil
+		}
+	}
+
+	hold := newInvoiceHold(invoice, code, reason)
+	if err := s.holdRepo.Create(ctx, hold); err != nil {
+		return err
+	}
+
+	s.invoiceHoldPlaced(ctx, invoice, hold)
+	return nil
+}
+
+// invoiceHoldPlaced logs and notifies a system hold placed on an invoice as
+// a whole
+func (s *HoldService) invoiceHoldPlaced(ctx context.Context, invoice *repository.Invoice, hold *repository.InvoiceHold) {
+	s.log.Info().
+		Str("invoice_id", invoice.ID).
+		Str("hold_id", hold.ID).
+		Str("hold_code", hold.HoldCode).
+		Msg("System invoice hold placed")
+
+	s.notify(ctx, "invoice_hold_placed", invoice, hold, "")
+}
+
+// openInvoiceHold returns the open system hold with a code on an invoice
+// as a whole, or nil if it has none
+func (s *HoldService) openInvoiceHold(ctx context.Context, invoice *repository.Invoice, code string) (*repository.InvoiceHold, error) {
+	holds, err := s.holdRepo.ListByInvoice(ctx, invoice.ID, invoice.EntityID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hold := range holds {
+		if hold.HoldType == HoldTypeSystem && hold.InvoiceLineID == nil && hold.HoldCode == code {
+			return hold, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// releaseSystemHold releases a system hold with notes
+func (s *HoldService) releaseSystemHold(ctx context.Context, invoice *repository.Invoice, hold *repository.InvoiceHold, notes string) error {
+	hold.ReleaseNotes = &notes
+	if err := s.holdRepo.Release(ctx, hold); err != nil {
+		return err
+	}
+
+	s.invoiceHoldReleased(ctx, invoice, hold)
+	return nil
+}
+
+// invoiceHoldReleased logs and notifies a system hold released once its
+// release has been committed
+func (s *HoldService) invoiceHoldReleased(ctx context.Context, invoice *repository.Invoice, hold *repository.InvoiceHold) {
+	s.log.Info().
+		Str("invoice_id", invoice.ID).
+		Str("hold_id", hold.ID).
+		Str("hold_code", hold.HoldCode).
+		Msg("System invoice hold released")
+
+	s.notify(ctx, "invoice_hold_released", invoice, hold, "")
+}
+
+// notify publishes a hold event to the hold's owner, the user who placed it
+// and the invoice's creator, other than the actor
+func (s *HoldService) notify(ctx context.Context, eventType string, invoice *repository.Invoice, hold *repository.InvoiceHold, actorID string) {
+	if s.notifications == nil {
+		return
+	}
+
+	recipients := make([]string, 0, 3)
+	seen := map[string]bool{"": true, actorID: true}
+	for _, id := range []*string{hold.OwnerID, hold.PlacedBy, invoice.CreatedBy} {
+		if id != nil && !seen[*id] {
+			seen[*id] = true
+			recipients = append(recipients, *id)
+		}
+	}
+
+	payload := map[string]interface{}{
+		"InvoiceNumber": invoice.InvoiceNumber,
+		"HoldID":        hold.ID,
+		"HoldCode":      hold.HoldCode,
+		"HoldType":      hold.HoldType,
+		"Reason":        hold.Reason,
+	}
+	if hold.LineNumber != nil {
+		payload["LineNumber"] = *hold.LineNumber
+	}
+	if hold.ReleaseNotes != nil {
+		payload["ReleaseNotes"] = *hold.ReleaseNotes
+	}
+
+	s.notifications.PublishInvoiceEvent(ctx, eventType, invoice.ID, invoice.EntityID, actorID, recipients, payload)
+}
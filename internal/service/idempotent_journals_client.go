@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// journalRequestStaleAfter is how long a reservation that never recorded a
+// journal blocks a retry. After that the creating request is assumed to have
+// died before GL-2 answered and the journal is requested again.
+const journalRequestStaleAfter = 5 * time.Minute
+
+// errRequestInProgress is wrapped by the conflict returned when an earlier
+// attempt at the same keyed request has not finished. Unlike other
+// conflicts it clears once that attempt completes or goes stale.
+var errRequestInProgress = errors.New(errors.ErrCodeConflict, "request in progress")
+
+// IdempotentJournalsClient wraps a journals client so that a journal request
+// carrying an IdempotencyKey creates at most one GL-2 journal. The key, the
+// request and the resulting journal ID are recorded locally; a repeated
+// request returns the recorded journal, and posting an already posted journal
+// is a no-op. Requests without a key pass straight through.
+type IdempotentJournalsClient struct {
+	journals client.JournalsClientInterface
+	requests *repository.JournalRequestRepository
+	log      *logger.Logger
+}
+
+// NewIdempotentJournalsClient creates an idempotent wrapper around journals
+func NewIdempotentJournalsClient(journals client.JournalsClientInterface, requests *repository.JournalRequestRepository, log *logger.Logger) *IdempotentJournalsClient {
+	return &IdempotentJournalsClient{
+		journals: journals,
+		requests: requests,
+		log:      log,
+	}
+}
+
+// CreateJournal returns the journal already created for req.IdempotencyKey,
+// or creates it and records it under the key
+func (c *IdempotentJournalsClient) CreateJournal(ctx context.Context, req *client.CreateJournalRequest) (string, error) {
+	if req.IdempotencyKey == "" {
+		return c.journals.CreateJournal(ctx, req)
+	}
+
+	request, err := json.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, errors.ErrCodeInternal, "failed to encode journal request")
+	}
+
+	jr, reserved, err := c.requests.Reserve(ctx, req.EntityID, req.IdempotencyKey, req.JournalNumber, request, journalRequestStaleAfter)
+	if err != nil {
+		return "", err
+	}
+
+	if !reserved {
+		if jr.JournalID == nil {
+			return "", errors.Wrap(errRequestInProgress, errors.ErrCodeConflict,
+				fmt.Sprintf("journal request '%s' is already in progress", req.IdempotencyKey))
+		}
+
+		c.log.Info().
+			Str("idempotency_key", req.IdempotencyKey).
+			Str("gl_journal_id", *jr.JournalID).
+			Msg("Reusing journal for repeated request")
+		return *jr.JournalID, nil
+	}
+
+	journalID, err := c.journals.CreateJournal(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.requests.SetJournalID(ctx, jr.ID, journalID); err != nil {
+		// The journal exists in GL-2 but is not recorded; a retry after the
+		// stale window would create it again, so make this visible
+		c.log.Error().
+			Err(err).
+			Str("idempotency_key", req.IdempotencyKey).
+			Str("gl_journal_id", journalID).
+			Msg("Created journal could not be recorded")
+		return "", err
+	}
+
+	return journalID, nil
+}
+
+// PostJournal posts a journal unless it is recorded as already posted
+func (c *IdempotentJournalsClient) PostJournal(ctx context.Context, journalID, entityID string) error {
+	jr, err := c.requests.GetByJournalID(ctx, entityID, journalID)
+	if err != nil {
+		return err
+	}
+	if jr != nil && jr.PostedAt != nil {
+		return nil
+	}
+
+	if err := c.journals.PostJournal(ctx, journalID, entityID); err != nil {
+		return err
+	}
+
+	if jr != nil {
+		return c.requests.MarkPosted(ctx, jr.ID)
+	}
+	return nil
+}
+
+// recordedJournal returns GL-2 journal journalID as it was sent, so that a
+// reversal negates the lines actually posted rather than the journal the
+// invoice and the entity's settings would build today. Journals created
+// before requests were kept cannot be reversed this way and must be reversed
+// in GL-2 by hand.
+func recordedJournal(ctx context.Context, requests *repository.JournalRequestRepository, entityID, journalID string) (*client.CreateJournalRequest, error) {
+	jr, err := requests.GetByJournalID(ctx, entityID, journalID)
+	if err != nil {
+		return nil, err
+	}
+	if jr == nil || jr.Request == nil {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("GL journal %s has no recorded lines to reverse; reverse it in GL-2 by hand", journalID))
+	}
+
+	var journal client.CreateJournalRequest
+	if err := json.Unmarshal(jr.Request, &journal); err != nil {
+		return nil, errors.Wrap(err, errors.ErrCodeInternal, "failed to decode recorded journal request")
+	}
+
+	return &journal, nil
+}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// GL posting saga steps. The forward steps run in order while the outbox
+// entry is pending; once a forward step exhausts its retries the entry
+// switches to compensating and the compensation steps undo whatever the
+// forward steps applied before returning the invoice to approved.
+const (
+	PostingStepCreateJournal        = "create_journal"
+	PostingStepPostJournal          = "post_journal"
+	PostingStepUpdateVendorBalance  = "update_vendor_balance"
+	PostingStepFinalize             = "finalize"
+	PostingStepReverseVendorBalance = "reverse_vendor_balance"
+	PostingStepReverseJournal       = "reverse_journal"
+	PostingStepRevertInvoice        = "revert_invoice"
+)
+
+const (
+	postingMaxAttempts = 8
+	postingLease       = 2 * time.Minute
+	postingBaseBackoff = 5 * time.Second
+	postingMaxBackoff  = 10 * time.Minute
+)
+
+// ProcessPostings leases up to limit outbox entries that are due and drives
+// each as far as it will go. It returns the number of entries claimed.
+func (s *InvoiceService) ProcessPostings(ctx context.Context, limit int) (int, error) {
+	entries, err := s.outboxRepo.Claim(ctx, limit, postingLease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		s.drivePosting(ctx, entry)
+	}
+
+	return len(entries), nil
+}
+
+// drivePosting runs the entry's remaining steps until the saga completes or
+// fails, or until a step errors, in which case the step is scheduled for retry.
+// Progress is saved after every step, renewing the entry's lease, so a crash
+// resumes at the step that was running once the lease expires.
+func (s *InvoiceService) drivePosting(ctx context.Context, entry *repository.PostingOutboxEntry) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, entry.InvoiceID, entry.EntityID)
+	if err != nil {
+		s.retryPosting(ctx, entry, err)
+		return
+	}
+
+	for entry.Status == "pending" || entry.Status == "compensating" {
+		entry.LockedUntil = postingLeaseUntil()
+		if err := s.runPostingStep(ctx, invoice, entry); err != nil {
+			s.retryPosting(ctx, entry, err)
+			return
+		}
+	}
+
+	switch entry.Status {
+	case "completed":
+		s.log.Info().
+			Str("invoice_id", invoice.ID).
+			Str("invoice_number", invoice.InvoiceNumber).
+			Str("gl_journal_id", *entry.JournalID).
+			Int64("total_amount", invoice.TotalAmount).
+			Msg("Invoice posted to GL")
+	case "failed":
+		s.log.Error().
+			Str("invoice_id", invoice.ID).
+			Str("invoice_number", invoice.InvoiceNumber).
+			Str("outbox_id", entry.ID).
+			Msg("Invoice GL posting failed and was compensated; invoice returned to approved")
+	}
+}
+
+// runPostingStep runs the entry's current step and records its outcome.
+// Every step checks the entry's flags first so that re-running a step whose
+// outcome was not saved does not apply its side effect locally twice, and
+// sends its side effect under a key derived from the entry so that GL-2 and
+// the vendor balance ledger do not apply it twice either.
+func (s *InvoiceService) runPostingStep(ctx context.Context, invoice *repository.Invoice, entry *repository.PostingOutboxEntry) error {
+	switch entry.Step {
+	case PostingStepCreateJournal:
+		if entry.JournalID == nil {
+			journalReq, err := s.journalBuilder.InvoiceJournal(ctx, invoice)
+			if err != nil {
+				return err
+			}
+			journalReq.IdempotencyKey = "invoice-post:" + entry.ID
+			journalID, err := s.journalsClient.CreateJournal(ctx, journalReq)
+			if err != nil {
+				return fmt.Errorf("failed to create journal entry: %w", err)
+			}
+			entry.JournalID = &journalID
+		}
+		entry.Step = PostingStepPostJournal
+
+	case PostingStepPostJournal:
+		if !entry.JournalPosted {
+			if err := s.journalsClient.PostJournal(ctx, *entry.JournalID, entry.EntityID); err != nil {
+				return fmt.Errorf("failed to post journal entry: %w", err)
+			}
+			entry.JournalPosted = true
+		}
+		entry.Step = PostingStepUpdateVendorBalance
+
+	case PostingStepUpdateVendorBalance:
+		if !entry.VendorBalanceApplied {
+			if err := s.balances.Apply(ctx, "invoice-post:"+entry.ID, invoice.VendorID, entry.EntityID, vendorBalanceAmount(invoice)); err != nil {
+				return fmt.Errorf("failed to update vendor balance: %w", err)
+			}
+			entry.VendorBalanceApplied = true
+		}
+		entry.Step = PostingStepFinalize
+
+	case PostingStepFinalize:
+		return s.invoiceRepo.CompletePosting(ctx, entry)
+
+	case PostingStepReverseVendorBalance:
+		if entry.VendorBalanceApplied {
+			if err := s.balances.Apply(ctx, "invoice-post-reversal:"+entry.ID, invoice.VendorID, entry.EntityID, -vendorBalanceAmount(invoice)); err != nil {
+				return fmt.Errorf("failed to reverse vendor balance: %w", err)
+			}
+			entry.VendorBalanceApplied = false
+		}
+		entry.Step = PostingStepReverseJournal
+
+	case PostingStepReverseJournal:
+		if entry.JournalPosted {
+			if err := s.reversePostingJournal(ctx, invoice, entry); err != nil {
+				return err
+			}
+		} else if entry.JournalID != nil {
+			// An unposted journal has no ledger effect; leave it in GL-2 as a draft
+			s.log.Warn().
+				Str("invoice_id", invoice.ID).
+				Str("gl_journal_id", *entry.JournalID).
+				Msg("Abandoning unposted GL journal for failed invoice posting")
+		}
+		entry.Step = PostingStepRevertInvoice
+
+	case PostingStepRevertInvoice:
+		reason := "GL posting failed"
+		if entry.LastError != nil {
+			reason = fmt.Sprintf("GL posting failed: %s", *entry.LastError)
+		}
+		transition, err := s.stateMachine.Transition(invoice, EventPostFailed, nil, &reason)
+		if err != nil {
+			return err
+		}
+		return s.invoiceRepo.FailPosting(ctx, entry, transition)
+
+	default:
+		return errors.New(errors.ErrCodeInternal, fmt.Sprintf("unknown posting step '%s'", entry.Step))
+	}
+
+	return s.outboxRepo.Save(ctx, entry)
+}
+
+// reversePostingJournal creates and posts a journal reversing the saga's
+// posted journal line for line as it was recorded. The reversal ID is saved before posting so a retry posts
+// the same reversal instead of creating another.
+func (s *InvoiceService) reversePostingJournal(ctx context.Context, invoice *repository.Invoice, entry *repository.PostingOutboxEntry) error {
+	if entry.ReversalJournalID == nil {
+		journalReq, err := recordedJournal(ctx, s.journalRequests, entry.EntityID, *entry.JournalID)
+		if err != nil {
+			return err
+		}
+		// Reverse on the original GL date so the failed posting nets to zero
+		// within the period it was posted into, unless that period has closed
+		// since, in which case the entity's closed period policy applies
+		postedDate, err := time.Parse("2006-01-02", journalReq.JournalDate)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrCodeInternal, "invalid recorded journal date")
+		}
+		reversalDate, _, err := s.resolvePostingDate(ctx, entry.EntityID, postedDate, "")
+		if err != nil {
+			return err
+		}
+		reversalReq := reversalJournalRequest(journalReq, reversalDate.Format("2006-01-02"), "posting failed")
+		reversalReq.IdempotencyKey = "invoice-post-reversal:" + entry.ID
+
+		reversalJournalID, err := s.journalsClient.CreateJournal(ctx, reversalReq)
+		if err != nil {
+			return fmt.Errorf("failed to create reversal journal entry: %w", err)
+		}
+		entry.ReversalJournalID = &reversalJournalID
+
+		if err := s.outboxRepo.Save(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	if err := s.journalsClient.PostJournal(ctx, *entry.ReversalJournalID, entry.EntityID); err != nil {
+		return fmt.Errorf("failed to post reversal journal entry: %w", err)
+	}
+	return nil
+}
+
+// retryPosting records a failed step and schedules the next attempt with
+// exponential backoff. A pending entry that has used up its attempts, or
+// whose step failed in a way retrying cannot fix, switches to compensation;
+// compensation itself is retried until it succeeds.
+func (s *InvoiceService) retryPosting(ctx context.Context, entry *repository.PostingOutboxEntry, stepErr error) {
+	msg := stepErr.Error()
+	entry.LastError = &msg
+	entry.Attempts++
+	entry.LockedUntil = nil
+
+	if entry.Status == "pending" && (entry.Attempts >= entry.MaxAttempts || !retryablePostingError(stepErr)) {
+		s.log.Error().
+			Err(stepErr).
+			Str("invoice_id", entry.InvoiceID).
+			Str("outbox_id", entry.ID).
+			Str("step", entry.Step).
+			Int("attempts", entry.Attempts).
+			Msg("GL posting step failed permanently or retries exhausted; compensating")
+
+		entry.Status = "compensating"
+		entry.Step = PostingStepReverseVendorBalance
+		entry.Attempts = 0
+		entry.NextAttemptAt = time.Now()
+	} else {
+		s.log.Warn().
+			Err(stepErr).
+			Str("invoice_id", entry.InvoiceID).
+			Str("outbox_id", entry.ID).
+			Str("status", entry.Status).
+			Str("step", entry.Step).
+			Int("attempts", entry.Attempts).
+			Msg("GL posting step failed; will retry")
+
+		entry.NextAttemptAt = time.Now().Add(postingBackoff(entry.Attempts))
+	}
+
+	// If this save fails too, the lease expires and the step is retried then
+	if err := s.outboxRepo.Save(ctx, entry); err != nil {
+		s.log.Error().Err(err).Str("outbox_id", entry.ID).Msg("Failed to save posting outbox entry")
+	}
+}
+
+// retryablePostingError reports whether a failed posting step may succeed
+// if run again. Invalid input, missing records and conflicts fail the same
+// way every time, except a stale invoice version, which the next attempt
+// re-reads, and a keyed request still held by an earlier attempt. Errors
+// from GL-2 and AP-1 calls are assumed transient.
+func retryablePostingError(err error) bool {
+	if stderrors.Is(err, repository.ErrVersionConflict) || stderrors.Is(err, errRequestInProgress) {
+		return true
+	}
+
+	var appErr *errors.AppError
+	if !stderrors.As(err, &appErr) {
+		return true
+	}
+	switch appErr.Code {
+	case errors.ErrCodeInvalidInput, errors.ErrCodeNotFound, errors.ErrCodeConflict:
+		return false
+	default:
+		return true
+	}
+}
+
+// postingBackoff returns the delay before retry number attempts
+func postingBackoff(attempts int) time.Duration {
+	backoff := postingBaseBackoff
+	for i := 1; i < attempts && backoff < postingMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > postingMaxBackoff {
+		backoff = postingMaxBackoff
+	}
+	return backoff
+}
+
+// postingLeaseUntil returns when a posting lease taken now expires, to the
+// microsecond the database stores it with so it can be compared on save
+func postingLeaseUntil() *time.Time {
+	until := time.Now().Add(postingLease).Truncate(time.Microsecond)
+	return &until
+}
+
+// vendorBalanceAmount returns the change a posted invoice makes to its
+// vendor's balance: its total, or minus its total for a credit memo
+func vendorBalanceAmount(invoice *repository.Invoice) int64 {
+	if invoice.InvoiceType == "credit_memo" {
+		return -invoice.TotalAmount
+	}
+	return invoice.TotalAmount
+}
+
+// checkPostingSettled rejects changes to a posted invoice whose GL posting
+// saga has not finished yet
+func checkPostingSettled(invoice *repository.Invoice) error {
+	if invoice.GLPostingStatus != nil && *invoice.GLPostingStatus == "pending" {
+		return errors.New(errors.ErrCodeConflict, "invoice GL posting is still in progress, retry later")
+	}
+	return nil
+}
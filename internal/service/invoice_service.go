@@ -9,88 +9,192 @@ import (
 	"github.com/pesio-ai/be-lib-common/errors"
 	"github.com/pesio-ai/be-lib-common/logger"
 	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
 	"github.com/pesio-ai/be-ap-invoices/internal/repository"
 )
 
 // InvoiceService handles invoice business logic
 type InvoiceService struct {
-	invoiceRepo    *repository.InvoiceRepository
-	vendorsClient  client.VendorsClientInterface
-	accountsClient client.AccountsClientInterface
-	journalsClient client.JournalsClientInterface
-	log            *logger.Logger
+	invoiceRepo     *repository.InvoiceRepository
+	outboxRepo      *repository.PostingOutboxRepository
+	journalRequests *repository.JournalRequestRepository
+	vendorsClient   client.VendorsClientInterface
+	accountsClient  client.AccountsClientInterface
+	journalsClient  client.JournalsClientInterface
+	periodsClient   client.PeriodsClientInterface
+	settings        *EntitySettingsService
+	taxes           *TaxService
+	fx              *FXService
+	paymentTerms    *PaymentTermsService
+	matching        *POMatchingService
+	holds           *HoldService
+	duplicates      *DuplicateDetectionService
+	splits          *SplitInvoiceService
+	balances        *VendorBalanceLedger
+	journalBuilder  *JournalBuilder
+	stateMachine    *InvoiceStateMachine
+	log             *logger.Logger
 }
 
 // NewInvoiceService creates a new invoice service
 func NewInvoiceService(
 	invoiceRepo *repository.InvoiceRepository,
+	outboxRepo *repository.PostingOutboxRepository,
+	journalRequests *repository.JournalRequestRepository,
+	balanceUpdates *repository.VendorBalanceUpdateRepository,
 	vendorsClient client.VendorsClientInterface,
 	accountsClient client.AccountsClientInterface,
 	journalsClient client.JournalsClientInterface,
+	periodsClient client.PeriodsClientInterface,
+	settings *EntitySettingsService,
+	taxes *TaxService,
+	fx *FXService,
+	paymentTerms *PaymentTermsService,
+	matching *POMatchingService,
+	holds *HoldService,
+	duplicates *DuplicateDetectionService,
+	splits *SplitInvoiceService,
 	log *logger.Logger,
 ) *InvoiceService {
 	return &InvoiceService{
-		invoiceRepo:    invoiceRepo,
-		vendorsClient:  vendorsClient,
-		accountsClient: accountsClient,
-		journalsClient: journalsClient,
-		log:            log,
+		invoiceRepo:     invoiceRepo,
+		outboxRepo:      outboxRepo,
+		journalRequests: journalRequests,
+		vendorsClient:   vendorsClient,
+		accountsClient:  accountsClient,
+		journalsClient:  journalsClient,
+		periodsClient:   periodsClient,
+		settings:        settings,
+		taxes:           taxes,
+		fx:              fx,
+		paymentTerms:    paymentTerms,
+		matching:        matching,
+		holds:           holds,
+		duplicates:      duplicates,
+		splits:          splits,
+		balances:        NewVendorBalanceLedger(vendorsClient, balanceUpdates, log),
+		journalBuilder:  NewJournalBuilder(settings, taxes),
+		stateMachine:    NewInvoiceStateMachine(),
+		log:             log,
 	}
 }
 
-// CreateInvoiceRequest represents a create invoice request
+// validInvoiceTypes lists the values of the invoice_type enum
+var validInvoiceTypes = map[string]bool{
+	"standard":    true,
+	"credit_memo": true,
+	"debit_memo":  true,
+	"prepayment":  true,
+	"recurring":   true,
+}
+
+// CreateInvoiceRequest represents a create invoice request.
+// DuplicateOverrideReason creates an invoice the entity's duplicate policy
+// would block as a likely duplicate. DuplicateWarnOnly is set for callers
+// with no way to send a reason, such as gRPC: for them the block policy
+// only warns.
 type CreateInvoiceRequest struct {
-	EntityID        string                 `json:"entity_id"`
-	VendorID        string                 `json:"vendor_id"`
-	InvoiceNumber   string                 `json:"invoice_number"`
-	InvoiceDate     string                 `json:"invoice_date"`
-	DueDate         string                 `json:"due_date"`
-	InvoiceType     string                 `json:"invoice_type"`
-	PaymentTerms    string                 `json:"payment_terms"`
-	DiscountPercent *float64               `json:"discount_percent,omitempty"`
-	DiscountDueDate *string                `json:"discount_due_date,omitempty"`
-	Currency        string                 `json:"currency"`
-	PONumber        *string                `json:"po_number,omitempty"`
-	ReferenceNumber *string                `json:"reference_number,omitempty"`
-	Description     *string                `json:"description,omitempty"`
-	Notes           *string                `json:"notes,omitempty"`
-	AttachmentURLs  []string               `json:"attachment_urls,omitempty"`
-	Lines           []*InvoiceLineRequest  `json:"lines"`
-	CreatedBy       string                 `json:"created_by,omitempty"`
+	EntityID         string                `json:"entity_id"`
+	VendorID         string                `json:"vendor_id"`
+	InvoiceNumber    string                `json:"invoice_number"`
+	InvoiceDate      string                `json:"invoice_date"`
+	DueDate          string                `json:"due_date"`
+	GLDate           *string               `json:"gl_date,omitempty"` // defaults to invoice_date
+	InvoiceType      string                `json:"invoice_type"`
+	PaymentTerms     string                `json:"payment_terms"`
+	DiscountPercent  *float64              `json:"discount_percent,omitempty"`
+	DiscountDueDate  *string               `json:"discount_due_date,omitempty"`
+	Currency         string                `json:"currency"`
+	ExchangeRate     *decimal.Rate         `json:"exchange_rate,omitempty"` // defaults to the rate on invoice_date
+	PricesIncludeTax bool                  `json:"prices_include_tax,omitempty"`
+	VendorTaxAmount  *int64                `json:"vendor_tax_amount,omitempty"`
+	PONumber         *string               `json:"po_number,omitempty"`
+	ReferenceNumber  *string               `json:"reference_number,omitempty"`
+	Description      *string               `json:"description,omitempty"`
+	Notes            *string               `json:"notes,omitempty"`
+	AttachmentURLs   []string              `json:"attachment_urls,omitempty"`
+	Lines            []*InvoiceLineRequest `json:"lines"`
+	CreatedBy        string                `json:"created_by,omitempty"`
+
+	DuplicateOverrideReason string `json:"duplicate_override_reason,omitempty"`
+	DuplicateWarnOnly       bool   `json:"-"`
 }
 
 // InvoiceLineRequest represents an invoice line request
 type InvoiceLineRequest struct {
-	LineNumber  int      `json:"line_number"`
-	AccountID   string   `json:"account_id"`
-	Description string   `json:"description"`
-	Quantity    float64  `json:"quantity"`
-	UnitPrice   int64    `json:"unit_price"`
-	LineAmount  int64    `json:"line_amount"`
-	TaxCode     *string  `json:"tax_code,omitempty"`
-	TaxRate     *float64 `json:"tax_rate,omitempty"`
-	TaxAmount   int64    `json:"tax_amount"`
-	Dimension1  *string  `json:"dimension1,omitempty"`
-	Dimension2  *string  `json:"dimension2,omitempty"`
-	Dimension3  *string  `json:"dimension3,omitempty"`
-	Dimension4  *string  `json:"dimension4,omitempty"`
-	ItemCode    *string  `json:"item_code,omitempty"`
-	ItemName    *string  `json:"item_name,omitempty"`
+	LineNumber  int              `json:"line_number"`
+	AccountID   string           `json:"account_id"`
+	Description string           `json:"description"`
+	Quantity    decimal.Decimal  `json:"quantity"`
+	UnitPrice   int64            `json:"unit_price"`
+	LineAmount  int64            `json:"line_amount"`
+	TaxCode     *string          `json:"tax_code,omitempty"`
+	TaxRate     *decimal.Decimal `json:"tax_rate,omitempty"`
+	TaxAmount   int64            `json:"tax_amount"`
+	Dimension1  *string          `json:"dimension1,omitempty"`
+	Dimension2  *string          `json:"dimension2,omitempty"`
+	Dimension3  *string          `json:"dimension3,omitempty"`
+	Dimension4  *string          `json:"dimension4,omitempty"`
+	ItemCode    *string          `json:"item_code,omitempty"`
+	ItemName    *string          `json:"item_name,omitempty"`
+}
+
+// UpdateInvoiceRequest represents an update invoice request for a draft invoice.
+// Nil header fields are left unchanged.
+type UpdateInvoiceRequest struct {
+	ID               string                      `json:"id"`
+	EntityID         string                      `json:"entity_id"`
+	VendorID         *string                     `json:"vendor_id,omitempty"`
+	InvoiceNumber    *string                     `json:"invoice_number,omitempty"`
+	InvoiceDate      *string                     `json:"invoice_date,omitempty"`
+	DueDate          *string                     `json:"due_date,omitempty"`
+	GLDate           *string                     `json:"gl_date,omitempty"` // empty clears
+	InvoiceType      *string                     `json:"invoice_type,omitempty"`
+	PaymentTerms     *string                     `json:"payment_terms,omitempty"`
+	DiscountPercent  *float64                    `json:"discount_percent,omitempty"`
+	DiscountDueDate  *string                     `json:"discount_due_date,omitempty"`
+	Currency         *string                     `json:"currency,omitempty"`
+	ExchangeRate     *decimal.Rate               `json:"exchange_rate,omitempty"` // re-derived when currency or invoice_date change
+	PricesIncludeTax *bool                       `json:"prices_include_tax,omitempty"`
+	VendorTaxAmount  *int64                      `json:"vendor_tax_amount,omitempty"`
+	PONumber         *string                     `json:"po_number,omitempty"`
+	ReferenceNumber  *string                     `json:"reference_number,omitempty"`
+	Description      *string                     `json:"description,omitempty"`
+	Notes            *string                     `json:"notes,omitempty"`
+	AttachmentURLs   *[]string                   `json:"attachment_urls,omitempty"`
+	Lines            []*UpdateInvoiceLineRequest `json:"lines,omitempty"`
+	ReplaceLines     bool                        `json:"replace_lines,omitempty"` // drop lines not listed in Lines
+	UpdatedBy        string                      `json:"updated_by,omitempty"`
+	ExpectedVersion  *int64                      `json:"version,omitempty"`
+}
+
+// UpdateInvoiceLineRequest represents a line edit within an update request.
+// An empty ID adds a new line; an ID with Delete removes that line; an ID
+// without Delete replaces the existing line with the supplied values.
+type UpdateInvoiceLineRequest struct {
+	ID     string `json:"id,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+	InvoiceLineRequest
 }
 
 // ApproveInvoiceRequest represents an approve invoice request
 type ApproveInvoiceRequest struct {
-	ID         string  `json:"id"`
-	EntityID   string  `json:"entity_id"`
-	ApprovedBy string  `json:"approved_by"`
-	Notes      *string `json:"notes,omitempty"`
+	ID              string  `json:"id"`
+	EntityID        string  `json:"entity_id"`
+	ApprovedBy      string  `json:"approved_by"`
+	Notes           *string `json:"notes,omitempty"`
+	ExpectedVersion *int64  `json:"version,omitempty"`
 }
 
-// PostInvoiceRequest represents a post invoice request
+// PostInvoiceRequest represents a post invoice request. PeriodID, when set,
+// is the accounting period to post into instead of the GL date's period.
 type PostInvoiceRequest struct {
-	ID       string `json:"id"`
-	EntityID string `json:"entity_id"`
-	PostedBy string `json:"posted_by"`
+	ID              string `json:"id"`
+	EntityID        string `json:"entity_id"`
+	PostedBy        string `json:"posted_by"`
+	PeriodID        string `json:"period_id,omitempty"`
+	ExpectedVersion *int64 `json:"version,omitempty"`
 }
 
 // RecordPaymentRequest represents a record payment request
@@ -98,11 +202,34 @@ type RecordPaymentRequest struct {
 	InvoiceID        string  `json:"invoice_id"`
 	EntityID         string  `json:"entity_id"`
 	PaymentDate      string  `json:"payment_date"`
+	GLDate           *string `json:"gl_date,omitempty"` // defaults to payment_date
 	PaymentAmount    int64   `json:"payment_amount"`
 	PaymentMethod    *string `json:"payment_method,omitempty"`
 	PaymentReference *string `json:"payment_reference,omitempty"`
 	Notes            *string `json:"notes,omitempty"`
 	CreatedBy        string  `json:"created_by,omitempty"`
+	ExpectedVersion  *int64  `json:"version,omitempty"`
+	IdempotencyKey   string  `json:"idempotency_key,omitempty"`
+}
+
+// CancelInvoiceRequest represents a cancel (draft/approved) or void (posted)
+// invoice request
+type CancelInvoiceRequest struct {
+	ID              string `json:"id"`
+	EntityID        string `json:"entity_id"`
+	Reason          string `json:"reason"`
+	CancelledBy     string `json:"cancelled_by,omitempty"`
+	ExpectedVersion *int64 `json:"version,omitempty"`
+}
+
+// VoidPaymentRequest represents a void payment request
+type VoidPaymentRequest struct {
+	InvoiceID       string `json:"invoice_id"`
+	EntityID        string `json:"entity_id"`
+	PaymentID       string `json:"payment_id"`
+	Reason          string `json:"reason"`
+	VoidedBy        string `json:"voided_by,omitempty"`
+	ExpectedVersion *int64 `json:"version,omitempty"`
 }
 
 // CreateInvoice creates a new invoice
@@ -117,15 +244,8 @@ func (s *InvoiceService) CreateInvoice(ctx context.Context, req *CreateInvoiceRe
 	}
 
 	// Validate invoice type
-	validTypes := map[string]bool{
-		"standard":   true,
-		"credit_memo": true,
-		"debit_memo":  true,
-		"prepayment":  true,
-		"recurring":   true,
-	}
 	invoiceType := strings.ToLower(req.InvoiceType)
-	if !validTypes[invoiceType] {
+	if !validInvoiceTypes[invoiceType] {
 		return nil, errors.InvalidInput("invoice_type", "invalid invoice type")
 	}
 
@@ -135,18 +255,23 @@ func (s *InvoiceService) CreateInvoice(ctx context.Context, req *CreateInvoiceRe
 		return nil, errors.InvalidInput("invoice_date", "invalid date format, expected YYYY-MM-DD")
 	}
 
-	dueDate, err := time.Parse("2006-01-02", req.DueDate)
-	if err != nil {
-		return nil, errors.InvalidInput("due_date", "invalid date format, expected YYYY-MM-DD")
-	}
+	// The due date may be left to the payment terms
+	var dueDate time.Time
+	if req.DueDate != "" {
+		dueDate, err = time.Parse("2006-01-02", req.DueDate)
+		if err != nil {
+			return nil, errors.InvalidInput("due_date", "invalid date format, expected YYYY-MM-DD")
+		}
 
-	if dueDate.Before(invoiceDate) {
-		return nil, errors.InvalidInput("due_date", "due date cannot be before invoice date")
+		if dueDate.Before(invoiceDate) {
+			return nil, errors.InvalidInput("due_date", "due date cannot be before invoice date")
+		}
 	}
 
 	// Validate currency
-	if len(req.Currency) != 3 {
-		return nil, errors.InvalidInput("currency", "currency must be 3-letter ISO code")
+	cur, err := currency.Lookup(req.Currency)
+	if err != nil {
+		return nil, errors.InvalidInput("currency", "currency must be an ISO 4217 code")
 	}
 
 	// Validate lines exist
@@ -159,6 +284,27 @@ func (s *InvoiceService) CreateInvoice(ctx context.Context, req *CreateInvoiceRe
 		return nil, errors.InvalidInput("discount_percent", "discount must be between 0 and 100")
 	}
 
+	// Validate vendor-stated tax
+	if req.VendorTaxAmount != nil && *req.VendorTaxAmount < 0 {
+		return nil, errors.InvalidInput("vendor_tax_amount", "vendor tax amount cannot be negative")
+	}
+
+	// Parse optional GL date
+	var glDate *time.Time
+	if req.GLDate != nil && *req.GLDate != "" {
+		parsedGLDate, err := time.Parse("2006-01-02", *req.GLDate)
+		if err != nil {
+			return nil, errors.InvalidInput("gl_date", "invalid date format, expected YYYY-MM-DD")
+		}
+		glDate = &parsedGLDate
+	}
+
+	// Default payment terms from the vendor, then entity settings
+	paymentTerms, err := s.resolvePaymentTerms(ctx, req.EntityID, req.VendorID, req.PaymentTerms)
+	if err != nil {
+		return nil, err
+	}
+
 	// Convert empty string to NULL for CreatedBy
 	var createdBy *string
 	if req.CreatedBy != "" {
@@ -177,101 +323,465 @@ func (s *InvoiceService) CreateInvoice(ctx context.Context, req *CreateInvoiceRe
 
 	// Build invoice
 	invoice := &repository.Invoice{
-		EntityID:        req.EntityID,
-		VendorID:        req.VendorID,
-		InvoiceNumber:   req.InvoiceNumber,
-		InvoiceDate:     invoiceDate,
-		DueDate:         dueDate,
-		InvoiceType:     invoiceType,
-		Status:          "draft",
-		PaymentTerms:    req.PaymentTerms,
-		DiscountPercent: req.DiscountPercent,
-		DiscountDueDate: discountDueDate,
-		Currency:        strings.ToUpper(req.Currency),
-		PONumber:        req.PONumber,
-		ReferenceNumber: req.ReferenceNumber,
-		Description:     req.Description,
-		Notes:           req.Notes,
-		AttachmentURLs:  req.AttachmentURLs,
-		CreatedBy:       createdBy,
-		Lines:           make([]*repository.InvoiceLine, 0),
+		EntityID:         req.EntityID,
+		VendorID:         req.VendorID,
+		InvoiceNumber:    req.InvoiceNumber,
+		InvoiceDate:      invoiceDate,
+		DueDate:          dueDate,
+		GLDate:           glDate,
+		InvoiceType:      invoiceType,
+		Status:           "draft",
+		PaymentTerms:     paymentTerms,
+		DiscountPercent:  req.DiscountPercent,
+		DiscountDueDate:  discountDueDate,
+		Currency:         cur.Code,
+		PricesIncludeTax: req.PricesIncludeTax,
+		VendorTaxAmount:  req.VendorTaxAmount,
+		PONumber:         req.PONumber,
+		ReferenceNumber:  req.ReferenceNumber,
+		Description:      req.Description,
+		Notes:            req.Notes,
+		AttachmentURLs:   req.AttachmentURLs,
+		CreatedBy:        createdBy,
+		Lines:            make([]*repository.InvoiceLine, 0),
+	}
+
+	// Derive the due date and discount from catalogued payment terms, or
+	// check those supplied against them
+	if err := s.applyPaymentTerms(ctx, invoice, paymentTermsFields{
+		DueDate:         req.DueDate != "",
+		DiscountPercent: req.DiscountPercent != nil,
+		DiscountDueDate: discountDueDate != nil,
+	}); err != nil {
+		return nil, err
 	}
 
 	// Validate and build lines
 	accountsSeen := make(map[string]bool)
 
 	for _, lineReq := range req.Lines {
-		// Validate quantity
-		if lineReq.Quantity <= 0 {
-			return nil, errors.InvalidInput("quantity", "quantity must be positive")
+		line, err := s.buildLine(ctx, req.EntityID, lineReq, accountsSeen)
+		if err != nil {
+			return nil, err
+		}
+
+		invoice.Lines = append(invoice.Lines, line)
+	}
+
+	// Calculate tax for lines with a tax code
+	if err := s.taxes.CalculateInvoiceTax(ctx, invoice); err != nil {
+		return nil, err
+	}
+
+	// Convert amounts into the functional currency
+	if err := s.fx.ApplyInvoiceRate(ctx, invoice, req.ExchangeRate); err != nil {
+		return nil, err
+	}
+
+	// Look for likely duplicates the unique invoice number misses
+	duplicates, err := s.duplicates.screen(ctx, invoice, req.DuplicateOverrideReason, req.DuplicateWarnOnly)
+	if err != nil {
+		return nil, err
+	}
+	invoice.DuplicateWarnings = markDuplicates(duplicates, req.DuplicateOverrideReason, createdBy)
+
+	// Create invoice, recording its likely duplicates in the same transaction
+	if err := s.invoiceRepo.Create(ctx, invoice); err != nil {
+		return nil, err
+	}
+
+	s.duplicates.logCreated(invoice)
+
+	s.log.Info().
+		Str("invoice_id", invoice.ID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Str("vendor_id", req.VendorID).
+		Str("entity_id", req.EntityID).
+		Int64("total_amount", invoice.TotalAmount).
+		Int("line_count", len(invoice.Lines)).
+		Msg("Invoice created")
+
+	return invoice, nil
+}
+
+// UpdateInvoice updates the header and lines of a draft invoice. Header fields
+// left nil are unchanged; totals are recomputed in the same transaction.
+func (s *InvoiceService) UpdateInvoice(ctx context.Context, req *UpdateInvoiceRequest) (*repository.Invoice, error) {
+	// Get invoice
+	invoice, err := s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate version and status
+	if err := checkVersion(invoice, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if invoice.Status != "draft" {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot update invoice with status '%s'", invoice.Status))
+	}
+	previousCurrency, previousInvoiceDate := invoice.Currency, invoice.InvoiceDate
+
+	// Apply header changes
+	if req.VendorID != nil && *req.VendorID != invoice.VendorID {
+		valid, message, err := s.vendorsClient.ValidateVendor(ctx, *req.VendorID, req.EntityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate vendor: %w", err)
+		}
+		if !valid {
+			return nil, errors.InvalidInput("vendor_id", message)
 		}
+		invoice.VendorID = *req.VendorID
+	}
 
-		// Validate amounts
-		if lineReq.UnitPrice < 0 {
-			return nil, errors.InvalidInput("unit_price", "unit price cannot be negative")
+	if req.InvoiceNumber != nil {
+		if *req.InvoiceNumber == "" {
+			return nil, errors.InvalidInput("invoice_number", "invoice number cannot be empty")
 		}
+		invoice.InvoiceNumber = *req.InvoiceNumber
+	}
 
-		if lineReq.LineAmount < 0 {
-			return nil, errors.InvalidInput("line_amount", "line amount cannot be negative")
+	if req.InvoiceType != nil {
+		invoiceType := strings.ToLower(*req.InvoiceType)
+		if !validInvoiceTypes[invoiceType] {
+			return nil, errors.InvalidInput("invoice_type", "invalid invoice type")
 		}
+		invoice.InvoiceType = invoiceType
+	}
 
-		if lineReq.TaxAmount < 0 {
-			return nil, errors.InvalidInput("tax_amount", "tax amount cannot be negative")
+	if req.InvoiceDate != nil {
+		invoiceDate, err := time.Parse("2006-01-02", *req.InvoiceDate)
+		if err != nil {
+			return nil, errors.InvalidInput("invoice_date", "invalid date format, expected YYYY-MM-DD")
 		}
+		invoice.InvoiceDate = invoiceDate
+	}
 
-		// Validate tax rate
-		if lineReq.TaxRate != nil && (*lineReq.TaxRate < 0 || *lineReq.TaxRate > 100) {
-			return nil, errors.InvalidInput("tax_rate", "tax rate must be between 0 and 100")
+	if req.DueDate != nil {
+		dueDate, err := time.Parse("2006-01-02", *req.DueDate)
+		if err != nil {
+			return nil, errors.InvalidInput("due_date", "invalid date format, expected YYYY-MM-DD")
 		}
+		invoice.DueDate = dueDate
+	}
 
-		// Validate account exists and allows posting (only validate each account once)
-		if !accountsSeen[lineReq.AccountID] {
-			valid, message, err := s.accountsClient.ValidateAccount(ctx, lineReq.AccountID, req.EntityID)
+	if req.GLDate != nil {
+		if *req.GLDate == "" {
+			invoice.GLDate = nil
+		} else {
+			glDate, err := time.Parse("2006-01-02", *req.GLDate)
 			if err != nil {
-				return nil, fmt.Errorf("failed to validate account %s: %w", lineReq.AccountID, err)
+				return nil, errors.InvalidInput("gl_date", "invalid date format, expected YYYY-MM-DD")
 			}
-			if !valid {
-				return nil, errors.InvalidInput("account_id", fmt.Sprintf("account %s: %s", lineReq.AccountID, message))
+			invoice.GLDate = &glDate
+		}
+	}
+
+	if req.Currency != nil {
+		cur, err := currency.Lookup(*req.Currency)
+		if err != nil {
+			return nil, errors.InvalidInput("currency", "currency must be an ISO 4217 code")
+		}
+		invoice.Currency = cur.Code
+	}
+
+	if req.PricesIncludeTax != nil {
+		invoice.PricesIncludeTax = *req.PricesIncludeTax
+	}
+
+	if req.VendorTaxAmount != nil {
+		if *req.VendorTaxAmount < 0 {
+			return nil, errors.InvalidInput("vendor_tax_amount", "vendor tax amount cannot be negative")
+		}
+		invoice.VendorTaxAmount = req.VendorTaxAmount
+	}
+
+	if req.PaymentTerms != nil {
+		invoice.PaymentTerms = *req.PaymentTerms
+	}
+
+	if req.DiscountPercent != nil {
+		if *req.DiscountPercent < 0 || *req.DiscountPercent > 100 {
+			return nil, errors.InvalidInput("discount_percent", "discount must be between 0 and 100")
+		}
+		invoice.DiscountPercent = req.DiscountPercent
+	}
+
+	if req.DiscountDueDate != nil {
+		if *req.DiscountDueDate == "" {
+			invoice.DiscountDueDate = nil
+		} else {
+			parsedDiscountDueDate, err := time.Parse("2006-01-02", *req.DiscountDueDate)
+			if err != nil {
+				return nil, errors.InvalidInput("discount_due_date", "invalid date format, expected YYYY-MM-DD")
 			}
-			accountsSeen[lineReq.AccountID] = true
-		}
-
-		line := &repository.InvoiceLine{
-			LineNumber:  lineReq.LineNumber,
-			AccountID:   lineReq.AccountID,
-			Description: lineReq.Description,
-			Quantity:    lineReq.Quantity,
-			UnitPrice:   lineReq.UnitPrice,
-			LineAmount:  lineReq.LineAmount,
-			TaxCode:     lineReq.TaxCode,
-			TaxRate:     lineReq.TaxRate,
-			TaxAmount:   lineReq.TaxAmount,
-			Dimension1:  lineReq.Dimension1,
-			Dimension2:  lineReq.Dimension2,
-			Dimension3:  lineReq.Dimension3,
-			Dimension4:  lineReq.Dimension4,
-			ItemCode:    lineReq.ItemCode,
-			ItemName:    lineReq.ItemName,
+			invoice.DiscountDueDate = &parsedDiscountDueDate
 		}
+	}
 
-		invoice.Lines = append(invoice.Lines, line)
+	// Derive the due date and discount again when the terms or dates change,
+	// or check those supplied against the terms
+	if req.PaymentTerms != nil || req.InvoiceDate != nil || req.DueDate != nil || req.DiscountPercent != nil || req.DiscountDueDate != nil {
+		if err := s.applyPaymentTerms(ctx, invoice, paymentTermsFields{
+			DueDate:         req.DueDate != nil,
+			DiscountPercent: req.DiscountPercent != nil,
+			DiscountDueDate: invoice.DiscountDueDate != nil && req.DiscountDueDate != nil,
+		}); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create invoice
-	if err := s.invoiceRepo.Create(ctx, invoice); err != nil {
+	if invoice.DueDate.Before(invoice.InvoiceDate) {
+		return nil, errors.InvalidInput("due_date", "due date cannot be before invoice date")
+	}
+
+	if req.PONumber != nil {
+		invoice.PONumber = req.PONumber
+	}
+	if req.ReferenceNumber != nil {
+		invoice.ReferenceNumber = req.ReferenceNumber
+	}
+	if req.Description != nil {
+		invoice.Description = req.Description
+	}
+	if req.Notes != nil {
+		invoice.Notes = req.Notes
+	}
+	if req.AttachmentURLs != nil {
+		invoice.AttachmentURLs = *req.AttachmentURLs
+	}
+
+	// Reconcile lines, counting those kept as stored
+	deletedLineIDs := make([]string, 0)
+	keptLines := len(invoice.Lines)
+	if req.ReplaceLines || len(req.Lines) > 0 {
+		keptLines = 0
+		existing := make(map[string]*repository.InvoiceLine, len(invoice.Lines))
+		for _, line := range invoice.Lines {
+			existing[line.ID] = line
+		}
+
+		lines := make([]*repository.InvoiceLine, 0, len(invoice.Lines)+len(req.Lines))
+		touched := make(map[string]bool)
+		accountsSeen := make(map[string]bool)
+
+		for _, lineReq := range req.Lines {
+			if lineReq.ID != "" {
+				if _, ok := existing[lineReq.ID]; !ok {
+					return nil, errors.NotFound("invoice_line", lineReq.ID)
+				}
+				if touched[lineReq.ID] {
+					return nil, errors.InvalidInput("lines", fmt.Sprintf("line %s edited more than once", lineReq.ID))
+				}
+				touched[lineReq.ID] = true
+
+				if lineReq.Delete {
+					deletedLineIDs = append(deletedLineIDs, lineReq.ID)
+					continue
+				}
+			} else if lineReq.Delete {
+				return nil, errors.InvalidInput("lines", "line id is required to delete a line")
+			}
+
+			line, err := s.buildLine(ctx, req.EntityID, &lineReq.InvoiceLineRequest, accountsSeen)
+			if err != nil {
+				return nil, err
+			}
+			line.ID = lineReq.ID
+			lines = append(lines, line)
+		}
+
+		// Keep untouched lines, or drop them when the line set is being replaced
+		for _, line := range invoice.Lines {
+			if touched[line.ID] {
+				continue
+			}
+			if req.ReplaceLines {
+				deletedLineIDs = append(deletedLineIDs, line.ID)
+				continue
+			}
+			lines = append(lines, line)
+			keptLines++
+		}
+
+		invoice.Lines = lines
+	}
+
+	// Stored amounts are in the minor unit of the previous currency, so a
+	// change to a currency with other minor units must resend all of them
+	if invoice.Currency != previousCurrency &&
+		currency.ForCode(invoice.Currency).MinorUnits != currency.ForCode(previousCurrency).MinorUnits &&
+		(keptLines > 0 || (req.VendorTaxAmount == nil && invoice.VendorTaxAmount != nil)) {
+		return nil, errors.InvalidInput("currency",
+			fmt.Sprintf("changing currency from %s to %s changes its minor units; replace every line and the vendor tax amount in the same update",
+				previousCurrency, invoice.Currency))
+	}
+
+	// Validate resulting lines
+	if len(invoice.Lines) < 1 {
+		return nil, errors.InvalidInput("lines", "invoice must have at least 1 line")
+	}
+	lineNumbers := make(map[int]bool, len(invoice.Lines))
+	for _, line := range invoice.Lines {
+		if lineNumbers[line.LineNumber] {
+			return nil, errors.InvalidInput("line_number", fmt.Sprintf("duplicate line number %d", line.LineNumber))
+		}
+		lineNumbers[line.LineNumber] = true
+	}
+
+	// Recalculate tax over the resulting lines; invoice-level rounding and
+	// the invoice date both depend on more than the edited lines
+	if err := s.taxes.CalculateInvoiceTax(ctx, invoice); err != nil {
+		return nil, err
+	}
+
+	// Convert amounts into the functional currency, keeping the stored rate
+	// unless a rate is supplied or what it was derived from has changed
+	exchangeRate := req.ExchangeRate
+	if exchangeRate == nil && invoice.Currency == previousCurrency && invoice.InvoiceDate.Equal(previousInvoiceDate) {
+		functional, err := s.fx.FunctionalCurrency(ctx, req.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		if functional == invoice.FunctionalCurrency {
+			storedRate := invoice.ExchangeRate
+			exchangeRate = &storedRate
+		}
+	}
+	if err := s.fx.ApplyInvoiceRate(ctx, invoice, exchangeRate); err != nil {
+		return nil, err
+	}
+
+	// Convert empty string to NULL for UpdatedBy
+	var updatedBy *string
+	if req.UpdatedBy != "" {
+		updatedBy = &req.UpdatedBy
+	}
+	invoice.UpdatedBy = updatedBy
+
+	// Update invoice
+	if err := s.invoiceRepo.Update(ctx, invoice, deletedLineIDs); err != nil {
 		return nil, err
 	}
 
 	s.log.Info().
 		Str("invoice_id", invoice.ID).
 		Str("invoice_number", invoice.InvoiceNumber).
-		Str("vendor_id", req.VendorID).
 		Str("entity_id", req.EntityID).
 		Int64("total_amount", invoice.TotalAmount).
 		Int("line_count", len(invoice.Lines)).
-		Msg("Invoice created")
+		Int("lines_deleted", len(deletedLineIDs)).
+		Int64("version", invoice.Version).
+		Msg("Invoice updated")
 
-	return invoice, nil
+	// Retrieve updated invoice
+	return s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
+}
+
+// buildLine validates a line request and converts it to a repository line.
+// Each account is validated against GL-1 once per accountsSeen set.
+func (s *InvoiceService) buildLine(ctx context.Context, entityID string, lineReq *InvoiceLineRequest, accountsSeen map[string]bool) (*repository.InvoiceLine, error) {
+	// Validate line number. Update moves stored lines to negative numbers
+	// while it renumbers them, so those are reserved.
+	if lineReq.LineNumber < 1 {
+		return nil, errors.InvalidInput("line_number", fmt.Sprintf("line number %d must be at least 1", lineReq.LineNumber))
+	}
+
+	// Validate quantity
+	if lineReq.Quantity.Sign() <= 0 {
+		return nil, errors.InvalidInput("quantity", "quantity must be positive")
+	}
+
+	// Validate amounts
+	if lineReq.UnitPrice < 0 {
+		return nil, errors.InvalidInput("unit_price", "unit price cannot be negative")
+	}
+
+	if lineReq.LineAmount < 0 {
+		return nil, errors.InvalidInput("line_amount", "line amount cannot be negative")
+	}
+
+	if lineReq.TaxAmount < 0 {
+		return nil, errors.InvalidInput("tax_amount", "tax amount cannot be negative")
+	}
+
+	// Validate tax rate
+	if lineReq.TaxRate != nil && !validPercent(*lineReq.TaxRate) {
+		return nil, errors.InvalidInput("tax_rate", "tax rate must be between 0 and 100")
+	}
+
+	// Derive the line amount from quantity and unit price, or verify the one
+	// entered is within the entity's line amount tolerance of it
+	lineAmount, err := s.lineAmount(ctx, entityID, lineReq)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate tax code. Tax on a line with a tax code is calculated from the
+	// code's rate, so any tax rate and amount entered for it are discarded.
+	taxRate, taxAmount := lineReq.TaxRate, lineReq.TaxAmount
+	if lineReq.TaxCode != nil && *lineReq.TaxCode != "" {
+		if err := s.taxes.ValidateTaxCode(ctx, entityID, *lineReq.TaxCode); err != nil {
+			return nil, err
+		}
+		taxRate, taxAmount = nil, 0
+	}
+
+	// Validate account exists and allows posting (only validate each account once)
+	if !accountsSeen[lineReq.AccountID] {
+		valid, message, err := s.accountsClient.ValidateAccount(ctx, lineReq.AccountID, entityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate account %s: %w", lineReq.AccountID, err)
+		}
+		if !valid {
+			return nil, errors.InvalidInput("account_id", fmt.Sprintf("account %s: %s", lineReq.AccountID, message))
+		}
+		accountsSeen[lineReq.AccountID] = true
+	}
+
+	return &repository.InvoiceLine{
+		LineNumber:  lineReq.LineNumber,
+		AccountID:   lineReq.AccountID,
+		Description: lineReq.Description,
+		Quantity:    lineReq.Quantity,
+		UnitPrice:   lineReq.UnitPrice,
+		LineAmount:  lineAmount,
+		TaxCode:     lineReq.TaxCode,
+		TaxRate:     taxRate,
+		TaxAmount:   taxAmount,
+		Dimension1:  lineReq.Dimension1,
+		Dimension2:  lineReq.Dimension2,
+		Dimension3:  lineReq.Dimension3,
+		Dimension4:  lineReq.Dimension4,
+		ItemCode:    lineReq.ItemCode,
+		ItemName:    lineReq.ItemName,
+	}, nil
+}
+
+// lineAmount returns the amount of a line: quantity * unit price, rounded
+// half away from zero to the currency's minor unit like tax. A line amount
+// entered on the request is kept if it is within the entity's line amount
+// tolerance of that, allowing for vendors that round differently, and
+// rejected otherwise.
+func (s *InvoiceService) lineAmount(ctx context.Context, entityID string, lineReq *InvoiceLineRequest) (int64, error) {
+	computed := decimal.MulRound(lineReq.UnitPrice, lineReq.Quantity)
+	if lineReq.LineAmount == 0 {
+		return computed, nil
+	}
+
+	settings, err := s.settings.GetSettings(ctx, entityID)
+	if err != nil {
+		return 0, err
+	}
+
+	difference := lineReq.LineAmount - computed
+	if difference > settings.LineAmountTolerance || -difference > settings.LineAmountTolerance {
+		return 0, errors.InvalidInput("line_amount",
+			fmt.Sprintf("line %d: line amount %d does not match quantity %s x unit price %d = %d",
+				lineReq.LineNumber, lineReq.LineAmount, lineReq.Quantity, lineReq.UnitPrice, computed))
+	}
+	return lineReq.LineAmount, nil
 }
 
 // GetInvoice retrieves an invoice by ID
@@ -279,6 +789,46 @@ func (s *InvoiceService) GetInvoice(ctx context.Context, id, entityID string) (*
 	return s.invoiceRepo.GetByID(ctx, id, entityID)
 }
 
+// GetStatusHistory returns the status transitions of an invoice, oldest first
+func (s *InvoiceService) GetStatusHistory(ctx context.Context, id, entityID string) ([]*repository.StatusHistoryEntry, error) {
+	if _, err := s.invoiceRepo.GetByID(ctx, id, entityID); err != nil {
+		return nil, err
+	}
+	return s.invoiceRepo.GetStatusHistory(ctx, id, entityID)
+}
+
+// CheckVersion verifies that an invoice is still at the version the caller
+// read. Handlers use it before side effects outside this service, such as
+// approval workflow actions, that must not run against a stale invoice.
+func (s *InvoiceService) CheckVersion(ctx context.Context, id, entityID string, expectedVersion *int64) error {
+	if expectedVersion == nil {
+		return nil
+	}
+	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
+	if err != nil {
+		return err
+	}
+	return checkVersion(invoice, expectedVersion)
+}
+
+// CheckNotOnHold verifies that an invoice has no open holds, so action can
+// go ahead. Handlers use it before approval workflow actions, so a step is
+// not recorded for an invoice that cannot then be approved.
+func (s *InvoiceService) CheckNotOnHold(ctx context.Context, id, entityID, action string) error {
+	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
+	if err != nil {
+		return err
+	}
+	return s.holds.checkReleased(ctx, invoice, action)
+}
+
+// ApprovalEscalation returns the split invoice finding whose combined total
+// an invoice's approval is routed on instead of its own, or nil if there is
+// none. Handlers use it when creating the approval workflow.
+func (s *InvoiceService) ApprovalEscalation(ctx context.Context, invoice *repository.Invoice) (*repository.SplitInvoiceFinding, error) {
+	return s.splits.escalation(ctx, invoice)
+}
+
 // ListInvoices lists invoices with filtering and pagination
 func (s *InvoiceService) ListInvoices(ctx context.Context, entityID string, vendorID, status *string, fromDate, toDate *string, page, pageSize int) ([]*repository.Invoice, int64, error) {
 	offset := (page - 1) * pageSize
@@ -293,10 +843,14 @@ func (s *InvoiceService) ApproveInvoice(ctx context.Context, req *ApproveInvoice
 		return nil, err
 	}
 
-	// Validate status
-	if invoice.Status != "pending_approval" {
-		return nil, errors.New(errors.ErrCodeConflict,
-			fmt.Sprintf("cannot approve invoice with status '%s'", invoice.Status))
+	// Validate version
+	if err := checkVersion(invoice, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+
+	// Open holds stop approval
+	if err := s.holds.checkReleased(ctx, invoice, "approve"); err != nil {
+		return nil, err
 	}
 
 	// TODO: Validate vendor is still active
@@ -308,8 +862,13 @@ func (s *InvoiceService) ApproveInvoice(ctx context.Context, req *ApproveInvoice
 		approvedBy = &req.ApprovedBy
 	}
 
+	transition, err := s.stateMachine.Transition(invoice, EventApprove, approvedBy, req.Notes)
+	if err != nil {
+		return nil, err
+	}
+
 	// Approve invoice
-	if err := s.invoiceRepo.Approve(ctx, req.ID, req.EntityID, approvedBy, req.Notes); err != nil {
+	if err := s.invoiceRepo.Approve(ctx, req.ID, req.EntityID, invoice.Version, transition); err != nil {
 		return nil, err
 	}
 
@@ -323,7 +882,12 @@ func (s *InvoiceService) ApproveInvoice(ctx context.Context, req *ApproveInvoice
 	return s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
 }
 
-// PostInvoice posts an invoice to GL
+// PostInvoice posts an invoice to GL on its GL date, or into req.PeriodID if
+// set, after checking the accounting period is open (see posting_period.go).
+// The invoice moves to posted together with a GL posting outbox entry, then the posting saga (see
+// invoice_posting.go) is attempted inline. If any step fails, the invoice is
+// returned with gl_posting_status 'pending' and the PostingDispatcher
+// finishes or compensates the posting in the background.
 func (s *InvoiceService) PostInvoice(ctx context.Context, req *PostInvoiceRequest) (*repository.Invoice, error) {
 	// Get invoice
 	invoice, err := s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
@@ -331,80 +895,48 @@ func (s *InvoiceService) PostInvoice(ctx context.Context, req *PostInvoiceReques
 		return nil, err
 	}
 
-	// Validate status
-	if invoice.Status != "approved" {
+	// A repeated post returns the invoice with its original journal. This is
+	// checked before the version, which the first post has already advanced,
+	// but only while the invoice is still posted or paid and the request asks
+	// for the period it was posted into; a voided invoice, or a post into
+	// another period, gets the usual conflict.
+	if repeatedPost(invoice, req) {
+		s.log.Info().
+			Str("invoice_id", req.ID).
+			Str("invoice_number", invoice.InvoiceNumber).
+			Msg("Invoice already posted to GL; returning existing posting")
+		return invoice, nil
+	}
+
+	// Validate version and status
+	if err := checkVersion(invoice, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if !s.stateMachine.CanFire(invoice.Status, EventPost) {
 		return nil, errors.New(errors.ErrCodeConflict,
 			fmt.Sprintf("cannot post invoice with status '%s', must be approved", invoice.Status))
 	}
 
-	// Validate not already posted
-	if invoice.PostedToGL {
-		return nil, errors.New(errors.ErrCodeConflict, "invoice has already been posted to GL")
-	}
-
-	// Build journal entry lines from invoice
-	journalLines := make([]*client.JournalLineRequest, 0, len(invoice.Lines)+1)
-
-	// Debit lines from invoice line items
-	for i, line := range invoice.Lines {
-		desc := fmt.Sprintf("Invoice %s - %s", invoice.InvoiceNumber, line.Description)
-		journalLines = append(journalLines, &client.JournalLineRequest{
-			LineNumber:  i + 1,
-			AccountID:   line.AccountID,
-			LineType:    "debit",
-			Amount:      line.LineAmount + line.TaxAmount,
-			Description: &desc,
-			Dimension1:  line.Dimension1,
-			Dimension2:  line.Dimension2,
-			Dimension3:  line.Dimension3,
-			Dimension4:  line.Dimension4,
-			Reference:   &invoice.InvoiceNumber,
-		})
-	}
-
-	// Credit line to Accounts Payable
-	// TODO: Make AP account configurable via entity settings
-	apAccountCode := "2000" // Default Accounts Payable account
-	apAccount, err := s.accountsClient.GetAccountByCode(ctx, apAccountCode, req.EntityID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get AP account: %w", err)
-	}
-
-	apDesc := fmt.Sprintf("Invoice %s from vendor %s", invoice.InvoiceNumber, invoice.VendorID)
-	journalLines = append(journalLines, &client.JournalLineRequest{
-		LineNumber:  len(invoice.Lines) + 1,
-		AccountID:   apAccount.ID,
-		LineType:    "credit",
-		Amount:      invoice.TotalAmount,
-		Description: &apDesc,
-		Reference:   &invoice.InvoiceNumber,
-	})
-
-	// Create journal entry in GL-2
-	journalReq := &client.CreateJournalRequest{
-		EntityID:      req.EntityID,
-		JournalNumber: fmt.Sprintf("AP-INV-%s", invoice.InvoiceNumber),
-		JournalDate:   invoice.InvoiceDate.Format("2006-01-02"),
-		JournalType:   "ap_invoice",
-		Description:   invoice.Description,
-		Reference:     &invoice.InvoiceNumber,
-		Currency:      invoice.Currency,
-		Lines:         journalLines,
+	// Open holds stop posting
+	if err := s.holds.checkReleased(ctx, invoice, "post"); err != nil {
+		return nil, err
 	}
 
-	glJournalID, err := s.journalsClient.CreateJournal(ctx, journalReq)
+	// Fix the GL date in an open period; the saga journals on it
+	glDate, period, err := s.resolvePostingDate(ctx, req.EntityID, invoiceGLDate(invoice), req.PeriodID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create journal entry: %w", err)
+		return nil, err
 	}
+	invoice.GLDate = &glDate
 
-	// Post the journal entry immediately
-	if err := s.journalsClient.PostJournal(ctx, glJournalID, req.EntityID); err != nil {
-		return nil, fmt.Errorf("failed to post journal entry: %w", err)
+	// Build the journal up front so configuration problems, such as a missing
+	// AP account, are reported to the caller instead of retried in the background
+	journalReq, err := s.journalBuilder.InvoiceJournal(ctx, invoice)
+	if err != nil {
+		return nil, err
 	}
-
-	// Update vendor balance in AP-1
-	if err := s.vendorsClient.UpdateBalance(ctx, invoice.VendorID, req.EntityID, invoice.TotalAmount); err != nil {
-		return nil, fmt.Errorf("failed to update vendor balance: %w", err)
+	if err := checkJournalBalanced(journalReq); err != nil {
+		return nil, err
 	}
 
 	// Convert empty string to NULL for PostedBy
@@ -413,24 +945,54 @@ func (s *InvoiceService) PostInvoice(ctx context.Context, req *PostInvoiceReques
 		postedBy = &req.PostedBy
 	}
 
-	// Mark as posted
-	if err := s.invoiceRepo.MarkAsPosted(ctx, req.ID, req.EntityID, glJournalID, postedBy); err != nil {
+	transition, err := s.stateMachine.Transition(invoice, EventPost, postedBy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mark as posted and queue the GL posting in one transaction. The entry is
+	// leased to this request so the dispatcher leaves it alone while it runs inline.
+	entry := &repository.PostingOutboxEntry{
+		InvoiceID:   req.ID,
+		EntityID:    req.EntityID,
+		MaxAttempts: postingMaxAttempts,
+		LockedUntil: postingLeaseUntil(),
+		PostedBy:    postedBy,
+	}
+
+	if err := s.invoiceRepo.QueuePosting(ctx, req.ID, req.EntityID, invoice.Version, transition, glDate, period.ID, entry); err != nil {
 		return nil, err
 	}
 
 	s.log.Info().
 		Str("invoice_id", req.ID).
 		Str("invoice_number", invoice.InvoiceNumber).
-		Str("gl_journal_id", glJournalID).
+		Str("outbox_id", entry.ID).
+		Str("gl_period_id", period.ID).
 		Str("posted_by", req.PostedBy).
-		Int64("total_amount", invoice.TotalAmount).
-		Msg("Invoice posted to GL")
+		Msg("Invoice GL posting queued")
+
+	s.drivePosting(ctx, entry)
 
 	// Retrieve updated invoice
 	return s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
 }
 
-// RecordPayment records a payment against an invoice
+// repeatedPost reports whether req repeats the post that put invoice in GL
+func repeatedPost(invoice *repository.Invoice, req *PostInvoiceRequest) bool {
+	if invoice.Status != "posted" && invoice.Status != "paid" {
+		return false
+	}
+	if !invoice.PostedToGL && checkPostingSettled(invoice) == nil {
+		return false
+	}
+	return req.PeriodID == "" || (invoice.GLPeriodID != nil && *invoice.GLPeriodID == req.PeriodID)
+}
+
+// RecordPayment records a payment against an invoice. A request carrying an
+// IdempotencyKey already used on this invoice returns the invoice without
+// recording another payment, finishing the original payment's GL journal if
+// an earlier attempt stopped short of it.
 func (s *InvoiceService) RecordPayment(ctx context.Context, req *RecordPaymentRequest) (*repository.Invoice, error) {
 	// Get invoice
 	invoice, err := s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
@@ -438,10 +1000,38 @@ func (s *InvoiceService) RecordPayment(ctx context.Context, req *RecordPaymentRe
 		return nil, err
 	}
 
+	// Replay a repeated request before the version check, which the first
+	// attempt has already advanced
+	if req.IdempotencyKey != "" {
+		payment, err := s.invoiceRepo.GetPaymentByIdempotencyKey(ctx, req.InvoiceID, req.IdempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		if payment != nil {
+			return s.replayPayment(ctx, invoice, payment, req)
+		}
+	}
+
+	// Validate version
+	if err := checkVersion(invoice, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+
 	// Validate invoice is posted
 	if invoice.Status != "posted" && invoice.Status != "paid" {
 		return nil, errors.New(errors.ErrCodeConflict, "can only record payments for posted invoices")
 	}
+	if invoice.InvoiceType == "credit_memo" {
+		return nil, errors.New(errors.ErrCodeConflict, "credit memos are applied to invoices, not paid")
+	}
+	if err := checkPostingSettled(invoice); err != nil {
+		return nil, err
+	}
+
+	// Open holds stop payment
+	if err := s.holds.checkReleased(ctx, invoice, "pay"); err != nil {
+		return nil, err
+	}
 
 	// Validate payment amount
 	if req.PaymentAmount <= 0 {
@@ -460,11 +1050,28 @@ func (s *InvoiceService) RecordPayment(ctx context.Context, req *RecordPaymentRe
 		return nil, errors.InvalidInput("payment_date", "invalid date format, expected YYYY-MM-DD")
 	}
 
-	// Convert empty string to NULL for CreatedBy
+	// Fix the GL date in an open period, defaulting to the payment date
+	glDate := paymentDate
+	if req.GLDate != nil && *req.GLDate != "" {
+		glDate, err = time.Parse("2006-01-02", *req.GLDate)
+		if err != nil {
+			return nil, errors.InvalidInput("gl_date", "invalid date format, expected YYYY-MM-DD")
+		}
+	}
+	glDate, period, err := s.resolvePostingDate(ctx, req.EntityID, glDate, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert empty strings to NULL for CreatedBy and IdempotencyKey
 	var createdBy *string
 	if req.CreatedBy != "" {
 		createdBy = &req.CreatedBy
 	}
+	var idempotencyKey *string
+	if req.IdempotencyKey != "" {
+		idempotencyKey = &req.IdempotencyKey
+	}
 
 	// Record payment
 	payment := &repository.InvoicePayment{
@@ -474,98 +1081,122 @@ func (s *InvoiceService) RecordPayment(ctx context.Context, req *RecordPaymentRe
 		PaymentMethod:    req.PaymentMethod,
 		PaymentReference: req.PaymentReference,
 		Notes:            req.Notes,
+		GLDate:           &glDate,
+		GLPeriodID:       &period.ID,
+		IdempotencyKey:   idempotencyKey,
 		CreatedBy:        createdBy,
 	}
 
-	if err := s.invoiceRepo.RecordPayment(ctx, payment); err != nil {
+	// Convert the payment at the rate on its payment date, and check the
+	// account for any realized FX gain or loss before recording it
+	if err := s.fx.ConvertPayment(ctx, invoice, payment); err != nil {
 		return nil, err
 	}
+	if payment.RealizedFXGainLoss != 0 {
+		if _, err := s.settings.RealizedFXAccountID(ctx, req.EntityID, payment.RealizedFXGainLoss > 0); err != nil {
+			return nil, err
+		}
+	}
 
-	// Create payment journal entry in GL-2
-	// TODO: Make cash/bank account configurable via entity settings
-	cashAccountCode := "1010" // Default Cash account
-	apAccountCode := "2000"    // Default Accounts Payable account
-
-	// Look up account IDs by code
-	cashAccount, err := s.accountsClient.GetAccountByCode(ctx, cashAccountCode, req.EntityID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get cash account: %w", err)
+	if err := s.invoiceRepo.RecordPayment(ctx, payment, req.EntityID, invoice.Version); err != nil {
+		return nil, err
 	}
 
-	apAccount, err := s.accountsClient.GetAccountByCode(ctx, apAccountCode, req.EntityID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get AP account: %w", err)
+	if err := s.postPayment(ctx, invoice, payment); err != nil {
+		return nil, err
 	}
 
-	paymentDesc := fmt.Sprintf("Payment for invoice %s", invoice.InvoiceNumber)
-	paymentRef := fmt.Sprintf("Payment-%s", payment.ID)
+	s.log.Info().
+		Str("invoice_id", req.InvoiceID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Str("payment_id", payment.ID).
+		Int64("payment_amount", req.PaymentAmount).
+		Int64("realized_fx_gain_loss", payment.RealizedFXGainLoss).
+		Msg("Payment recorded")
+
+	// Retrieve updated invoice
+	return s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
+}
 
-	journalLines := []*client.JournalLineRequest{
-		{
-			LineNumber:  1,
-			AccountID:   cashAccount.ID,
-			LineType:    "debit",
-			Amount:      req.PaymentAmount,
-			Description: &paymentDesc,
-			Reference:   &paymentRef,
-		},
-		{
-			LineNumber:  2,
-			AccountID:   apAccount.ID,
-			LineType:    "credit",
-			Amount:      req.PaymentAmount,
-			Description: &paymentDesc,
-			Reference:   &paymentRef,
-		},
+// replayPayment answers a repeated record-payment request with the payment
+// recorded by the first attempt
+func (s *InvoiceService) replayPayment(ctx context.Context, invoice *repository.Invoice, payment *repository.InvoicePayment, req *RecordPaymentRequest) (*repository.Invoice, error) {
+	if payment.PaymentAmount != req.PaymentAmount {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("idempotency key '%s' was already used for a payment of %d", req.IdempotencyKey, payment.PaymentAmount))
 	}
 
-	journalReq := &client.CreateJournalRequest{
-		EntityID:      req.EntityID,
-		JournalNumber: fmt.Sprintf("AP-PMT-%s", payment.ID),
-		JournalDate:   req.PaymentDate,
-		JournalType:   "ap_payment",
-		Description:   req.Notes,
-		Reference:     &paymentRef,
-		Currency:      invoice.Currency,
-		Lines:         journalLines,
+	// The first attempt failed after recording the payment; finish it. The
+	// journal request is keyed by payment, so a journal GL-2 already created
+	// for it is reused rather than duplicated.
+	if payment.GLJournalID == nil && payment.VoidedAt == nil {
+		if err := s.postPayment(ctx, invoice, payment); err != nil {
+			return nil, err
+		}
+	}
+
+	s.log.Info().
+		Str("invoice_id", invoice.ID).
+		Str("payment_id", payment.ID).
+		Str("idempotency_key", req.IdempotencyKey).
+		Msg("Payment already recorded; returning original payment")
+
+	return s.invoiceRepo.GetByID(ctx, invoice.ID, invoice.EntityID)
+}
+
+// postPayment creates and posts the GL-2 journal for a recorded payment and
+// reduces the vendor balance in AP-1. The journal ID is stored last, so a
+// payment without one has not finished posting and may be posted again; the
+// journal and the balance change are both keyed by payment, so whichever of
+// them an earlier attempt completed is not repeated.
+func (s *InvoiceService) postPayment(ctx context.Context, invoice *repository.Invoice, payment *repository.InvoicePayment) error {
+	// Create payment journal entry in GL-2
+	journalReq, err := s.journalBuilder.PaymentJournal(ctx, invoice, payment)
+	if err != nil {
+		return err
+	}
+	if err := checkJournalBalanced(journalReq); err != nil {
+		return err
 	}
 
 	glJournalID, err := s.journalsClient.CreateJournal(ctx, journalReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create payment journal entry: %w", err)
+		return fmt.Errorf("failed to create payment journal entry: %w", err)
 	}
 
 	// Post the payment journal entry immediately
-	if err := s.journalsClient.PostJournal(ctx, glJournalID, req.EntityID); err != nil {
-		return nil, fmt.Errorf("failed to post payment journal entry: %w", err)
+	if err := s.journalsClient.PostJournal(ctx, glJournalID, invoice.EntityID); err != nil {
+		return fmt.Errorf("failed to post payment journal entry: %w", err)
 	}
 
 	// Update vendor balance in AP-1 (decrease balance)
-	if err := s.vendorsClient.UpdateBalance(ctx, invoice.VendorID, req.EntityID, -req.PaymentAmount); err != nil {
-		return nil, fmt.Errorf("failed to update vendor balance: %w", err)
+	if err := s.balances.Apply(ctx, "payment:"+payment.ID, invoice.VendorID, invoice.EntityID, -payment.PaymentAmount); err != nil {
+		return fmt.Errorf("failed to update vendor balance: %w", err)
 	}
 
-	s.log.Info().
-		Str("invoice_id", req.InvoiceID).
-		Str("invoice_number", invoice.InvoiceNumber).
-		Str("payment_id", payment.ID).
-		Int64("payment_amount", req.PaymentAmount).
-		Msg("Payment recorded")
+	// Keep the journal so a voided payment can be reversed
+	if err := s.invoiceRepo.SetPaymentJournal(ctx, payment.ID, glJournalID); err != nil {
+		return err
+	}
+	payment.GLJournalID = &glJournalID
 
-	// Retrieve updated invoice
-	return s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
+	return nil
 }
 
 // SubmitForApproval submits an invoice for approval
-func (s *InvoiceService) SubmitForApproval(ctx context.Context, id, entityID, submittedBy string) error {
+// expectedVersion, when set, must match the invoice's current version.
+func (s *InvoiceService) SubmitForApproval(ctx context.Context, id, entityID, submittedBy string, expectedVersion *int64) error {
 	// Get invoice
 	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
 	if err != nil {
 		return err
 	}
 
-	// Validate status
-	if invoice.Status != "draft" {
+	// Validate version and status
+	if err := checkVersion(invoice, expectedVersion); err != nil {
+		return err
+	}
+	if !s.stateMachine.CanFire(invoice.Status, EventSubmit) {
 		return errors.New(errors.ErrCodeConflict,
 			fmt.Sprintf("cannot submit invoice with status '%s' for approval", invoice.Status))
 	}
@@ -575,14 +1206,35 @@ func (s *InvoiceService) SubmitForApproval(ctx context.Context, id, entityID, su
 		return errors.InvalidInput("lines", "invoice must have at least 1 line")
 	}
 
+	// Match to the purchase order; unresolved variances block submission
+	if err := s.matching.checkSubmission(ctx, invoice); err != nil {
+		return err
+	}
+
+	// Flag a purchase split to stay under an approval threshold; under the
+	// hold policy this places a hold, which stops submission below
+	if err := s.splits.screen(ctx, invoice); err != nil {
+		return err
+	}
+
+	// Open holds stop submission
+	if err := s.holds.checkReleased(ctx, invoice, "submit"); err != nil {
+		return err
+	}
+
 	// Convert empty string to NULL for submitted_by
 	var submittedByPtr *string
 	if submittedBy != "" {
 		submittedByPtr = &submittedBy
 	}
 
+	transition, err := s.stateMachine.Transition(invoice, EventSubmit, submittedByPtr, nil)
+	if err != nil {
+		return err
+	}
+
 	// Update status
-	if err := s.invoiceRepo.UpdateStatus(ctx, id, entityID, "pending_approval", submittedByPtr); err != nil {
+	if err := s.invoiceRepo.UpdateStatus(ctx, id, entityID, invoice.Version, transition); err != nil {
 		return err
 	}
 
@@ -598,16 +1250,16 @@ func (s *InvoiceService) SubmitForApproval(ctx context.Context, id, entityID, su
 // RejectInvoice rejects a pending-approval invoice and returns it to draft.
 // This is the service-level (non-workflow) path. The workflow path is handled
 // directly by ApprovalRoutingService from the gRPC handler.
-func (s *InvoiceService) RejectInvoice(ctx context.Context, id, entityID, rejectedBy, reason string) error {
+func (s *InvoiceService) RejectInvoice(ctx context.Context, id, entityID, rejectedBy, reason string, expectedVersion *int64) error {
 	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
 	if err != nil {
 		return err
 	}
 
-	if invoice.Status != "pending_approval" {
-		return errors.New(errors.ErrCodeConflict,
-			fmt.Sprintf("cannot reject invoice with status '%s'", invoice.Status))
+	if err := checkVersion(invoice, expectedVersion); err != nil {
+		return err
 	}
+
 	if reason == "" {
 		return errors.InvalidInput("reason", "rejection reason is required")
 	}
@@ -617,7 +1269,12 @@ func (s *InvoiceService) RejectInvoice(ctx context.Context, id, entityID, reject
 		rejectedByPtr = &rejectedBy
 	}
 
-	if err := s.invoiceRepo.UpdateStatus(ctx, id, entityID, "draft", rejectedByPtr); err != nil {
+	transition, err := s.stateMachine.Transition(invoice, EventReject, rejectedByPtr, &reason)
+	if err != nil {
+		return err
+	}
+
+	if err := s.invoiceRepo.UpdateStatus(ctx, id, entityID, invoice.Version, transition); err != nil {
 		return err
 	}
 
@@ -633,15 +1290,14 @@ func (s *InvoiceService) RejectInvoice(ctx context.Context, id, entityID, reject
 
 // RecallInvoice lets the original submitter cancel a pending-approval invoice.
 // This is the service-level path; the workflow path calls ApprovalRoutingService.
-func (s *InvoiceService) RecallInvoice(ctx context.Context, id, entityID, recalledBy string) error {
+func (s *InvoiceService) RecallInvoice(ctx context.Context, id, entityID, recalledBy string, expectedVersion *int64) error {
 	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
 	if err != nil {
 		return err
 	}
 
-	if invoice.Status != "pending_approval" {
-		return errors.New(errors.ErrCodeConflict,
-			fmt.Sprintf("cannot recall invoice with status '%s'", invoice.Status))
+	if err := checkVersion(invoice, expectedVersion); err != nil {
+		return err
 	}
 
 	var recalledByPtr *string
@@ -649,7 +1305,12 @@ func (s *InvoiceService) RecallInvoice(ctx context.Context, id, entityID, recall
 		recalledByPtr = &recalledBy
 	}
 
-	if err := s.invoiceRepo.UpdateStatus(ctx, id, entityID, "draft", recalledByPtr); err != nil {
+	transition, err := s.stateMachine.Transition(invoice, EventRecall, recalledByPtr, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := s.invoiceRepo.UpdateStatus(ctx, id, entityID, invoice.Version, transition); err != nil {
 		return err
 	}
 
@@ -663,19 +1324,23 @@ func (s *InvoiceService) RecallInvoice(ctx context.Context, id, entityID, recall
 }
 
 // DeleteInvoice deletes a draft invoice
-func (s *InvoiceService) DeleteInvoice(ctx context.Context, id, entityID string) error {
-	// Verify invoice exists and is draft
+func (s *InvoiceService) DeleteInvoice(ctx context.Context, id, entityID string, expectedVersion *int64) error {
+	// Verify invoice exists, is unchanged and is draft
 	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
 	if err != nil {
 		return err
 	}
 
+	if err := checkVersion(invoice, expectedVersion); err != nil {
+		return err
+	}
+
 	if invoice.Status != "draft" {
 		return errors.New(errors.ErrCodeConflict,
 			fmt.Sprintf("cannot delete invoice with status '%s'", invoice.Status))
 	}
 
-	if err := s.invoiceRepo.Delete(ctx, id, entityID); err != nil {
+	if err := s.invoiceRepo.Delete(ctx, id, entityID, invoice.Version); err != nil {
 		return err
 	}
 
@@ -686,3 +1351,226 @@ func (s *InvoiceService) DeleteInvoice(ctx context.Context, id, entityID string)
 
 	return nil
 }
+
+// CancelInvoice cancels a draft or approved invoice. Nothing has reached the
+// GL yet, so no reversal is needed; posted invoices must be voided instead.
+func (s *InvoiceService) CancelInvoice(ctx context.Context, req *CancelInvoiceRequest) (*repository.Invoice, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(invoice, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if req.Reason == "" {
+		return nil, errors.InvalidInput("reason", "cancellation reason is required")
+	}
+
+	var cancelledBy *string
+	if req.CancelledBy != "" {
+		cancelledBy = &req.CancelledBy
+	}
+
+	transition, err := s.stateMachine.Transition(invoice, EventCancel, cancelledBy, &req.Reason)
+	if err != nil {
+		if invoice.Status == "posted" {
+			return nil, errors.New(errors.ErrCodeConflict, "cannot cancel posted invoice, void it instead")
+		}
+		return nil, err
+	}
+
+	if err := s.invoiceRepo.Cancel(ctx, req.ID, req.EntityID, invoice.Version, transition, nil); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("invoice_id", req.ID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Str("cancelled_by", req.CancelledBy).
+		Str("reason", req.Reason).
+		Msg("Invoice cancelled")
+
+	return s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
+}
+
+// VoidInvoice voids a posted invoice: it posts a journal reversing the
+// original posting, reverses the vendor balance and cancels the invoice.
+// Invoices with payments are refused until those payments are voided, as are
+// invoices and credit memos with credit applied. The reversal journal and the
+// balance change are keyed on the invoice, so a void that fails part way is
+// retried by voiding again: the steps already done are not repeated.
+func (s *InvoiceService) VoidInvoice(ctx context.Context, req *CancelInvoiceRequest) (*repository.Invoice, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(invoice, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if req.Reason == "" {
+		return nil, errors.InvalidInput("reason", "void reason is required")
+	}
+
+	var voidedBy *string
+	if req.CancelledBy != "" {
+		voidedBy = &req.CancelledBy
+	}
+
+	transition, err := s.stateMachine.Transition(invoice, EventVoid, voidedBy, &req.Reason)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPostingSettled(invoice); err != nil {
+		return nil, err
+	}
+
+	if invoice.AmountPaid > 0 {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot void invoice with payments or applied credit of %d, void the payments and unapply the credit first", invoice.AmountPaid))
+	}
+
+	// Reverse the original journal entry in GL-2, today or in the next open period
+	reversalDate, _, err := s.resolvePostingDate(ctx, req.EntityID, time.Now(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if invoice.GLJournalID == nil {
+		return nil, errors.New(errors.ErrCodeConflict, "cannot void invoice with no GL journal, reverse it in GL-2 by hand")
+	}
+	journalReq, err := recordedJournal(ctx, s.journalRequests, req.EntityID, *invoice.GLJournalID)
+	if err != nil {
+		return nil, err
+	}
+	reversalReq := reversalJournalRequest(journalReq, reversalDate.Format("2006-01-02"), req.Reason)
+	reversalReq.IdempotencyKey = "invoice-void:" + invoice.ID
+
+	reversalJournalID, err := s.journalsClient.CreateJournal(ctx, reversalReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reversal journal entry: %w", err)
+	}
+
+	if err := s.journalsClient.PostJournal(ctx, reversalJournalID, req.EntityID); err != nil {
+		return nil, fmt.Errorf("failed to post reversal journal entry: %w", err)
+	}
+
+	// Reverse the vendor balance in AP-1
+	if err := s.balances.Apply(ctx, "invoice-void:"+invoice.ID, invoice.VendorID, req.EntityID, -vendorBalanceAmount(invoice)); err != nil {
+		return nil, fmt.Errorf("failed to reverse vendor balance: %w", err)
+	}
+
+	if err := s.invoiceRepo.Cancel(ctx, req.ID, req.EntityID, invoice.Version, transition, &reversalJournalID); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("invoice_id", req.ID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Str("reversal_journal_id", reversalJournalID).
+		Str("voided_by", req.CancelledBy).
+		Str("reason", req.Reason).
+		Int64("total_amount", invoice.TotalAmount).
+		Msg("Invoice voided")
+
+	return s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
+}
+
+// VoidPayment voids a payment: it posts a journal reversing the payment
+// journal, restores the vendor balance and excludes the payment from the
+// invoice's amount paid. A paid invoice returns to posted. As with
+// VoidInvoice, a void that fails part way is retried by voiding again.
+func (s *InvoiceService) VoidPayment(ctx context.Context, req *VoidPaymentRequest) (*repository.Invoice, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(invoice, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if invoice.Status != "posted" && invoice.Status != "paid" {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot void payment on invoice with status '%s'", invoice.Status))
+	}
+	if req.Reason == "" {
+		return nil, errors.InvalidInput("reason", "void reason is required")
+	}
+
+	payment, err := s.invoiceRepo.GetPayment(ctx, req.PaymentID, req.InvoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.VoidedAt != nil {
+		return nil, errors.New(errors.ErrCodeConflict, "cannot void payment that is already voided")
+	}
+	if invoice.InvoiceType == "prepayment" && payment.PaymentAmount > invoice.PrepaymentBalance {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot void payment of %d: only %d of the prepayment is unapplied", payment.PaymentAmount, invoice.PrepaymentBalance))
+	}
+
+	// Reverse the payment journal in GL-2. Payments recorded before journals
+	// were tracked have no journal ID and must be reversed in GL-2 by hand.
+	if payment.GLJournalID != nil {
+		reversalDate, _, err := s.resolvePostingDate(ctx, req.EntityID, time.Now(), "")
+		if err != nil {
+			return nil, err
+		}
+
+		journalReq, err := recordedJournal(ctx, s.journalRequests, req.EntityID, *payment.GLJournalID)
+		if err != nil {
+			return nil, err
+		}
+		reversalReq := reversalJournalRequest(journalReq, reversalDate.Format("2006-01-02"), req.Reason)
+		reversalReq.IdempotencyKey = "payment-void:" + payment.ID
+
+		reversalJournalID, err := s.journalsClient.CreateJournal(ctx, reversalReq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create payment reversal journal entry: %w", err)
+		}
+		if err := s.journalsClient.PostJournal(ctx, reversalJournalID, req.EntityID); err != nil {
+			return nil, fmt.Errorf("failed to post payment reversal journal entry: %w", err)
+		}
+		payment.ReversalJournalID = &reversalJournalID
+	} else {
+		s.log.Warn().
+			Str("invoice_id", req.InvoiceID).
+			Str("payment_id", req.PaymentID).
+			Msg("Payment has no GL journal; voiding without reversal")
+	}
+
+	// Restore the vendor balance in AP-1
+	if err := s.balances.Apply(ctx, "payment-void:"+payment.ID, invoice.VendorID, req.EntityID, payment.PaymentAmount); err != nil {
+		return nil, fmt.Errorf("failed to restore vendor balance: %w", err)
+	}
+
+	if req.VoidedBy != "" {
+		payment.VoidedBy = &req.VoidedBy
+	}
+	payment.VoidReason = &req.Reason
+
+	if err := s.invoiceRepo.VoidPayment(ctx, payment, req.EntityID, invoice.Version); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("invoice_id", req.InvoiceID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Str("payment_id", payment.ID).
+		Int64("payment_amount", payment.PaymentAmount).
+		Str("reason", req.Reason).
+		Msg("Payment voided")
+
+	return s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
+}
+
+// checkVersion rejects a request made against a stale copy of the invoice.
+// A nil expected version skips the check; the repository still guards the
+// write itself against concurrent changes since the invoice was read.
+func checkVersion(invoice *repository.Invoice, expected *int64) error {
+	if expected != nil && *expected != invoice.Version {
+		return repository.ErrVersionConflict
+	}
+	return nil
+}
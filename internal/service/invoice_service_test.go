@@ -0,0 +1,35 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	apperrors "github.com/pesio-ai/be-lib-common/errors"
+)
+
+func TestBuildLineLineNumber(t *testing.T) {
+	tests := []struct {
+		lineNumber int
+		wantField  string
+	}{
+		{lineNumber: -1, wantField: "line number"},
+		{lineNumber: 0, wantField: "line number"},
+		// Passes the line number check and fails on the zero quantity
+		{lineNumber: 1, wantField: "quantity"},
+	}
+
+	s := &InvoiceService{}
+	for _, tt := range tests {
+		_, err := s.buildLine(context.Background(), "entity", &InvoiceLineRequest{LineNumber: tt.lineNumber}, map[string]bool{})
+		var appErr *apperrors.AppError
+		if !errors.As(err, &appErr) || appErr.Code != apperrors.ErrCodeInvalidInput {
+			t.Errorf("buildLine(line_number %d) error = %v, want invalid input", tt.lineNumber, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.wantField) {
+			t.Errorf("buildLine(line_number %d) error = %q, want it to mention %s", tt.lineNumber, err, tt.wantField)
+		}
+	}
+}
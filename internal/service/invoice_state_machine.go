@@ -0,0 +1,95 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Invoice lifecycle events
+const (
+	EventSubmit      = "submit"
+	EventApprove     = "approve"
+	EventReject      = "reject"
+	EventRecall      = "recall"
+	EventPost        = "post"
+	EventPostFailed  = "post_failed"
+	EventPay         = "pay"
+	EventCancel      = "cancel"
+	EventVoid        = "void"
+	EventVoidPayment = "void_payment"
+)
+
+// invoiceEvent describes which statuses an event may fire from and the
+// status it moves the invoice to
+type invoiceEvent struct {
+	from []string
+	to   string
+}
+
+// invoiceEvents declares every allowed invoice status transition. The
+// invoice_status_transitions table (migrations 005 to 007) mirrors this
+// list so the database rejects transitions made outside this service, such
+// as by the payment trigger, which fires pay and void_payment. post_failed
+// is fired by the posting saga when it compensates a failed GL posting.
+var invoiceEvents = map[string]invoiceEvent{
+	EventSubmit:      {from: []string{"draft"}, to: "pending_approval"},
+	EventApprove:     {from: []string{"pending_approval"}, to: "approved"},
+	EventReject:      {from: []string{"pending_approval"}, to: "draft"},
+	EventRecall:      {from: []string{"pending_approval"}, to: "draft"},
+	EventPost:        {from: []string{"approved"}, to: "posted"},
+	EventPostFailed:  {from: []string{"posted"}, to: "approved"},
+	EventPay:         {from: []string{"posted"}, to: "paid"},
+	EventCancel:      {from: []string{"draft", "approved"}, to: "cancelled"},
+	EventVoid:        {from: []string{"posted"}, to: "cancelled"},
+	EventVoidPayment: {from: []string{"paid"}, to: "posted"},
+}
+
+// InvoiceStateMachine guards invoice status transitions
+type InvoiceStateMachine struct {
+	events map[string]invoiceEvent
+}
+
+// NewInvoiceStateMachine creates a state machine over the declared invoice events
+func NewInvoiceStateMachine() *InvoiceStateMachine {
+	return &InvoiceStateMachine{events: invoiceEvents}
+}
+
+// Fire returns the status an invoice in status from moves to when event
+// fires, or a conflict error if the event is not allowed from that status.
+func (m *InvoiceStateMachine) Fire(from, event string) (string, error) {
+	e, ok := m.events[event]
+	if !ok {
+		return "", errors.New(errors.ErrCodeInternal, fmt.Sprintf("unknown invoice event '%s'", event))
+	}
+	for _, status := range e.from {
+		if status == from {
+			return e.to, nil
+		}
+	}
+	return "", errors.New(errors.ErrCodeConflict,
+		fmt.Sprintf("cannot %s invoice with status '%s'", event, from))
+}
+
+// Transition fires event against the invoice's current status and returns
+// the guarded transition for the repository to apply and record
+func (m *InvoiceStateMachine) Transition(invoice *repository.Invoice, event string, actor, reason *string) (repository.StatusTransition, error) {
+	to, err := m.Fire(invoice.Status, event)
+	if err != nil {
+		return repository.StatusTransition{}, err
+	}
+	return repository.StatusTransition{
+		From:   invoice.Status,
+		To:     to,
+		Event:  event,
+		Actor:  actor,
+		Reason: reason,
+	}, nil
+}
+
+// CanFire reports whether event is allowed from status
+func (m *InvoiceStateMachine) CanFire(from, event string) bool {
+	_, err := m.Fire(from, event)
+	return err == nil
+}
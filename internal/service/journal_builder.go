@@ -0,0 +1,517 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+	"github.com/pesio-ai/be-lib-common/errors"
+)
+
+// JournalBuilder builds the GL-2 journals that post invoices and payments.
+// It resolves accounts from entity settings and tax codes but never calls
+// GL-2, so the journals it returns back both posting and PreviewPosting.
+type JournalBuilder struct {
+	settings *EntitySettingsService
+	taxes    *TaxService
+}
+
+// NewJournalBuilder creates a new journal builder
+func NewJournalBuilder(settings *EntitySettingsService, taxes *TaxService) *JournalBuilder {
+	return &JournalBuilder{settings: settings, taxes: taxes}
+}
+
+// InvoiceJournal builds the journal that posts an invoice on its GL date:
+// a debit per line to its expense account, a debit per tax code to its input
+// tax account for the recoverable tax, and a credit to Accounts Payable.
+// Tax that is not recoverable, including all tax on lines without a
+// registered tax code, is capitalized into the line's expense debit. Each line's functional
+// amount is converted at the invoice's exchange rate; the recoverable tax is
+// converted per invoice line, so the debits sum to the functional AP credit.
+// A credit memo posts the same lines with every debit and credit swapped.
+// A prepayment posts to the prepayment account instead (see
+// prepaymentInvoiceJournal).
+func (b *JournalBuilder) InvoiceJournal(ctx context.Context, invoice *repository.Invoice) (*client.CreateJournalRequest, error) {
+	if invoice.InvoiceType == "prepayment" {
+		return b.prepaymentInvoiceJournal(ctx, invoice)
+	}
+
+	taxCodes, err := b.taxes.taxCodesByCode(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	journalLines := make([]*client.JournalLineRequest, 0, len(invoice.Lines)+1)
+	recoverableByCode := make(map[string]int64)
+	functionalRecoverableByCode := make(map[string]int64)
+
+	// Debit lines from invoice line items
+	for i, line := range invoice.Lines {
+		expenseAmount := line.LineAmount + line.TaxAmount
+		functionalExpenseAmount := line.FunctionalLineAmount + line.FunctionalTaxAmount
+
+		// A code that is not registered, such as one saved before the tax code
+		// table existed, has no recoverable share: its stored tax is
+		// capitalized like tax on a line without a code
+		if taxCode, ok := lineTaxCode(taxCodes, line); ok {
+			recoverable := recoverableTax(line.TaxAmount, taxCode.RecoverablePercent)
+			functionalRecoverable := convertAmount(recoverable, invoice.Currency, invoice.FunctionalCurrency, invoice.ExchangeRate)
+			recoverableByCode[taxCode.Code] += recoverable
+			functionalRecoverableByCode[taxCode.Code] += functionalRecoverable
+			expenseAmount -= recoverable
+			functionalExpenseAmount -= functionalRecoverable
+		}
+
+		desc := fmt.Sprintf("Invoice %s - %s", invoice.InvoiceNumber, line.Description)
+		journalLines = append(journalLines, &client.JournalLineRequest{
+			LineNumber:       i + 1,
+			AccountID:        line.AccountID,
+			LineType:         "debit",
+			Amount:           expenseAmount,
+			FunctionalAmount: functionalExpenseAmount,
+			Description:      &desc,
+			Dimension1:       line.Dimension1,
+			Dimension2:       line.Dimension2,
+			Dimension3:       line.Dimension3,
+			Dimension4:       line.Dimension4,
+			Reference:        &invoice.InvoiceNumber,
+		})
+	}
+
+	// Summary debit per tax code for recoverable input tax, in code order
+	codes := make([]string, 0, len(recoverableByCode))
+	for code, amount := range recoverableByCode {
+		if amount != 0 || functionalRecoverableByCode[code] != 0 {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		accountID, err := b.taxes.InputTaxAccountID(ctx, taxCodes[code])
+		if err != nil {
+			return nil, err
+		}
+
+		taxDesc := fmt.Sprintf("Invoice %s - input tax %s", invoice.InvoiceNumber, code)
+		journalLines = append(journalLines, &client.JournalLineRequest{
+			LineNumber:       len(journalLines) + 1,
+			AccountID:        accountID,
+			LineType:         "debit",
+			Amount:           recoverableByCode[code],
+			FunctionalAmount: functionalRecoverableByCode[code],
+			Description:      &taxDesc,
+			Reference:        &invoice.InvoiceNumber,
+		})
+	}
+
+	// Credit line to the entity's Accounts Payable control account
+	apAccountID, err := b.settings.APControlAccountID(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	apDesc := fmt.Sprintf("Invoice %s from vendor %s", invoice.InvoiceNumber, invoice.VendorID)
+	journalLines = append(journalLines, &client.JournalLineRequest{
+		LineNumber:       len(journalLines) + 1,
+		AccountID:        apAccountID,
+		LineType:         "credit",
+		Amount:           invoice.TotalAmount,
+		FunctionalAmount: invoice.FunctionalTotalAmount,
+		Description:      &apDesc,
+		Reference:        &invoice.InvoiceNumber,
+	})
+
+	journalNumber := fmt.Sprintf("AP-INV-%s", invoice.InvoiceNumber)
+	if invoice.InvoiceType == "credit_memo" {
+		journalLines = reversedJournalLines(journalLines)
+		journalNumber = fmt.Sprintf("AP-CM-%s", invoice.InvoiceNumber)
+	}
+
+	return &client.CreateJournalRequest{
+		EntityID:           invoice.EntityID,
+		JournalNumber:      journalNumber,
+		JournalDate:        invoiceGLDate(invoice).Format("2006-01-02"),
+		JournalType:        "ap_invoice",
+		Description:        invoice.Description,
+		Reference:          &invoice.InvoiceNumber,
+		Currency:           invoice.Currency,
+		FunctionalCurrency: invoice.FunctionalCurrency,
+		ExchangeRate:       &invoice.ExchangeRate,
+		Lines:              journalLines,
+	}, nil
+}
+
+// lineTaxCode returns the registered tax code of a line that carries tax
+func lineTaxCode(taxCodes map[string]*repository.TaxCode, line *repository.InvoiceLine) (*repository.TaxCode, bool) {
+	if line.TaxCode == nil || *line.TaxCode == "" || line.TaxAmount == 0 {
+		return nil, false
+	}
+	taxCode, ok := taxCodes[*line.TaxCode]
+	return taxCode, ok
+}
+
+// PaymentJournal builds the journal that records a payment on its GL date:
+// a debit to Accounts Payable, settling the liability at the invoice's
+// booked rate, and a credit to cash at the payment's rate. A difference
+// between the two functional amounts is credited to the realized FX gain
+// account or debited to the realized FX loss account, with no amount in the
+// invoice currency.
+func (b *JournalBuilder) PaymentJournal(ctx context.Context, invoice *repository.Invoice, payment *repository.InvoicePayment) (*client.CreateJournalRequest, error) {
+	// Resolve the entity's cash/bank and Accounts Payable control accounts
+	cashAccountID, err := b.settings.CashAccountID(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	apAccountID, err := b.settings.APControlAccountID(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentDesc := fmt.Sprintf("Payment for invoice %s", invoice.InvoiceNumber)
+	paymentRef := fmt.Sprintf("Payment-%s", payment.ID)
+
+	journalLines := []*client.JournalLineRequest{
+		{
+			LineNumber:       1,
+			AccountID:        apAccountID,
+			LineType:         "debit",
+			Amount:           payment.PaymentAmount,
+			FunctionalAmount: payment.FunctionalAPAmount,
+			Description:      &paymentDesc,
+			Reference:        &paymentRef,
+		},
+		{
+			LineNumber:       2,
+			AccountID:        cashAccountID,
+			LineType:         "credit",
+			Amount:           payment.PaymentAmount,
+			FunctionalAmount: payment.FunctionalAmount,
+			Description:      &paymentDesc,
+			Reference:        &paymentRef,
+		},
+	}
+
+	// Realized FX gain (credit) or loss (debit) in the functional currency
+	if payment.RealizedFXGainLoss != 0 {
+		gain := payment.RealizedFXGainLoss > 0
+		fxAccountID, err := b.settings.RealizedFXAccountID(ctx, invoice.EntityID, gain)
+		if err != nil {
+			return nil, err
+		}
+
+		fxLine := &client.JournalLineRequest{
+			LineNumber:       len(journalLines) + 1,
+			AccountID:        fxAccountID,
+			LineType:         "credit",
+			FunctionalAmount: payment.RealizedFXGainLoss,
+			Reference:        &paymentRef,
+		}
+		fxDesc := fmt.Sprintf("Payment for invoice %s - realized FX gain", invoice.InvoiceNumber)
+		if !gain {
+			fxLine.LineType = "debit"
+			fxLine.FunctionalAmount = -payment.RealizedFXGainLoss
+			fxDesc = fmt.Sprintf("Payment for invoice %s - realized FX loss", invoice.InvoiceNumber)
+		}
+		fxLine.Description = &fxDesc
+		journalLines = append(journalLines, fxLine)
+	}
+
+	return &client.CreateJournalRequest{
+		EntityID:           invoice.EntityID,
+		JournalNumber:      fmt.Sprintf("AP-PMT-%s", payment.ID),
+		JournalDate:        paymentGLDate(payment).Format("2006-01-02"),
+		JournalType:        "ap_payment",
+		Description:        payment.Notes,
+		Reference:          &paymentRef,
+		Currency:           invoice.Currency,
+		FunctionalCurrency: invoice.FunctionalCurrency,
+		ExchangeRate:       &payment.ExchangeRate,
+		Lines:              journalLines,
+		IdempotencyKey:     "payment:" + payment.ID,
+	}, nil
+}
+
+// prepaymentInvoiceJournal builds the journal that posts a prepayment invoice
+// on its GL date: one debit of the whole invoice, tax included, to the
+// entity's prepayment account, and a credit to Accounts Payable. The advance
+// stays in the prepayment account until it is applied to final invoices.
+func (b *JournalBuilder) prepaymentInvoiceJournal(ctx context.Context, invoice *repository.Invoice) (*client.CreateJournalRequest, error) {
+	prepaymentAccountID, err := b.settings.PrepaymentAccountID(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	apAccountID, err := b.settings.APControlAccountID(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	prepaymentDesc := fmt.Sprintf("Prepayment %s to vendor %s", invoice.InvoiceNumber, invoice.VendorID)
+	journalLines := []*client.JournalLineRequest{
+		{
+			LineNumber:       1,
+			AccountID:        prepaymentAccountID,
+			LineType:         "debit",
+			Amount:           invoice.TotalAmount,
+			FunctionalAmount: invoice.FunctionalTotalAmount,
+			Description:      &prepaymentDesc,
+			Reference:        &invoice.InvoiceNumber,
+		},
+		{
+			LineNumber:       2,
+			AccountID:        apAccountID,
+			LineType:         "credit",
+			Amount:           invoice.TotalAmount,
+			FunctionalAmount: invoice.FunctionalTotalAmount,
+			Description:      &prepaymentDesc,
+			Reference:        &invoice.InvoiceNumber,
+		},
+	}
+
+	return &client.CreateJournalRequest{
+		EntityID:           invoice.EntityID,
+		JournalNumber:      fmt.Sprintf("AP-PRE-%s", invoice.InvoiceNumber),
+		JournalDate:        invoiceGLDate(invoice).Format("2006-01-02"),
+		JournalType:        "ap_invoice",
+		Description:        invoice.Description,
+		Reference:          &invoice.InvoiceNumber,
+		Currency:           invoice.Currency,
+		FunctionalCurrency: invoice.FunctionalCurrency,
+		ExchangeRate:       &invoice.ExchangeRate,
+		Lines:              journalLines,
+	}, nil
+}
+
+// PrepaymentApplicationJournal builds the journal that applies a paid
+// prepayment to a final invoice on the application's GL date: a debit to
+// Accounts Payable, settling the invoice's liability at its booked rate,
+// and a credit to the prepayment account, releasing the advance at the
+// prepayment's booked rate. A difference between the two functional amounts
+// is credited to the realized FX gain account or debited to the realized FX
+// loss account.
+func (b *JournalBuilder) PrepaymentApplicationJournal(ctx context.Context, prepayment, invoice *repository.Invoice, application *repository.PrepaymentApplication) (*client.CreateJournalRequest, error) {
+	apAccountID, err := b.settings.APControlAccountID(ctx, prepayment.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	prepaymentAccountID, err := b.settings.PrepaymentAccountID(ctx, prepayment.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := fmt.Sprintf("Prepayment %s applied to invoice %s", prepayment.InvoiceNumber, invoice.InvoiceNumber)
+	reference := fmt.Sprintf("PrepaymentApplication-%s", application.ID)
+
+	journalLines := []*client.JournalLineRequest{
+		{
+			LineNumber:       1,
+			AccountID:        apAccountID,
+			LineType:         "debit",
+			Amount:           application.Amount,
+			FunctionalAmount: application.FunctionalInvoiceAmount,
+			Description:      &desc,
+			Reference:        &invoice.InvoiceNumber,
+		},
+		{
+			LineNumber:       2,
+			AccountID:        prepaymentAccountID,
+			LineType:         "credit",
+			Amount:           application.Amount,
+			FunctionalAmount: application.FunctionalPrepaymentAmount,
+			Description:      &desc,
+			Reference:        &prepayment.InvoiceNumber,
+		},
+	}
+
+	// Realized FX gain (credit) or loss (debit) in the functional currency
+	if application.RealizedFXGainLoss != 0 {
+		gain := application.RealizedFXGainLoss > 0
+		fxAccountID, err := b.settings.RealizedFXAccountID(ctx, prepayment.EntityID, gain)
+		if err != nil {
+			return nil, err
+		}
+
+		fxLine := &client.JournalLineRequest{
+			LineNumber:       len(journalLines) + 1,
+			AccountID:        fxAccountID,
+			LineType:         "credit",
+			FunctionalAmount: application.RealizedFXGainLoss,
+			Reference:        &reference,
+		}
+		fxDesc := fmt.Sprintf("%s - realized FX gain", desc)
+		if !gain {
+			fxLine.LineType = "debit"
+			fxLine.FunctionalAmount = -application.RealizedFXGainLoss
+			fxDesc = fmt.Sprintf("%s - realized FX loss", desc)
+		}
+		fxLine.Description = &fxDesc
+		journalLines = append(journalLines, fxLine)
+	}
+
+	return &client.CreateJournalRequest{
+		EntityID:           prepayment.EntityID,
+		JournalNumber:      fmt.Sprintf("AP-PREA-%s", application.ID),
+		JournalDate:        application.GLDate.Format("2006-01-02"),
+		JournalType:        "ap_invoice",
+		Description:        &desc,
+		Reference:          &reference,
+		Currency:           prepayment.Currency,
+		FunctionalCurrency: prepayment.FunctionalCurrency,
+		Lines:              journalLines,
+		IdempotencyKey:     "prepayment-application:" + application.ID,
+	}, nil
+}
+
+// CreditApplicationJournal builds the journal that records the realized FX
+// gain or loss of a credit application on its GL date. Both documents sit in
+// Accounts Payable, so in the invoice currency the application nets to
+// nothing; in the functional currency the invoice's liability is debited at
+// its booked rate and the credit memo's balance credited at its own, and
+// the difference is credited to the realized FX gain account or debited to
+// the realized FX loss account.
+func (b *JournalBuilder) CreditApplicationJournal(ctx context.Context, creditMemo, invoice *repository.Invoice, application *repository.CreditApplication) (*client.CreateJournalRequest, error) {
+	apAccountID, err := b.settings.APControlAccountID(ctx, creditMemo.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	gain := application.RealizedFXGainLoss > 0
+	fxAccountID, err := b.settings.RealizedFXAccountID(ctx, creditMemo.EntityID, gain)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := fmt.Sprintf("Credit memo %s applied to invoice %s", creditMemo.InvoiceNumber, invoice.InvoiceNumber)
+	reference := fmt.Sprintf("CreditApplication-%s", application.ID)
+
+	journalLines := []*client.JournalLineRequest{
+		{
+			LineNumber:       1,
+			AccountID:        apAccountID,
+			LineType:         "debit",
+			Amount:           application.Amount,
+			FunctionalAmount: application.FunctionalInvoiceAmount,
+			Description:      &desc,
+			Reference:        &invoice.InvoiceNumber,
+		},
+		{
+			LineNumber:       2,
+			AccountID:        apAccountID,
+			LineType:         "credit",
+			Amount:           application.Amount,
+			FunctionalAmount: application.FunctionalCreditAmount,
+			Description:      &desc,
+			Reference:        &creditMemo.InvoiceNumber,
+		},
+	}
+
+	// Realized FX gain (credit) or loss (debit) in the functional currency
+	fxLine := &client.JournalLineRequest{
+		LineNumber:       len(journalLines) + 1,
+		AccountID:        fxAccountID,
+		LineType:         "credit",
+		FunctionalAmount: application.RealizedFXGainLoss,
+		Reference:        &reference,
+	}
+	fxDesc := fmt.Sprintf("%s - realized FX gain", desc)
+	if !gain {
+		fxLine.LineType = "debit"
+		fxLine.FunctionalAmount = -application.RealizedFXGainLoss
+		fxDesc = fmt.Sprintf("%s - realized FX loss", desc)
+	}
+	fxLine.Description = &fxDesc
+	journalLines = append(journalLines, fxLine)
+
+	return &client.CreateJournalRequest{
+		EntityID:           creditMemo.EntityID,
+		JournalNumber:      fmt.Sprintf("AP-CMA-%s", application.ID),
+		JournalDate:        application.GLDate.Format("2006-01-02"),
+		JournalType:        "ap_payment",
+		Description:        &desc,
+		Reference:          &reference,
+		Currency:           creditMemo.Currency,
+		FunctionalCurrency: creditMemo.FunctionalCurrency,
+		Lines:              journalLines,
+		IdempotencyKey:     "credit-application:" + application.ID,
+	}, nil
+}
+
+// reversedJournalLines returns copies of lines with every debit and credit
+// swapped
+func reversedJournalLines(lines []*client.JournalLineRequest) []*client.JournalLineRequest {
+	reversed := make([]*client.JournalLineRequest, len(lines))
+	for i, line := range lines {
+		swapped := *line
+		if line.LineType == "debit" {
+			swapped.LineType = "credit"
+		} else {
+			swapped.LineType = "debit"
+		}
+		reversed[i] = &swapped
+	}
+	return reversed
+}
+
+// reversalJournalRequest returns a copy of journal with every debit and credit
+// swapped, numbered and dated as a reversal
+func reversalJournalRequest(journal *client.CreateJournalRequest, journalDate, reason string) *client.CreateJournalRequest {
+	lines := reversedJournalLines(journal.Lines)
+
+	desc := fmt.Sprintf("Reversal of %s: %s", journal.JournalNumber, reason)
+	return &client.CreateJournalRequest{
+		EntityID:           journal.EntityID,
+		JournalNumber:      journal.JournalNumber + "-REV",
+		JournalDate:        journalDate,
+		JournalType:        journal.JournalType,
+		Description:        &desc,
+		Reference:          journal.Reference,
+		Currency:           journal.Currency,
+		FunctionalCurrency: journal.FunctionalCurrency,
+		ExchangeRate:       journal.ExchangeRate,
+		Lines:              lines,
+	}
+}
+
+// journalTotals returns the total debits and credits of a journal
+func journalTotals(journal *client.CreateJournalRequest) (debit, credit int64) {
+	for _, line := range journal.Lines {
+		if line.LineType == "debit" {
+			debit += line.Amount
+		} else {
+			credit += line.Amount
+		}
+	}
+	return debit, credit
+}
+
+// journalFunctionalTotals returns the total functional debits and credits of
+// a journal
+func journalFunctionalTotals(journal *client.CreateJournalRequest) (debit, credit int64) {
+	for _, line := range journal.Lines {
+		if line.LineType == "debit" {
+			debit += line.FunctionalAmount
+		} else {
+			credit += line.FunctionalAmount
+		}
+	}
+	return debit, credit
+}
+
+// checkJournalBalanced rejects a journal whose debits and credits differ,
+// in either currency, before it is sent to GL-2
+func checkJournalBalanced(journal *client.CreateJournalRequest) error {
+	debit, credit := journalTotals(journal)
+	if debit != credit {
+		return errors.New(errors.ErrCodeInternal,
+			fmt.Sprintf("journal %s does not balance: debits %d, credits %d", journal.JournalNumber, debit, credit))
+	}
+	debit, credit = journalFunctionalTotals(journal)
+	if debit != credit {
+		return errors.New(errors.ErrCodeInternal,
+			fmt.Sprintf("journal %s does not balance in %s: debits %d, credits %d", journal.JournalNumber, journal.FunctionalCurrency, debit, credit))
+	}
+	return nil
+}
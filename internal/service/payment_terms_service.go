@@ -0,0 +1,369 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// validTermTypes lists the kinds of payment terms
+var validTermTypes = map[string]bool{
+	"net":          true,
+	"eom":          true,
+	"day_of_month": true,
+	"installment":  true,
+}
+
+// PaymentTermsService manages the per-entity payment terms catalog and
+// works out the due dates and early-payment discounts terms give an invoice
+type PaymentTermsService struct {
+	termsRepo *repository.PaymentTermsRepository
+	log       *logger.Logger
+}
+
+// NewPaymentTermsService creates a new payment terms service
+func NewPaymentTermsService(termsRepo *repository.PaymentTermsRepository, log *logger.Logger) *PaymentTermsService {
+	return &PaymentTermsService{
+		termsRepo: termsRepo,
+		log:       log,
+	}
+}
+
+// UpsertPaymentTermsRequest represents a create or replace payment terms
+// request
+type UpsertPaymentTermsRequest struct {
+	EntityID        string                        `json:"entity_id"`
+	Code            string                        `json:"code"`
+	Description     *string                       `json:"description,omitempty"`
+	TermType        string                        `json:"term_type"`
+	NetDays         int                           `json:"net_days"`
+	DayOfMonth      *int                          `json:"day_of_month,omitempty"`
+	CutoffDay       *int                          `json:"cutoff_day,omitempty"`
+	Installments    []*repository.InstallmentTerm `json:"installments,omitempty"`
+	DiscountPercent decimal.Decimal               `json:"discount_percent"`
+	DiscountDays    *int                          `json:"discount_days,omitempty"`
+	IsActive        *bool                         `json:"is_active,omitempty"` // defaults to true
+	UpdatedBy       string                        `json:"updated_by,omitempty"`
+}
+
+// paymentDates are the due date and early-payment discount payment terms
+// give an invoice
+type paymentDates struct {
+	DueDate         time.Time
+	DiscountPercent *float64
+	DiscountDueDate *time.Time
+}
+
+// Installment is one scheduled payment of an invoice
+type Installment struct {
+	Sequence int       `json:"sequence"`
+	DueDate  time.Time `json:"due_date"`
+	Amount   int64     `json:"amount"` // minor units of the invoice currency
+}
+
+// ListTerms returns the payment terms of an entity
+func (s *PaymentTermsService) ListTerms(ctx context.Context, entityID string) ([]*repository.PaymentTerms, error) {
+	return s.termsRepo.List(ctx, entityID)
+}
+
+// GetTerms returns the catalogued payment terms of an entity with a code,
+// or nil if the code is not in the catalog
+func (s *PaymentTermsService) GetTerms(ctx context.Context, entityID, code string) (*repository.PaymentTerms, error) {
+	if code == "" {
+		return nil, nil
+	}
+	return s.termsRepo.GetByCode(ctx, entityID, code)
+}
+
+// UpsertTerms creates or replaces payment terms. Installments are kept in
+// due order and must add up to 100 percent.
+func (s *PaymentTermsService) UpsertTerms(ctx context.Context, req *UpsertPaymentTermsRequest) (*repository.PaymentTerms, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+	if req.Code == "" || len(req.Code) > 50 {
+		return nil, errors.InvalidInput("code", "code must be 1 to 50 characters")
+	}
+	if !validTermTypes[req.TermType] {
+		return nil, errors.InvalidInput("term_type", "term type must be net, eom, day_of_month or installment")
+	}
+	if req.NetDays < 0 {
+		return nil, errors.InvalidInput("net_days", "net days cannot be negative")
+	}
+
+	terms := &repository.PaymentTerms{
+		EntityID:        req.EntityID,
+		Code:            req.Code,
+		Description:     req.Description,
+		TermType:        req.TermType,
+		NetDays:         req.NetDays,
+		DiscountPercent: req.DiscountPercent,
+		IsActive:        true,
+	}
+	if req.IsActive != nil {
+		terms.IsActive = *req.IsActive
+	}
+
+	switch req.TermType {
+	case "day_of_month":
+		if req.DayOfMonth == nil || *req.DayOfMonth < 1 || *req.DayOfMonth > 31 {
+			return nil, errors.InvalidInput("day_of_month", "day of month must be between 1 and 31")
+		}
+		if req.CutoffDay != nil && (*req.CutoffDay < 1 || *req.CutoffDay > 31) {
+			return nil, errors.InvalidInput("cutoff_day", "cutoff day must be between 1 and 31")
+		}
+		if req.NetDays != 0 {
+			return nil, errors.InvalidInput("net_days", "net days do not apply to day-of-month terms")
+		}
+		terms.DayOfMonth, terms.CutoffDay = req.DayOfMonth, req.CutoffDay
+
+	case "installment":
+		if req.NetDays != 0 {
+			return nil, errors.InvalidInput("net_days", "net days do not apply to installment terms")
+		}
+		if len(req.Installments) < 2 {
+			return nil, errors.InvalidInput("installments", "installment terms need at least 2 installments")
+		}
+		total := new(big.Rat)
+		for _, installment := range req.Installments {
+			if installment.Percent.Sign() <= 0 {
+				return nil, errors.InvalidInput("installments", "installment percent must be positive")
+			}
+			if installment.NetDays < 0 {
+				return nil, errors.InvalidInput("installments", "installment net days cannot be negative")
+			}
+			total.Add(total, installment.Percent.Rat())
+		}
+		if total.Cmp(big.NewRat(100, 1)) != 0 {
+			return nil, errors.InvalidInput("installments", "installment percents must add up to 100")
+		}
+		sort.SliceStable(req.Installments, func(i, j int) bool {
+			return req.Installments[i].NetDays < req.Installments[j].NetDays
+		})
+		terms.Installments = req.Installments
+	}
+
+	if req.TermType != "day_of_month" && (req.DayOfMonth != nil || req.CutoffDay != nil) {
+		return nil, errors.InvalidInput("day_of_month", "day of month applies to day-of-month terms only")
+	}
+	if req.TermType != "installment" && len(req.Installments) > 0 {
+		return nil, errors.InvalidInput("installments", "installments apply to installment terms only")
+	}
+
+	// Validate early-payment discount
+	if req.DiscountPercent.Sign() != 0 {
+		if !validPercent(req.DiscountPercent) {
+			return nil, errors.InvalidInput("discount_percent", "discount must be between 0 and 100")
+		}
+		if req.TermType == "installment" {
+			return nil, errors.InvalidInput("discount_percent", "installment terms cannot offer an early-payment discount")
+		}
+		if req.DiscountDays == nil || *req.DiscountDays < 0 {
+			return nil, errors.InvalidInput("discount_days", "discount days are required with a discount")
+		}
+		if req.TermType != "day_of_month" && *req.DiscountDays > req.NetDays {
+			return nil, errors.InvalidInput("discount_days", "discount days cannot be after the due date")
+		}
+		terms.DiscountDays = req.DiscountDays
+	} else if req.DiscountDays != nil {
+		return nil, errors.InvalidInput("discount_days", "discount days require a discount percent")
+	}
+
+	// Convert empty string to NULL for UpdatedBy
+	if req.UpdatedBy != "" {
+		terms.UpdatedBy = &req.UpdatedBy
+	}
+
+	if err := s.termsRepo.Upsert(ctx, terms); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("entity_id", req.EntityID).
+		Str("payment_terms", req.Code).
+		Str("term_type", req.TermType).
+		Msg("Payment terms saved")
+
+	return terms, nil
+}
+
+// termsDates returns the due date and early-payment discount terms give an
+// invoice dated invoiceDate. Installment terms fall due with their last
+// installment.
+func termsDates(terms *repository.PaymentTerms, invoiceDate time.Time) *paymentDates {
+	// Days are counted from the end of the invoice month for EOM terms
+	base := invoiceDate
+	if terms.TermType == "eom" {
+		base = time.Date(invoiceDate.Year(), invoiceDate.Month()+1, 0, 0, 0, 0, 0, invoiceDate.Location())
+	}
+
+	dates := &paymentDates{DueDate: base.AddDate(0, 0, terms.NetDays)}
+
+	switch terms.TermType {
+	case "day_of_month":
+		months := 1
+		if terms.CutoffDay != nil && invoiceDate.Day() > *terms.CutoffDay {
+			months = 2
+		}
+		first := time.Date(invoiceDate.Year(), invoiceDate.Month()+time.Month(months), 1, 0, 0, 0, 0, invoiceDate.Location())
+		day := *terms.DayOfMonth
+		if lastDay := first.AddDate(0, 1, -1).Day(); day > lastDay {
+			day = lastDay
+		}
+		dates.DueDate = first.AddDate(0, 0, day-1)
+	case "installment":
+		last := terms.Installments[len(terms.Installments)-1]
+		dates.DueDate = invoiceDate.AddDate(0, 0, last.NetDays)
+	}
+
+	if terms.DiscountPercent.Sign() > 0 && terms.DiscountDays != nil {
+		percent := terms.DiscountPercent.Float64()
+		discountDueDate := base.AddDate(0, 0, *terms.DiscountDays)
+		dates.DiscountPercent = &percent
+		dates.DiscountDueDate = &discountDueDate
+	}
+
+	return dates
+}
+
+// termsInstallments splits an invoice total into the installments of its
+// terms. Each installment is its percent of the total, rounded half away
+// from zero, and the last takes whatever rounding leaves.
+func termsInstallments(terms *repository.PaymentTerms, invoiceDate time.Time, totalAmount int64) []*Installment {
+	installments := make([]*Installment, 0, len(terms.Installments))
+	remaining := totalAmount
+
+	for i, term := range terms.Installments {
+		amount := decimal.PercentOf(totalAmount, term.Percent)
+		if i == len(terms.Installments)-1 {
+			amount = remaining
+		}
+		remaining -= amount
+
+		installments = append(installments, &Installment{
+			Sequence: i + 1,
+			DueDate:  invoiceDate.AddDate(0, 0, term.NetDays),
+			Amount:   amount,
+		})
+	}
+
+	return installments
+}
+
+// paymentTermsFields records which of the due date and early-payment
+// discount an invoice request supplied
+type paymentTermsFields struct {
+	DueDate         bool
+	DiscountPercent bool
+	DiscountDueDate bool
+}
+
+// resolvePaymentTerms returns the payment terms code of a new invoice: the
+// one requested, else the vendor's, else the entity's default
+func (s *InvoiceService) resolvePaymentTerms(ctx context.Context, entityID, vendorID, requested string) (string, error) {
+	if requested != "" {
+		return requested, nil
+	}
+
+	vendor, err := s.vendorsClient.GetVendor(ctx, vendorID, entityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get vendor: %w", err)
+	}
+	if vendor.PaymentTerms != "" {
+		return vendor.PaymentTerms, nil
+	}
+
+	settings, err := s.settings.GetSettings(ctx, entityID)
+	if err != nil {
+		return "", err
+	}
+	return settings.DefaultPaymentTerms, nil
+}
+
+// applyPaymentTerms sets an invoice's due date and early-payment discount
+// from its payment terms when they are in the entity's catalog. Values the
+// request supplied are kept only if they agree with the terms. Terms not in
+// the catalog are free text: the invoice keeps the values supplied, and
+// must have a due date.
+func (s *InvoiceService) applyPaymentTerms(ctx context.Context, invoice *repository.Invoice, supplied paymentTermsFields) error {
+	terms, err := s.paymentTerms.GetTerms(ctx, invoice.EntityID, invoice.PaymentTerms)
+	if err != nil {
+		return err
+	}
+
+	if terms == nil {
+		if invoice.DueDate.IsZero() {
+			return errors.InvalidInput("due_date",
+				fmt.Sprintf("due date is required: payment terms '%s' are not in the catalog", invoice.PaymentTerms))
+		}
+		return nil
+	}
+	if !terms.IsActive {
+		return errors.InvalidInput("payment_terms", fmt.Sprintf("payment terms %s are inactive", terms.Code))
+	}
+
+	dates := termsDates(terms, invoice.InvoiceDate)
+
+	if supplied.DueDate && !invoice.DueDate.Equal(dates.DueDate) {
+		return errors.InvalidInput("due_date",
+			fmt.Sprintf("due date %s does not match payment terms %s, which make the invoice due %s",
+				invoice.DueDate.Format("2006-01-02"), terms.Code, dates.DueDate.Format("2006-01-02")))
+	}
+
+	if supplied.DiscountPercent && invoice.DiscountPercent != nil {
+		if dates.DiscountPercent == nil && *invoice.DiscountPercent != 0 {
+			return errors.InvalidInput("discount_percent",
+				fmt.Sprintf("payment terms %s offer no early-payment discount", terms.Code))
+		}
+		if dates.DiscountPercent != nil && decimal.FromFloat(*invoice.DiscountPercent).Cmp(terms.DiscountPercent) != 0 {
+			return errors.InvalidInput("discount_percent",
+				fmt.Sprintf("discount %v%% does not match payment terms %s, which offer %s%%",
+					*invoice.DiscountPercent, terms.Code, terms.DiscountPercent))
+		}
+	}
+
+	if supplied.DiscountDueDate && invoice.DiscountDueDate != nil {
+		if dates.DiscountDueDate == nil {
+			return errors.InvalidInput("discount_due_date",
+				fmt.Sprintf("payment terms %s offer no early-payment discount", terms.Code))
+		}
+		if !invoice.DiscountDueDate.Equal(*dates.DiscountDueDate) {
+			return errors.InvalidInput("discount_due_date",
+				fmt.Sprintf("discount due date %s does not match payment terms %s, which give %s",
+					invoice.DiscountDueDate.Format("2006-01-02"), terms.Code, dates.DiscountDueDate.Format("2006-01-02")))
+		}
+	}
+
+	invoice.DueDate = dates.DueDate
+	invoice.DiscountPercent = dates.DiscountPercent
+	invoice.DiscountDueDate = dates.DiscountDueDate
+
+	return nil
+}
+
+// PaymentSchedule returns the installments an invoice is payable in under
+// its current payment terms. Invoices on other than installment terms are
+// payable in one installment on their due date.
+func (s *InvoiceService) PaymentSchedule(ctx context.Context, id, entityID string) ([]*Installment, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
+	if err != nil {
+		return nil, err
+	}
+
+	terms, err := s.paymentTerms.GetTerms(ctx, entityID, invoice.PaymentTerms)
+	if err != nil {
+		return nil, err
+	}
+
+	if terms == nil || terms.TermType != "installment" {
+		return []*Installment{{Sequence: 1, DueDate: invoice.DueDate, Amount: invoice.TotalAmount}}, nil
+	}
+	return termsInstallments(terms, invoice.InvoiceDate, invoice.TotalAmount), nil
+}
@@ -0,0 +1,457 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// PO match levels, set per entity
+const (
+	MatchTwoWay   = "two_way"   // invoice against purchase order
+	MatchThreeWay = "three_way" // invoice against purchase order and goods receipt
+)
+
+// Line match statuses
+const (
+	MatchStatusMatched   = "matched"
+	MatchStatusVariance  = "variance"
+	MatchStatusUnmatched = "unmatched"
+	MatchStatusAccepted  = "accepted"
+)
+
+// POMatchingService matches invoice lines to the lines of the purchase
+// order named in the invoice's PO number and stores the result of each
+// line for review. Unresolved variances block submission for approval, and
+// hold the lines of draft invoices with system holds until resolved.
+type POMatchingService struct {
+	matchRepo      *repository.InvoiceMatchRepository
+	invoiceRepo    *repository.InvoiceRepository
+	receiptRepo    *repository.ReceiptRepository
+	purchaseOrders client.PurchaseOrdersClientInterface
+	settings       *EntitySettingsService
+	holds          *HoldService
+	log            *logger.Logger
+}
+
+// NewPOMatchingService creates a new PO matching service
+func NewPOMatchingService(
+	matchRepo *repository.InvoiceMatchRepository,
+	invoiceRepo *repository.InvoiceRepository,
+	receiptRepo *repository.ReceiptRepository,
+	purchaseOrders client.PurchaseOrdersClientInterface,
+	settings *EntitySettingsService,
+	holds *HoldService,
+	log *logger.Logger,
+) *POMatchingService {
+	return &POMatchingService{
+		matchRepo:      matchRepo,
+		invoiceRepo:    invoiceRepo,
+		receiptRepo:    receiptRepo,
+		purchaseOrders: purchaseOrders,
+		settings:       settings,
+		holds:          holds,
+		log:            log,
+	}
+}
+
+// AcceptMatchRequest represents a request to accept a PO match variance
+type AcceptMatchRequest struct {
+	InvoiceID  string `json:"invoice_id"`
+	EntityID   string `json:"entity_id"`
+	MatchID    string `json:"match_id"`
+	Notes      string `json:"notes"`
+	ResolvedBy string `json:"resolved_by,omitempty"`
+}
+
+// requiresMatch reports whether an invoice is matched before submission:
+// one with a PO number that bills goods or services, so not a credit memo
+// or a prepayment
+func requiresMatch(invoice *repository.Invoice) bool {
+	if invoice.PONumber == nil || strings.TrimSpace(*invoice.PONumber) == "" {
+		return false
+	}
+	return invoice.InvoiceType != "credit_memo" && invoice.InvoiceType != "prepayment"
+}
+
+// MatchInvoice matches an invoice to its purchase order now and returns the
+// result of each line
+func (s *POMatchingService) MatchInvoice(ctx context.Context, id, entityID string) ([]*repository.LineMatch, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
+	if err != nil {
+		return nil, err
+	}
+	if !requiresMatch(invoice) {
+		return nil, errors.InvalidInput("po_number", "invoice has no purchase order to match")
+	}
+	return s.match(ctx, invoice)
+}
+
+// ListMatches returns the latest match result of each line of an invoice
+func (s *POMatchingService) ListMatches(ctx context.Context, id, entityID string) ([]*repository.LineMatch, error) {
+	if _, err := s.invoiceRepo.GetByID(ctx, id, entityID); err != nil {
+		return nil, err
+	}
+	return s.matchRepo.ListByInvoice(ctx, id, entityID)
+}
+
+// AcceptVariance records a reviewer's acceptance of a line's variance, or
+// of a line billing something not on the purchase order, so it no longer
+// blocks submission. The acceptance holds while the line and its variance
+// stay as they were accepted.
+func (s *POMatchingService) AcceptVariance(ctx context.Context, req *AcceptMatchRequest) (*repository.LineMatch, error) {
+	if strings.TrimSpace(req.Notes) == "" {
+		return nil, errors.InvalidInput("notes", "notes are required to accept a variance")
+	}
+
+	invoice, err := s.invoiceRepo.GetByID(ctx, req.InvoiceID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Status != "draft" {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot accept match variances of an invoice with status '%s'", invoice.Status))
+	}
+
+	matches, err := s.matchRepo.ListByInvoice(ctx, req.InvoiceID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	var match *repository.LineMatch
+	for _, m := range matches {
+		if m.ID == req.MatchID {
+			match = m
+			break
+		}
+	}
+	if match == nil {
+		return nil, errors.NotFound("invoice_match", req.MatchID)
+	}
+
+	notes := strings.TrimSpace(req.Notes)
+	match.ResolutionNotes = &notes
+	// Convert empty string to NULL for ResolvedBy
+	match.ResolvedBy = nil
+	if req.ResolvedBy != "" {
+		match.ResolvedBy = &req.ResolvedBy
+	}
+
+	if err := s.matchRepo.Accept(ctx, match); err != nil {
+		return nil, err
+	}
+	if err := s.holds.releaseLineHolds(ctx, invoice, match.InvoiceLineID, "PO match variance accepted"); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("invoice_id", req.InvoiceID).
+		Int("line_number", match.LineNumber).
+		Str("resolved_by", req.ResolvedBy).
+		Msg("PO match variance accepted")
+
+	return match, nil
+}
+
+// checkSubmission matches an invoice that requires it and returns a
+// conflict error if any line is left with an unresolved variance
+func (s *POMatchingService) checkSubmission(ctx context.Context, invoice *repository.Invoice) error {
+	if !requiresMatch(invoice) {
+		// Release holds left from when the invoice had a purchase order
+		return s.holds.syncMatchHolds(ctx, invoice, nil)
+	}
+
+	matches, err := s.match(ctx, invoice)
+	if err != nil {
+		return err
+	}
+
+	unresolved := make([]string, 0)
+	for _, m := range matches {
+		if m.Status == MatchStatusVariance || m.Status == MatchStatusUnmatched {
+			unresolved = append(unresolved, fmt.Sprintf("line %d: %s", m.LineNumber, strings.Join(m.Reasons, "; ")))
+		}
+	}
+	if len(unresolved) > 0 {
+		return errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("invoice has unresolved PO match variances: %s", strings.Join(unresolved, ", ")))
+	}
+
+	return nil
+}
+
+// match matches every line of an invoice to its purchase order, replaces
+// the invoice's stored results and returns them. The system holds of a
+// draft invoice are brought in line with the result.
+func (s *POMatchingService) match(ctx context.Context, invoice *repository.Invoice) ([]*repository.LineMatch, error) {
+	poNumber := strings.TrimSpace(*invoice.PONumber)
+
+	settings, err := s.settings.GetSettings(ctx, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	po, err := s.purchaseOrders.GetPurchaseOrder(ctx, poNumber, invoice.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get purchase order %s: %w", poNumber, err)
+	}
+
+	invoiced, err := s.matchRepo.InvoicedQuantities(ctx, invoice.EntityID, poNumber, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Receipts recorded here take the place of those reported with the PO
+	var received map[int]decimal.Decimal
+	if settings.POMatchLevel == MatchThreeWay {
+		received, err = s.receiptRepo.ReceivedQuantities(ctx, invoice.EntityID, poNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	previous, err := s.matchRepo.ListByInvoice(ctx, invoice.ID, invoice.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	accepted := make(map[string]*repository.LineMatch)
+	for _, m := range previous {
+		if m.Status == MatchStatusAccepted {
+			accepted[m.InvoiceLineID] = m
+		}
+	}
+
+	matcher := &poMatcher{
+		po:                po,
+		level:             settings.POMatchLevel,
+		priceTolerance:    decimal.FromFloat(settings.PercentTolerance),
+		quantityTolerance: decimal.FromFloat(settings.QuantityTolerance),
+		invoiced:          invoiced,
+		received:          received,
+		problem:           poProblem(po, invoice, poNumber),
+		holds:             make(map[string]map[string]string),
+	}
+
+	matches := make([]*repository.LineMatch, 0, len(invoice.Lines))
+	for _, line := range invoice.Lines {
+		m := matcher.matchLine(line)
+		m.EntityID = invoice.EntityID
+		m.PONumber = poNumber
+		carryAcceptance(m, accepted[line.ID])
+		if m.Status == MatchStatusAccepted {
+			delete(matcher.holds, line.ID)
+		}
+		matches = append(matches, m)
+	}
+
+	if err := s.matchRepo.ReplaceForInvoice(ctx, invoice.ID, matches); err != nil {
+		return nil, err
+	}
+
+	// Holds are for invoices still to be submitted; later matches are for review
+	if invoice.Status == "draft" {
+		if err := s.holds.syncMatchHolds(ctx, invoice, matcher.holds); err != nil {
+			return nil, err
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, m := range matches {
+		counts[m.Status]++
+	}
+	s.log.Info().
+		Str("invoice_id", invoice.ID).
+		Str("po_number", poNumber).
+		Str("match_level", settings.POMatchLevel).
+		Int("matched", counts[MatchStatusMatched]).
+		Int("variances", counts[MatchStatusVariance]).
+		Int("unmatched", counts[MatchStatusUnmatched]).
+		Int("accepted", counts[MatchStatusAccepted]).
+		Msg("Invoice matched to purchase order")
+
+	return matches, nil
+}
+
+// poProblem returns why no line of an invoice can match a purchase order,
+// or "" if its lines can be matched
+func poProblem(po *client.PurchaseOrder, invoice *repository.Invoice, poNumber string) string {
+	switch {
+	case po == nil:
+		return fmt.Sprintf("purchase order %s not found", poNumber)
+	case po.VendorID != invoice.VendorID:
+		return fmt.Sprintf("purchase order %s is for another vendor", poNumber)
+	case po.Currency != invoice.Currency:
+		return fmt.Sprintf("purchase order %s is in %s, not %s", poNumber, po.Currency, invoice.Currency)
+	case !po.IsOpen():
+		return fmt.Sprintf("purchase order %s is %s", poNumber, po.Status)
+	}
+	return ""
+}
+
+// carryAcceptance keeps a reviewer's acceptance of a line's earlier result
+// when the line still has exactly the variance that was accepted
+func carryAcceptance(m, prior *repository.LineMatch) {
+	if prior == nil || m.Status == MatchStatusMatched {
+		return
+	}
+	if !sameIntPtr(m.POLineNumber, prior.POLineNumber) ||
+		m.Quantity.Cmp(prior.Quantity) != 0 ||
+		m.UnitPrice != prior.UnitPrice ||
+		m.QuantityVariance.Cmp(prior.QuantityVariance) != 0 ||
+		m.PriceVariance != prior.PriceVariance {
+		return
+	}
+
+	m.Status = MatchStatusAccepted
+	m.ResolvedBy = prior.ResolvedBy
+	m.ResolvedAt = prior.ResolvedAt
+	m.ResolutionNotes = prior.ResolutionNotes
+}
+
+// sameIntPtr reports whether two optional ints are equal
+func sameIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// poMatcher matches the lines of one invoice to the lines of its purchase
+// order, tracking how much of each PO line earlier lines have billed
+type poMatcher struct {
+	po                *client.PurchaseOrder
+	level             string
+	priceTolerance    decimal.Decimal         // percent of the PO unit price
+	quantityTolerance decimal.Decimal         // percent of the expected quantity
+	invoiced          map[int]decimal.Decimal // billed by other invoices, by PO line
+	received          map[int]decimal.Decimal // net of returns, by PO line; empty if no receipts are recorded
+	problem           string
+	holds             map[string]map[string]string // hold reasons by code, by invoice line ID
+}
+
+// hold records that an invoice line is to be held with a hold code
+func (m *poMatcher) hold(line *repository.InvoiceLine, code, reason string) {
+	if m.holds[line.ID] == nil {
+		m.holds[line.ID] = make(map[string]string)
+	}
+	m.holds[line.ID][code] = reason
+}
+
+// matchLine matches one invoice line. Billing below the PO price or
+// quantity is not a variance; billing above them is, once beyond tolerance.
+func (m *poMatcher) matchLine(line *repository.InvoiceLine) *repository.LineMatch {
+	match := &repository.LineMatch{
+		InvoiceLineID: line.ID,
+		LineNumber:    line.LineNumber,
+		MatchLevel:    m.level,
+		Status:        MatchStatusMatched,
+		Quantity:      line.Quantity,
+		UnitPrice:     line.UnitPrice,
+		Reasons:       make([]string, 0),
+	}
+
+	if m.problem != "" {
+		match.Status = MatchStatusUnmatched
+		match.Reasons = append(match.Reasons, m.problem)
+		m.hold(line, HoldPOMismatch, m.problem)
+		return match
+	}
+
+	poLine := m.poLineFor(line)
+	if poLine == nil {
+		match.Status = MatchStatusUnmatched
+		match.Reasons = append(match.Reasons, "no matching purchase order line")
+		m.hold(line, HoldPOMismatch, "no matching purchase order line")
+		return match
+	}
+
+	poLineNumber := poLine.LineNumber
+	poQuantity := poLine.Quantity
+	poUnitPrice := poLine.UnitPrice
+	match.POLineNumber = &poLineNumber
+	match.POQuantity = &poQuantity
+	match.POUnitPrice = &poUnitPrice
+
+	// Earlier lines of this invoice billing the same PO line count as
+	// previously invoiced
+	match.PreviouslyInvoicedQuantity = m.invoiced[poLineNumber]
+	billed := match.PreviouslyInvoicedQuantity.Add(line.Quantity)
+	m.invoiced[poLineNumber] = billed
+
+	// Quantity: billed to date against ordered, and received for three-way
+	expected, what, code := poQuantity, "ordered", HoldQuantityVariance
+	if m.level == MatchThreeWay {
+		received := poLine.QuantityReceived
+		if len(m.received) > 0 {
+			received = m.received[poLineNumber]
+		}
+		match.ReceivedQuantity = &received
+		if received.Cmp(expected) < 0 {
+			expected, what, code = received, "received", HoldMissingReceipt
+		}
+	}
+	if excess := billed.Sub(expected); excess.Sign() > 0 {
+		match.QuantityVariance = excess
+		if !withinPercent(excess, expected, m.quantityTolerance) {
+			reason := fmt.Sprintf("quantity billed %s exceeds %s quantity %s", billed, what, expected)
+			match.Status = MatchStatusVariance
+			match.Reasons = append(match.Reasons, reason)
+			m.hold(line, code, reason)
+		}
+	}
+
+	// Price: unit price against the PO unit price
+	match.PriceVariance = line.UnitPrice - poUnitPrice
+	if match.PriceVariance > decimal.PercentOf(poUnitPrice, m.priceTolerance) {
+		reason := fmt.Sprintf("unit price %d exceeds PO unit price %d", line.UnitPrice, poUnitPrice)
+		match.Status = MatchStatusVariance
+		match.Reasons = append(match.Reasons, reason)
+		m.hold(line, HoldPriceVariance, reason)
+	}
+
+	return match
+}
+
+// poLineFor returns the PO line an invoice line bills: one with the same
+// item code or, for a line without an item code, the same description.
+// Of several such PO lines the first with quantity left to bill is taken.
+func (m *poMatcher) poLineFor(line *repository.InvoiceLine) *client.PurchaseOrderLine {
+	var first *client.PurchaseOrderLine
+	for _, poLine := range m.po.Lines {
+		if !sameItem(line, poLine) {
+			continue
+		}
+		billed := m.invoiced[poLine.LineNumber]
+		if billed.Cmp(poLine.Quantity) < 0 {
+			return poLine
+		}
+		if first == nil {
+			first = poLine
+		}
+	}
+	return first
+}
+
+// sameItem reports whether an invoice line and a PO line are for the same
+// item. Codes and descriptions compare case-insensitively.
+func sameItem(line *repository.InvoiceLine, poLine *client.PurchaseOrderLine) bool {
+	if line.ItemCode != nil && strings.TrimSpace(*line.ItemCode) != "" {
+		return poLine.ItemCode != nil &&
+			strings.EqualFold(strings.TrimSpace(*line.ItemCode), strings.TrimSpace(*poLine.ItemCode))
+	}
+	return strings.EqualFold(strings.TrimSpace(line.Description), strings.TrimSpace(poLine.Description))
+}
+
+// withinPercent reports whether excess is at most percent % of expected
+func withinPercent(excess, expected, percent decimal.Decimal) bool {
+	allowed := new(big.Rat).Mul(expected.Rat(), percent.Rat())
+	allowed.Quo(allowed, big.NewRat(100, 1))
+	return excess.Rat().Cmp(allowed) <= 0
+}
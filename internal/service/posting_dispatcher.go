@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/logger"
+)
+
+// PostingDispatcher drives GL posting outbox entries in the background. It
+// picks up postings whose inline attempt failed, retries them with backoff and
+// resumes sagas interrupted by a restart.
+type PostingDispatcher struct {
+	invoiceService *InvoiceService
+	interval       time.Duration
+	batchSize      int
+	log            *logger.Logger
+}
+
+// NewPostingDispatcher creates a dispatcher that polls the outbox every
+// interval, claiming up to batchSize entries at a time
+func NewPostingDispatcher(invoiceService *InvoiceService, interval time.Duration, batchSize int, log *logger.Logger) *PostingDispatcher {
+	return &PostingDispatcher{
+		invoiceService: invoiceService,
+		interval:       interval,
+		batchSize:      batchSize,
+		log:            log,
+	}
+}
+
+// Run dispatches due entries until ctx is cancelled. A full batch is followed
+// immediately by another so a backlog drains without waiting for the ticker.
+func (d *PostingDispatcher) Run(ctx context.Context) {
+	d.log.Info().
+		Dur("interval", d.interval).
+		Int("batch_size", d.batchSize).
+		Msg("GL posting dispatcher started")
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			n, err := d.invoiceService.ProcessPostings(ctx, d.batchSize)
+			if err != nil {
+				d.log.Error().Err(err).Msg("Failed to process GL posting outbox")
+				break
+			}
+			if n < d.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			d.log.Info().Msg("GL posting dispatcher stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
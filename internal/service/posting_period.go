@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Closed period policies, set per entity
+const (
+	ClosedPeriodReject      = "reject"
+	ClosedPeriodRollForward = "roll_forward"
+)
+
+// maxRollForwardPeriods bounds the search for an open period when rolling
+// a posting forward
+const maxRollForwardPeriods = 12
+
+// resolvePostingDate returns the GL date and accounting period a posting
+// requested on date lands in. If periodID is set the posting goes into that
+// period, moving date to the period's nearest boundary when it falls
+// outside it. If the period is closed the entity's policy either rejects the
+// posting or rolls it forward to the first day of the next open period.
+func (s *InvoiceService) resolvePostingDate(ctx context.Context, entityID string, date time.Time, periodID string) (time.Time, *client.Period, error) {
+	var period *client.Period
+	var err error
+
+	if periodID != "" {
+		period, err = s.periodsClient.GetPeriod(ctx, periodID, entityID)
+		if err != nil {
+			return time.Time{}, nil, errors.InvalidInput("period_id", err.Error())
+		}
+		if date.Before(period.StartDate) {
+			date = period.StartDate
+		} else if date.After(period.EndDate) {
+			date = period.EndDate
+		}
+	} else {
+		period, err = s.periodsClient.GetPeriodForDate(ctx, entityID, date)
+		if err != nil {
+			return time.Time{}, nil, fmt.Errorf("failed to get accounting period: %w", err)
+		}
+	}
+
+	if period.IsOpen() {
+		return date, period, nil
+	}
+
+	settings, err := s.settings.GetSettings(ctx, entityID)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	if settings.ClosedPeriodPolicy != ClosedPeriodRollForward {
+		return time.Time{}, nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("accounting period %s is closed", period.Name))
+	}
+
+	closed := period
+	for i := 0; i < maxRollForwardPeriods; i++ {
+		period, err = s.periodsClient.GetPeriodForDate(ctx, entityID, period.EndDate.AddDate(0, 0, 1))
+		if err != nil {
+			return time.Time{}, nil, fmt.Errorf("failed to get accounting period: %w", err)
+		}
+		if period.IsOpen() {
+			s.log.Info().
+				Str("entity_id", entityID).
+				Str("closed_period", closed.Name).
+				Str("period", period.Name).
+				Msg("Posting rolled forward from closed period")
+			return period.StartDate, period, nil
+		}
+	}
+
+	return time.Time{}, nil, errors.New(errors.ErrCodeConflict,
+		fmt.Sprintf("accounting period %s is closed and no open period follows it", closed.Name))
+}
+
+// invoiceGLDate returns the date an invoice posts on: its GL date, or its
+// invoice date if none is set
+func invoiceGLDate(invoice *repository.Invoice) time.Time {
+	if invoice.GLDate != nil {
+		return *invoice.GLDate
+	}
+	return invoice.InvoiceDate
+}
+
+// paymentGLDate returns the date a payment posts on: its GL date, or its
+// payment date if none is set
+func paymentGLDate(payment *repository.InvoicePayment) time.Time {
+	if payment.GLDate != nil {
+		return *payment.GLDate
+	}
+	return payment.PaymentDate
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// PreviewPostingRequest represents a posting preview request. Without a
+// PaymentAmount it previews posting the invoice, into PeriodID if set; with
+// one it previews recording a payment of that amount.
+type PreviewPostingRequest struct {
+	ID            string  `json:"id"`
+	EntityID      string  `json:"entity_id"`
+	PeriodID      string  `json:"period_id,omitempty"`
+	PaymentAmount *int64  `json:"payment_amount,omitempty"`
+	PaymentDate   *string `json:"payment_date,omitempty"` // defaults to today
+	GLDate        *string `json:"gl_date,omitempty"`      // payment GL date; defaults to payment_date
+}
+
+// PostingPreview is the journal a posting would send to GL-2, with the
+// accounting period it lands in and its balance check in both currencies
+type PostingPreview struct {
+	Journal               *client.CreateJournalRequest `json:"journal"`
+	GLPeriodID            string                       `json:"gl_period_id"`
+	TotalDebit            int64                        `json:"total_debit"`
+	TotalCredit           int64                        `json:"total_credit"`
+	TotalFunctionalDebit  int64                        `json:"total_functional_debit"`
+	TotalFunctionalCredit int64                        `json:"total_functional_credit"`
+	Balanced              bool                         `json:"balanced"`
+}
+
+// PreviewPosting returns the journal that posting an invoice, or recording a
+// payment against it, would create. Accounts and the GL date are resolved
+// exactly as for the real posting, and closed periods are reported the same
+// way, but nothing is saved and GL-2 is not called.
+func (s *InvoiceService) PreviewPosting(ctx context.Context, req *PreviewPostingRequest) (*PostingPreview, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, req.ID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	var journal *client.CreateJournalRequest
+	var periodID string
+
+	if req.PaymentAmount != nil {
+		journal, periodID, err = s.previewPayment(ctx, invoice, req)
+	} else {
+		journal, periodID, err = s.previewInvoice(ctx, invoice, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	debit, credit := journalTotals(journal)
+	functionalDebit, functionalCredit := journalFunctionalTotals(journal)
+	return &PostingPreview{
+		Journal:               journal,
+		GLPeriodID:            periodID,
+		TotalDebit:            debit,
+		TotalCredit:           credit,
+		TotalFunctionalDebit:  functionalDebit,
+		TotalFunctionalCredit: functionalCredit,
+		Balanced:              debit == credit && functionalDebit == functionalCredit,
+	}, nil
+}
+
+// previewInvoice builds the posting journal of an invoice. A posted invoice
+// is shown on the GL date and period it was posted with.
+func (s *InvoiceService) previewInvoice(ctx context.Context, invoice *repository.Invoice, req *PreviewPostingRequest) (*client.CreateJournalRequest, string, error) {
+	if invoice.Status == "cancelled" {
+		return nil, "", errors.New(errors.ErrCodeConflict, "cannot preview posting of a cancelled invoice")
+	}
+
+	if invoice.GLPeriodID != nil {
+		journal, err := s.journalBuilder.InvoiceJournal(ctx, invoice)
+		return journal, *invoice.GLPeriodID, err
+	}
+
+	glDate, period, err := s.resolvePostingDate(ctx, req.EntityID, invoiceGLDate(invoice), req.PeriodID)
+	if err != nil {
+		return nil, "", err
+	}
+	invoice.GLDate = &glDate
+
+	journal, err := s.journalBuilder.InvoiceJournal(ctx, invoice)
+	return journal, period.ID, err
+}
+
+// previewPayment builds the journal of a payment not yet recorded
+func (s *InvoiceService) previewPayment(ctx context.Context, invoice *repository.Invoice, req *PreviewPostingRequest) (*client.CreateJournalRequest, string, error) {
+	if invoice.InvoiceType == "credit_memo" {
+		return nil, "", errors.New(errors.ErrCodeConflict, "credit memos are applied to invoices, not paid")
+	}
+	if *req.PaymentAmount <= 0 {
+		return nil, "", errors.InvalidInput("payment_amount", "payment amount must be positive")
+	}
+
+	paymentDate := time.Now().UTC().Truncate(24 * time.Hour)
+	if req.PaymentDate != nil && *req.PaymentDate != "" {
+		parsed, err := time.Parse("2006-01-02", *req.PaymentDate)
+		if err != nil {
+			return nil, "", errors.InvalidInput("payment_date", "invalid date format, expected YYYY-MM-DD")
+		}
+		paymentDate = parsed
+	}
+
+	glDate := paymentDate
+	if req.GLDate != nil && *req.GLDate != "" {
+		parsed, err := time.Parse("2006-01-02", *req.GLDate)
+		if err != nil {
+			return nil, "", errors.InvalidInput("gl_date", "invalid date format, expected YYYY-MM-DD")
+		}
+		glDate = parsed
+	}
+
+	glDate, period, err := s.resolvePostingDate(ctx, req.EntityID, glDate, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The payment has no ID until it is recorded
+	payment := &repository.InvoicePayment{
+		ID:            "PREVIEW",
+		InvoiceID:     invoice.ID,
+		PaymentDate:   paymentDate,
+		PaymentAmount: *req.PaymentAmount,
+		GLDate:        &glDate,
+	}
+	if err := s.fx.ConvertPayment(ctx, invoice, payment); err != nil {
+		return nil, "", err
+	}
+
+	journal, err := s.journalBuilder.PaymentJournal(ctx, invoice, payment)
+	return journal, period.ID, err
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// ApplyPrepaymentRequest represents an apply prepayment request. Each
+// application allocates part of the prepayment's paid balance to one final
+// invoice.
+type ApplyPrepaymentRequest struct {
+	PrepaymentID    string                          `json:"prepayment_id"`
+	EntityID        string                          `json:"entity_id"`
+	ApplicationDate string                          `json:"application_date"`
+	GLDate          *string                         `json:"gl_date,omitempty"` // defaults to application_date
+	Applications    []*PrepaymentApplicationRequest `json:"applications"`
+	CreatedBy       string                          `json:"created_by,omitempty"`
+	ExpectedVersion *int64                          `json:"version,omitempty"`
+}
+
+// PrepaymentApplicationRequest represents the allocation of a prepayment to
+// one final invoice
+type PrepaymentApplicationRequest struct {
+	InvoiceID       string `json:"invoice_id"`
+	Amount          int64  `json:"amount"`
+	ExpectedVersion *int64 `json:"version,omitempty"`
+}
+
+// ApplyPrepayment applies what has been paid on a prepayment to later
+// standard invoices of the same vendor and currency. Each application
+// settles part of an invoice, which moves to paid once nothing is left due,
+// and posts a GL-2 journal that debits Accounts Payable and credits the
+// prepayment account, with any realized FX gain or loss between the two
+// documents' booked rates. The vendor balance goes down by the amount
+// applied. A repeated request first finishes any journal an earlier
+// attempt stopped short of.
+func (s *InvoiceService) ApplyPrepayment(ctx context.Context, req *ApplyPrepaymentRequest) (*repository.Invoice, error) {
+	prepayment, err := s.invoiceRepo.GetByID(ctx, req.PrepaymentID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if prepayment.InvoiceType != "prepayment" {
+		return nil, errors.InvalidInput("prepayment_id",
+			fmt.Sprintf("invoice %s is not a prepayment", prepayment.InvoiceNumber))
+	}
+
+	// The journals are keyed by application, so one GL-2 already created for
+	// an earlier attempt is reused rather than duplicated
+	if err := s.postPendingPrepaymentApplications(ctx, prepayment); err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(prepayment, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if prepayment.Status != "posted" && prepayment.Status != "paid" {
+		return nil, errors.New(errors.ErrCodeConflict, "can only apply posted prepayments")
+	}
+	if err := checkPostingSettled(prepayment); err != nil {
+		return nil, err
+	}
+
+	if len(req.Applications) == 0 {
+		return nil, errors.InvalidInput("applications", "at least one application is required")
+	}
+
+	// Validate and parse application date
+	applicationDate, err := time.Parse("2006-01-02", req.ApplicationDate)
+	if err != nil {
+		return nil, errors.InvalidInput("application_date", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	// Fix the GL date in an open period, defaulting to the application date
+	glDate := applicationDate
+	if req.GLDate != nil && *req.GLDate != "" {
+		glDate, err = time.Parse("2006-01-02", *req.GLDate)
+		if err != nil {
+			return nil, errors.InvalidInput("gl_date", "invalid date format, expected YYYY-MM-DD")
+		}
+	}
+	glDate, period, err := s.resolvePostingDate(ctx, req.EntityID, glDate, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the prepayment account before recording anything
+	if _, err := s.settings.PrepaymentAccountID(ctx, req.EntityID); err != nil {
+		return nil, err
+	}
+
+	// Convert empty string to NULL for CreatedBy
+	var createdBy *string
+	if req.CreatedBy != "" {
+		createdBy = &req.CreatedBy
+	}
+
+	var total int64
+	for _, appReq := range req.Applications {
+		if appReq.Amount <= 0 {
+			return nil, errors.InvalidInput("amount", "application amount must be positive")
+		}
+		total += appReq.Amount
+	}
+	if total > prepayment.PrepaymentBalance {
+		return nil, errors.InvalidInput("applications",
+			fmt.Sprintf("applications total (%d) exceeds paid prepayment balance (%d)", total, prepayment.PrepaymentBalance))
+	}
+
+	// The advance is released application by application, so the one that
+	// releases the last of the prepayment releases the rest of its
+	// functional amount
+	unapplied := prepayment.TotalAmount - prepayment.PrepaymentApplied
+	functionalApplied := prepayment.FunctionalApplied
+
+	invoices := make([]*repository.Invoice, 0, len(req.Applications))
+	applications := make([]*repository.PrepaymentApplication, 0, len(req.Applications))
+	seen := make(map[string]bool)
+
+	for _, appReq := range req.Applications {
+		if seen[appReq.InvoiceID] {
+			return nil, errors.InvalidInput("invoice_id",
+				fmt.Sprintf("invoice %s is listed more than once", appReq.InvoiceID))
+		}
+		seen[appReq.InvoiceID] = true
+
+		invoice, err := s.invoiceRepo.GetByID(ctx, appReq.InvoiceID, req.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPrepaymentTarget(prepayment, invoice, appReq); err != nil {
+			return nil, err
+		}
+
+		application := &repository.PrepaymentApplication{
+			EntityID:                   req.EntityID,
+			PrepaymentID:               prepayment.ID,
+			InvoiceID:                  invoice.ID,
+			ApplicationDate:            applicationDate,
+			Amount:                     appReq.Amount,
+			FunctionalInvoiceAmount:    functionalSettlement(invoice, appReq.Amount, invoice.AmountDue, invoice.FunctionalAmountPaid),
+			FunctionalPrepaymentAmount: functionalSettlement(prepayment, appReq.Amount, unapplied, functionalApplied),
+			GLDate:                     glDate,
+			GLPeriodID:                 period.ID,
+			CreatedBy:                  createdBy,
+		}
+		application.RealizedFXGainLoss = application.FunctionalInvoiceAmount - application.FunctionalPrepaymentAmount
+
+		// Check the account for any realized FX gain or loss before recording
+		if application.RealizedFXGainLoss != 0 {
+			if _, err := s.settings.RealizedFXAccountID(ctx, req.EntityID, application.RealizedFXGainLoss > 0); err != nil {
+				return nil, err
+			}
+		}
+
+		unapplied -= application.Amount
+		functionalApplied += application.FunctionalPrepaymentAmount
+		invoices = append(invoices, invoice)
+		applications = append(applications, application)
+	}
+
+	if err := s.invoiceRepo.ApplyPrepayment(ctx, prepayment, invoices, applications); err != nil {
+		return nil, err
+	}
+
+	for i, application := range applications {
+		if err := s.postPrepaymentApplication(ctx, prepayment, invoices[i], application); err != nil {
+			return nil, err
+		}
+	}
+
+	s.log.Info().
+		Str("prepayment_id", prepayment.ID).
+		Str("prepayment_number", prepayment.InvoiceNumber).
+		Int("invoice_count", len(applications)).
+		Int64("amount_applied", total).
+		Msg("Prepayment applied")
+
+	return s.invoiceRepo.GetByID(ctx, prepayment.ID, req.EntityID)
+}
+
+// checkPrepaymentTarget rejects an application to an invoice the
+// prepayment cannot settle
+func checkPrepaymentTarget(prepayment, invoice *repository.Invoice, appReq *PrepaymentApplicationRequest) error {
+	if err := checkVersion(invoice, appReq.ExpectedVersion); err != nil {
+		return err
+	}
+	if invoice.InvoiceType != "standard" && invoice.InvoiceType != "recurring" {
+		return errors.InvalidInput("invoice_id",
+			fmt.Sprintf("invoice %s is a %s; prepayments apply to standard and recurring invoices", invoice.InvoiceNumber, invoice.InvoiceType))
+	}
+	if invoice.Status != "posted" {
+		return errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("invoice %s is not open: status '%s'", invoice.InvoiceNumber, invoice.Status))
+	}
+	if err := checkPostingSettled(invoice); err != nil {
+		return err
+	}
+	if invoice.VendorID != prepayment.VendorID {
+		return errors.InvalidInput("invoice_id",
+			fmt.Sprintf("invoice %s belongs to a different vendor than the prepayment", invoice.InvoiceNumber))
+	}
+	if invoice.Currency != prepayment.Currency || invoice.FunctionalCurrency != prepayment.FunctionalCurrency {
+		return errors.InvalidInput("invoice_id",
+			fmt.Sprintf("invoice %s is in %s, the prepayment in %s", invoice.InvoiceNumber, invoice.Currency, prepayment.Currency))
+	}
+	if appReq.Amount > invoice.AmountDue {
+		return errors.InvalidInput("amount",
+			fmt.Sprintf("application amount (%d) exceeds amount due (%d) on invoice %s", appReq.Amount, invoice.AmountDue, invoice.InvoiceNumber))
+	}
+	return nil
+}
+
+// postPendingPrepaymentApplications posts the journals of a prepayment's
+// applications that were recorded without one
+func (s *InvoiceService) postPendingPrepaymentApplications(ctx context.Context, prepayment *repository.Invoice) error {
+	pending, err := s.invoiceRepo.ListUnpostedPrepaymentApplications(ctx, prepayment.ID, prepayment.EntityID)
+	if err != nil {
+		return err
+	}
+
+	for _, application := range pending {
+		invoice, err := s.invoiceRepo.GetByID(ctx, application.InvoiceID, prepayment.EntityID)
+		if err != nil {
+			return err
+		}
+		if err := s.postPrepaymentApplication(ctx, prepayment, invoice, application); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// postPrepaymentApplication creates and posts the GL-2 reclass journal for
+// a prepayment application and reduces the vendor balance in AP-1. The
+// journal ID is stored last, so an application without one has not
+// finished posting and may be posted again; the journal and the balance
+// change are both keyed by application, so a retry skips whichever an
+// earlier attempt already made.
+func (s *InvoiceService) postPrepaymentApplication(ctx context.Context, prepayment, invoice *repository.Invoice, application *repository.PrepaymentApplication) error {
+	journalReq, err := s.journalBuilder.PrepaymentApplicationJournal(ctx, prepayment, invoice, application)
+	if err != nil {
+		return err
+	}
+	if err := checkJournalBalanced(journalReq); err != nil {
+		return err
+	}
+
+	glJournalID, err := s.journalsClient.CreateJournal(ctx, journalReq)
+	if err != nil {
+		return fmt.Errorf("failed to create prepayment application journal entry: %w", err)
+	}
+	if err := s.journalsClient.PostJournal(ctx, glJournalID, prepayment.EntityID); err != nil {
+		return fmt.Errorf("failed to post prepayment application journal entry: %w", err)
+	}
+
+	// The invoice's share of the vendor balance is settled by the advance
+	if err := s.balances.Apply(ctx, "prepayment-application:"+application.ID, invoice.VendorID, invoice.EntityID, -application.Amount); err != nil {
+		return fmt.Errorf("failed to update vendor balance: %w", err)
+	}
+
+	if err := s.invoiceRepo.SetPrepaymentApplicationJournal(ctx, application.ID, glJournalID); err != nil {
+		return err
+	}
+	application.GLJournalID = &glJournalID
+
+	return nil
+}
+
+// ListPrepaymentApplications returns the prepayments applied to an invoice,
+// or the applications of a prepayment, oldest first
+func (s *InvoiceService) ListPrepaymentApplications(ctx context.Context, invoiceID, entityID string) ([]*repository.PrepaymentApplication, error) {
+	if _, err := s.invoiceRepo.GetByID(ctx, invoiceID, entityID); err != nil {
+		return nil, err
+	}
+	return s.invoiceRepo.ListPrepaymentApplications(ctx, invoiceID, entityID)
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// validPOStatuses are the statuses a stand-in purchase order may have
+var validPOStatuses = map[string]bool{
+	"open":      true,
+	"closed":    true,
+	"cancelled": true,
+}
+
+// TablePurchaseOrdersClient is the purchase order client backed by the local
+// ap_purchase_orders stand-in tables, used until procurement exposes its
+// purchase orders
+type TablePurchaseOrdersClient struct {
+	poRepo *repository.PurchaseOrderRepository
+}
+
+// NewTablePurchaseOrdersClient creates a table-backed purchase order client
+func NewTablePurchaseOrdersClient(poRepo *repository.PurchaseOrderRepository) *TablePurchaseOrdersClient {
+	return &TablePurchaseOrdersClient{poRepo: poRepo}
+}
+
+// GetPurchaseOrder returns the purchase order with its lines, or nil if the
+// entity has no such PO
+func (c *TablePurchaseOrdersClient) GetPurchaseOrder(ctx context.Context, poNumber, entityID string) (*client.PurchaseOrder, error) {
+	stored, err := c.poRepo.GetByNumber(ctx, entityID, poNumber)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	po := &client.PurchaseOrder{
+		ID:        stored.ID,
+		EntityID:  stored.EntityID,
+		PONumber:  stored.PONumber,
+		VendorID:  stored.VendorID,
+		Currency:  stored.Currency,
+		Status:    stored.Status,
+		OrderDate: stored.OrderDate,
+		Lines:     make([]*client.PurchaseOrderLine, 0, len(stored.Lines)),
+	}
+	for _, line := range stored.Lines {
+		po.Lines = append(po.Lines, &client.PurchaseOrderLine{
+			LineNumber:       line.LineNumber,
+			ItemCode:         line.ItemCode,
+			Description:      line.Description,
+			Quantity:         line.Quantity,
+			UnitPrice:        line.UnitPrice,
+			QuantityReceived: line.QuantityReceived,
+		})
+	}
+
+	return po, nil
+}
+
+// PurchaseOrderService maintains the stand-in purchase orders invoices are
+// matched against
+type PurchaseOrderService struct {
+	poRepo        *repository.PurchaseOrderRepository
+	vendorsClient client.VendorsClientInterface
+	log           *logger.Logger
+}
+
+// NewPurchaseOrderService creates a new purchase order service
+func NewPurchaseOrderService(
+	poRepo *repository.PurchaseOrderRepository,
+	vendorsClient client.VendorsClientInterface,
+	log *logger.Logger,
+) *PurchaseOrderService {
+	return &PurchaseOrderService{
+		poRepo:        poRepo,
+		vendorsClient: vendorsClient,
+		log:           log,
+	}
+}
+
+// UpsertPurchaseOrderRequest represents a create or replace purchase order
+// request
+type UpsertPurchaseOrderRequest struct {
+	EntityID  string                      `json:"entity_id"`
+	PONumber  string                      `json:"po_number"`
+	VendorID  string                      `json:"vendor_id"`
+	Currency  string                      `json:"currency"`
+	Status    string                      `json:"status,omitempty"` // defaults to open
+	OrderDate string                      `json:"order_date"`
+	Lines     []*PurchaseOrderLineRequest `json:"lines"`
+	UpdatedBy string                      `json:"updated_by,omitempty"`
+}
+
+// PurchaseOrderLineRequest represents a purchase order line in a request
+type PurchaseOrderLineRequest struct {
+	LineNumber       int             `json:"line_number"`
+	ItemCode         *string         `json:"item_code,omitempty"`
+	Description      string          `json:"description"`
+	Quantity         decimal.Decimal `json:"quantity"`
+	UnitPrice        int64           `json:"unit_price"`
+	QuantityReceived decimal.Decimal `json:"quantity_received,omitempty"`
+}
+
+// GetPurchaseOrder retrieves a stand-in purchase order with its lines
+func (s *PurchaseOrderService) GetPurchaseOrder(ctx context.Context, poNumber, entityID string) (*repository.PurchaseOrder, error) {
+	po, err := s.poRepo.GetByNumber(ctx, entityID, poNumber)
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return nil, errors.NotFound("purchase_order", poNumber)
+	}
+	return po, nil
+}
+
+// UpsertPurchaseOrder validates and stores a stand-in purchase order,
+// replacing all lines of an existing PO with the same number
+func (s *PurchaseOrderService) UpsertPurchaseOrder(ctx context.Context, req *UpsertPurchaseOrderRequest) (*repository.PurchaseOrder, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+	poNumber := strings.TrimSpace(req.PONumber)
+	if poNumber == "" {
+		return nil, errors.InvalidInput("po_number", "PO number is required")
+	}
+
+	// Validate vendor exists and is active
+	valid, message, err := s.vendorsClient.ValidateVendor(ctx, req.VendorID, req.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate vendor: %w", err)
+	}
+	if !valid {
+		return nil, errors.InvalidInput("vendor_id", message)
+	}
+
+	cur, err := currency.Lookup(req.Currency)
+	if err != nil {
+		return nil, errors.InvalidInput("currency", "currency must be an ISO 4217 code")
+	}
+
+	status := strings.ToLower(req.Status)
+	if status == "" {
+		status = "open"
+	}
+	if !validPOStatuses[status] {
+		return nil, errors.InvalidInput("status", fmt.Sprintf("invalid purchase order status: %s", req.Status))
+	}
+
+	orderDate, err := time.Parse("2006-01-02", req.OrderDate)
+	if err != nil {
+		return nil, errors.InvalidInput("order_date", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	if len(req.Lines) < 1 {
+		return nil, errors.InvalidInput("lines", "purchase order must have at least 1 line")
+	}
+
+	po := &repository.PurchaseOrder{
+		EntityID:  req.EntityID,
+		PONumber:  poNumber,
+		VendorID:  req.VendorID,
+		Currency:  cur.Code,
+		Status:    status,
+		OrderDate: orderDate,
+		Lines:     make([]*repository.PurchaseOrderLine, 0, len(req.Lines)),
+	}
+
+	lineNumbers := make(map[int]bool)
+	for _, lineReq := range req.Lines {
+		if lineReq.LineNumber < 1 || lineNumbers[lineReq.LineNumber] {
+			return nil, errors.InvalidInput("line_number",
+				fmt.Sprintf("line number %d must be positive and unique", lineReq.LineNumber))
+		}
+		lineNumbers[lineReq.LineNumber] = true
+
+		if strings.TrimSpace(lineReq.Description) == "" {
+			return nil, errors.InvalidInput("description", fmt.Sprintf("line %d: description is required", lineReq.LineNumber))
+		}
+		if lineReq.Quantity.Sign() <= 0 {
+			return nil, errors.InvalidInput("quantity", fmt.Sprintf("line %d: quantity must be positive", lineReq.LineNumber))
+		}
+		if lineReq.UnitPrice < 0 {
+			return nil, errors.InvalidInput("unit_price", fmt.Sprintf("line %d: unit price cannot be negative", lineReq.LineNumber))
+		}
+		if lineReq.QuantityReceived.Sign() < 0 {
+			return nil, errors.InvalidInput("quantity_received", fmt.Sprintf("line %d: quantity received cannot be negative", lineReq.LineNumber))
+		}
+
+		po.Lines = append(po.Lines, &repository.PurchaseOrderLine{
+			LineNumber:       lineReq.LineNumber,
+			ItemCode:         lineReq.ItemCode,
+			Description:      strings.TrimSpace(lineReq.Description),
+			Quantity:         lineReq.Quantity,
+			UnitPrice:        lineReq.UnitPrice,
+			QuantityReceived: lineReq.QuantityReceived,
+		})
+	}
+
+	// Convert empty string to NULL for UpdatedBy
+	if req.UpdatedBy != "" {
+		po.UpdatedBy = &req.UpdatedBy
+	}
+
+	if err := s.poRepo.Upsert(ctx, po); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("entity_id", req.EntityID).
+		Str("po_number", poNumber).
+		Int("lines", len(po.Lines)).
+		Msg("Purchase order saved")
+
+	return po, nil
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Goods receipt types
+const (
+	ReceiptTypeReceipt = "receipt"
+	ReceiptTypeReturn  = "return"
+)
+
+// ReceiptService records goods received against purchase orders and
+// returns of them, for three-way matching and for reviewers to see what was
+// received before approving an invoice
+type ReceiptService struct {
+	receiptRepo    *repository.ReceiptRepository
+	invoiceRepo    *repository.InvoiceRepository
+	purchaseOrders client.PurchaseOrdersClientInterface
+	log            *logger.Logger
+}
+
+// NewReceiptService creates a new receipt service
+func NewReceiptService(
+	receiptRepo *repository.ReceiptRepository,
+	invoiceRepo *repository.InvoiceRepository,
+	purchaseOrders client.PurchaseOrdersClientInterface,
+	log *logger.Logger,
+) *ReceiptService {
+	return &ReceiptService{
+		receiptRepo:    receiptRepo,
+		invoiceRepo:    invoiceRepo,
+		purchaseOrders: purchaseOrders,
+		log:            log,
+	}
+}
+
+// RecordReceiptRequest represents a record goods receipt request
+type RecordReceiptRequest struct {
+	EntityID      string                `json:"entity_id"`
+	ReceiptNumber string                `json:"receipt_number"`
+	PONumber      string                `json:"po_number"`
+	ReceiptDate   string                `json:"receipt_date"`
+	Lines         []*ReceiptLineRequest `json:"lines"`
+	Notes         *string               `json:"notes,omitempty"`
+	CreatedBy     string                `json:"created_by,omitempty"`
+}
+
+// RecordReturnRequest represents a return of goods from a receipt
+type RecordReturnRequest struct {
+	EntityID     string                `json:"entity_id"`
+	ReceiptID    string                `json:"receipt_id"`
+	ReturnNumber string                `json:"return_number"`
+	ReturnDate   string                `json:"return_date"`
+	Lines        []*ReceiptLineRequest `json:"lines"`
+	Notes        *string               `json:"notes,omitempty"`
+	CreatedBy    string                `json:"created_by,omitempty"`
+}
+
+// ReceiptLineRequest is the quantity of one PO line received or returned
+type ReceiptLineRequest struct {
+	POLineNumber int             `json:"po_line_number"`
+	Quantity     decimal.Decimal `json:"quantity"`
+}
+
+// RecordReceipt records goods received against an open purchase order. The
+// vendor is the PO's; each line names a PO line and a positive quantity.
+// Receiving more than ordered is recorded as received.
+func (s *ReceiptService) RecordReceipt(ctx context.Context, req *RecordReceiptRequest) (*repository.GoodsReceipt, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+	receiptNumber := strings.TrimSpace(req.ReceiptNumber)
+	if receiptNumber == "" {
+		return nil, errors.InvalidInput("receipt_number", "receipt number is required")
+	}
+	poNumber := strings.TrimSpace(req.PONumber)
+	if poNumber == "" {
+		return nil, errors.InvalidInput("po_number", "PO number is required")
+	}
+
+	receiptDate, err := time.Parse("2006-01-02", req.ReceiptDate)
+	if err != nil {
+		return nil, errors.InvalidInput("receipt_date", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	po, err := s.purchaseOrders.GetPurchaseOrder(ctx, poNumber, req.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get purchase order %s: %w", poNumber, err)
+	}
+	if po == nil {
+		return nil, errors.InvalidInput("po_number", fmt.Sprintf("purchase order %s not found", poNumber))
+	}
+	if !po.IsOpen() {
+		return nil, errors.InvalidInput("po_number", fmt.Sprintf("purchase order %s is %s", poNumber, po.Status))
+	}
+
+	poLines := make(map[int]*client.PurchaseOrderLine, len(po.Lines))
+	for _, poLine := range po.Lines {
+		poLines[poLine.LineNumber] = poLine
+	}
+
+	lines, err := receiptLines(req.Lines, poLines, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &repository.GoodsReceipt{
+		EntityID:      req.EntityID,
+		ReceiptNumber: receiptNumber,
+		ReceiptType:   ReceiptTypeReceipt,
+		PONumber:      poNumber,
+		VendorID:      po.VendorID,
+		ReceiptDate:   receiptDate,
+		Notes:         req.Notes,
+		Lines:         lines,
+	}
+	return s.create(ctx, receipt, req.CreatedBy)
+}
+
+// RecordReturn records goods sent back from a receipt. Each PO line
+// returned must be on the receipt, and no more can be returned than the
+// receipt brought in less its earlier returns.
+func (s *ReceiptService) RecordReturn(ctx context.Context, req *RecordReturnRequest) (*repository.GoodsReceipt, error) {
+	returnNumber := strings.TrimSpace(req.ReturnNumber)
+	if returnNumber == "" {
+		return nil, errors.InvalidInput("return_number", "return number is required")
+	}
+
+	returnDate, err := time.Parse("2006-01-02", req.ReturnDate)
+	if err != nil {
+		return nil, errors.InvalidInput("return_date", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	original, err := s.receiptRepo.GetByID(ctx, req.ReceiptID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if original.ReceiptType != ReceiptTypeReceipt {
+		return nil, errors.InvalidInput("receipt_id", "goods can only be returned against a receipt")
+	}
+	if returnDate.Before(original.ReceiptDate) {
+		return nil, errors.InvalidInput("return_date", "return date cannot be before the receipt date")
+	}
+
+	returned, err := s.receiptRepo.ReturnedQuantities(ctx, original.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// What can still be returned of each PO line on the receipt
+	returnable := make(map[int]decimal.Decimal)
+	received := make(map[int]*client.PurchaseOrderLine)
+	for _, line := range original.Lines {
+		returnable[line.POLineNumber] = returnable[line.POLineNumber].Add(line.Quantity)
+		received[line.POLineNumber] = &client.PurchaseOrderLine{
+			LineNumber:  line.POLineNumber,
+			ItemCode:    line.ItemCode,
+			Description: line.Description,
+		}
+	}
+	for poLineNumber, quantity := range returned {
+		returnable[poLineNumber] = returnable[poLineNumber].Sub(quantity)
+	}
+
+	lines, err := receiptLines(req.Lines, received, returnable)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &repository.GoodsReceipt{
+		EntityID:      original.EntityID,
+		ReceiptNumber: returnNumber,
+		ReceiptType:   ReceiptTypeReturn,
+		PONumber:      original.PONumber,
+		VendorID:      original.VendorID,
+		ReceiptDate:   returnDate,
+		ReturnOfID:    &original.ID,
+		Notes:         req.Notes,
+		Lines:         lines,
+	}
+	return s.create(ctx, receipt, req.CreatedBy)
+}
+
+// receiptLines validates the lines of a receipt or return against the PO
+// lines they may name and builds them. With limits, the quantity of each
+// PO line cannot exceed its limit.
+func receiptLines(reqs []*ReceiptLineRequest, poLines map[int]*client.PurchaseOrderLine, limits map[int]decimal.Decimal) ([]*repository.GoodsReceiptLine, error) {
+	if len(reqs) < 1 {
+		return nil, errors.InvalidInput("lines", "at least 1 line is required")
+	}
+
+	lines := make([]*repository.GoodsReceiptLine, 0, len(reqs))
+	seen := make(map[int]bool)
+	for i, lineReq := range reqs {
+		poLine := poLines[lineReq.POLineNumber]
+		if poLine == nil {
+			return nil, errors.InvalidInput("po_line_number", fmt.Sprintf("line %d: PO line %d not found", i+1, lineReq.POLineNumber))
+		}
+		if seen[lineReq.POLineNumber] {
+			return nil, errors.InvalidInput("po_line_number", fmt.Sprintf("line %d: PO line %d appears more than once", i+1, lineReq.POLineNumber))
+		}
+		seen[lineReq.POLineNumber] = true
+
+		if lineReq.Quantity.Sign() <= 0 {
+			return nil, errors.InvalidInput("quantity", fmt.Sprintf("line %d: quantity must be positive", i+1))
+		}
+		if limits != nil && lineReq.Quantity.Cmp(limits[lineReq.POLineNumber]) > 0 {
+			return nil, errors.InvalidInput("quantity",
+				fmt.Sprintf("line %d: only %s of PO line %d can be returned", i+1, limits[lineReq.POLineNumber], lineReq.POLineNumber))
+		}
+
+		lines = append(lines, &repository.GoodsReceiptLine{
+			LineNumber:   i + 1,
+			POLineNumber: lineReq.POLineNumber,
+			ItemCode:     poLine.ItemCode,
+			Description:  poLine.Description,
+			Quantity:     lineReq.Quantity,
+		})
+	}
+
+	return lines, nil
+}
+
+// create stores a receipt or return
+func (s *ReceiptService) create(ctx context.Context, receipt *repository.GoodsReceipt, createdBy string) (*repository.GoodsReceipt, error) {
+	// Convert empty string to NULL for CreatedBy
+	if createdBy != "" {
+		receipt.CreatedBy = &createdBy
+	}
+
+	if err := s.receiptRepo.Create(ctx, receipt); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("receipt_id", receipt.ID).
+		Str("receipt_number", receipt.ReceiptNumber).
+		Str("receipt_type", receipt.ReceiptType).
+		Str("po_number", receipt.PONumber).
+		Int("lines", len(receipt.Lines)).
+		Msg("Goods receipt recorded")
+
+	return receipt, nil
+}
+
+// GetReceipt retrieves a receipt or return with its lines
+func (s *ReceiptService) GetReceipt(ctx context.Context, id, entityID string) (*repository.GoodsReceipt, error) {
+	return s.receiptRepo.GetByID(ctx, id, entityID)
+}
+
+// ListPOReceipts returns the receipts and returns of a purchase order
+func (s *ReceiptService) ListPOReceipts(ctx context.Context, poNumber, entityID string) ([]*repository.GoodsReceipt, error) {
+	return s.receiptRepo.ListByPO(ctx, entityID, strings.TrimSpace(poNumber))
+}
+
+// ListInvoiceReceipts returns the receipts and returns of the purchase
+// order an invoice bills
+func (s *ReceiptService) ListInvoiceReceipts(ctx context.Context, id, entityID string) ([]*repository.GoodsReceipt, error) {
+	invoice, err := s.invoiceRepo.GetByID(ctx, id, entityID)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.PONumber == nil || strings.TrimSpace(*invoice.PONumber) == "" {
+		return nil, errors.InvalidInput("po_number", "invoice has no purchase order")
+	}
+	return s.ListPOReceipts(ctx, *invoice.PONumber, entityID)
+}
+
+// ListUninvoiced returns a vendor's PO lines with goods received that
+// submitted invoices have not yet billed
+func (s *ReceiptService) ListUninvoiced(ctx context.Context, entityID, vendorID string) ([]*repository.UninvoicedReceipt, error) {
+	return s.receiptRepo.ListUninvoiced(ctx, entityID, vendorID)
+}
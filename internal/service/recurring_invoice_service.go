@@ -0,0 +1,605 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+	"github.com/pesio-ai/be-ap-invoices/internal/schedule"
+)
+
+// RecurringInvoiceService manages recurring invoice templates and generates
+// their draft invoices. Each occurrence becomes an ordinary draft of type
+// 'recurring' created through InvoiceService.CreateInvoice, so it is
+// validated, taxed and converted like any other invoice.
+type RecurringInvoiceService struct {
+	templateRepo   *repository.RecurringTemplateRepository
+	invoiceRepo    *repository.InvoiceRepository
+	invoiceService *InvoiceService
+	vendorsClient  client.VendorsClientInterface
+	log            *logger.Logger
+}
+
+// NewRecurringInvoiceService creates a new recurring invoice service
+func NewRecurringInvoiceService(
+	templateRepo *repository.RecurringTemplateRepository,
+	invoiceRepo *repository.InvoiceRepository,
+	invoiceService *InvoiceService,
+	vendorsClient client.VendorsClientInterface,
+	log *logger.Logger,
+) *RecurringInvoiceService {
+	return &RecurringInvoiceService{
+		templateRepo:   templateRepo,
+		invoiceRepo:    invoiceRepo,
+		invoiceService: invoiceService,
+		vendorsClient:  vendorsClient,
+		log:            log,
+	}
+}
+
+// CreateRecurringTemplateRequest represents a create recurring template
+// request
+type CreateRecurringTemplateRequest struct {
+	EntityID         string                `json:"entity_id"`
+	VendorID         string                `json:"vendor_id"`
+	Name             string                `json:"name"`
+	NumberPrefix     string                `json:"number_prefix"`
+	Currency         string                `json:"currency"`
+	PaymentTerms     *string               `json:"payment_terms,omitempty"` // defaults to the vendor's, then the entity's terms
+	DueDays          *int                  `json:"due_days,omitempty"`      // only for terms not in the catalog
+	PricesIncludeTax bool                  `json:"prices_include_tax,omitempty"`
+	Description      *string               `json:"description,omitempty"`
+	Notes            *string               `json:"notes,omitempty"`
+	Lines            []*InvoiceLineRequest `json:"lines"`
+	Frequency        string                `json:"frequency"`
+	CronExpression   *string               `json:"cron_expression,omitempty"` // custom frequency only
+	StartDate        string                `json:"start_date"`
+	EndDate          *string               `json:"end_date,omitempty"`
+	AutoSubmit       bool                  `json:"auto_submit,omitempty"`
+	CreatedBy        string                `json:"created_by,omitempty"`
+}
+
+// RecurringTemplateActionRequest represents a pause, resume or skip request
+type RecurringTemplateActionRequest struct {
+	ID        string `json:"id"`
+	EntityID  string `json:"entity_id"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+}
+
+// CreateTemplate validates and stores a recurring template. Its lines are
+// checked as invoice lines now, so a template that could never generate an
+// invoice is rejected up front. The first occurrence is the start date or
+// the first date after it on the schedule; occurrences already past are
+// generated by the scheduler's next run.
+func (s *RecurringInvoiceService) CreateTemplate(ctx context.Context, req *CreateRecurringTemplateRequest) (*repository.RecurringTemplate, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, errors.InvalidInput("name", "name is required")
+	}
+	if strings.TrimSpace(req.NumberPrefix) == "" {
+		return nil, errors.InvalidInput("number_prefix", "number prefix is required")
+	}
+
+	// Validate vendor exists and is active
+	valid, message, err := s.vendorsClient.ValidateVendor(ctx, req.VendorID, req.EntityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate vendor: %w", err)
+	}
+	if !valid {
+		return nil, errors.InvalidInput("vendor_id", message)
+	}
+
+	// Validate currency
+	cur, err := currency.Lookup(req.Currency)
+	if err != nil {
+		return nil, errors.InvalidInput("currency", "currency must be an ISO 4217 code")
+	}
+
+	// Catalogued payment terms set each invoice's due date; other terms
+	// need the template to say when its invoices fall due
+	var requestedTerms string
+	if req.PaymentTerms != nil {
+		requestedTerms = *req.PaymentTerms
+	}
+	paymentTerms, err := s.invoiceService.resolvePaymentTerms(ctx, req.EntityID, req.VendorID, requestedTerms)
+	if err != nil {
+		return nil, err
+	}
+	terms, err := s.invoiceService.paymentTerms.GetTerms(ctx, req.EntityID, paymentTerms)
+	if err != nil {
+		return nil, err
+	}
+	if terms != nil && req.DueDays != nil {
+		return nil, errors.InvalidInput("due_days",
+			fmt.Sprintf("payment terms %s set the due date; due days do not apply", terms.Code))
+	}
+	if terms == nil && req.DueDays == nil {
+		return nil, errors.InvalidInput("due_days",
+			fmt.Sprintf("due days are required: payment terms '%s' are not in the catalog", paymentTerms))
+	}
+	if req.DueDays != nil && *req.DueDays < 0 {
+		return nil, errors.InvalidInput("due_days", "due days cannot be negative")
+	}
+
+	// Validate schedule
+	frequency := strings.ToLower(req.Frequency)
+	var cronExpression *string
+	if frequency == schedule.Custom {
+		if req.CronExpression == nil || strings.TrimSpace(*req.CronExpression) == "" {
+			return nil, errors.InvalidInput("cron_expression", "cron expression is required for a custom frequency")
+		}
+		expr := strings.TrimSpace(*req.CronExpression)
+		cronExpression = &expr
+	}
+
+	startDate, err := time.Parse("2006-01-02", req.StartDate)
+	if err != nil {
+		return nil, errors.InvalidInput("start_date", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	var endDate *time.Time
+	if req.EndDate != nil && *req.EndDate != "" {
+		parsedEndDate, err := time.Parse("2006-01-02", *req.EndDate)
+		if err != nil {
+			return nil, errors.InvalidInput("end_date", "invalid date format, expected YYYY-MM-DD")
+		}
+		if parsedEndDate.Before(startDate) {
+			return nil, errors.InvalidInput("end_date", "end date cannot be before start date")
+		}
+		endDate = &parsedEndDate
+	}
+
+	template := &repository.RecurringTemplate{
+		EntityID:         req.EntityID,
+		VendorID:         req.VendorID,
+		Name:             strings.TrimSpace(req.Name),
+		NumberPrefix:     strings.TrimSpace(req.NumberPrefix),
+		Currency:         cur.Code,
+		PaymentTerms:     req.PaymentTerms,
+		DueDays:          req.DueDays,
+		PricesIncludeTax: req.PricesIncludeTax,
+		Description:      req.Description,
+		Notes:            req.Notes,
+		Frequency:        frequency,
+		CronExpression:   cronExpression,
+		StartDate:        startDate,
+		EndDate:          endDate,
+		AutoSubmit:       req.AutoSubmit,
+		Status:           "active",
+		Lines:            make([]*repository.RecurringTemplateLine, 0, len(req.Lines)),
+	}
+
+	sched, err := templateSchedule(template)
+	if err != nil {
+		return nil, errors.InvalidInput("frequency", err.Error())
+	}
+	template.NextRunDate = nextOccurrence(sched, template, startDate.AddDate(0, 0, -1))
+	if template.NextRunDate == nil {
+		return nil, errors.InvalidInput("frequency", "schedule has no occurrence between the start and end dates")
+	}
+
+	// Validate lines as the invoice lines they will become
+	if len(req.Lines) < 1 {
+		return nil, errors.InvalidInput("lines", "template must have at least 1 line")
+	}
+	accountsSeen := make(map[string]bool)
+	for _, lineReq := range req.Lines {
+		if _, err := s.invoiceService.buildLine(ctx, req.EntityID, lineReq, accountsSeen); err != nil {
+			return nil, err
+		}
+		template.Lines = append(template.Lines, &repository.RecurringTemplateLine{
+			AccountID:   lineReq.AccountID,
+			Description: lineReq.Description,
+			Quantity:    lineReq.Quantity,
+			UnitPrice:   lineReq.UnitPrice,
+			LineAmount:  lineReq.LineAmount,
+			TaxCode:     lineReq.TaxCode,
+			TaxRate:     lineReq.TaxRate,
+			TaxAmount:   lineReq.TaxAmount,
+			Dimension1:  lineReq.Dimension1,
+			Dimension2:  lineReq.Dimension2,
+			Dimension3:  lineReq.Dimension3,
+			Dimension4:  lineReq.Dimension4,
+			ItemCode:    lineReq.ItemCode,
+			ItemName:    lineReq.ItemName,
+		})
+	}
+
+	// Invoice numbers are unique per vendor, so two of its templates may not
+	// share a prefix
+	existing, err := s.templateRepo.List(ctx, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range existing {
+		if other.VendorID == template.VendorID && strings.EqualFold(other.NumberPrefix, template.NumberPrefix) {
+			return nil, errors.New(errors.ErrCodeConflict,
+				fmt.Sprintf("recurring template %s already numbers this vendor's invoices with prefix %s", other.Name, other.NumberPrefix))
+		}
+	}
+
+	// Convert empty string to NULL for CreatedBy
+	if req.CreatedBy != "" {
+		template.CreatedBy = &req.CreatedBy
+	}
+
+	if err := s.templateRepo.Create(ctx, template); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("template_id", template.ID).
+		Str("vendor_id", template.VendorID).
+		Str("entity_id", template.EntityID).
+		Str("frequency", template.Frequency).
+		Time("next_run_date", *template.NextRunDate).
+		Msg("Recurring template created")
+
+	return template, nil
+}
+
+// GetTemplate retrieves a template with its occurrences
+func (s *RecurringInvoiceService) GetTemplate(ctx context.Context, id, entityID string) (*repository.RecurringTemplate, error) {
+	return s.templateRepo.GetByID(ctx, id, entityID)
+}
+
+// ListTemplates lists the templates of an entity
+func (s *RecurringInvoiceService) ListTemplates(ctx context.Context, entityID string) ([]*repository.RecurringTemplate, error) {
+	return s.templateRepo.List(ctx, entityID)
+}
+
+// PauseTemplate stops an active template from generating invoices until it
+// is resumed
+func (s *RecurringInvoiceService) PauseTemplate(ctx context.Context, req *RecurringTemplateActionRequest) (*repository.RecurringTemplate, error) {
+	template, err := s.templateRepo.GetByID(ctx, req.ID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if template.Status != "active" {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot pause recurring template with status '%s'", template.Status))
+	}
+
+	if err := s.templateRepo.SetStatus(ctx, template, "active", "paused", template.NextRunDate, optionalString(req.UpdatedBy)); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().Str("template_id", template.ID).Msg("Recurring template paused")
+
+	return template, nil
+}
+
+// ResumeTemplate reactivates a paused template. Occurrences that fell while
+// it was paused are not generated: the schedule picks up from today, or
+// from the occurrence it was paused before if that is still to come.
+func (s *RecurringInvoiceService) ResumeTemplate(ctx context.Context, req *RecurringTemplateActionRequest) (*repository.RecurringTemplate, error) {
+	template, err := s.templateRepo.GetByID(ctx, req.ID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if template.Status != "paused" {
+		return nil, errors.New(errors.ErrCodeConflict,
+			fmt.Sprintf("cannot resume recurring template with status '%s'", template.Status))
+	}
+
+	sched, err := templateSchedule(template)
+	if err != nil {
+		return nil, err
+	}
+
+	from := schedule.Date(time.Now())
+	if template.NextRunDate != nil && template.NextRunDate.After(from) {
+		from = *template.NextRunDate
+	}
+	next := nextOccurrence(sched, template, from.AddDate(0, 0, -1))
+
+	if err := s.templateRepo.SetStatus(ctx, template, "paused", "active", next, optionalString(req.UpdatedBy)); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().Str("template_id", template.ID).Str("status", template.Status).Msg("Recurring template resumed")
+
+	return template, nil
+}
+
+// SkipOccurrence skips a template's next occurrence without generating an
+// invoice for it, recording it as skipped. A paused template may skip too;
+// the occurrence after is then the one it resumes at, if still to come.
+func (s *RecurringInvoiceService) SkipOccurrence(ctx context.Context, req *RecurringTemplateActionRequest) (*repository.RecurringTemplate, error) {
+	template, err := s.templateRepo.GetByID(ctx, req.ID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if template.Status == "ended" || template.NextRunDate == nil {
+		return nil, errors.New(errors.ErrCodeConflict, "recurring template has no occurrence left to skip")
+	}
+
+	sched, err := templateSchedule(template)
+	if err != nil {
+		return nil, err
+	}
+
+	occurrence := &repository.RecurringOccurrence{
+		OccurrenceDate: *template.NextRunDate,
+		Status:         "skipped",
+		CreatedBy:      optionalString(req.UpdatedBy),
+	}
+	claimed, err := s.templateRepo.ClaimOccurrence(ctx, template, occurrence, nextOccurrence(sched, template, occurrence.OccurrenceDate))
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errors.New(errors.ErrCodeConflict, "recurring template's next occurrence has changed")
+	}
+
+	s.log.Info().
+		Str("template_id", template.ID).
+		Time("occurrence_date", occurrence.OccurrenceDate).
+		Msg("Recurring occurrence skipped")
+
+	return s.templateRepo.GetByID(ctx, template.ID, template.EntityID)
+}
+
+// Retrying occurrences: a pending occurrence not completed within
+// occurrenceLease is presumed abandoned by a scheduler that stopped, and a
+// failed one is retried after occurrenceRetryBackoff, doubling each time,
+// until it has been attempted occurrenceMaxAttempts times
+const (
+	occurrenceLease        = 15 * time.Minute
+	occurrenceRetryBackoff = 15 * time.Minute
+	occurrenceMaxAttempts  = 5
+)
+
+// GenerateDue generates the invoices of up to limit active templates with
+// occurrences due today or earlier and returns how many templates it
+// processed. A template behind by several occurrences catches up on all of
+// them. An occurrence whose invoice cannot be created is recorded as failed
+// and retried later by RetryOccurrences; the schedule moves on, so the
+// template's other occurrences are not held up by it.
+func (s *RecurringInvoiceService) GenerateDue(ctx context.Context, limit int) (int, error) {
+	today := schedule.Date(time.Now())
+
+	templates, err := s.templateRepo.ListDue(ctx, today, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, template := range templates {
+		if err := s.generateTemplate(ctx, template, today); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(templates), nil
+}
+
+// generateTemplate generates a template's occurrences up to today
+func (s *RecurringInvoiceService) generateTemplate(ctx context.Context, template *repository.RecurringTemplate, today time.Time) error {
+	sched, err := templateSchedule(template)
+	if err != nil {
+		return err
+	}
+
+	for template.Status == "active" && template.NextRunDate != nil && !template.NextRunDate.After(today) {
+		occurrence := &repository.RecurringOccurrence{
+			OccurrenceDate: *template.NextRunDate,
+			Status:         "pending",
+			Attempts:       1,
+		}
+
+		// Claim the occurrence before creating its invoice; a scheduler that
+		// loses the claim leaves the template to the one that won it
+		claimed, err := s.templateRepo.ClaimOccurrence(ctx, template, occurrence, nextOccurrence(sched, template, occurrence.OccurrenceDate))
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return nil
+		}
+
+		s.generateOccurrence(ctx, template, occurrence)
+
+		if err := s.templateRepo.CompleteOccurrence(ctx, occurrence); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RetryOccurrences generates again up to limit occurrences that did not
+// complete: pending ones left past their lease and failed ones whose next
+// attempt has come. It returns how many it listed. Occurrences of paused
+// templates wait until the template resumes.
+func (s *RecurringInvoiceService) RetryOccurrences(ctx context.Context, limit int) (int, error) {
+	staleBefore := time.Now().Add(-occurrenceLease)
+
+	occurrences, err := s.templateRepo.ListRetryable(ctx, staleBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, occurrence := range occurrences {
+		template, err := s.templateRepo.GetByID(ctx, occurrence.TemplateID, occurrence.EntityID)
+		if err != nil {
+			return 0, err
+		}
+
+		claimed, err := s.templateRepo.ReclaimOccurrence(ctx, occurrence, staleBefore)
+		if err != nil {
+			return 0, err
+		}
+		if !claimed {
+			continue
+		}
+
+		s.log.Info().
+			Str("template_id", template.ID).
+			Time("occurrence_date", occurrence.OccurrenceDate).
+			Int("attempt", occurrence.Attempts).
+			Msg("Retrying recurring occurrence")
+
+		s.generateOccurrence(ctx, template, occurrence)
+
+		if err := s.templateRepo.CompleteOccurrence(ctx, occurrence); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(occurrences), nil
+}
+
+// generateOccurrence creates the draft invoice of a claimed occurrence and,
+// if the template asks, submits it for approval. The outcome is left on the
+// occurrence: generated with the invoice, or failed with the error. An
+// invoice that was created but could not be submitted stays a draft and its
+// occurrence is generated with the submission error. A failed occurrence
+// is given its next attempt while it has attempts left. A retried
+// occurrence first looks for the invoice an abandoned attempt may already
+// have created, by its number, rather than creating a second one.
+func (s *RecurringInvoiceService) generateOccurrence(ctx context.Context, template *repository.RecurringTemplate, occurrence *repository.RecurringOccurrence) {
+	invoiceDate := occurrence.OccurrenceDate
+	req := &CreateInvoiceRequest{
+		EntityID:         template.EntityID,
+		VendorID:         template.VendorID,
+		InvoiceNumber:    fmt.Sprintf("%s-%s", template.NumberPrefix, invoiceDate.Format("20060102")),
+		InvoiceDate:      invoiceDate.Format("2006-01-02"),
+		InvoiceType:      "recurring",
+		Currency:         template.Currency,
+		PricesIncludeTax: template.PricesIncludeTax,
+		Description:      template.Description,
+		Notes:            template.Notes,
+		Lines:            make([]*InvoiceLineRequest, 0, len(template.Lines)),
+	}
+	if template.PaymentTerms != nil {
+		req.PaymentTerms = *template.PaymentTerms
+	}
+	// Without due days the payment terms set the due date
+	if template.DueDays != nil {
+		req.DueDate = invoiceDate.AddDate(0, 0, *template.DueDays).Format("2006-01-02")
+	}
+	// Generated invoices are created on behalf of the template's author
+	if template.CreatedBy != nil {
+		req.CreatedBy = *template.CreatedBy
+	}
+
+	for i, line := range template.Lines {
+		req.Lines = append(req.Lines, &InvoiceLineRequest{
+			LineNumber:  i + 1,
+			AccountID:   line.AccountID,
+			Description: line.Description,
+			Quantity:    line.Quantity,
+			UnitPrice:   line.UnitPrice,
+			LineAmount:  line.LineAmount,
+			TaxCode:     line.TaxCode,
+			TaxRate:     line.TaxRate,
+			TaxAmount:   line.TaxAmount,
+			Dimension1:  line.Dimension1,
+			Dimension2:  line.Dimension2,
+			Dimension3:  line.Dimension3,
+			Dimension4:  line.Dimension4,
+			ItemCode:    line.ItemCode,
+			ItemName:    line.ItemName,
+		})
+	}
+
+	invoice, err := s.occurrenceInvoice(ctx, occurrence, req)
+	if err != nil {
+		s.log.Error().
+			Err(err).
+			Str("template_id", template.ID).
+			Time("occurrence_date", occurrence.OccurrenceDate).
+			Int("attempt", occurrence.Attempts).
+			Msg("Failed to generate recurring invoice")
+
+		message := err.Error()
+		occurrence.Status = "failed"
+		occurrence.ErrorMessage = &message
+		occurrence.NextAttemptAt = nextAttemptAt(occurrence.Attempts, time.Now())
+		return
+	}
+
+	occurrence.Status = "generated"
+	occurrence.InvoiceID = &invoice.ID
+	occurrence.ErrorMessage = nil
+
+	if template.AutoSubmit && invoice.Status == "draft" {
+		if err := s.invoiceService.SubmitForApproval(ctx, invoice.ID, invoice.EntityID, req.CreatedBy, nil); err != nil {
+			s.log.Error().
+				Err(err).
+				Str("template_id", template.ID).
+				Str("invoice_id", invoice.ID).
+				Msg("Failed to submit recurring invoice for approval")
+
+			message := fmt.Sprintf("invoice left in draft: %s", err.Error())
+			occurrence.ErrorMessage = &message
+		}
+	}
+
+	s.log.Info().
+		Str("template_id", template.ID).
+		Str("invoice_id", invoice.ID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Time("occurrence_date", occurrence.OccurrenceDate).
+		Msg("Recurring invoice generated")
+}
+
+// occurrenceInvoice creates the invoice of an occurrence, or on a retry
+// returns the one an earlier attempt already created
+func (s *RecurringInvoiceService) occurrenceInvoice(ctx context.Context, occurrence *repository.RecurringOccurrence, req *CreateInvoiceRequest) (*repository.Invoice, error) {
+	if occurrence.Attempts > 1 {
+		invoice, err := s.invoiceRepo.FindByNumber(ctx, req.EntityID, req.VendorID, req.InvoiceNumber)
+		if err != nil {
+			return nil, err
+		}
+		if invoice != nil {
+			return invoice, nil
+		}
+	}
+	return s.invoiceService.CreateInvoice(ctx, req)
+}
+
+// nextAttemptAt returns when an occurrence that failed on its attempts-th
+// attempt is retried, or nil once it has no attempts left
+func nextAttemptAt(attempts int, now time.Time) *time.Time {
+	if attempts >= occurrenceMaxAttempts {
+		return nil
+	}
+	next := now.Add(occurrenceRetryBackoff << uint(attempts-1))
+	return &next
+}
+
+// templateSchedule returns the schedule of a template
+func templateSchedule(template *repository.RecurringTemplate) (*schedule.Schedule, error) {
+	var cronExpression string
+	if template.CronExpression != nil {
+		cronExpression = *template.CronExpression
+	}
+	return schedule.New(template.Frequency, cronExpression, template.StartDate)
+}
+
+// nextOccurrence returns a template's first occurrence after a date, or nil
+// if its schedule ends before then
+func nextOccurrence(sched *schedule.Schedule, template *repository.RecurringTemplate, after time.Time) *time.Time {
+	next := sched.Next(after)
+	if next.IsZero() || (template.EndDate != nil && next.After(*template.EndDate)) {
+		return nil
+	}
+	return &next
+}
+
+// optionalString converts an empty string to NULL
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
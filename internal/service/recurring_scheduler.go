@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/logger"
+)
+
+// RecurringScheduler generates the draft invoices of recurring templates in
+// the background as their occurrences fall due
+type RecurringScheduler struct {
+	recurringService *RecurringInvoiceService
+	interval         time.Duration
+	batchSize        int
+	log              *logger.Logger
+}
+
+// NewRecurringScheduler creates a scheduler that checks for due templates
+// every interval, processing up to batchSize templates at a time
+func NewRecurringScheduler(recurringService *RecurringInvoiceService, interval time.Duration, batchSize int, log *logger.Logger) *RecurringScheduler {
+	return &RecurringScheduler{
+		recurringService: recurringService,
+		interval:         interval,
+		batchSize:        batchSize,
+		log:              log,
+	}
+}
+
+// Run generates due invoices until ctx is cancelled. A full batch is followed
+// immediately by another so templates that fell behind catch up without
+// waiting for the ticker. Each tick then retries a batch of occurrences that
+// did not complete.
+func (s *RecurringScheduler) Run(ctx context.Context) {
+	s.log.Info().
+		Dur("interval", s.interval).
+		Int("batch_size", s.batchSize).
+		Msg("Recurring invoice scheduler started")
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			n, err := s.recurringService.GenerateDue(ctx, s.batchSize)
+			if err != nil {
+				s.log.Error().Err(err).Msg("Failed to generate recurring invoices")
+				break
+			}
+			if n < s.batchSize {
+				break
+			}
+		}
+
+		if ctx.Err() == nil {
+			if _, err := s.recurringService.RetryOccurrences(ctx, s.batchSize); err != nil {
+				s.log.Error().Err(err).Msg("Failed to retry recurring occurrences")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			s.log.Info().Msg("Recurring invoice scheduler stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/currency"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// Split invoice policies, set per entity
+const (
+	SplitPolicyOff      = "off"      // invoices are not checked when submitted
+	SplitPolicyHold     = "hold"     // flagged invoices are put on a split_invoice hold
+	SplitPolicyEscalate = "escalate" // flagged invoices are routed for approval on the combined total
+)
+
+// defaultSplitWindowDays is the number of days, counting both ends, over
+// which a vendor's invoices are combined for entities without saved settings
+const defaultSplitWindowDays = 7
+
+// Split invoice finding actions
+const (
+	SplitActionHeld      = "held"
+	SplitActionEscalated = "escalated"
+)
+
+// Split invoice finding statuses
+const (
+	SplitFindingOpen      = "open"
+	SplitFindingCleared   = "cleared"   // not a split; the hold or escalation is lifted
+	SplitFindingConfirmed = "confirmed" // a split; the escalation stays, or the hold is lifted for one
+)
+
+// SplitInvoiceService detects purchases split across several invoices from
+// one vendor so that each stays under an approval rule's min_amount and
+// routes to a lower rule than their combined total would
+type SplitInvoiceService struct {
+	splitRepo   *repository.SplitInvoiceRepository
+	rulesRepo   *repository.ApprovalRulesRepository
+	invoiceRepo *repository.InvoiceRepository
+	settings    *EntitySettingsService
+	holds       *HoldService
+	log         *logger.Logger
+}
+
+// NewSplitInvoiceService creates a new split invoice service
+func NewSplitInvoiceService(
+	splitRepo *repository.SplitInvoiceRepository,
+	rulesRepo *repository.ApprovalRulesRepository,
+	invoiceRepo *repository.InvoiceRepository,
+	settings *EntitySettingsService,
+	holds *HoldService,
+	log *logger.Logger,
+) *SplitInvoiceService {
+	return &SplitInvoiceService{
+		splitRepo:   splitRepo,
+		rulesRepo:   rulesRepo,
+		invoiceRepo: invoiceRepo,
+		settings:    settings,
+		holds:       holds,
+		log:         log,
+	}
+}
+
+// ReviewSplitFindingRequest represents a request to review a split invoice
+// finding as cleared or confirmed
+type ReviewSplitFindingRequest struct {
+	FindingID  string `json:"finding_id"`
+	EntityID   string `json:"entity_id"`
+	Decision   string `json:"decision"` // cleared or confirmed
+	Notes      string `json:"notes"`
+	ReviewedBy string `json:"reviewed_by,omitempty"`
+}
+
+// ListFindings returns an entity's split invoice findings matching the
+// filter, newest first
+func (s *SplitInvoiceService) ListFindings(ctx context.Context, entityID string, filter *repository.SplitFindingFilter) ([]*repository.SplitInvoiceFinding, error) {
+	if filter.Status != nil {
+		switch *filter.Status {
+		case SplitFindingOpen, SplitFindingCleared, SplitFindingConfirmed:
+		default:
+			return nil, errors.InvalidInput("status", "status must be open, cleared or confirmed")
+		}
+	}
+	return s.splitRepo.List(ctx, entityID, filter)
+}
+
+// ReviewFinding records the review of an open finding. Clearing it releases
+// the invoice's split_invoice hold, or stops approvals it is submitted for
+// from then on being routed on the combined total. Confirming it keeps an
+// escalation in place; a held finding is switched to escalated and its hold
+// released, so the invoice can be submitted and is routed on the combined
+// total.
+func (s *SplitInvoiceService) ReviewFinding(ctx context.Context, req *ReviewSplitFindingRequest) (*repository.SplitInvoiceFinding, error) {
+	if req.Decision != SplitFindingCleared && req.Decision != SplitFindingConfirmed {
+		return nil, errors.InvalidInput("decision", "decision must be cleared or confirmed")
+	}
+	notes := strings.TrimSpace(req.Notes)
+	if notes == "" {
+		return nil, errors.InvalidInput("notes", "notes are required to review a split invoice finding")
+	}
+
+	finding, err := s.splitRepo.GetByID(ctx, req.FindingID, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if finding.Status != SplitFindingOpen {
+		return nil, errors.New(errors.ErrCodeConflict, "split invoice finding has already been reviewed")
+	}
+
+	// The hold is released in the same transaction as the review, so a
+	// review that fails, e.g. to a concurrent reviewer, leaves it in place
+	var invoice *repository.Invoice
+	var hold *repository.InvoiceHold
+	if finding.Action == SplitActionHeld {
+		invoice, err = s.invoiceRepo.GetByID(ctx, finding.InvoiceID, finding.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		releaseNotes := "Split invoice finding cleared: " + notes
+		if req.Decision == SplitFindingConfirmed {
+			releaseNotes = "Split invoice finding confirmed, approval escalated: " + notes
+			finding.Action = SplitActionEscalated
+		}
+		hold, err = s.holds.openInvoiceHold(ctx, invoice, HoldSplitInvoice)
+		if err != nil {
+			return nil, err
+		}
+		if hold != nil {
+			hold.ReleaseNotes = &releaseNotes
+		}
+	}
+
+	finding.Status = req.Decision
+	finding.ReviewNotes = &notes
+	// Convert empty string to NULL for ReviewedBy
+	if req.ReviewedBy != "" {
+		finding.ReviewedBy = &req.ReviewedBy
+	}
+
+	if err := s.splitRepo.Review(ctx, finding, hold); err != nil {
+		return nil, err
+	}
+	if hold != nil {
+		s.holds.invoiceHoldReleased(ctx, invoice, hold)
+	}
+
+	s.log.Info().
+		Str("finding_id", finding.ID).
+		Str("invoice_id", finding.InvoiceID).
+		Str("decision", finding.Status).
+		Str("action", finding.Action).
+		Str("reviewed_by", req.ReviewedBy).
+		Msg("Split invoice finding reviewed")
+
+	return finding, nil
+}
+
+// screen checks an invoice being submitted for approval under the entity's
+// policy. A finding is recorded the first time its total combined with the
+// vendor's other invoices crosses an approval threshold, together with a
+// split_invoice hold on the invoice if the policy is hold, which stops the
+// submission. A held finding not yet reviewed puts the hold back if the
+// invoice is submitted again without it.
+func (s *SplitInvoiceService) screen(ctx context.Context, invoice *repository.Invoice) error {
+	settings, err := s.settings.GetSettings(ctx, invoice.EntityID)
+	if err != nil {
+		return err
+	}
+	if settings.SplitInvoicePolicy == SplitPolicyOff {
+		return nil
+	}
+
+	// An invoice is flagged once; a reviewed finding is not raised again
+	existing, err := s.splitRepo.GetByInvoice(ctx, invoice.ID, invoice.EntityID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.Action == SplitActionHeld && existing.Status == SplitFindingOpen {
+			return s.holds.placeInvoiceHold(ctx, invoice, HoldSplitInvoice, splitHoldReason(existing))
+		}
+		return nil
+	}
+
+	finding, err := s.detect(ctx, invoice, settings.SplitInvoiceWindowDays)
+	if err != nil || finding == nil {
+		return err
+	}
+
+	finding.Action = SplitActionEscalated
+	var hold *repository.InvoiceHold
+	if settings.SplitInvoicePolicy == SplitPolicyHold {
+		finding.Action = SplitActionHeld
+		hold = newInvoiceHold(invoice, HoldSplitInvoice, splitHoldReason(finding))
+	}
+	if err := s.splitRepo.Create(ctx, finding, hold); err != nil {
+		return err
+	}
+
+	s.log.Warn().
+		Str("invoice_id", invoice.ID).
+		Str("invoice_number", invoice.InvoiceNumber).
+		Str("vendor_id", invoice.VendorID).
+		Strs("related_invoices", finding.RelatedInvoiceNumbers).
+		Int64("combined_total", finding.CombinedTotal).
+		Int64("threshold", finding.Threshold).
+		Str("escalated_rule", finding.EscalatedRuleName).
+		Str("action", finding.Action).
+		Msg("Possible split invoice detected")
+
+	if hold != nil {
+		s.holds.invoiceHoldPlaced(ctx, invoice, hold)
+	}
+
+	return nil
+}
+
+// splitHoldReason describes a held finding as the reason for its hold
+func splitHoldReason(finding *repository.SplitInvoiceFinding) string {
+	cur := currency.ForCode(finding.Currency)
+	return fmt.Sprintf("with %s from the same vendor, dated %s to %s, totals %s, over the %s threshold of rule %s",
+		strings.Join(finding.RelatedInvoiceNumbers, ", "),
+		finding.WindowStart.Format("2006-01-02"), finding.WindowEnd.Format("2006-01-02"),
+		cur.Format(finding.CombinedTotal), cur.Format(finding.Threshold), finding.EscalatedRuleName)
+}
+
+// escalation returns the finding approvals of an invoice are routed on
+// instead of its own total: an escalated finding not cleared on review,
+// including a held one confirmed on review.
+// Returns nil (no error) if there is none.
+func (s *SplitInvoiceService) escalation(ctx context.Context, invoice *repository.Invoice) (*repository.SplitInvoiceFinding, error) {
+	finding, err := s.splitRepo.GetByInvoice(ctx, invoice.ID, invoice.EntityID)
+	if err != nil || finding == nil {
+		return nil, err
+	}
+	if finding.Action != SplitActionEscalated || finding.Status == SplitFindingCleared {
+		return nil, nil
+	}
+	return finding, nil
+}
+
+// detect combines an invoice with the same vendor's other submitted
+// invoices in its currency, each under an approval rule's min_amount, over
+// the windowDays containing it that give the highest total. It returns a
+// finding, not yet recorded, for the highest min_amount the combined total
+// reaches if that routes to another rule than the invoice alone, or nil.
+func (s *SplitInvoiceService) detect(ctx context.Context, invoice *repository.Invoice, windowDays int) (*repository.SplitInvoiceFinding, error) {
+	if invoice.InvoiceType == "credit_memo" || invoice.TotalAmount <= 0 {
+		return nil, nil
+	}
+
+	rules, err := s.rulesRepo.List(ctx, invoice.EntityID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Thresholds the invoice alone does not reach, highest first
+	seen := make(map[int64]bool)
+	thresholds := make([]int64, 0)
+	for _, rule := range rules {
+		if rule.RuleType != "amount_based" || rule.MinAmount == nil || *rule.MinAmount <= invoice.TotalAmount || seen[*rule.MinAmount] {
+			continue
+		}
+		seen[*rule.MinAmount] = true
+		thresholds = append(thresholds, *rule.MinAmount)
+	}
+	if len(thresholds) == 0 {
+		return nil, nil
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+
+	span := windowDays - 1
+	members, err := s.splitRepo.ListVendorInvoices(ctx, &repository.SplitInvoiceSearch{
+		EntityID:  invoice.EntityID,
+		ExcludeID: invoice.ID,
+		VendorID:  invoice.VendorID,
+		Currency:  invoice.Currency,
+		DateFrom:  invoice.InvoiceDate.AddDate(0, 0, -span),
+		DateTo:    invoice.InvoiceDate.AddDate(0, 0, span),
+	})
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	// Route as CreateApprovalWorkflow does, on the first line's department
+	var department *string
+	if len(invoice.Lines) > 0 && invoice.Lines[0].Dimension2 != nil {
+		department = invoice.Lines[0].Dimension2
+	}
+	current, err := s.rulesRepo.FindMatchingRule(ctx, invoice.EntityID, invoice.TotalAmount, &invoice.VendorID, department)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, threshold := range thresholds {
+		group, total := splitWindow(invoice, members, threshold, span)
+		if len(group) == 0 || total < threshold {
+			continue
+		}
+
+		escalated, err := s.rulesRepo.FindMatchingRule(ctx, invoice.EntityID, total, &invoice.VendorID, department)
+		if err != nil {
+			return nil, err
+		}
+		if escalated == nil || (current != nil && current.ID == escalated.ID) {
+			continue
+		}
+
+		finding := &repository.SplitInvoiceFinding{
+			EntityID:              invoice.EntityID,
+			InvoiceID:             invoice.ID,
+			InvoiceNumber:         invoice.InvoiceNumber,
+			VendorID:              invoice.VendorID,
+			Currency:              invoice.Currency,
+			RelatedInvoiceIDs:     make([]string, 0, len(group)),
+			RelatedInvoiceNumbers: make([]string, 0, len(group)),
+			CombinedTotal:         total,
+			Threshold:             threshold,
+			EscalatedRuleID:       &escalated.ID,
+			EscalatedRuleName:     escalated.RuleName,
+			WindowStart:           invoice.InvoiceDate,
+			WindowEnd:             invoice.InvoiceDate,
+		}
+		for _, member := range group {
+			finding.RelatedInvoiceIDs = append(finding.RelatedInvoiceIDs, member.InvoiceID)
+			finding.RelatedInvoiceNumbers = append(finding.RelatedInvoiceNumbers, member.InvoiceNumber)
+			if member.InvoiceDate.Before(finding.WindowStart) {
+				finding.WindowStart = member.InvoiceDate
+			}
+			if member.InvoiceDate.After(finding.WindowEnd) {
+				finding.WindowEnd = member.InvoiceDate
+			}
+		}
+		return finding, nil
+	}
+
+	return nil, nil
+}
+
+// splitWindow returns the members under threshold in the window of span+1
+// days containing the invoice's date that gives the highest combined total,
+// and that total including the invoice
+func splitWindow(invoice *repository.Invoice, members []*repository.SplitInvoiceMember, threshold int64, span int) ([]*repository.SplitInvoiceMember, int64) {
+	eligible := make([]*repository.SplitInvoiceMember, 0, len(members))
+	for _, member := range members {
+		if member.TotalAmount > 0 && member.TotalAmount < threshold {
+			eligible = append(eligible, member)
+		}
+	}
+
+	// Each window starts on the invoice's date or a member's date before it
+	starts := []*repository.SplitInvoiceMember{{InvoiceDate: invoice.InvoiceDate}}
+	starts = append(starts, eligible...)
+
+	var best []*repository.SplitInvoiceMember
+	var bestTotal int64
+	for _, start := range starts {
+		from := start.InvoiceDate
+		to := from.AddDate(0, 0, span)
+		if from.After(invoice.InvoiceDate) || to.Before(invoice.InvoiceDate) {
+			continue
+		}
+
+		group := make([]*repository.SplitInvoiceMember, 0, len(eligible))
+		total := invoice.TotalAmount
+		for _, member := range eligible {
+			if !member.InvoiceDate.Before(from) && !member.InvoiceDate.After(to) {
+				group = append(group, member)
+				total += member.TotalAmount
+			}
+		}
+		if total > bestTotal {
+			best, bestTotal = group, total
+		}
+	}
+
+	return best, bestTotal
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+)
+
+// Tax rounding modes, set per entity
+const (
+	TaxRoundingLine    = "line"    // round each line's tax to the minor unit
+	TaxRoundingInvoice = "invoice" // round each tax code's total, then allocate it to lines
+)
+
+// taxableAmount is one line's input to calculateTax
+type taxableAmount struct {
+	amount int64    // net amount, or gross amount when prices include tax
+	rate   *big.Rat // percent
+	group  string   // lines whose tax is rounded together under invoice rounding
+}
+
+// calculateTax returns the tax on each amount, in minor units of the invoice
+// currency. Tax is computed exactly and rounded half away from zero, as line
+// amounts are. Under invoice rounding each group's total tax is rounded once
+// and allocated to its lines by largest remainder, ties going to the earlier
+// line, so the lines always add up to the rounded total.
+func calculateTax(amounts []taxableAmount, pricesIncludeTax bool, rounding string) []int64 {
+	exact := make([]*big.Rat, len(amounts))
+	for i, a := range amounts {
+		exact[i] = exactTax(a.amount, a.rate, pricesIncludeTax)
+	}
+
+	taxes := make([]int64, len(amounts))
+	if rounding != TaxRoundingInvoice {
+		for i := range exact {
+			taxes[i] = decimal.Round(exact[i])
+		}
+		return taxes
+	}
+
+	groups := make(map[string][]int)
+	order := make([]string, 0)
+	for i, a := range amounts {
+		if _, ok := groups[a.group]; !ok {
+			order = append(order, a.group)
+		}
+		groups[a.group] = append(groups[a.group], i)
+	}
+
+	for _, group := range order {
+		allocateRounded(exact, groups[group], taxes)
+	}
+	return taxes
+}
+
+// exactTax returns the unrounded tax on amount at rate percent. For a gross
+// amount the tax is the part of it that is tax: amount * rate / (100 + rate).
+func exactTax(amount int64, rate *big.Rat, pricesIncludeTax bool) *big.Rat {
+	tax := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), rate)
+	if pricesIncludeTax {
+		return tax.Quo(tax, new(big.Rat).Add(big.NewRat(100, 1), rate))
+	}
+	return tax.Quo(tax, big.NewRat(100, 1))
+}
+
+// allocateRounded sets taxes[i] for every i in indexes so that they add up to
+// the rounded sum of exact[i], each differing from exact[i] by less than one minor unit
+func allocateRounded(exact []*big.Rat, indexes []int, taxes []int64) {
+	total := new(big.Rat)
+	for _, i := range indexes {
+		total.Add(total, exact[i])
+	}
+	target := decimal.Round(total)
+
+	type remainder struct {
+		index int
+		value *big.Rat
+	}
+	remainders := make([]remainder, 0, len(indexes))
+
+	var allocated int64
+	for _, i := range indexes {
+		floor := decimal.Floor(exact[i])
+		taxes[i] = floor
+		allocated += floor
+		remainders = append(remainders, remainder{i, new(big.Rat).Sub(exact[i], new(big.Rat).SetInt64(floor))})
+	}
+
+	sort.SliceStable(remainders, func(a, b int) bool {
+		return remainders[a].value.Cmp(remainders[b].value) > 0
+	})
+	for k := 0; int64(k) < target-allocated && k < len(remainders); k++ {
+		taxes[remainders[k].index]++
+	}
+}
@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/decimal"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// TaxService manages per-entity tax codes and their rates, calculates line
+// tax, and decides how much of a line's tax is recoverable input tax and
+// which account it posts to
+type TaxService struct {
+	taxCodeRepo    *repository.TaxCodeRepository
+	settings       *EntitySettingsService
+	accountsClient client.AccountsClientInterface
+	log            *logger.Logger
+}
+
+// NewTaxService creates a new tax service
+func NewTaxService(
+	taxCodeRepo *repository.TaxCodeRepository,
+	settings *EntitySettingsService,
+	accountsClient client.AccountsClientInterface,
+	log *logger.Logger,
+) *TaxService {
+	return &TaxService{
+		taxCodeRepo:    taxCodeRepo,
+		settings:       settings,
+		accountsClient: accountsClient,
+		log:            log,
+	}
+}
+
+// UpsertTaxCodeRequest represents a create or replace tax code request
+type UpsertTaxCodeRequest struct {
+	EntityID           string          `json:"entity_id"`
+	Code               string          `json:"code"`
+	Description        *string         `json:"description,omitempty"`
+	Jurisdiction       *string         `json:"jurisdiction,omitempty"`
+	RecoverablePercent decimal.Decimal `json:"recoverable_percent"`
+	InputTaxAccountID  *string         `json:"input_tax_account_id,omitempty"`
+	IsActive           *bool           `json:"is_active,omitempty"` // defaults to true
+	UpdatedBy          string          `json:"updated_by,omitempty"`
+}
+
+// AddTaxRateRequest represents an add tax rate request
+type AddTaxRateRequest struct {
+	EntityID      string          `json:"entity_id"`
+	Code          string          `json:"code"`
+	Rate          decimal.Decimal `json:"rate"` // percent
+	EffectiveFrom string          `json:"effective_from"`
+	EffectiveTo   *string         `json:"effective_to,omitempty"`
+	CreatedBy     string          `json:"created_by,omitempty"`
+}
+
+// ListTaxCodes returns the tax codes of an entity
+func (s *TaxService) ListTaxCodes(ctx context.Context, entityID string) ([]*repository.TaxCode, error) {
+	return s.taxCodeRepo.List(ctx, entityID)
+}
+
+// UpsertTaxCode creates or replaces a tax code. The input tax account, if
+// set, is validated against GL-1.
+func (s *TaxService) UpsertTaxCode(ctx context.Context, req *UpsertTaxCodeRequest) (*repository.TaxCode, error) {
+	if req.EntityID == "" {
+		return nil, errors.InvalidInput("entity_id", "entity_id is required")
+	}
+	if req.Code == "" || len(req.Code) > 20 {
+		return nil, errors.InvalidInput("code", "code must be 1 to 20 characters")
+	}
+	if !validPercent(req.RecoverablePercent) {
+		return nil, errors.InvalidInput("recoverable_percent", "recoverable percent must be between 0 and 100")
+	}
+
+	if req.InputTaxAccountID != nil && *req.InputTaxAccountID != "" {
+		valid, message, err := s.accountsClient.ValidateAccount(ctx, *req.InputTaxAccountID, req.EntityID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate account %s: %w", *req.InputTaxAccountID, err)
+		}
+		if !valid {
+			return nil, errors.InvalidInput("input_tax_account_id", fmt.Sprintf("account %s: %s", *req.InputTaxAccountID, message))
+		}
+	} else {
+		req.InputTaxAccountID = nil
+	}
+
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	taxCode := &repository.TaxCode{
+		EntityID:           req.EntityID,
+		Code:               req.Code,
+		Description:        req.Description,
+		Jurisdiction:       req.Jurisdiction,
+		RecoverablePercent: req.RecoverablePercent,
+		InputTaxAccountID:  req.InputTaxAccountID,
+		IsActive:           isActive,
+	}
+
+	// Convert empty string to NULL for UpdatedBy
+	if req.UpdatedBy != "" {
+		taxCode.UpdatedBy = &req.UpdatedBy
+	}
+
+	if err := s.taxCodeRepo.Upsert(ctx, taxCode); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("entity_id", req.EntityID).
+		Str("tax_code", req.Code).
+		Str("recoverable_percent", req.RecoverablePercent.String()).
+		Msg("Tax code saved")
+
+	return taxCode, nil
+}
+
+// AddTaxRate adds a dated rate to a tax code. A rate starting after the
+// code's current open-ended rate supersedes it, ending it the day before;
+// any other overlap with an existing rate is rejected.
+func (s *TaxService) AddTaxRate(ctx context.Context, req *AddTaxRateRequest) (*repository.TaxCode, error) {
+	if !validPercent(req.Rate) {
+		return nil, errors.InvalidInput("rate", "rate must be between 0 and 100")
+	}
+
+	effectiveFrom, err := time.Parse("2006-01-02", req.EffectiveFrom)
+	if err != nil {
+		return nil, errors.InvalidInput("effective_from", "invalid date format, expected YYYY-MM-DD")
+	}
+
+	var effectiveTo *time.Time
+	if req.EffectiveTo != nil && *req.EffectiveTo != "" {
+		parsed, err := time.Parse("2006-01-02", *req.EffectiveTo)
+		if err != nil {
+			return nil, errors.InvalidInput("effective_to", "invalid date format, expected YYYY-MM-DD")
+		}
+		if parsed.Before(effectiveFrom) {
+			return nil, errors.InvalidInput("effective_to", "effective_to cannot be before effective_from")
+		}
+		effectiveTo = &parsed
+	}
+
+	taxCode, err := s.taxCodeRepo.GetByCode(ctx, req.EntityID, req.Code)
+	if err != nil {
+		return nil, err
+	}
+	if taxCode == nil {
+		return nil, errors.NotFound("tax_code", req.Code)
+	}
+
+	var superseded *repository.TaxRate
+	for _, existing := range taxCode.Rates {
+		if existing.EffectiveTo == nil && effectiveFrom.After(existing.EffectiveFrom) {
+			superseded = existing
+			continue
+		}
+		if !ratesOverlap(existing.EffectiveFrom, existing.EffectiveTo, effectiveFrom, effectiveTo) {
+			continue
+		}
+		return nil, errors.InvalidInput("effective_from",
+			fmt.Sprintf("rate overlaps the rate of %s%% effective from %s",
+				existing.Rate, existing.EffectiveFrom.Format("2006-01-02")))
+	}
+
+	rate := &repository.TaxRate{
+		TaxCodeID:     taxCode.ID,
+		Rate:          req.Rate,
+		EffectiveFrom: effectiveFrom,
+		EffectiveTo:   effectiveTo,
+	}
+
+	// Convert empty string to NULL for CreatedBy
+	if req.CreatedBy != "" {
+		rate.CreatedBy = &req.CreatedBy
+	}
+
+	// The superseded rate is ended with the new one added
+	var supersededID *string
+	if superseded != nil {
+		supersededID = &superseded.ID
+	}
+
+	if err := s.taxCodeRepo.AddRate(ctx, rate, supersededID); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().
+		Str("entity_id", req.EntityID).
+		Str("tax_code", req.Code).
+		Str("rate", req.Rate.String()).
+		Str("effective_from", req.EffectiveFrom).
+		Msg("Tax rate added")
+
+	return s.taxCodeRepo.GetByCode(ctx, req.EntityID, req.Code)
+}
+
+// ratesOverlap reports whether two date ranges with optional inclusive ends overlap
+func ratesOverlap(fromA time.Time, toA *time.Time, fromB time.Time, toB *time.Time) bool {
+	if toA != nil && toA.Before(fromB) {
+		return false
+	}
+	if toB != nil && toB.Before(fromA) {
+		return false
+	}
+	return true
+}
+
+// CalculateInvoiceTax sets the tax of every invoice line with a tax code
+// from the code's rate effective on the invoice date, rounded as the entity
+// is configured. With PricesIncludeTax the amount entered on such a line is
+// gross and is split into net line amount and tax. Lines without a tax code
+// keep the tax entered on them. If the vendor stated the invoice's tax, the
+// difference from the resulting tax is recorded and flagged when it exceeds
+// the entity's amount tolerance.
+//
+// Lines arrive with stored tax already separated from the net amount, so
+// for a gross amount the line's net and tax are added back together.
+func (s *TaxService) CalculateInvoiceTax(ctx context.Context, invoice *repository.Invoice) error {
+	settings, err := s.settings.GetSettings(ctx, invoice.EntityID)
+	if err != nil {
+		return err
+	}
+
+	taxCodes, err := s.taxCodesByCode(ctx, invoice.EntityID)
+	if err != nil {
+		return err
+	}
+
+	taxed := make([]*repository.InvoiceLine, 0, len(invoice.Lines))
+	amounts := make([]taxableAmount, 0, len(invoice.Lines))
+
+	for _, line := range invoice.Lines {
+		if line.TaxCode == nil || *line.TaxCode == "" {
+			continue
+		}
+
+		taxCode, ok := taxCodes[*line.TaxCode]
+		if !ok {
+			return errors.InvalidInput("tax_code",
+				fmt.Sprintf("line %d: tax code %s not found", line.LineNumber, *line.TaxCode))
+		}
+		rate := taxCode.RateOn(invoice.InvoiceDate)
+		if rate == nil {
+			return errors.InvalidInput("tax_code",
+				fmt.Sprintf("line %d: tax code %s has no rate effective on %s",
+					line.LineNumber, taxCode.Code, invoice.InvoiceDate.Format("2006-01-02")))
+		}
+
+		amount := line.LineAmount
+		if invoice.PricesIncludeTax {
+			amount += line.TaxAmount
+		}
+
+		rateValue := rate.Rate
+		line.TaxRate = &rateValue
+
+		taxed = append(taxed, line)
+		amounts = append(amounts, taxableAmount{
+			amount: amount,
+			rate:   rate.Rate.Rat(),
+			group:  taxCode.Code,
+		})
+	}
+
+	taxes := calculateTax(amounts, invoice.PricesIncludeTax, settings.TaxRounding)
+	for i, line := range taxed {
+		if invoice.PricesIncludeTax {
+			line.LineAmount = amounts[i].amount - taxes[i]
+		}
+		line.TaxAmount = taxes[i]
+	}
+
+	// Compare with the tax stated by the vendor
+	invoice.TaxDiscrepancy = nil
+	invoice.TaxFlagged = false
+	if invoice.VendorTaxAmount != nil {
+		var taxAmount int64
+		for _, line := range invoice.Lines {
+			taxAmount += line.TaxAmount
+		}
+
+		discrepancy := taxAmount - *invoice.VendorTaxAmount
+		invoice.TaxDiscrepancy = &discrepancy
+		invoice.TaxFlagged = discrepancy > settings.AmountTolerance || -discrepancy > settings.AmountTolerance
+
+		if invoice.TaxFlagged {
+			s.log.Warn().
+				Str("invoice_number", invoice.InvoiceNumber).
+				Str("entity_id", invoice.EntityID).
+				Int64("tax_amount", taxAmount).
+				Int64("vendor_tax_amount", *invoice.VendorTaxAmount).
+				Int64("tax_discrepancy", discrepancy).
+				Msg("Invoice tax differs from vendor-stated tax")
+		}
+	}
+
+	return nil
+}
+
+// ValidateTaxCode checks that code is an active tax code of the entity
+func (s *TaxService) ValidateTaxCode(ctx context.Context, entityID, code string) error {
+	taxCode, err := s.taxCodeRepo.GetByCode(ctx, entityID, code)
+	if err != nil {
+		return err
+	}
+	if taxCode == nil {
+		return errors.InvalidInput("tax_code", fmt.Sprintf("tax code %s not found", code))
+	}
+	if !taxCode.IsActive {
+		return errors.InvalidInput("tax_code", fmt.Sprintf("tax code %s is inactive", code))
+	}
+	return nil
+}
+
+// taxCodesByCode returns the tax codes of an entity keyed by code
+func (s *TaxService) taxCodesByCode(ctx context.Context, entityID string) (map[string]*repository.TaxCode, error) {
+	taxCodes, err := s.taxCodeRepo.List(ctx, entityID)
+	if err != nil {
+		return nil, err
+	}
+
+	byCode := make(map[string]*repository.TaxCode, len(taxCodes))
+	for _, taxCode := range taxCodes {
+		byCode[taxCode.Code] = taxCode
+	}
+	return byCode, nil
+}
+
+// InputTaxAccountID returns the account recoverable tax of a tax code posts
+// to: the code's own input tax account, or the entity's tax receivable account
+func (s *TaxService) InputTaxAccountID(ctx context.Context, taxCode *repository.TaxCode) (string, error) {
+	if taxCode.InputTaxAccountID != nil {
+		return *taxCode.InputTaxAccountID, nil
+	}
+
+	settings, err := s.settings.GetSettings(ctx, taxCode.EntityID)
+	if err != nil {
+		return "", err
+	}
+	if settings.TaxReceivableAccountID == nil {
+		return "", errors.InvalidInput("tax_code",
+			fmt.Sprintf("tax code %s is recoverable but has no input tax account and no tax receivable account is configured", taxCode.Code))
+	}
+	return *settings.TaxReceivableAccountID, nil
+}
+
+// recoverableTax returns the recoverable share of taxAmount, rounded half
+// away from zero to the minor unit
+func recoverableTax(taxAmount int64, recoverablePercent decimal.Decimal) int64 {
+	return decimal.PercentOf(taxAmount, recoverablePercent)
+}
+
+// validPercent reports whether percent is between 0 and 100
+func validPercent(percent decimal.Decimal) bool {
+	return percent.Sign() >= 0 && percent.Cmp(decimal.FromInt(100)) <= 0
+}
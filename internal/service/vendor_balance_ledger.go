@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pesio-ai/be-lib-common/errors"
+	"github.com/pesio-ai/be-lib-common/logger"
+	"github.com/pesio-ai/be-ap-invoices/internal/client"
+	"github.com/pesio-ai/be-ap-invoices/internal/repository"
+)
+
+// balanceUpdateStaleAfter is how long a reservation that was never marked
+// applied blocks a retry, as journalRequestStaleAfter does for journals
+const balanceUpdateStaleAfter = 5 * time.Minute
+
+// VendorBalanceLedger applies AP-1 vendor balance changes at most once per
+// idempotency key. AP-1 takes a bare amount, so a change retried after it
+// was applied would otherwise move the balance twice; the key is recorded
+// locally first and a repeated change already applied is skipped.
+type VendorBalanceLedger struct {
+	vendors client.VendorsClientInterface
+	updates *repository.VendorBalanceUpdateRepository
+	log     *logger.Logger
+}
+
+// NewVendorBalanceLedger creates a vendor balance ledger
+func NewVendorBalanceLedger(vendors client.VendorsClientInterface, updates *repository.VendorBalanceUpdateRepository, log *logger.Logger) *VendorBalanceLedger {
+	return &VendorBalanceLedger{
+		vendors: vendors,
+		updates: updates,
+		log:     log,
+	}
+}
+
+// Apply changes the vendor's balance by amount unless the change recorded
+// under key has already been applied
+func (l *VendorBalanceLedger) Apply(ctx context.Context, key, vendorID, entityID string, amount int64) error {
+	update, reserved, err := l.updates.Reserve(ctx, entityID, key, vendorID, amount, balanceUpdateStaleAfter)
+	if err != nil {
+		return err
+	}
+
+	if !reserved {
+		if update.AppliedAt == nil {
+			return errors.Wrap(errRequestInProgress, errors.ErrCodeConflict,
+				fmt.Sprintf("vendor balance update '%s' is already in progress", key))
+		}
+
+		l.log.Info().
+			Str("idempotency_key", key).
+			Str("vendor_id", vendorID).
+			Msg("Vendor balance update already applied")
+		return nil
+	}
+
+	if err := l.vendors.UpdateBalance(ctx, vendorID, entityID, amount); err != nil {
+		return err
+	}
+
+	if err := l.updates.MarkApplied(ctx, update.ID); err != nil {
+		// AP-1 has applied the change but it is not recorded; a retry after
+		// the stale window would apply it again, so make this visible
+		l.log.Error().
+			Err(err).
+			Str("idempotency_key", key).
+			Str("vendor_id", vendorID).
+			Int64("amount", amount).
+			Msg("Applied vendor balance update could not be recorded")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+-- ============================================================
+-- Migration 003: Draft invoice updates
+-- ============================================================
+-- Draft invoices can now have lines added, modified and removed in
+-- place. The original totals trigger only read NEW.invoice_id, which is
+-- NULL on DELETE, so removing a line left the header totals stale.
+
+CREATE OR REPLACE FUNCTION update_invoice_totals()
+RETURNS TRIGGER AS $$
+DECLARE
+    v_invoice_id UUID;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        v_invoice_id := OLD.invoice_id;
+    ELSE
+        v_invoice_id := NEW.invoice_id;
+    END IF;
+
+    UPDATE invoices
+    SET
+        subtotal = (
+            SELECT COALESCE(SUM(line_amount), 0)
+            FROM invoice_lines
+            WHERE invoice_id = v_invoice_id
+        ),
+        tax_amount = (
+            SELECT COALESCE(SUM(tax_amount), 0)
+            FROM invoice_lines
+            WHERE invoice_id = v_invoice_id
+        ),
+        total_amount = (
+            SELECT COALESCE(SUM(line_amount + tax_amount), 0)
+            FROM invoice_lines
+            WHERE invoice_id = v_invoice_id
+        ),
+        updated_at = NOW()
+    WHERE id = v_invoice_id;
+
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,14 @@
+-- ============================================================
+-- Migration 004: Optimistic concurrency on invoices
+-- ============================================================
+-- Every mutating write to an invoice header checks the version the
+-- caller last read and bumps it, so concurrent edits and status changes
+-- fail with a conflict instead of silently overwriting each other.
+--
+-- The repository bumps the version explicitly. The line totals trigger
+-- deliberately does not, otherwise a single update touching N lines
+-- would advance the version N+1 times.
+
+ALTER TABLE invoices ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+
+COMMENT ON COLUMN invoices.version IS 'Optimistic concurrency token, incremented on every header write';
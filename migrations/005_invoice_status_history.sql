@@ -0,0 +1,117 @@
+-- ============================================================
+-- Migration 005: Invoice state machine and status history
+-- ============================================================
+-- Declares the allowed invoice status transitions, rejects any other
+-- status change at the database level (including the one made by the
+-- payment trigger), and records every transition with its actor.
+--
+-- invoice_status_transitions mirrors invoiceEvents in
+-- internal/service/invoice_state_machine.go; keep the two in sync.
+
+-- ── Allowed Transitions ───────────────────────────────────────
+
+CREATE TABLE invoice_status_transitions (
+    from_status invoice_status NOT NULL,
+    to_status   invoice_status NOT NULL,
+    event       VARCHAR(50) NOT NULL,
+
+    PRIMARY KEY (from_status, to_status)
+);
+
+INSERT INTO invoice_status_transitions (from_status, to_status, event) VALUES
+    ('draft',            'pending_approval', 'submit'),
+    ('pending_approval', 'approved',         'approve'),
+    ('pending_approval', 'draft',            'reject'),
+    ('approved',         'posted',           'post'),
+    ('posted',           'paid',             'pay');
+
+-- ── Status History ────────────────────────────────────────────
+-- Append-only; one row per status change.
+
+CREATE TABLE invoice_status_history (
+    id          UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    invoice_id  UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    entity_id   UUID NOT NULL,
+
+    from_status invoice_status NOT NULL,
+    to_status   invoice_status NOT NULL,
+    event       VARCHAR(50) NOT NULL,
+
+    changed_by  UUID,               -- user_id; NULL for system changes
+    changed_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    reason      TEXT
+);
+
+CREATE INDEX idx_status_history_invoice_id ON invoice_status_history(invoice_id, changed_at);
+CREATE INDEX idx_status_history_entity_id  ON invoice_status_history(entity_id);
+
+-- ── Transition Guard ──────────────────────────────────────────
+
+CREATE OR REPLACE FUNCTION guard_invoice_status_transition()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.status IS DISTINCT FROM OLD.status AND NOT EXISTS (
+        SELECT 1
+        FROM invoice_status_transitions
+        WHERE from_status = OLD.status AND to_status = NEW.status
+    ) THEN
+        RAISE EXCEPTION 'invalid invoice status transition from % to %', OLD.status, NEW.status
+            USING ERRCODE = 'check_violation';
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trigger_guard_invoice_status_transition
+BEFORE UPDATE OF status ON invoices
+FOR EACH ROW
+EXECUTE FUNCTION guard_invoice_status_transition();
+
+-- ── Payment Trigger ───────────────────────────────────────────
+-- Only a posted invoice moves to paid, and the move is recorded in the
+-- history against the user who recorded the payment.
+
+CREATE OR REPLACE FUNCTION update_invoice_payment_status()
+RETURNS TRIGGER AS $$
+DECLARE
+    v_total_paid BIGINT;
+    v_total_amount BIGINT;
+    v_status invoice_status;
+    v_entity_id UUID;
+BEGIN
+    -- Calculate total paid
+    SELECT COALESCE(SUM(payment_amount), 0)
+    INTO v_total_paid
+    FROM invoice_payments
+    WHERE invoice_id = NEW.invoice_id;
+
+    -- Get invoice total and current status
+    SELECT total_amount, status, entity_id
+    INTO v_total_amount, v_status, v_entity_id
+    FROM invoices
+    WHERE id = NEW.invoice_id;
+
+    UPDATE invoices
+    SET amount_paid = v_total_paid,
+        updated_at = NOW()
+    WHERE id = NEW.invoice_id;
+
+    IF v_total_paid >= v_total_amount AND v_status = 'posted' THEN
+        UPDATE invoices
+        SET status = 'paid'::invoice_status
+        WHERE id = NEW.invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (NEW.invoice_id, v_entity_id, v_status, 'paid', 'pay', NEW.created_by,
+             'Invoice fully paid');
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON TABLE invoice_status_transitions IS 'Allowed invoice status transitions, enforced by trigger';
+COMMENT ON TABLE invoice_status_history IS 'Append-only log of invoice status changes with actor and reason';
@@ -0,0 +1,100 @@
+-- ============================================================
+-- Migration 006: Cancel and void invoices and payments
+-- ============================================================
+-- Draft and approved invoices can be cancelled outright. Posted invoices
+-- are voided: a reversing journal is posted to GL-2 and the invoice moves
+-- to cancelled. A posted invoice with payments cannot be voided until its
+-- payments are voided, which reverses each payment journal and, for a
+-- paid invoice, returns it to posted.
+
+-- ── Invoice Cancellation ──────────────────────────────────────
+
+ALTER TABLE invoices
+    ADD COLUMN cancelled_by        UUID,
+    ADD COLUMN cancelled_at        TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN cancel_reason       TEXT,
+    ADD COLUMN reversal_journal_id UUID;  -- Reversing journal in GL-2 (voided invoices only)
+
+-- ── Payment Voids ─────────────────────────────────────────────
+
+ALTER TABLE invoice_payments
+    ADD COLUMN gl_journal_id       UUID,  -- Payment journal in GL-2
+    ADD COLUMN voided_at           TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN voided_by           UUID,
+    ADD COLUMN void_reason         TEXT,
+    ADD COLUMN reversal_journal_id UUID;
+
+CREATE INDEX idx_invoice_payments_active ON invoice_payments(invoice_id) WHERE voided_at IS NULL;
+
+-- ── Transitions ───────────────────────────────────────────────
+
+INSERT INTO invoice_status_transitions (from_status, to_status, event) VALUES
+    ('draft',    'cancelled', 'cancel'),
+    ('approved', 'cancelled', 'cancel'),
+    ('posted',   'cancelled', 'void'),
+    ('paid',     'posted',    'void_payment');
+
+-- ── Payment Trigger ───────────────────────────────────────────
+-- Voided payments no longer count towards amount_paid. Voiding a payment
+-- on a paid invoice returns it to posted.
+
+CREATE OR REPLACE FUNCTION update_invoice_payment_status()
+RETURNS TRIGGER AS $$
+DECLARE
+    v_total_paid BIGINT;
+    v_total_amount BIGINT;
+    v_status invoice_status;
+    v_entity_id UUID;
+BEGIN
+    -- Calculate total paid, excluding voided payments
+    SELECT COALESCE(SUM(payment_amount), 0)
+    INTO v_total_paid
+    FROM invoice_payments
+    WHERE invoice_id = NEW.invoice_id AND voided_at IS NULL;
+
+    -- Get invoice total and current status
+    SELECT total_amount, status, entity_id
+    INTO v_total_amount, v_status, v_entity_id
+    FROM invoices
+    WHERE id = NEW.invoice_id;
+
+    UPDATE invoices
+    SET amount_paid = v_total_paid,
+        updated_at = NOW()
+    WHERE id = NEW.invoice_id;
+
+    IF v_total_paid >= v_total_amount AND v_status = 'posted' THEN
+        UPDATE invoices
+        SET status = 'paid'::invoice_status
+        WHERE id = NEW.invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (NEW.invoice_id, v_entity_id, v_status, 'paid', 'pay', NEW.created_by,
+             'Invoice fully paid');
+    ELSIF v_total_paid < v_total_amount AND v_status = 'paid' THEN
+        UPDATE invoices
+        SET status = 'posted'::invoice_status
+        WHERE id = NEW.invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (NEW.invoice_id, v_entity_id, v_status, 'posted', 'void_payment', NEW.voided_by,
+             NEW.void_reason);
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER trigger_update_invoice_payment_status ON invoice_payments;
+
+CREATE TRIGGER trigger_update_invoice_payment_status
+AFTER INSERT OR UPDATE OF voided_at ON invoice_payments
+FOR EACH ROW
+EXECUTE FUNCTION update_invoice_payment_status();
+
+COMMENT ON COLUMN invoices.reversal_journal_id IS 'GL-2 journal reversing the posting of a voided invoice';
+COMMENT ON COLUMN invoice_payments.voided_at IS 'Set when the payment is voided; voided payments are excluded from amount_paid';
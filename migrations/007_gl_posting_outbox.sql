@@ -0,0 +1,80 @@
+-- ============================================================
+-- Migration 007: Transactional outbox for GL posting
+-- ============================================================
+-- Posting an invoice used to call GL-2 and AP-1 inline and then mark the
+-- invoice posted, so a failure part way left the ledger and the invoice
+-- disagreeing. Posting is now a saga: the status change to posted and an
+-- outbox row are written in one transaction, and a dispatcher drives each
+-- downstream step (create journal, post journal, update vendor balance,
+-- finalize) with retries. If a step keeps failing, completed steps are
+-- compensated and the invoice returns to approved.
+
+CREATE TYPE gl_posting_status AS ENUM ('pending', 'posted', 'failed');
+
+CREATE TYPE posting_outbox_status AS ENUM (
+    'pending',
+    'compensating',
+    'completed',
+    'failed'
+);
+
+-- ── Invoice Posting State ─────────────────────────────────────
+
+ALTER TABLE invoices ADD COLUMN gl_posting_status gl_posting_status;
+
+UPDATE invoices SET gl_posting_status = 'posted' WHERE posted_to_gl = TRUE;
+
+-- ── Posting Outbox ────────────────────────────────────────────
+-- One row per posting attempt. step is the next step to run; the flags
+-- record which side effects have been applied so retries and
+-- compensation never repeat or miss one.
+
+CREATE TABLE invoice_posting_outbox (
+    id          UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    invoice_id  UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    entity_id   UUID NOT NULL,
+
+    status      posting_outbox_status NOT NULL DEFAULT 'pending',
+    step        VARCHAR(50) NOT NULL DEFAULT 'create_journal',
+
+    -- Progress
+    journal_id              UUID,       -- GL-2 journal, once created
+    journal_posted          BOOLEAN NOT NULL DEFAULT FALSE,
+    vendor_balance_applied  BOOLEAN NOT NULL DEFAULT FALSE,
+    reversal_journal_id     UUID,       -- set when compensation reverses the journal
+
+    -- Retry control
+    attempts        INT NOT NULL DEFAULT 0,
+    max_attempts    INT NOT NULL DEFAULT 8,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until    TIMESTAMP WITH TIME ZONE,   -- lease held by the processing dispatcher
+    last_error      TEXT,
+
+    posted_by       UUID,
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    completed_at    TIMESTAMP WITH TIME ZONE,
+
+    CONSTRAINT posting_outbox_attempts_check CHECK (attempts >= 0)
+);
+
+-- At most one unfinished posting per invoice
+CREATE UNIQUE INDEX idx_posting_outbox_invoice_open
+    ON invoice_posting_outbox(invoice_id)
+    WHERE status IN ('pending', 'compensating');
+
+CREATE INDEX idx_posting_outbox_due
+    ON invoice_posting_outbox(next_attempt_at)
+    WHERE status IN ('pending', 'compensating');
+
+CREATE TRIGGER trigger_posting_outbox_updated_at
+BEFORE UPDATE ON invoice_posting_outbox
+FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- ── Transitions ───────────────────────────────────────────────
+
+INSERT INTO invoice_status_transitions (from_status, to_status, event) VALUES
+    ('posted', 'approved', 'post_failed');
+
+COMMENT ON TABLE invoice_posting_outbox IS 'GL posting saga state, written with the posted status change and driven by the posting dispatcher';
+COMMENT ON COLUMN invoices.gl_posting_status IS 'pending while the posting saga runs, posted once GL-2 and AP-1 are updated, failed after compensation';
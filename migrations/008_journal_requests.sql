@@ -0,0 +1,45 @@
+-- ============================================================
+-- Migration 008: Idempotent GL journal requests
+-- ============================================================
+-- Every journal this service asks GL-2 to create is recorded under an
+-- idempotency key derived from what it posts (an invoice posting, a
+-- payment, a reversal). A retried request finds the recorded journal and
+-- reuses it instead of creating a second one, and a journal already
+-- posted is not posted again.
+--
+-- Payments additionally accept a client idempotency key so a retried
+-- record-payment call returns the original payment rather than adding one.
+
+-- ── Journal Requests ──────────────────────────────────────────
+
+CREATE TABLE journal_requests (
+    id              UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id       UUID NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    journal_number  VARCHAR(100) NOT NULL,
+
+    journal_id      UUID,                       -- GL-2 journal, once created
+    posted_at       TIMESTAMP WITH TIME ZONE,   -- set once GL-2 has posted it
+
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT journal_requests_key_unique UNIQUE (entity_id, idempotency_key)
+);
+
+CREATE INDEX idx_journal_requests_journal_id ON journal_requests(journal_id) WHERE journal_id IS NOT NULL;
+
+CREATE TRIGGER trigger_journal_requests_updated_at
+BEFORE UPDATE ON journal_requests
+FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- ── Payment Idempotency ───────────────────────────────────────
+
+ALTER TABLE invoice_payments ADD COLUMN idempotency_key VARCHAR(255);
+
+CREATE UNIQUE INDEX idx_invoice_payments_idempotency_key
+    ON invoice_payments(invoice_id, idempotency_key)
+    WHERE idempotency_key IS NOT NULL;
+
+COMMENT ON TABLE journal_requests IS 'GL-2 journals requested by this service, keyed for idempotent retries';
+COMMENT ON COLUMN invoice_payments.idempotency_key IS 'Client-supplied key; a repeated record-payment call with the same key returns the original payment';
@@ -0,0 +1,44 @@
+-- ============================================================
+-- Migration 009: Per-entity AP configuration
+-- ============================================================
+-- Control accounts and defaults used when posting to GL-2, configured per
+-- entity instead of hard-coded. Account columns hold GL-1 account IDs and
+-- are validated against GL-1 when the settings are saved. An entity with
+-- no row, or with an account left NULL, falls back to the chart-of-accounts
+-- codes the service used before (2000 Accounts Payable, 1010 Cash) where a
+-- fallback exists.
+
+CREATE TABLE ap_entity_settings (
+    entity_id UUID PRIMARY KEY,
+
+    -- Control Accounts (GL-1 account IDs)
+    ap_control_account_id       UUID,
+    default_cash_account_id     UUID,
+    tax_payable_account_id      UUID,
+    tax_receivable_account_id   UUID,
+    rounding_account_id         UUID,
+
+    -- Defaults
+    default_payment_terms VARCHAR(50) NOT NULL DEFAULT 'net30',
+
+    -- Tolerances for matching invoices against expected amounts
+    amount_tolerance  BIGINT NOT NULL DEFAULT 0,            -- cents
+    percent_tolerance NUMERIC(5, 2) NOT NULL DEFAULT 0,     -- percent of expected amount
+
+    -- Audit fields
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_by UUID,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_entity_settings_amount_tolerance_check CHECK (amount_tolerance >= 0),
+    CONSTRAINT ap_entity_settings_percent_tolerance_check CHECK (percent_tolerance >= 0 AND percent_tolerance <= 100)
+);
+
+CREATE TRIGGER trigger_ap_entity_settings_updated_at
+BEFORE UPDATE ON ap_entity_settings
+FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE ap_entity_settings IS 'Per-entity AP control accounts, defaults and tolerances';
+COMMENT ON COLUMN ap_entity_settings.ap_control_account_id IS 'Accounts Payable control account credited when invoices post and debited when they are paid';
+COMMENT ON COLUMN ap_entity_settings.default_cash_account_id IS 'Cash/bank account payments are made from: credited, against the AP control account, when a payment is recorded';
@@ -0,0 +1,36 @@
+-- ============================================================
+-- Migration 010: GL dates and period-aware posting
+-- ============================================================
+-- Invoices and payments carry an accounting (GL) date separate from the
+-- document date. The GL date and the accounting period it falls in are
+-- fixed when the invoice or payment posts, after checking the period is
+-- open. Postings into a closed period are rejected or rolled forward into
+-- the next open period, per entity.
+
+-- ── Invoices ──────────────────────────────────────────────────
+
+ALTER TABLE invoices
+    ADD COLUMN gl_date      DATE,           -- Requested until posted, then the journal date
+    ADD COLUMN gl_period_id VARCHAR(100);   -- Accounting period posted into
+
+-- Invoices already posted were journaled on their invoice date
+UPDATE invoices SET gl_date = invoice_date WHERE posted_to_gl = TRUE;
+
+-- ── Payments ──────────────────────────────────────────────────
+
+ALTER TABLE invoice_payments
+    ADD COLUMN gl_date      DATE,
+    ADD COLUMN gl_period_id VARCHAR(100);
+
+UPDATE invoice_payments SET gl_date = payment_date;
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN closed_period_policy VARCHAR(20) NOT NULL DEFAULT 'reject',
+    ADD CONSTRAINT ap_entity_settings_closed_period_policy_check
+        CHECK (closed_period_policy IN ('reject', 'roll_forward'));
+
+COMMENT ON COLUMN invoices.gl_date IS 'Accounting date; defaults to invoice_date and is fixed when the invoice posts';
+COMMENT ON COLUMN invoice_payments.gl_date IS 'Accounting date; defaults to payment_date';
+COMMENT ON COLUMN ap_entity_settings.closed_period_policy IS 'reject: refuse postings into closed periods; roll_forward: post on the first day of the next open period';
@@ -0,0 +1,38 @@
+-- ============================================================
+-- Migration 011: Tax codes and recoverable input tax
+-- ============================================================
+-- Tax codes are configured per entity and drive how line tax is journaled.
+-- The recoverable share of a line's tax (VAT/GST that can be reclaimed) is
+-- debited to an input tax account in one summary line per tax code; the
+-- rest is capitalized into the line's expense account. Lines without a tax
+-- code keep their whole tax in expense, as before.
+
+CREATE TABLE ap_tax_codes (
+    id          UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id   UUID NOT NULL,
+    code        VARCHAR(20) NOT NULL,
+    description TEXT,
+
+    -- Recoverability
+    recoverable_percent  NUMERIC(5, 2) NOT NULL DEFAULT 0,   -- share of tax posted to input tax
+    input_tax_account_id UUID,                               -- GL-1 account; entity tax receivable account if NULL
+
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+
+    -- Audit fields
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_by UUID,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_tax_codes_code_unique UNIQUE (entity_id, code),
+    CONSTRAINT ap_tax_codes_recoverable_percent_check CHECK (recoverable_percent >= 0 AND recoverable_percent <= 100)
+);
+
+CREATE TRIGGER trigger_ap_tax_codes_updated_at
+BEFORE UPDATE ON ap_tax_codes
+FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE ap_tax_codes IS 'Per-entity tax codes referenced by invoice_lines.tax_code';
+COMMENT ON COLUMN ap_tax_codes.recoverable_percent IS 'Percent of line tax that is recoverable and posted to input tax; the rest is expensed';
+COMMENT ON COLUMN ap_tax_codes.input_tax_account_id IS 'Input tax account debited with recoverable tax; falls back to ap_entity_settings.tax_receivable_account_id';
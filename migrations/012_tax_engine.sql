@@ -0,0 +1,55 @@
+-- ============================================================
+-- Migration 012: Tax rates and server-side tax calculation
+-- ============================================================
+-- Tax codes gain a jurisdiction and dated rates. Line tax for lines with a
+-- tax code is calculated by the service from the rate effective on the
+-- invoice date, on tax-exclusive or tax-inclusive prices, rounded per line
+-- or per invoice as the entity is configured. Tax stated by the vendor is
+-- kept on the invoice and compared with the calculated tax.
+
+-- ── Tax Codes ─────────────────────────────────────────────────
+
+ALTER TABLE ap_tax_codes ADD COLUMN jurisdiction VARCHAR(50);
+
+CREATE TABLE ap_tax_rates (
+    id             UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tax_code_id    UUID NOT NULL REFERENCES ap_tax_codes(id) ON DELETE CASCADE,
+    rate           NUMERIC(7, 4) NOT NULL,   -- percent, e.g. 8.8750
+    effective_from DATE NOT NULL,
+    effective_to   DATE,                     -- inclusive; NULL while current
+
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_tax_rates_rate_check CHECK (rate >= 0 AND rate <= 100),
+    CONSTRAINT ap_tax_rates_dates_check CHECK (effective_to IS NULL OR effective_to >= effective_from),
+    CONSTRAINT ap_tax_rates_from_unique UNIQUE (tax_code_id, effective_from)
+);
+
+CREATE INDEX idx_ap_tax_rates_tax_code ON ap_tax_rates(tax_code_id, effective_from);
+
+-- Registry rates carry four decimal places
+ALTER TABLE invoice_lines DROP CONSTRAINT invoice_lines_tax_rate_check;
+ALTER TABLE invoice_lines ALTER COLUMN tax_rate TYPE NUMERIC(7, 4);
+ALTER TABLE invoice_lines ADD CONSTRAINT invoice_lines_tax_rate_check
+    CHECK (tax_rate IS NULL OR (tax_rate >= 0 AND tax_rate <= 100));
+
+-- ── Invoices ──────────────────────────────────────────────────
+
+ALTER TABLE invoices
+    ADD COLUMN prices_include_tax      BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN vendor_tax_amount       BIGINT,                    -- tax stated on the vendor's invoice
+    ADD COLUMN tax_discrepancy         BIGINT,                    -- calculated tax - vendor_tax_amount
+    ADD COLUMN tax_discrepancy_flagged BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN tax_rounding VARCHAR(10) NOT NULL DEFAULT 'line',
+    ADD CONSTRAINT ap_entity_settings_tax_rounding_check
+        CHECK (tax_rounding IN ('line', 'invoice'));
+
+COMMENT ON TABLE ap_tax_rates IS 'Dated rates of a tax code; the rate effective on the invoice date applies';
+COMMENT ON COLUMN invoices.prices_include_tax IS 'Line amounts were entered gross; the service split them into net and tax';
+COMMENT ON COLUMN invoices.tax_discrepancy_flagged IS 'Calculated tax differs from vendor_tax_amount by more than the entity amount tolerance';
+COMMENT ON COLUMN ap_entity_settings.tax_rounding IS 'line: round each line''s tax; invoice: round each tax code''s total and allocate it to lines';
@@ -0,0 +1,13 @@
+-- ============================================================
+-- Migration 013: Server-side line amounts
+-- ============================================================
+-- Line amounts are derived from quantity * unit_price by the service. A
+-- line amount supplied by the caller is accepted only within the entity's
+-- line amount tolerance of the computed amount.
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN line_amount_tolerance BIGINT NOT NULL DEFAULT 0,   -- cents
+    ADD CONSTRAINT ap_entity_settings_line_amount_tolerance_check
+        CHECK (line_amount_tolerance >= 0);
+
+COMMENT ON COLUMN ap_entity_settings.line_amount_tolerance IS 'Largest accepted difference between a supplied line amount and quantity * unit_price, in cents';
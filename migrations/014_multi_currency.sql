@@ -0,0 +1,105 @@
+-- ============================================================
+-- Migration 014: Multi-currency invoices
+-- ============================================================
+-- An entity keeps its ledger in a functional currency. Invoices and
+-- payments in another currency store the exchange rate applied to them and
+-- their amounts converted to the functional currency, and their journals
+-- carry both. Rates come from a local exchange rate table.
+
+-- ── Exchange Rates ────────────────────────────────────────────
+
+CREATE TABLE ap_exchange_rates (
+    id             UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    from_currency  VARCHAR(3) NOT NULL,
+    to_currency    VARCHAR(3) NOT NULL,
+    rate_date      DATE NOT NULL,
+    rate           NUMERIC(20, 10) NOT NULL,   -- units of to_currency per unit of from_currency
+    source         VARCHAR(50),
+
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_exchange_rates_rate_check CHECK (rate > 0),
+    CONSTRAINT ap_exchange_rates_pair_check CHECK (from_currency <> to_currency),
+    CONSTRAINT ap_exchange_rates_unique UNIQUE (from_currency, to_currency, rate_date)
+);
+
+CREATE INDEX idx_ap_exchange_rates_pair ON ap_exchange_rates(from_currency, to_currency, rate_date DESC);
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings ADD COLUMN functional_currency VARCHAR(3);   -- NULL: each invoice's own currency
+
+-- ── Invoices, Lines and Payments ──────────────────────────────
+
+ALTER TABLE invoices
+    ADD COLUMN functional_currency     VARCHAR(3),
+    ADD COLUMN exchange_rate           NUMERIC(20, 10) NOT NULL DEFAULT 1,
+    ADD COLUMN functional_subtotal     BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN functional_tax_amount   BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN functional_total_amount BIGINT NOT NULL DEFAULT 0,
+    ADD CONSTRAINT invoices_exchange_rate_check CHECK (exchange_rate > 0);
+
+ALTER TABLE invoice_lines
+    ADD COLUMN functional_line_amount BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN functional_tax_amount  BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE invoice_payments
+    ADD COLUMN exchange_rate             NUMERIC(20, 10) NOT NULL DEFAULT 1,
+    ADD COLUMN functional_payment_amount BIGINT,
+    ADD CONSTRAINT invoice_payments_exchange_rate_check CHECK (exchange_rate > 0);
+
+-- Existing invoices were posted in their own currency at a rate of 1
+UPDATE invoice_lines
+SET functional_line_amount = line_amount,
+    functional_tax_amount = tax_amount;
+
+UPDATE invoices
+SET functional_currency = currency,
+    functional_subtotal = subtotal,
+    functional_tax_amount = tax_amount,
+    functional_total_amount = total_amount;
+
+UPDATE invoice_payments SET functional_payment_amount = payment_amount;
+
+ALTER TABLE invoices ALTER COLUMN functional_currency SET NOT NULL;
+ALTER TABLE invoice_payments ALTER COLUMN functional_payment_amount SET NOT NULL;
+
+-- Totals trigger maintains the functional totals alongside the transaction totals
+CREATE OR REPLACE FUNCTION update_invoice_totals()
+RETURNS TRIGGER AS $$
+DECLARE
+    v_invoice_id UUID;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        v_invoice_id := OLD.invoice_id;
+    ELSE
+        v_invoice_id := NEW.invoice_id;
+    END IF;
+
+    UPDATE invoices
+    SET (subtotal, tax_amount, total_amount,
+         functional_subtotal, functional_tax_amount, functional_total_amount) = (
+            SELECT COALESCE(SUM(line_amount), 0),
+                   COALESCE(SUM(tax_amount), 0),
+                   COALESCE(SUM(line_amount + tax_amount), 0),
+                   COALESCE(SUM(functional_line_amount), 0),
+                   COALESCE(SUM(functional_tax_amount), 0),
+                   COALESCE(SUM(functional_line_amount + functional_tax_amount), 0)
+            FROM invoice_lines
+            WHERE invoice_id = v_invoice_id
+        ),
+        updated_at = NOW()
+    WHERE id = v_invoice_id;
+
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON TABLE ap_exchange_rates IS 'Local exchange rates; the latest rate on or before a date applies';
+COMMENT ON COLUMN ap_entity_settings.functional_currency IS 'Currency the entity''s ledger is kept in; NULL posts every invoice in its own currency';
+COMMENT ON COLUMN invoices.exchange_rate IS 'Units of functional_currency per unit of currency';
+COMMENT ON COLUMN invoices.functional_total_amount IS 'Sum of the lines'' functional amounts, in minor units of functional_currency';
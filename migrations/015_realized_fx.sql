@@ -0,0 +1,108 @@
+-- ============================================================
+-- Migration 015: Realized FX gain/loss on payments
+-- ============================================================
+-- A foreign-currency invoice's liability is booked at the exchange rate
+-- captured when it is posted, while cash leaves at the rate on the payment
+-- date. Each payment settles its share of the liability at the booked rate
+-- and posts the functional-currency difference to the entity's realized
+-- FX gain or loss account.
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN realized_fx_gain_account_id UUID,
+    ADD COLUMN realized_fx_loss_account_id UUID;
+
+-- ── Invoices ──────────────────────────────────────────────────
+
+ALTER TABLE invoices
+    ADD COLUMN posted_exchange_rate   NUMERIC(20, 10),
+    ADD COLUMN functional_amount_paid BIGINT NOT NULL DEFAULT 0,
+    ADD CONSTRAINT invoices_posted_exchange_rate_check CHECK (posted_exchange_rate > 0);
+
+-- ── Payments ──────────────────────────────────────────────────
+
+ALTER TABLE invoice_payments
+    ADD COLUMN functional_ap_amount  BIGINT,
+    ADD COLUMN realized_fx_gain_loss BIGINT NOT NULL DEFAULT 0;
+
+-- Existing invoices were posted, and paid, at their own exchange rate
+UPDATE invoices
+SET posted_exchange_rate = exchange_rate
+WHERE status IN ('posted', 'paid');
+
+UPDATE invoice_payments SET functional_ap_amount = functional_payment_amount;
+
+ALTER TABLE invoice_payments ALTER COLUMN functional_ap_amount SET NOT NULL;
+
+UPDATE invoices i
+SET functional_amount_paid = p.total
+FROM (
+    SELECT invoice_id, SUM(functional_ap_amount) AS total
+    FROM invoice_payments
+    WHERE voided_at IS NULL
+    GROUP BY invoice_id
+) p
+WHERE i.id = p.invoice_id;
+
+-- Payment trigger maintains the functional liability settled alongside
+-- amount_paid
+CREATE OR REPLACE FUNCTION update_invoice_payment_status()
+RETURNS TRIGGER AS $$
+DECLARE
+    v_total_paid BIGINT;
+    v_functional_paid BIGINT;
+    v_total_amount BIGINT;
+    v_status invoice_status;
+    v_entity_id UUID;
+BEGIN
+    -- Calculate total paid, excluding voided payments
+    SELECT COALESCE(SUM(payment_amount), 0), COALESCE(SUM(functional_ap_amount), 0)
+    INTO v_total_paid, v_functional_paid
+    FROM invoice_payments
+    WHERE invoice_id = NEW.invoice_id AND voided_at IS NULL;
+
+    -- Get invoice total and current status
+    SELECT total_amount, status, entity_id
+    INTO v_total_amount, v_status, v_entity_id
+    FROM invoices
+    WHERE id = NEW.invoice_id;
+
+    UPDATE invoices
+    SET amount_paid = v_total_paid,
+        functional_amount_paid = v_functional_paid,
+        updated_at = NOW()
+    WHERE id = NEW.invoice_id;
+
+    IF v_total_paid >= v_total_amount AND v_status = 'posted' THEN
+        UPDATE invoices
+        SET status = 'paid'::invoice_status
+        WHERE id = NEW.invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (NEW.invoice_id, v_entity_id, v_status, 'paid', 'pay', NEW.created_by,
+             'Invoice fully paid');
+    ELSIF v_total_paid < v_total_amount AND v_status = 'paid' THEN
+        UPDATE invoices
+        SET status = 'posted'::invoice_status
+        WHERE id = NEW.invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (NEW.invoice_id, v_entity_id, v_status, 'posted', 'void_payment', NEW.voided_by,
+             NEW.void_reason);
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON COLUMN ap_entity_settings.realized_fx_gain_account_id IS 'Account credited with realized FX gains on payments';
+COMMENT ON COLUMN ap_entity_settings.realized_fx_loss_account_id IS 'Account debited with realized FX losses on payments';
+COMMENT ON COLUMN invoices.posted_exchange_rate IS 'Exchange rate the liability was booked at when the invoice was posted';
+COMMENT ON COLUMN invoices.functional_amount_paid IS 'Functional liability settled by non-voided payments, at the posted rate';
+COMMENT ON COLUMN invoice_payments.functional_ap_amount IS 'Functional liability settled by the payment, at the invoice''s posted rate';
+COMMENT ON COLUMN invoice_payments.realized_fx_gain_loss IS 'functional_ap_amount - functional_payment_amount; positive is a gain';
@@ -0,0 +1,83 @@
+-- ============================================================
+-- Migration 016: Period-end FX revaluation
+-- ============================================================
+-- At period end the open balance of each posted foreign-currency invoice is
+-- revalued from the rate its liability was booked at to the period-end rate.
+-- The difference is posted as unrealized FX gain/loss in a journal dated the
+-- last day of the period and reversed on the first day of the next, so
+-- payments keep settling the liability at the booked rate. Each run is kept
+-- with its per-invoice detail for audit.
+
+-- ── Period-End Rates ──────────────────────────────────────────
+
+ALTER TABLE ap_exchange_rates
+    ADD COLUMN rate_type VARCHAR(20) NOT NULL DEFAULT 'spot',
+    ADD CONSTRAINT ap_exchange_rates_rate_type_check CHECK (rate_type IN ('spot', 'period_end')),
+    DROP CONSTRAINT ap_exchange_rates_unique,
+    ADD CONSTRAINT ap_exchange_rates_unique UNIQUE (from_currency, to_currency, rate_type, rate_date);
+
+DROP INDEX idx_ap_exchange_rates_pair;
+CREATE INDEX idx_ap_exchange_rates_pair ON ap_exchange_rates(from_currency, to_currency, rate_type, rate_date DESC);
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN unrealized_fx_gain_account_id UUID,
+    ADD COLUMN unrealized_fx_loss_account_id UUID;
+
+-- ── Revaluation Runs ──────────────────────────────────────────
+
+CREATE TABLE ap_fx_revaluation_runs (
+    id                  UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id           UUID NOT NULL,
+    gl_period_id        VARCHAR(100) NOT NULL,
+    period_end          DATE NOT NULL,
+    reversal_date       DATE NOT NULL,
+    functional_currency VARCHAR(3) NOT NULL,
+    status              VARCHAR(20) NOT NULL DEFAULT 'pending',
+
+    invoice_count  INTEGER NOT NULL DEFAULT 0,
+    total_gain     BIGINT NOT NULL DEFAULT 0,   -- minor units of functional_currency
+    total_loss     BIGINT NOT NULL DEFAULT 0,
+
+    gl_journal_id       UUID,
+    reversal_journal_id UUID,
+    error_message       TEXT,
+
+    created_by   UUID,
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE,
+
+    CONSTRAINT ap_fx_revaluation_runs_status_check CHECK (status IN ('pending', 'posted', 'failed'))
+);
+
+-- One live run per entity and period; a failed run may be retried
+CREATE UNIQUE INDEX idx_ap_fx_revaluation_runs_period
+    ON ap_fx_revaluation_runs(entity_id, gl_period_id)
+    WHERE status <> 'failed';
+CREATE INDEX idx_ap_fx_revaluation_runs_entity ON ap_fx_revaluation_runs(entity_id, period_end DESC);
+
+CREATE TABLE ap_fx_revaluation_lines (
+    id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    run_id     UUID NOT NULL REFERENCES ap_fx_revaluation_runs(id) ON DELETE CASCADE,
+    invoice_id UUID NOT NULL REFERENCES invoices(id),
+
+    invoice_number       VARCHAR(100) NOT NULL,
+    currency             VARCHAR(3) NOT NULL,
+    amount_due           BIGINT NOT NULL,            -- minor units of currency
+    booked_rate          NUMERIC(20, 10) NOT NULL,
+    booked_functional    BIGINT NOT NULL,            -- open liability at booked_rate
+    period_end_rate      NUMERIC(20, 10) NOT NULL,
+    revalued_functional  BIGINT NOT NULL,            -- amount_due at period_end_rate
+    adjustment           BIGINT NOT NULL,            -- revalued - booked; positive is a loss
+
+    CONSTRAINT ap_fx_revaluation_lines_unique UNIQUE (run_id, invoice_id)
+);
+
+CREATE INDEX idx_ap_fx_revaluation_lines_invoice ON ap_fx_revaluation_lines(invoice_id);
+
+COMMENT ON COLUMN ap_exchange_rates.rate_type IS 'spot: daily rates for invoices and payments; period_end: closing rates for revaluation';
+COMMENT ON COLUMN ap_entity_settings.unrealized_fx_gain_account_id IS 'Account credited with unrealized FX gains on period-end revaluation';
+COMMENT ON COLUMN ap_entity_settings.unrealized_fx_loss_account_id IS 'Account debited with unrealized FX losses on period-end revaluation';
+COMMENT ON TABLE ap_fx_revaluation_runs IS 'Period-end FX revaluations of open foreign-currency payables';
+COMMENT ON TABLE ap_fx_revaluation_lines IS 'Per-invoice detail of a revaluation run';
@@ -0,0 +1,136 @@
+-- ============================================================
+-- Migration 017: Credit memo application
+-- ============================================================
+-- A posted credit memo reduces what is owed to its vendor. Its balance is
+-- applied to the vendor's open invoices in the same currency: each
+-- application settles part of the invoice and consumes the same amount of
+-- the credit memo, so amount_paid on both documents counts payments and
+-- applied credit alike. When the two documents were booked at different
+-- exchange rates, the functional difference is a realized FX gain or loss.
+
+-- ── Applications ──────────────────────────────────────────────
+
+CREATE TABLE ap_credit_applications (
+    id             UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id      UUID NOT NULL,
+    credit_memo_id UUID NOT NULL REFERENCES invoices(id),
+    invoice_id     UUID NOT NULL REFERENCES invoices(id),
+
+    application_date DATE NOT NULL,
+    amount           BIGINT NOT NULL,       -- minor units of the documents' currency
+
+    functional_invoice_amount BIGINT NOT NULL,            -- invoice liability settled, at its posted rate
+    functional_credit_amount  BIGINT NOT NULL,            -- credit consumed, at the credit memo's posted rate
+    realized_fx_gain_loss     BIGINT NOT NULL DEFAULT 0,  -- invoice - credit; positive is a gain
+
+    gl_date       DATE NOT NULL,
+    gl_period_id  VARCHAR(100) NOT NULL,
+    gl_journal_id UUID,                     -- FX journal in GL-2, only when realized_fx_gain_loss <> 0
+
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_credit_applications_amount_check CHECK (amount > 0),
+    CONSTRAINT ap_credit_applications_documents_check CHECK (credit_memo_id <> invoice_id)
+);
+
+CREATE INDEX idx_ap_credit_applications_credit_memo ON ap_credit_applications(credit_memo_id);
+CREATE INDEX idx_ap_credit_applications_invoice ON ap_credit_applications(invoice_id);
+
+-- ── Settlement ────────────────────────────────────────────────
+-- One function recalculates what has been settled on an invoice, from its
+-- non-voided payments and the credit applied on either side, and moves it
+-- between posted and paid. Both the payment and the application triggers
+-- call it.
+
+CREATE OR REPLACE FUNCTION refresh_invoice_settlement(p_invoice_id UUID, p_actor UUID, p_reason TEXT)
+RETURNS VOID AS $$
+DECLARE
+    v_total_paid BIGINT;
+    v_functional_paid BIGINT;
+    v_total_amount BIGINT;
+    v_status invoice_status;
+    v_entity_id UUID;
+BEGIN
+    SELECT COALESCE(SUM(amount), 0), COALESCE(SUM(functional_amount), 0)
+    INTO v_total_paid, v_functional_paid
+    FROM (
+        SELECT payment_amount AS amount, functional_ap_amount AS functional_amount
+        FROM invoice_payments
+        WHERE invoice_id = p_invoice_id AND voided_at IS NULL
+        UNION ALL
+        SELECT amount, functional_invoice_amount
+        FROM ap_credit_applications
+        WHERE invoice_id = p_invoice_id
+        UNION ALL
+        SELECT amount, functional_credit_amount
+        FROM ap_credit_applications
+        WHERE credit_memo_id = p_invoice_id
+    ) s;
+
+    -- Get invoice total and current status
+    SELECT total_amount, status, entity_id
+    INTO v_total_amount, v_status, v_entity_id
+    FROM invoices
+    WHERE id = p_invoice_id;
+
+    UPDATE invoices
+    SET amount_paid = v_total_paid,
+        functional_amount_paid = v_functional_paid,
+        updated_at = NOW()
+    WHERE id = p_invoice_id;
+
+    IF v_total_paid >= v_total_amount AND v_status = 'posted' THEN
+        UPDATE invoices
+        SET status = 'paid'::invoice_status
+        WHERE id = p_invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (p_invoice_id, v_entity_id, v_status, 'paid', 'pay', p_actor, p_reason);
+    ELSIF v_total_paid < v_total_amount AND v_status = 'paid' THEN
+        UPDATE invoices
+        SET status = 'posted'::invoice_status
+        WHERE id = p_invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (p_invoice_id, v_entity_id, v_status, 'posted', 'void_payment', p_actor, p_reason);
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION update_invoice_payment_status()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.voided_at IS NULL THEN
+        PERFORM refresh_invoice_settlement(NEW.invoice_id, NEW.created_by, 'Invoice fully paid');
+    ELSE
+        PERFORM refresh_invoice_settlement(NEW.invoice_id, NEW.voided_by, NEW.void_reason);
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION update_invoice_credit_status()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM refresh_invoice_settlement(NEW.invoice_id, NEW.created_by, 'Invoice settled by credit memo');
+    PERFORM refresh_invoice_settlement(NEW.credit_memo_id, NEW.created_by, 'Credit memo fully applied');
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trigger_update_invoice_credit_status
+AFTER INSERT ON ap_credit_applications
+FOR EACH ROW
+EXECUTE FUNCTION update_invoice_credit_status();
+
+COMMENT ON TABLE ap_credit_applications IS 'Credit memo balances applied to open invoices of the same vendor and currency';
+COMMENT ON COLUMN ap_credit_applications.realized_fx_gain_loss IS 'functional_invoice_amount - functional_credit_amount; positive is a gain';
+COMMENT ON COLUMN invoices.amount_paid IS 'Settled by non-voided payments and applied credit';
+COMMENT ON COLUMN invoices.functional_amount_paid IS 'Functional amount settled by non-voided payments and applied credit, at the posted rate';
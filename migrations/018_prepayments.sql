@@ -0,0 +1,154 @@
+-- ============================================================
+-- Migration 018: Prepayments
+-- ============================================================
+-- A prepayment invoice bills an advance before the goods or services are
+-- invoiced. It posts to the entity's prepayment (vendor advances) asset
+-- account instead of expense and is paid like any invoice. What has been
+-- paid on it is then applied to the vendor's later standard invoices: each
+-- application settles part of the final invoice and reclassifies as much
+-- of the advance out of the prepayment account, until the prepayment's
+-- remaining balance is used up.
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN prepayment_account_id UUID;
+
+-- ── Invoices ──────────────────────────────────────────────────
+
+ALTER TABLE invoices
+    ADD COLUMN prepayment_applied            BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN functional_prepayment_applied BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN prepayment_balance BIGINT NOT NULL GENERATED ALWAYS AS (
+        CASE WHEN invoice_type = 'prepayment' THEN amount_paid - prepayment_applied ELSE 0 END
+    ) STORED,
+    ADD CONSTRAINT invoices_prepayment_applied_check CHECK (prepayment_applied BETWEEN 0 AND amount_paid);
+
+-- ── Applications ──────────────────────────────────────────────
+
+CREATE TABLE ap_prepayment_applications (
+    id            UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id     UUID NOT NULL,
+    prepayment_id UUID NOT NULL REFERENCES invoices(id),
+    invoice_id    UUID NOT NULL REFERENCES invoices(id),
+
+    application_date DATE NOT NULL,
+    amount           BIGINT NOT NULL,       -- minor units of the documents' currency
+
+    functional_invoice_amount    BIGINT NOT NULL,            -- invoice liability settled, at its posted rate
+    functional_prepayment_amount BIGINT NOT NULL,            -- advance reclassified, at the prepayment's posted rate
+    realized_fx_gain_loss        BIGINT NOT NULL DEFAULT 0,  -- invoice - prepayment; positive is a gain
+
+    gl_date       DATE NOT NULL,
+    gl_period_id  VARCHAR(100) NOT NULL,
+    gl_journal_id UUID,                     -- Reclass journal in GL-2
+
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_prepayment_applications_amount_check CHECK (amount > 0),
+    CONSTRAINT ap_prepayment_applications_documents_check CHECK (prepayment_id <> invoice_id)
+);
+
+CREATE INDEX idx_ap_prepayment_applications_prepayment ON ap_prepayment_applications(prepayment_id);
+CREATE INDEX idx_ap_prepayment_applications_invoice ON ap_prepayment_applications(invoice_id);
+
+-- ── Settlement ────────────────────────────────────────────────
+-- A final invoice counts applied prepayments towards amount_paid alongside
+-- payments and credit. The prepayment's own amount_paid is the cash paid on
+-- it; what it has given up to final invoices is prepayment_applied.
+
+CREATE OR REPLACE FUNCTION refresh_invoice_settlement(p_invoice_id UUID, p_actor UUID, p_reason TEXT)
+RETURNS VOID AS $$
+DECLARE
+    v_total_paid BIGINT;
+    v_functional_paid BIGINT;
+    v_total_amount BIGINT;
+    v_status invoice_status;
+    v_entity_id UUID;
+BEGIN
+    SELECT COALESCE(SUM(amount), 0), COALESCE(SUM(functional_amount), 0)
+    INTO v_total_paid, v_functional_paid
+    FROM (
+        SELECT payment_amount AS amount, functional_ap_amount AS functional_amount
+        FROM invoice_payments
+        WHERE invoice_id = p_invoice_id AND voided_at IS NULL
+        UNION ALL
+        SELECT amount, functional_invoice_amount
+        FROM ap_credit_applications
+        WHERE invoice_id = p_invoice_id
+        UNION ALL
+        SELECT amount, functional_credit_amount
+        FROM ap_credit_applications
+        WHERE credit_memo_id = p_invoice_id
+        UNION ALL
+        SELECT amount, functional_invoice_amount
+        FROM ap_prepayment_applications
+        WHERE invoice_id = p_invoice_id
+    ) s;
+
+    -- Get invoice total and current status
+    SELECT total_amount, status, entity_id
+    INTO v_total_amount, v_status, v_entity_id
+    FROM invoices
+    WHERE id = p_invoice_id;
+
+    UPDATE invoices
+    SET amount_paid = v_total_paid,
+        functional_amount_paid = v_functional_paid,
+        updated_at = NOW()
+    WHERE id = p_invoice_id;
+
+    IF v_total_paid >= v_total_amount AND v_status = 'posted' THEN
+        UPDATE invoices
+        SET status = 'paid'::invoice_status
+        WHERE id = p_invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (p_invoice_id, v_entity_id, v_status, 'paid', 'pay', p_actor, p_reason);
+    ELSIF v_total_paid < v_total_amount AND v_status = 'paid' THEN
+        UPDATE invoices
+        SET status = 'posted'::invoice_status
+        WHERE id = p_invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (p_invoice_id, v_entity_id, v_status, 'posted', 'void_payment', p_actor, p_reason);
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION update_invoice_prepayment_status()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM refresh_invoice_settlement(NEW.invoice_id, NEW.created_by, 'Invoice settled by prepayment');
+
+    UPDATE invoices i
+    SET prepayment_applied = a.total,
+        functional_prepayment_applied = a.functional_total,
+        updated_at = NOW()
+    FROM (
+        SELECT COALESCE(SUM(amount), 0) AS total,
+               COALESCE(SUM(functional_prepayment_amount), 0) AS functional_total
+        FROM ap_prepayment_applications
+        WHERE prepayment_id = NEW.prepayment_id
+    ) a
+    WHERE i.id = NEW.prepayment_id;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trigger_update_invoice_prepayment_status
+AFTER INSERT ON ap_prepayment_applications
+FOR EACH ROW
+EXECUTE FUNCTION update_invoice_prepayment_status();
+
+COMMENT ON COLUMN ap_entity_settings.prepayment_account_id IS 'Asset account prepayment invoices post to and are reclassified out of when applied';
+COMMENT ON COLUMN invoices.prepayment_applied IS 'Prepayments only: paid advance applied to final invoices';
+COMMENT ON COLUMN invoices.prepayment_balance IS 'Prepayments only: paid advance not yet applied (amount_paid - prepayment_applied)';
+COMMENT ON TABLE ap_prepayment_applications IS 'Paid prepayments applied to later standard invoices of the same vendor and currency';
+COMMENT ON COLUMN ap_prepayment_applications.realized_fx_gain_loss IS 'functional_invoice_amount - functional_prepayment_amount; positive is a gain';
@@ -0,0 +1,81 @@
+-- ============================================================
+-- Migration 019: Recurring invoice templates
+-- ============================================================
+-- A recurring template holds everything needed to bill a vendor's regular
+-- charge — rent, subscriptions, service contracts — and the schedule it
+-- repeats on. The scheduler creates a draft invoice of type 'recurring' from
+-- the template on each occurrence, numbered from the template's prefix and
+-- the occurrence date, and optionally submits it for approval. Occurrences
+-- may be skipped one at a time and the whole template paused.
+
+CREATE TABLE ap_recurring_templates (
+    id        UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id UUID NOT NULL,
+    vendor_id UUID NOT NULL,
+    name      VARCHAR(255) NOT NULL,
+
+    -- Generated invoices are numbered <number_prefix>-<YYYYMMDD>
+    number_prefix VARCHAR(50) NOT NULL,
+
+    currency           VARCHAR(3) NOT NULL,
+    payment_terms      VARCHAR(50),            -- defaults to the entity's terms
+    due_days           INTEGER NOT NULL DEFAULT 30,
+    prices_include_tax BOOLEAN NOT NULL DEFAULT false,
+    description        TEXT,
+    notes              TEXT,
+    lines              JSONB NOT NULL,         -- invoice line requests
+
+    -- Schedule
+    frequency       VARCHAR(20) NOT NULL,
+    cron_expression VARCHAR(100),              -- custom frequency only
+    start_date      DATE NOT NULL,
+    end_date        DATE,
+    next_run_date   DATE,                      -- NULL once the schedule has ended
+    last_run_date   DATE,
+    auto_submit     BOOLEAN NOT NULL DEFAULT false,
+    status          VARCHAR(20) NOT NULL DEFAULT 'active',
+
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_by UUID,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_recurring_templates_prefix_unique UNIQUE (entity_id, vendor_id, number_prefix),
+    CONSTRAINT ap_recurring_templates_frequency_check CHECK (frequency IN ('weekly', 'monthly', 'quarterly', 'annually', 'custom')),
+    CONSTRAINT ap_recurring_templates_cron_check CHECK ((frequency = 'custom') = (cron_expression IS NOT NULL)),
+    CONSTRAINT ap_recurring_templates_status_check CHECK (status IN ('active', 'paused', 'ended')),
+    CONSTRAINT ap_recurring_templates_dates_check CHECK (end_date IS NULL OR end_date >= start_date),
+    CONSTRAINT ap_recurring_templates_due_days_check CHECK (due_days >= 0)
+);
+
+CREATE INDEX idx_ap_recurring_templates_entity ON ap_recurring_templates(entity_id, name);
+CREATE INDEX idx_ap_recurring_templates_due ON ap_recurring_templates(next_run_date) WHERE status = 'active';
+
+CREATE TRIGGER trigger_ap_recurring_templates_updated_at
+BEFORE UPDATE ON ap_recurring_templates
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+-- ── Occurrences ───────────────────────────────────────────────
+-- One row per scheduled date, claimed before its invoice is created so an
+-- occurrence is never generated twice
+
+CREATE TABLE ap_recurring_occurrences (
+    id              UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    template_id     UUID NOT NULL REFERENCES ap_recurring_templates(id),
+    entity_id       UUID NOT NULL,
+    occurrence_date DATE NOT NULL,
+    status          VARCHAR(20) NOT NULL,
+    invoice_id      UUID REFERENCES invoices(id) ON DELETE SET NULL,
+    error_message   TEXT,
+    created_by      UUID,
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_recurring_occurrences_unique UNIQUE (template_id, occurrence_date),
+    CONSTRAINT ap_recurring_occurrences_status_check CHECK (status IN ('pending', 'generated', 'skipped', 'failed'))
+);
+
+COMMENT ON TABLE ap_recurring_templates IS 'Templates the scheduler creates recurring draft invoices from';
+COMMENT ON COLUMN ap_recurring_templates.next_run_date IS 'Next occurrence to generate or skip; NULL once past end_date';
+COMMENT ON TABLE ap_recurring_occurrences IS 'Scheduled occurrences of recurring templates and the invoices generated for them';
+COMMENT ON COLUMN ap_recurring_occurrences.status IS 'pending while its invoice is created, then generated, skipped or failed';
@@ -0,0 +1,73 @@
+-- ============================================================
+-- Migration 020: Payment terms catalog
+-- ============================================================
+-- Payment terms are configured per entity under the code invoices carry in
+-- payment_terms. A catalogued code determines the invoice's due date and
+-- early-payment discount, which are derived when not supplied and checked
+-- when they are. Codes not in the catalog remain free text, with the due
+-- date and discount supplied by the client as before.
+--
+--   net          due net_days after the invoice date (NET 30)
+--   eom          due net_days after the end of the invoice month (NET 10 EOM)
+--   day_of_month due on day_of_month of the next month, or the month after
+--                for invoices dated after cutoff_day
+--   installment  due in parts: each installment is a percent of the total
+--                due net_days after the invoice date
+--
+-- Net, EOM and day-of-month terms may offer an early-payment discount of
+-- discount_percent within discount_days of the invoice date, or of the end
+-- of the invoice month for EOM terms (2/10 NET 30).
+
+CREATE TABLE ap_payment_terms (
+    id          UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id   UUID NOT NULL,
+    code        VARCHAR(50) NOT NULL,
+    description TEXT,
+    term_type   VARCHAR(20) NOT NULL,
+
+    net_days     INTEGER NOT NULL DEFAULT 0,
+    day_of_month INTEGER,
+    cutoff_day   INTEGER,
+    installments JSONB,                     -- [{"percent": "50", "net_days": 30}, ...]
+
+    -- Early-payment discount
+    discount_percent NUMERIC(5, 2) NOT NULL DEFAULT 0,
+    discount_days    INTEGER,
+
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+
+    -- Audit fields
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_by UUID,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_payment_terms_code_unique UNIQUE (entity_id, code),
+    CONSTRAINT ap_payment_terms_type_check CHECK (term_type IN ('net', 'eom', 'day_of_month', 'installment')),
+    CONSTRAINT ap_payment_terms_net_days_check CHECK (net_days >= 0),
+    CONSTRAINT ap_payment_terms_day_of_month_check CHECK (
+        (term_type = 'day_of_month') = (day_of_month IS NOT NULL) AND (day_of_month IS NULL OR day_of_month BETWEEN 1 AND 31)
+    ),
+    CONSTRAINT ap_payment_terms_cutoff_day_check CHECK (cutoff_day IS NULL OR cutoff_day BETWEEN 1 AND 31),
+    CONSTRAINT ap_payment_terms_installments_check CHECK ((term_type = 'installment') = (installments IS NOT NULL)),
+    CONSTRAINT ap_payment_terms_discount_check CHECK (
+        (discount_percent = 0 AND discount_days IS NULL)
+        OR (discount_percent > 0 AND discount_percent <= 100 AND discount_days >= 0 AND term_type <> 'installment')
+    )
+);
+
+CREATE TRIGGER trigger_ap_payment_terms_updated_at
+BEFORE UPDATE ON ap_payment_terms
+FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE ap_payment_terms IS 'Per-entity payment terms referenced by invoices.payment_terms';
+COMMENT ON COLUMN ap_payment_terms.net_days IS 'Days from the invoice date (net) or the end of the invoice month (eom) to the due date';
+COMMENT ON COLUMN ap_payment_terms.cutoff_day IS 'Day-of-month terms: invoices dated after this day fall due a month later';
+COMMENT ON COLUMN ap_payment_terms.discount_days IS 'Days within which the early-payment discount applies, counted like net_days';
+
+-- ── Recurring Templates ───────────────────────────────────────
+-- A template on catalogued terms leaves the due date of its invoices to them
+
+ALTER TABLE ap_recurring_templates
+    ALTER COLUMN due_days DROP NOT NULL,
+    ALTER COLUMN due_days DROP DEFAULT;
@@ -0,0 +1,109 @@
+-- ============================================================
+-- Migration 021: Purchase order matching
+-- ============================================================
+-- Invoice lines are matched to the lines of the purchase order named in
+-- po_number before the invoice can be submitted for approval. Two-way
+-- matching compares the quantity and unit price billed with the PO line;
+-- three-way matching also requires the quantity billed to have been
+-- received. Differences within the entity's tolerances match; larger ones
+-- are variances that block submission until the invoice is corrected or a
+-- reviewer accepts them.
+--
+-- Purchase orders belong to procurement. Until it exposes them, the
+-- ap_purchase_orders tables are a local stand-in loaded through this
+-- service's API.
+
+-- ── Entity Policy ─────────────────────────────────────────────
+-- Unit prices match within percent_tolerance of the PO price (migration
+-- 009); quantities within quantity_tolerance of the PO or received quantity.
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN po_match_level     VARCHAR(20) NOT NULL DEFAULT 'two_way',
+    ADD COLUMN quantity_tolerance NUMERIC(5, 2) NOT NULL DEFAULT 0,   -- percent of expected quantity
+    ADD CONSTRAINT ap_entity_settings_po_match_level_check CHECK (po_match_level IN ('two_way', 'three_way')),
+    ADD CONSTRAINT ap_entity_settings_quantity_tolerance_check CHECK (quantity_tolerance >= 0 AND quantity_tolerance <= 100);
+
+-- ── Purchase Orders (stand-in) ────────────────────────────────
+
+CREATE TABLE ap_purchase_orders (
+    id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id  UUID NOT NULL,
+    po_number  VARCHAR(100) NOT NULL,
+    vendor_id  UUID NOT NULL,
+    currency   VARCHAR(3) NOT NULL,
+    status     VARCHAR(20) NOT NULL DEFAULT 'open',
+    order_date DATE NOT NULL,
+
+    -- Audit fields
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_by UUID,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_purchase_orders_number_unique UNIQUE (entity_id, po_number),
+    CONSTRAINT ap_purchase_orders_status_check CHECK (status IN ('open', 'closed', 'cancelled'))
+);
+
+CREATE TABLE ap_purchase_order_lines (
+    id                UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    purchase_order_id UUID NOT NULL REFERENCES ap_purchase_orders(id) ON DELETE CASCADE,
+    line_number       INTEGER NOT NULL,
+    item_code         VARCHAR(100),
+    description       TEXT NOT NULL,
+    quantity          NUMERIC(15, 4) NOT NULL,
+    unit_price        BIGINT NOT NULL,                      -- minor units of the PO currency
+    quantity_received NUMERIC(15, 4) NOT NULL DEFAULT 0,
+
+    CONSTRAINT ap_purchase_order_lines_number_unique UNIQUE (purchase_order_id, line_number),
+    CONSTRAINT ap_purchase_order_lines_quantity_check CHECK (quantity > 0 AND quantity_received >= 0),
+    CONSTRAINT ap_purchase_order_lines_unit_price_check CHECK (unit_price >= 0)
+);
+
+CREATE TRIGGER trigger_ap_purchase_orders_updated_at
+BEFORE UPDATE ON ap_purchase_orders
+FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- ── Match Results ─────────────────────────────────────────────
+-- One row per invoice line from the invoice's latest match. A line billing
+-- an item not on the PO is unmatched; one outside tolerance is a variance
+-- until accepted.
+
+CREATE TABLE ap_invoice_line_matches (
+    id              UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id       UUID NOT NULL,
+    invoice_id      UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    invoice_line_id UUID NOT NULL REFERENCES invoice_lines(id) ON DELETE CASCADE,
+    line_number     INTEGER NOT NULL,
+
+    po_number      VARCHAR(100) NOT NULL,
+    po_line_number INTEGER,                 -- NULL when unmatched
+    match_level    VARCHAR(20) NOT NULL,
+    status         VARCHAR(20) NOT NULL,
+
+    quantity                     NUMERIC(15, 4) NOT NULL,            -- billed on this line
+    unit_price                   BIGINT NOT NULL,
+    po_quantity                  NUMERIC(15, 4),
+    po_unit_price                BIGINT,
+    received_quantity            NUMERIC(15, 4),                     -- three-way only
+    previously_invoiced_quantity NUMERIC(15, 4) NOT NULL DEFAULT 0,  -- on submitted invoices and earlier lines
+    quantity_variance            NUMERIC(15, 4) NOT NULL DEFAULT 0,  -- billed beyond the PO or received quantity
+    price_variance               BIGINT NOT NULL DEFAULT 0,          -- unit_price - po_unit_price
+    reasons                      TEXT[] NOT NULL DEFAULT '{}',
+
+    resolved_by      UUID,
+    resolved_at      TIMESTAMP WITH TIME ZONE,
+    resolution_notes TEXT,
+    matched_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_invoice_line_matches_line_unique UNIQUE (invoice_line_id),
+    CONSTRAINT ap_invoice_line_matches_level_check CHECK (match_level IN ('two_way', 'three_way')),
+    CONSTRAINT ap_invoice_line_matches_status_check CHECK (status IN ('matched', 'variance', 'unmatched', 'accepted'))
+);
+
+CREATE INDEX idx_ap_invoice_line_matches_invoice ON ap_invoice_line_matches(invoice_id, line_number);
+CREATE INDEX idx_ap_invoice_line_matches_po ON ap_invoice_line_matches(entity_id, po_number, po_line_number);
+
+COMMENT ON TABLE ap_purchase_orders IS 'Local stand-in for procurement purchase orders used by PO matching';
+COMMENT ON COLUMN ap_purchase_order_lines.quantity_received IS 'Quantity received against the line, used by three-way matching';
+COMMENT ON TABLE ap_invoice_line_matches IS 'Latest PO match result of each invoice line';
+COMMENT ON COLUMN ap_invoice_line_matches.status IS 'matched, variance or unmatched as matched; accepted once a reviewer accepts the variance';
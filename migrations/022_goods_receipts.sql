@@ -0,0 +1,49 @@
+-- ============================================================
+-- Migration 022: Goods receipts
+-- ============================================================
+-- Goods received against a purchase order are recorded per PO line, and
+-- goods sent back as returns against the receipt they came in on. The net
+-- quantity received on a PO line is its receipts less their returns; three-
+-- way matching uses it in place of the quantity received reported with the
+-- purchase order once any receipt of the PO is recorded here. Received
+-- quantities not yet billed by a submitted invoice are uninvoiced receipts.
+
+CREATE TABLE ap_goods_receipts (
+    id             UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id      UUID NOT NULL,
+    receipt_number VARCHAR(100) NOT NULL,   -- GRN or return note number
+    receipt_type   VARCHAR(20) NOT NULL,
+    po_number      VARCHAR(100) NOT NULL,
+    vendor_id      UUID NOT NULL,
+    receipt_date   DATE NOT NULL,
+    return_of_id   UUID REFERENCES ap_goods_receipts(id),  -- returns only: the receipt returned against
+    notes          TEXT,
+
+    created_by UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_goods_receipts_number_unique UNIQUE (entity_id, receipt_number),
+    CONSTRAINT ap_goods_receipts_type_check CHECK (receipt_type IN ('receipt', 'return')),
+    CONSTRAINT ap_goods_receipts_return_check CHECK ((receipt_type = 'return') = (return_of_id IS NOT NULL))
+);
+
+CREATE TABLE ap_goods_receipt_lines (
+    id             UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    receipt_id     UUID NOT NULL REFERENCES ap_goods_receipts(id) ON DELETE CASCADE,
+    line_number    INTEGER NOT NULL,
+    po_line_number INTEGER NOT NULL,
+    item_code      VARCHAR(100),
+    description    TEXT NOT NULL,
+    quantity       NUMERIC(15, 4) NOT NULL,  -- received, or returned for a return
+
+    CONSTRAINT ap_goods_receipt_lines_number_unique UNIQUE (receipt_id, line_number),
+    CONSTRAINT ap_goods_receipt_lines_quantity_check CHECK (quantity > 0)
+);
+
+CREATE INDEX idx_ap_goods_receipts_po ON ap_goods_receipts(entity_id, po_number, receipt_date);
+CREATE INDEX idx_ap_goods_receipts_vendor ON ap_goods_receipts(entity_id, vendor_id);
+CREATE INDEX idx_ap_goods_receipts_return_of ON ap_goods_receipts(return_of_id);
+CREATE INDEX idx_ap_goods_receipt_lines_receipt ON ap_goods_receipt_lines(receipt_id);
+
+COMMENT ON TABLE ap_goods_receipts IS 'Goods received against purchase orders, and returns of them';
+COMMENT ON COLUMN ap_goods_receipt_lines.quantity IS 'Quantity received, or returned for a return; always positive';
@@ -0,0 +1,45 @@
+-- ============================================================
+-- Migration 023: Invoice holds
+-- ============================================================
+-- A hold stops an invoice from being submitted, approved, posted or paid
+-- without rejecting it, until it is released. Holds are placed on the
+-- invoice or on one of its lines (which holds the whole invoice) with a
+-- hold code and a reason. Manual holds are placed and released by AP users;
+-- one with owner_only set can only be released by its owner. System holds
+-- are placed by PO matching on lines with variances and released by it once
+-- the variance is corrected or accepted.
+
+CREATE TABLE ap_invoice_holds (
+    id              UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id       UUID NOT NULL,
+    invoice_id      UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    invoice_line_id UUID REFERENCES invoice_lines(id) ON DELETE CASCADE,  -- NULL for the whole invoice
+    hold_code       VARCHAR(50) NOT NULL,
+    hold_type       VARCHAR(20) NOT NULL,
+    reason          TEXT NOT NULL,
+    owner_id        UUID,                                   -- responsible for resolving the hold
+    owner_only      BOOLEAN NOT NULL DEFAULT false,         -- only the owner may release
+    status          VARCHAR(20) NOT NULL DEFAULT 'open',
+
+    placed_by     UUID,
+    placed_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    released_by   UUID,
+    released_at   TIMESTAMP WITH TIME ZONE,
+    release_notes TEXT,
+
+    CONSTRAINT ap_invoice_holds_type_check CHECK (hold_type IN ('manual', 'system')),
+    CONSTRAINT ap_invoice_holds_status_check CHECK (status IN ('open', 'released')),
+    CONSTRAINT ap_invoice_holds_owner_check CHECK (NOT owner_only OR owner_id IS NOT NULL),
+    CONSTRAINT ap_invoice_holds_release_check CHECK ((status = 'released') = (released_at IS NOT NULL))
+);
+
+-- One open hold of each code per invoice or line
+CREATE UNIQUE INDEX idx_ap_invoice_holds_open_unique
+    ON ap_invoice_holds(invoice_id, COALESCE(invoice_line_id, '00000000-0000-0000-0000-000000000000'::uuid), hold_code)
+    WHERE status = 'open';
+
+CREATE INDEX idx_ap_invoice_holds_invoice ON ap_invoice_holds(invoice_id, placed_at);
+CREATE INDEX idx_ap_invoice_holds_open ON ap_invoice_holds(entity_id, hold_code, placed_at) WHERE status = 'open';
+
+COMMENT ON TABLE ap_invoice_holds IS 'Holds stopping invoices from being submitted, approved, posted or paid until released';
+COMMENT ON COLUMN ap_invoice_holds.hold_type IS 'manual, placed by AP users; system, placed and released by PO matching';
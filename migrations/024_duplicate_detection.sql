@@ -0,0 +1,60 @@
+-- ============================================================
+-- Migration 024: Duplicate invoice detection
+-- ============================================================
+-- invoices_entity_vendor_number_unique only rejects the exact invoice
+-- number under the same vendor. New invoices are also compared with the
+-- entity's other invoices that share their normalized number, or a similar
+-- amount from the same vendor or around the same date, and scored on
+-- vendor, amount, date and number similarity. Candidates scoring at least
+-- the entity's duplicate_threshold are warned about, or block the invoice
+-- unless the user overrides with a reason, per its duplicate_policy.
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN duplicate_policy    VARCHAR(20) NOT NULL DEFAULT 'warn',
+    ADD COLUMN duplicate_threshold INTEGER NOT NULL DEFAULT 70,   -- score out of 100
+    ADD CONSTRAINT ap_entity_settings_duplicate_policy_check CHECK (duplicate_policy IN ('off', 'warn', 'block')),
+    ADD CONSTRAINT ap_entity_settings_duplicate_threshold_check CHECK (duplicate_threshold BETWEEN 1 AND 100);
+
+-- ── Normalized Invoice Numbers ────────────────────────────────
+-- Upper case, leading zeros dropped from each run of digits, then letters
+-- and digits only: "inv-001", "INV 1" and "INV0001" are all INV1, and
+-- "INV-2024-001" is INV20241. Must agree with normalizeInvoiceNumber in
+-- internal/service/duplicate_service.go.
+
+ALTER TABLE invoices
+    ADD COLUMN normalized_invoice_number VARCHAR(100) GENERATED ALWAYS AS (
+        regexp_replace(regexp_replace(upper(invoice_number), '(^|[^0-9])0+([0-9])', '\1\2', 'g'), '[^A-Z0-9]', '', 'g')
+    ) STORED;
+
+CREATE INDEX idx_invoices_normalized_number ON invoices(entity_id, normalized_invoice_number);
+CREATE INDEX idx_invoices_entity_amount ON invoices(entity_id, currency, total_amount);
+
+-- ── Detected Duplicates ───────────────────────────────────────
+-- Candidates found when an invoice was created: warned about, or
+-- overridden with a reason when the policy would have blocked it.
+
+CREATE TABLE ap_duplicate_candidates (
+    id              UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id       UUID NOT NULL,
+    invoice_id      UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    candidate_id    UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    score           INTEGER NOT NULL,
+    reasons         TEXT[] NOT NULL DEFAULT '{}',
+    action          VARCHAR(20) NOT NULL,
+    override_reason TEXT,
+    overridden_by   UUID,
+    detected_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT ap_duplicate_candidates_unique UNIQUE (invoice_id, candidate_id),
+    CONSTRAINT ap_duplicate_candidates_action_check CHECK (action IN ('warned', 'overridden')),
+    CONSTRAINT ap_duplicate_candidates_override_check CHECK ((action = 'overridden') = (override_reason IS NOT NULL)),
+    CONSTRAINT ap_duplicate_candidates_score_check CHECK (score BETWEEN 0 AND 100)
+);
+
+CREATE INDEX idx_ap_duplicate_candidates_invoice ON ap_duplicate_candidates(invoice_id);
+CREATE INDEX idx_ap_duplicate_candidates_candidate ON ap_duplicate_candidates(candidate_id);
+
+COMMENT ON COLUMN invoices.normalized_invoice_number IS 'Invoice number normalized for duplicate detection';
+COMMENT ON TABLE ap_duplicate_candidates IS 'Possible duplicates found when invoices were created, with overrides';
@@ -0,0 +1,60 @@
+-- ============================================================
+-- Migration 025: Split invoice detection
+-- ============================================================
+-- Approval rules route on an invoice's own total, so a purchase split into
+-- several invoices from the same vendor, each under a rule's min_amount,
+-- avoids the approval that rule requires. When an invoice is submitted for
+-- approval it is combined with the vendor's other submitted invoices in the
+-- same currency dated within the entity's split_invoice_window_days; if
+-- their combined total reaches a min_amount none of them reaches alone, and
+-- would route to another rule, a finding is recorded for review. Per the
+-- entity's split_invoice_policy the invoice is also put on a split_invoice
+-- system hold, or its approval is routed on the combined total.
+
+-- ── Entity Policy ─────────────────────────────────────────────
+
+ALTER TABLE ap_entity_settings
+    ADD COLUMN split_invoice_policy      VARCHAR(20) NOT NULL DEFAULT 'escalate',
+    ADD COLUMN split_invoice_window_days INTEGER NOT NULL DEFAULT 7,
+    ADD CONSTRAINT ap_entity_settings_split_invoice_policy_check CHECK (split_invoice_policy IN ('off', 'hold', 'escalate')),
+    ADD CONSTRAINT ap_entity_settings_split_invoice_window_check CHECK (split_invoice_window_days BETWEEN 1 AND 90);
+
+-- ── Findings ──────────────────────────────────────────────────
+-- At most one per invoice: an invoice resubmitted after its finding was
+-- reviewed is not flagged again.
+
+CREATE TABLE ap_split_invoice_findings (
+    id                  UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id           UUID NOT NULL,
+    invoice_id          UUID NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,  -- the invoice whose submission crossed the threshold
+    vendor_id           UUID NOT NULL,
+    currency            VARCHAR(3) NOT NULL,
+    related_invoice_ids UUID[] NOT NULL,                    -- the vendor's other invoices combined with it
+    combined_total      BIGINT NOT NULL,
+    threshold           BIGINT NOT NULL,                    -- the min_amount crossed
+    escalated_rule_id   UUID REFERENCES invoice_approval_rules(id) ON DELETE SET NULL,
+    escalated_rule_name VARCHAR(255) NOT NULL,              -- kept if the rule is deleted
+    window_start        DATE NOT NULL,
+    window_end          DATE NOT NULL,
+    action              VARCHAR(20) NOT NULL,
+    status              VARCHAR(20) NOT NULL DEFAULT 'open',
+    detected_at         TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    reviewed_by  UUID,
+    reviewed_at  TIMESTAMP WITH TIME ZONE,
+    review_notes TEXT,
+
+    CONSTRAINT ap_split_invoice_findings_invoice_unique UNIQUE (invoice_id),
+    CONSTRAINT ap_split_invoice_findings_action_check CHECK (action IN ('held', 'escalated')),
+    CONSTRAINT ap_split_invoice_findings_status_check CHECK (status IN ('open', 'cleared', 'confirmed')),
+    CONSTRAINT ap_split_invoice_findings_review_check CHECK ((status = 'open') = (reviewed_at IS NULL)),
+    CONSTRAINT ap_split_invoice_findings_window_check CHECK (window_end >= window_start)
+);
+
+CREATE INDEX idx_ap_split_invoice_findings_entity ON ap_split_invoice_findings(entity_id, status, detected_at);
+CREATE INDEX idx_ap_split_invoice_findings_vendor ON ap_split_invoice_findings(entity_id, vendor_id);
+
+COMMENT ON TABLE ap_split_invoice_findings IS 'Invoices whose combined total with the same vendor''s crosses an approval threshold, for review';
+COMMENT ON COLUMN ap_split_invoice_findings.action IS 'held, put on a split_invoice system hold; escalated, approval routed on combined_total';
+COMMENT ON COLUMN ap_split_invoice_findings.status IS 'open until reviewed; cleared releases the hold or escalation, confirmed keeps it';
+COMMENT ON COLUMN ap_invoice_holds.hold_type IS 'manual, placed by AP users; system, placed and released by PO matching or split invoice detection';
@@ -0,0 +1,14 @@
+-- ============================================================
+-- Migration 026: Recall transition
+-- ============================================================
+-- invoice_status_transitions mirrors invoiceEvents but had no row for
+-- recall, which moves pending_approval back to draft like reject. The key
+-- becomes (from_status, to_status, event) so both events are listed; the
+-- transition guard still checks only from_status and to_status.
+
+ALTER TABLE invoice_status_transitions
+    DROP CONSTRAINT invoice_status_transitions_pkey,
+    ADD PRIMARY KEY (from_status, to_status, event);
+
+INSERT INTO invoice_status_transitions (from_status, to_status, event) VALUES
+    ('pending_approval', 'draft', 'recall');
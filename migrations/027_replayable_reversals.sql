@@ -0,0 +1,41 @@
+-- ============================================================
+-- Migration 027: Replayable reversals and vendor balance updates
+-- ============================================================
+-- Reversals (voids, payment voids, failed posting compensation) were
+-- rebuilt from the invoice and the entity's current settings, tax rates
+-- and accounts, so once any of those changed a reversal no longer netted
+-- out the journal actually posted. Each journal request now keeps the
+-- journal as it was sent to GL-2, and a reversal negates those lines.
+--
+-- Vendor balance changes in AP-1 are not idempotent, so a void or payment
+-- retried after its balance change but before it was recorded moved the
+-- balance twice. Each change is now recorded under an idempotency key the
+-- way journal requests are, and a retry skips a change already applied.
+
+-- ── Journal Requests ──────────────────────────────────────────
+
+ALTER TABLE journal_requests ADD COLUMN request JSONB;  -- the journal as sent; NULL for journals requested before this migration
+
+-- ── Vendor Balance Updates ────────────────────────────────────
+
+CREATE TABLE vendor_balance_updates (
+    id              UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    entity_id       UUID NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    vendor_id       UUID NOT NULL,
+    amount          BIGINT NOT NULL,
+
+    applied_at      TIMESTAMP WITH TIME ZONE,   -- set once AP-1 has applied it
+
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT vendor_balance_updates_key_unique UNIQUE (entity_id, idempotency_key)
+);
+
+CREATE TRIGGER trigger_vendor_balance_updates_updated_at
+BEFORE UPDATE ON vendor_balance_updates
+FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON COLUMN journal_requests.request IS 'The journal as sent to GL-2; reversals negate its lines';
+COMMENT ON TABLE vendor_balance_updates IS 'AP-1 vendor balance changes made by this service, keyed for idempotent retries';
@@ -0,0 +1,19 @@
+-- ============================================================
+-- Migration 028: Required functional currency
+-- ============================================================
+-- An entity without a functional_currency used to post each invoice in the
+-- invoice's own currency, so a ledger could mix currencies. Invoices now
+-- require the entity's functional currency to be configured. Entities whose
+-- invoices so far are all in one currency take that currency; entities with
+-- invoices in several must choose one before creating or editing invoices.
+
+INSERT INTO ap_entity_settings (entity_id, functional_currency)
+SELECT entity_id, MIN(currency)
+FROM invoices
+GROUP BY entity_id
+HAVING COUNT(DISTINCT currency) = 1
+ON CONFLICT (entity_id) DO UPDATE
+SET functional_currency = EXCLUDED.functional_currency
+WHERE ap_entity_settings.functional_currency IS NULL;
+
+COMMENT ON COLUMN ap_entity_settings.functional_currency IS 'Currency the entity''s ledger is kept in; required before invoices can be created';
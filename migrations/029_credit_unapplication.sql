@@ -0,0 +1,105 @@
+-- ============================================================
+-- Migration 029: Credit memo unapplication
+-- ============================================================
+-- Applied credit could not be taken back, and an invoice or credit memo
+-- with applied credit cannot be voided, so such a document could never be
+-- voided at all. An application can now be reversed: it stays on record
+-- with reversed_at set, its realized FX journal (if any) is reversed in
+-- GL-2, and it no longer counts towards either document's amount paid.
+
+-- ── Applications ──────────────────────────────────────────────
+
+ALTER TABLE ap_credit_applications
+    ADD COLUMN reversed_at         TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN reversed_by         UUID,
+    ADD COLUMN reversal_reason     TEXT,
+    ADD COLUMN reversal_journal_id UUID;    -- reverses gl_journal_id
+
+-- ── Settlement ────────────────────────────────────────────────
+
+CREATE OR REPLACE FUNCTION refresh_invoice_settlement(p_invoice_id UUID, p_actor UUID, p_reason TEXT)
+RETURNS VOID AS $$
+DECLARE
+    v_total_paid BIGINT;
+    v_functional_paid BIGINT;
+    v_total_amount BIGINT;
+    v_status invoice_status;
+    v_entity_id UUID;
+BEGIN
+    SELECT COALESCE(SUM(amount), 0), COALESCE(SUM(functional_amount), 0)
+    INTO v_total_paid, v_functional_paid
+    FROM (
+        SELECT payment_amount AS amount, functional_ap_amount AS functional_amount
+        FROM invoice_payments
+        WHERE invoice_id = p_invoice_id AND voided_at IS NULL
+        UNION ALL
+        SELECT amount, functional_invoice_amount
+        FROM ap_credit_applications
+        WHERE invoice_id = p_invoice_id AND reversed_at IS NULL
+        UNION ALL
+        SELECT amount, functional_credit_amount
+        FROM ap_credit_applications
+        WHERE credit_memo_id = p_invoice_id AND reversed_at IS NULL
+        UNION ALL
+        SELECT amount, functional_invoice_amount
+        FROM ap_prepayment_applications
+        WHERE invoice_id = p_invoice_id
+    ) s;
+
+    -- Get invoice total and current status
+    SELECT total_amount, status, entity_id
+    INTO v_total_amount, v_status, v_entity_id
+    FROM invoices
+    WHERE id = p_invoice_id;
+
+    UPDATE invoices
+    SET amount_paid = v_total_paid,
+        functional_amount_paid = v_functional_paid,
+        updated_at = NOW()
+    WHERE id = p_invoice_id;
+
+    IF v_total_paid >= v_total_amount AND v_status = 'posted' THEN
+        UPDATE invoices
+        SET status = 'paid'::invoice_status
+        WHERE id = p_invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (p_invoice_id, v_entity_id, v_status, 'paid', 'pay', p_actor, p_reason);
+    ELSIF v_total_paid < v_total_amount AND v_status = 'paid' THEN
+        UPDATE invoices
+        SET status = 'posted'::invoice_status
+        WHERE id = p_invoice_id;
+
+        INSERT INTO invoice_status_history
+            (invoice_id, entity_id, from_status, to_status, event, changed_by, reason)
+        VALUES
+            (p_invoice_id, v_entity_id, v_status, 'posted', 'void_payment', p_actor, p_reason);
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION update_invoice_credit_status()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.reversed_at IS NULL THEN
+        PERFORM refresh_invoice_settlement(NEW.invoice_id, NEW.created_by, 'Invoice settled by credit memo');
+        PERFORM refresh_invoice_settlement(NEW.credit_memo_id, NEW.created_by, 'Credit memo fully applied');
+    ELSE
+        PERFORM refresh_invoice_settlement(NEW.invoice_id, NEW.reversed_by, NEW.reversal_reason);
+        PERFORM refresh_invoice_settlement(NEW.credit_memo_id, NEW.reversed_by, NEW.reversal_reason);
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trigger_reverse_invoice_credit_status
+AFTER UPDATE OF reversed_at ON ap_credit_applications
+FOR EACH ROW
+WHEN (OLD.reversed_at IS NULL AND NEW.reversed_at IS NOT NULL)
+EXECUTE FUNCTION update_invoice_credit_status();
+
+COMMENT ON COLUMN ap_credit_applications.reversed_at IS 'Set when the application is reversed; a reversed application no longer settles either document';
+COMMENT ON COLUMN invoices.amount_paid IS 'Settled by non-voided payments and applied credit that was not reversed';
@@ -0,0 +1,30 @@
+-- ============================================================
+-- Migration 030: Recurring occurrence retries
+-- ============================================================
+-- An occurrence is claimed as pending before its invoice is created, and
+-- the schedule moves on in the same transaction. A scheduler that stopped
+-- between the claim and recording the outcome left the occurrence pending
+-- for good, and an invoice that could not be created, even for a passing
+-- reason, left it failed for good. A pending occurrence idle past a lease
+-- is now claimed again, and a failed one is retried with a growing backoff
+-- up to a fixed number of attempts. Occurrences that failed before this
+-- migration are not retried.
+
+ALTER TABLE ap_recurring_occurrences
+    ADD COLUMN attempts        INT NOT NULL DEFAULT 0,     -- generation attempts; 0 for skipped occurrences
+    ADD COLUMN next_attempt_at TIMESTAMP WITH TIME ZONE,   -- failed only: when it is retried; NULL once out of attempts
+    ADD COLUMN updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+UPDATE ap_recurring_occurrences SET attempts = 1 WHERE status <> 'skipped';
+
+CREATE TRIGGER trigger_ap_recurring_occurrences_updated_at
+BEFORE UPDATE ON ap_recurring_occurrences
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at_column();
+
+CREATE INDEX idx_ap_recurring_occurrences_retry
+    ON ap_recurring_occurrences(status, next_attempt_at)
+    WHERE status IN ('pending', 'failed');
+
+COMMENT ON COLUMN ap_recurring_occurrences.status IS 'pending while its invoice is created, then generated, skipped or failed; a pending occurrence idle past its lease is claimed again';
+COMMENT ON COLUMN ap_recurring_occurrences.next_attempt_at IS 'When a failed occurrence is retried; NULL once it has no attempts left';
@@ -0,0 +1,34 @@
+-- ============================================================
+-- Migration 031: Confirmed split invoice holds
+-- ============================================================
+-- Confirming a held split invoice finding kept its split_invoice hold, and
+-- that hold can only be released by reviewing the finding, so a confirmed
+-- invoice could never be submitted again. Confirming a held finding now
+-- switches it to escalated and releases its hold, so the invoice is routed
+-- for approval on the combined total. Findings confirmed before this
+-- migration are brought in line.
+
+-- ── Holds ─────────────────────────────────────────────────────
+
+UPDATE ap_invoice_holds h
+SET status = 'released',
+    released_by = f.reviewed_by,
+    released_at = NOW(),
+    release_notes = 'Split invoice finding confirmed, approval escalated: ' || f.review_notes
+FROM ap_split_invoice_findings f
+WHERE h.invoice_id = f.invoice_id
+  AND h.invoice_line_id IS NULL
+  AND h.hold_code = 'split_invoice'
+  AND h.hold_type = 'system'
+  AND h.status = 'open'
+  AND f.action = 'held'
+  AND f.status = 'confirmed';
+
+-- ── Findings ──────────────────────────────────────────────────
+
+UPDATE ap_split_invoice_findings
+SET action = 'escalated'
+WHERE action = 'held' AND status = 'confirmed';
+
+COMMENT ON COLUMN ap_split_invoice_findings.action IS 'held, put on a split_invoice system hold; escalated, approval routed on combined_total; a held finding confirmed on review becomes escalated';
+COMMENT ON COLUMN ap_split_invoice_findings.status IS 'open until reviewed; cleared releases the hold or escalation, confirmed keeps an escalation and turns a hold into one';